@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mjl-/bstore"
@@ -24,10 +25,37 @@ import (
 	"github.com/mjl-/mox/tlsrptdb"
 )
 
+// fileID identifies a file on a file system, for finding hardlinked files.
+type fileID struct {
+	dev, ino uint64
+}
+
+// linkShared keeps hardlinked files in srcpath hardlinked when copied to dstpath.
+// If srcpath has multiple links and was copied before, dstpath is created as
+// hardlink to the earlier copy and true is returned. Otherwise dstpath is
+// remembered for later files, and the caller must copy the file.
+func linkShared(shared map[fileID]string, srcpath, dstpath string) bool {
+	fi, err := os.Stat(srcpath)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || uint64(st.Nlink) <= 1 {
+		return false
+	}
+	id := fileID{uint64(st.Dev), uint64(st.Ino)}
+	if p, ok := shared[id]; ok && os.Link(p, dstpath) == nil {
+		return true
+	}
+	shared[id] = dstpath
+	return false
+}
+
 func backupctl(ctx context.Context, ctl *ctl) {
 	/* protocol:
 	> "backup"
 	> destdir
+	> previous backup dir for incremental backup, or ""
 	> "verbose" or ""
 	< stream
 	< "ok" or error
@@ -39,6 +67,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 	// directories.
 
 	dstDataDir := ctl.xread()
+	prevDataDir := ctl.xread()
 	verbose := ctl.xread() == "verbose"
 
 	// Set when an error is encountered. At the end, we warn if set.
@@ -94,6 +123,15 @@ func backupctl(ctx context.Context, ctl *ctl) {
 	if _, err := os.Stat(dstDataDir); err == nil {
 		xwarnx("destination data directory already exists", nil, mlog.Field("dir", dstDataDir))
 	}
+	if prevDataDir != "" && filepath.Clean(prevDataDir) == filepath.Clean(dstDataDir) {
+		xwarnx("previous backup directory is the same as destination, making full backup", nil, mlog.Field("dir", prevDataDir))
+		prevDataDir = ""
+	} else if prevDataDir != "" {
+		if _, err := os.Stat(filepath.Join(prevDataDir, "moxversion")); err != nil {
+			xwarnx("previous backup not usable, making full backup", err, mlog.Field("dir", prevDataDir))
+			prevDataDir = ""
+		}
+	}
 
 	srcDataDir := filepath.Clean(mox.DataDirPath("."))
 
@@ -220,8 +258,10 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		return nil
 	}
 
-	// Try to create a hardlink. Fall back to copying the file (e.g. when on different file system).
+	// Try to create a hardlink. Fall back to copying the file (e.g. when on different
+	// file system). Message files stored once for multiple messages are copied once.
 	warnedHardlink := false // We warn once about failing to hardlink.
+	shared := map[fileID]string{}
 	linkOrCopy := func(srcpath, dstpath string) (bool, error) {
 		ensureDestDir(dstpath)
 
@@ -235,6 +275,10 @@ func backupctl(ctx context.Context, ctl *ctl) {
 			warnedHardlink = true
 		}
 
+		if linkShared(shared, srcpath, dstpath) {
+			return true, nil
+		}
+
 		// Fall back to copying.
 		sf, err := os.Open(srcpath)
 		if err != nil {
@@ -259,13 +303,49 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		if err != nil {
 			return false, fmt.Errorf("close: %v", err)
 		}
+		// Keep the modification time, for recognizing unchanged message files in a next
+		// incremental backup.
+		if sfi, err := sf.Stat(); err != nil {
+			return false, fmt.Errorf("stat source path: %v", err)
+		} else if err := os.Chtimes(dstpath, sfi.ModTime(), sfi.ModTime()); err != nil {
+			return false, fmt.Errorf("setting modification time: %v", err)
+		}
 		return false, nil
 	}
 
+	// Message files are hardlinked from the previous backup, if any, when the file
+	// there is the same file as in the data directory (hardlinked), or a copy of it
+	// with the same size and modification time. Message files with the same path
+	// but different contents, e.g. after reuse of a message ID following a restore,
+	// are not reused. For an incremental backup to a different file system than the
+	// data directory, only new message files are copied. Other message files are
+	// hardlinked or copied from the data directory.
+	warnedPrevHardlink := false
+	backupMessage := func(path string) (reused, linked bool, rerr error) {
+		srcpath := filepath.Join(srcDataDir, path)
+		dstpath := filepath.Join(dstDataDir, path)
+		if prevDataDir != "" {
+			prevpath := filepath.Join(prevDataDir, path)
+			if pfi, err := os.Stat(prevpath); err == nil {
+				if sfi, err := os.Stat(srcpath); err == nil && (os.SameFile(sfi, pfi) || sfi.Size() == pfi.Size() && sfi.ModTime().Equal(pfi.ModTime())) {
+					ensureDestDir(dstpath)
+					if err := os.Link(prevpath, dstpath); err == nil {
+						return true, false, nil
+					} else if !warnedPrevHardlink {
+						xwarnx("creating hardlink to message in previous backup", err, mlog.Field("prevpath", prevpath), mlog.Field("dstpath", dstpath))
+						warnedPrevHardlink = true
+					}
+				}
+			}
+		}
+		linked, err := linkOrCopy(srcpath, dstpath)
+		return false, linked, err
+	}
+
 	// Start making the backup.
 	tmStart := time.Now()
 
-	ctl.log.Print("making backup", mlog.Field("destdir", dstDataDir))
+	ctl.log.Print("making backup", mlog.Field("destdir", dstDataDir), mlog.Field("previousdir", prevDataDir))
 
 	err := os.MkdirAll(dstDataDir, 0770)
 	if err != nil {
@@ -316,14 +396,15 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		// new message may have been queued).
 		tmMsgs := time.Now()
 		seen := map[string]struct{}{}
-		var nlinked, ncopied int
+		var nreused, nlinked, ncopied int
 		err = bstore.QueryDB[queue.Msg](ctx, db).ForEach(func(m queue.Msg) error {
 			mp := store.MessagePath(m.ID)
 			seen[mp] = struct{}{}
-			srcpath := filepath.Join(srcDataDir, "queue", mp)
-			dstpath := filepath.Join(dstDataDir, "queue", mp)
-			if linked, err := linkOrCopy(srcpath, dstpath); err != nil {
-				xerrx("linking/copying queue message", err, mlog.Field("srcpath", srcpath), mlog.Field("dstpath", dstpath))
+			qmp := filepath.Join("queue", mp)
+			if reused, linked, err := backupMessage(qmp); err != nil {
+				xerrx("linking/copying queue message", err, mlog.Field("path", qmp))
+			} else if reused {
+				nreused++
 			} else if linked {
 				nlinked++
 			} else {
@@ -334,7 +415,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		if err != nil {
 			xerrx("processing queue messages (not backed up properly)", err, mlog.Field("duration", time.Since(tmMsgs)))
 		} else {
-			xvlog("queue message files linked/copied", mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("duration", time.Since(tmMsgs)))
+			xvlog("queue message files linked/copied", mlog.Field("reused", nreused), mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("duration", time.Since(tmMsgs)))
 		}
 
 		// Read through all files in queue directory and warn about anything we haven't handled yet.
@@ -419,15 +500,15 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		// been removed).
 		tmMsgs := time.Now()
 		seen := map[string]struct{}{}
-		var nlinked, ncopied int
+		var nreused, nlinked, ncopied int
 		err = bstore.QueryDB[store.Message](ctx, db).ForEach(func(m store.Message) error {
 			mp := store.MessagePath(m.ID)
 			seen[mp] = struct{}{}
 			amp := filepath.Join("accounts", acc.Name, "msg", mp)
-			srcpath := filepath.Join(srcDataDir, amp)
-			dstpath := filepath.Join(dstDataDir, amp)
-			if linked, err := linkOrCopy(srcpath, dstpath); err != nil {
-				xerrx("linking/copying account message", err, mlog.Field("srcpath", srcpath), mlog.Field("dstpath", dstpath))
+			if reused, linked, err := backupMessage(amp); err != nil {
+				xerrx("linking/copying account message", err, mlog.Field("path", amp))
+			} else if reused {
+				nreused++
 			} else if linked {
 				nlinked++
 			} else {
@@ -438,7 +519,7 @@ func backupctl(ctx context.Context, ctl *ctl) {
 		if err != nil {
 			xerrx("processing account messages (not backed up properly)", err, mlog.Field("duration", time.Since(tmMsgs)))
 		} else {
-			xvlog("account message files linked/copied", mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("duration", time.Since(tmMsgs)))
+			xvlog("account message files linked/copied", mlog.Field("reused", nreused), mlog.Field("linked", nlinked), mlog.Field("copied", ncopied), mlog.Field("duration", time.Since(tmMsgs)))
 		}
 
 		// Read through all files in account directory and warn about anything we haven't handled yet.
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dmarcdb"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/mtastsdb"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+	"github.com/mjl-/mox/tlsrptdb"
+)
+
+// Test making a full and an incremental backup, and restoring them, for the
+// entire data directory and for a single account.
+func TestBackupRestore(t *testing.T) {
+	tcheckf := func(err error, format string, args ...any) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+	}
+
+	os.RemoveAll("testdata/backup/data")
+	os.RemoveAll("testdata/backup/tmp")
+	defer os.RemoveAll("testdata/backup/tmp")
+	defer func() {
+		// Data directories moved away by restore.
+		l, _ := filepath.Glob("testdata/backup/data.replaced-*")
+		for _, p := range l {
+			os.RemoveAll(p)
+		}
+	}()
+	mox.Context = context.Background()
+	mox.ConfigStaticPath = "testdata/backup/mox.conf"
+	mox.MustLoadConfig(false)
+	dataDir, err := filepath.Abs(mox.DataDirPath(""))
+	tcheckf(err, "data dir")
+	backupDir, err := filepath.Abs("testdata/backup/tmp")
+	tcheckf(err, "backup dir")
+
+	log := mlog.New("backup")
+
+	err = dmarcdb.Init()
+	tcheckf(err, "dmarcdb init")
+	err = mtastsdb.Init(false)
+	tcheckf(err, "mtastsdb init")
+	defer mtastsdb.Close()
+	err = tlsrptdb.Init()
+	tcheckf(err, "tlsrptdb init")
+	defer tlsrptdb.Close()
+	err = queue.Init()
+	tcheckf(err, "queue init")
+	defer queue.Shutdown()
+	switchDone := store.Switchboard()
+	defer close(switchDone)
+	err = os.WriteFile(mox.DataDirPath("receivedid.key"), make([]byte, 16), 0660)
+	tcheckf(err, "write receivedid.key")
+
+	acc, err := store.OpenAccount("mjl")
+	tcheckf(err, "open account")
+	defer acc.Close()
+
+	deliver := func() int64 {
+		t.Helper()
+		msgFile, err := store.CreateMessageTemp("backup-test")
+		tcheckf(err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		const msg = "Subject: test\r\n\r\ntest\r\n"
+		_, err = msgFile.Write([]byte(msg))
+		tcheckf(err, "write message")
+		m := store.Message{Received: time.Now(), Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheckf(err, "deliver message")
+		return m.ID
+	}
+
+	backup := func(dst, prev string) {
+		t.Helper()
+		sconn, cconn := net.Pipe()
+		stop := struct{}{}
+		go func() {
+			defer func() {
+				x := recover()
+				if x != nil && x != stop {
+					panic(x)
+				}
+				sconn.Close()
+			}()
+			backupctl(context.Background(), &ctl{cmd: "backup", conn: sconn, x: stop, log: log})
+		}()
+		c := &ctl{conn: cconn, x: stop, log: log}
+		defer cconn.Close()
+		c.xwrite(filepath.Join(backupDir, dst))
+		if prev != "" {
+			prev = filepath.Join(backupDir, prev)
+		}
+		c.xwrite(prev)
+		c.xwrite("")
+		output, err := io.ReadAll(c.reader())
+		tcheckf(err, "reading backup output")
+		if line := c.xread(); line != "ok" {
+			t.Fatalf("backup failed: %s, output:\n%s", line, output)
+		}
+	}
+
+	countMessages := func(dbpath string) int {
+		t.Helper()
+		db, err := bstore.Open(context.Background(), dbpath, &bstore.Options{MustExist: true}, store.DBTypes...)
+		tcheckf(err, "open account database")
+		defer db.Close()
+		n, err := bstore.QueryDB[store.Message](context.Background(), db).Count()
+		tcheckf(err, "count messages")
+		return n
+	}
+
+	id1 := deliver()
+	backup("full", "")
+
+	// Message with same ID and size as in the full backup but different content, as
+	// after a restore of an earlier backup. Must not be reused for the incremental
+	// backup.
+	mp := filepath.Join("accounts", "mjl", "msg", store.MessagePath(id1))
+	err = os.Remove(filepath.Join(dataDir, mp))
+	tcheckf(err, "remove message file")
+	err = os.WriteFile(filepath.Join(dataDir, mp), []byte("Subject: tost\r\n\r\ntest\r\n"), 0660)
+	tcheckf(err, "write message file")
+
+	id2 := deliver()
+	backup("incr", "full")
+
+	fi1, err := os.Stat(filepath.Join(backupDir, "full", mp))
+	tcheckf(err, "stat message in full backup")
+	fi2, err := os.Stat(filepath.Join(backupDir, "incr", mp))
+	tcheckf(err, "stat message in incremental backup")
+	if os.SameFile(fi1, fi2) {
+		t.Fatalf("changed message file reused from previous backup")
+	}
+	buf, err := os.ReadFile(filepath.Join(backupDir, "incr", mp))
+	tcheckf(err, "read message from incremental backup")
+	if string(buf) != "Subject: tost\r\n\r\ntest\r\n" {
+		t.Fatalf("got message %q in incremental backup, expected changed message", buf)
+	}
+	mp2 := filepath.Join("accounts", "mjl", "msg", store.MessagePath(id2))
+	if _, err := os.Stat(filepath.Join(backupDir, "incr", mp2)); err != nil {
+		t.Fatalf("new message not in incremental backup: %v", err)
+	}
+
+	// Unchanged messages are reused by a next incremental backup.
+	backup("incr2", "incr")
+	fi2, err = os.Stat(filepath.Join(backupDir, "incr", mp2))
+	tcheckf(err, "stat message in incremental backup")
+	fi3, err := os.Stat(filepath.Join(backupDir, "incr2", mp2))
+	tcheckf(err, "stat message in second incremental backup")
+	if !os.SameFile(fi2, fi3) {
+		t.Fatalf("unchanged message file not reused from previous backup")
+	}
+
+	// Restore a single account from the full backup.
+	restore(filepath.Join(backupDir, "full"), dataDir, "mjl")
+	if n := countMessages(filepath.Join(dataDir, "accounts", "mjl", "index.db")); n != 1 {
+		t.Fatalf("got %d messages after restoring account, expected 1", n)
+	}
+
+	// Restore the entire data directory from the incremental backup.
+	restore(filepath.Join(backupDir, "incr"), dataDir, "")
+	if n := countMessages(filepath.Join(dataDir, "accounts", "mjl", "index.db")); n != 2 {
+		t.Fatalf("got %d messages after restoring data directory, expected 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "queue", "index.db")); err != nil {
+		t.Fatalf("queue database not restored: %v", err)
+	}
+}
@@ -53,7 +53,9 @@ type Static struct {
 		Account string
 		Mailbox string `sconf-doc:"E.g. Postmaster or Inbox."`
 	} `sconf-doc:"Destination for emails delivered to postmaster addresses: a plain 'postmaster' without domain, 'postmaster@<hostname>' (also for each listener with SMTP enabled), and as fallback for each domain without explicitly configured postmaster destination."`
-	DefaultMailboxes []string `sconf:"optional" sconf-doc:"Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
+	DefaultMailboxes []string   `sconf:"optional" sconf-doc:"Mailboxes to create when adding an account. Inbox is always created. If no mailboxes are specified, the following are automatically created: Sent, Archive, Trash, Drafts and Junk."`
+	Queue            Queue      `sconf:"optional" sconf-doc:"Settings for the queue of outgoing messages."`
+	IMAPImport       IMAPImport `sconf:"optional" sconf-doc:"Restrictions for connections to remote IMAP servers when importing messages, through the account web interface or \"mox import imap\"."`
 
 	// All IPs that were explicitly listen on for external SMTP. Only set when there
 	// are no unspecified external SMTP listeners and there is at most one for IPv4 and
@@ -69,6 +71,45 @@ type Static struct {
 	GID uint32 `sconf:"-" json:"-"`
 }
 
+// IMAPImport restricts the remote IMAP servers that imports can connect to.
+type IMAPImport struct {
+	AllowPrivateIPs bool  `sconf:"optional" sconf-doc:"Allow connecting to loopback, private and link-local IP addresses, e.g. for importing from a server on the local network. By default, connections to such IPs are refused: users could otherwise use imports to probe internal services."`
+	AllowPorts      []int `sconf:"optional" sconf-doc:"Ports that can be connected to, in addition to the standard IMAP ports 993 and 143."`
+}
+
+// Queue configures delivery attempts for outgoing messages.
+type Queue struct {
+	RetrySchedule  []time.Duration        `sconf:"optional" sconf-doc:"Intervals between delivery attempts for a message that failed with a temporary error. The first attempt is made immediately. If the last interval has passed and delivery failed again, the message fails permanently. Default: 7m30s, 15m, 30m, 1h, 2h, 4h, 8h. Each interval gets a few seconds of jitter."`
+	MaxLifetime    time.Duration          `sconf:"optional" sconf-doc:"Maximum time a message stays in the queue after it was added, e.g. 48h. If a next attempt would be scheduled after this time, the message fails permanently instead. Default: no limit, only the RetrySchedule determines when delivery is given up."`
+	DelayDSNAfter  time.Duration          `sconf:"optional" sconf-doc:"Time after queueing a message after which the sender is sent a DSN that delivery is delayed. It is sent once, after the first failed delivery attempt after this time. Default: 1h30m, which is after the 5th attempt with the default RetrySchedule."`
+	DomainPolicies map[string]QueuePolicy `sconf:"optional" sconf-doc:"Overrides of retry settings per recipient domain, e.g. for faster retries to partner domains. The key is a domain name, subdomains do not match."`
+
+	DefaultConcurrency int                    `sconf:"optional" sconf-doc:"Maximum number of concurrent deliveries to a single recipient domain, for domains without Concurrency in DestinationLimits. Default: 1."`
+	DestinationLimits  map[string]QueueLimits `sconf:"optional" sconf-doc:"Limits for deliveries to a destination. The key is a recipient domain or the host name of an MX host. Limits for a recipient domain apply to deliveries of messages for that domain. Limits for an MX host apply to connections to that host, for all recipient domains it handles, e.g. for large providers hosting many domains."`
+	ThrottleBackoff    time.Duration          `sconf:"optional" sconf-doc:"If a remote server responds with a temporary 421 or 451 error code, e.g. because we are sending too many messages, no further deliveries are started to the recipient domain and the MX host for this duration. Default: 5m."`
+
+	MaxFutureRelease time.Duration `sconf:"optional" sconf-doc:"Maximum time a message submitted with the SMTP FUTURERELEASE extension (RFC 4865) can be held before delivery. Clients request a hold with the HOLDFOR or HOLDUNTIL parameter to MAIL FROM. Default: 720h (30 days). A negative value, e.g. -1s, disables FUTURERELEASE."`
+
+	HistoryRetention time.Duration `sconf:"optional" sconf-doc:"How long to keep a record of messages that were delivered or failed permanently, with details of the final delivery attempt. History can be searched with \"mox queue history\", the admin web interface, and accounts can see the status of their own messages in the account web interface. Default: 168h (7 days). A negative value, e.g. -1s, disables keeping history."`
+
+	DomainPoliciesParsed    map[dns.Domain]QueuePolicy `sconf:"-" json:"-"`
+	DestinationLimitsParsed map[string]QueueLimits     `sconf:"-" json:"-"` // Keyed by domain name, with unicode.
+}
+
+// QueueLimits are limits for deliveries to a recipient domain or MX host.
+type QueueLimits struct {
+	Concurrency       int `sconf:"optional" sconf-doc:"Maximum number of concurrent deliveries. For a recipient domain, the default is DefaultConcurrency. For an MX host, the default is no limit."`
+	MessagesPerMinute int `sconf:"optional" sconf-doc:"Maximum number of deliveries started per minute. Default: no limit."`
+}
+
+// QueuePolicy overrides queue retry settings for a recipient domain. Unset fields
+// are taken from the Queue configuration.
+type QueuePolicy struct {
+	RetrySchedule []time.Duration `sconf:"optional" sconf-doc:"Intervals between delivery attempts, see Queue."`
+	MaxLifetime   time.Duration   `sconf:"optional" sconf-doc:"Maximum time in queue, see Queue."`
+	DelayDSNAfter time.Duration   `sconf:"optional" sconf-doc:"Time after which a delayed DSN is sent, see Queue."`
+}
+
 // Dynamic is the parsed form of domains.conf, and is automatically reloaded when changed.
 type Dynamic struct {
 	Domains            map[string]Domain  `sconf-doc:"Domains for which email is accepted. For internationalized domains, use their IDNA names in UTF-8."`
@@ -94,29 +135,42 @@ type Listener struct {
 	Hostname       string     `sconf:"optional" sconf-doc:"If empty, the config global Hostname is used."`
 	HostnameDomain dns.Domain `sconf:"-" json:"-"` // Set when parsing config.
 
-	TLS                *TLS  `sconf:"optional" sconf-doc:"For SMTP/IMAP STARTTLS, direct TLS and HTTPS connections."`
-	SMTPMaxMessageSize int64 `sconf:"optional" sconf-doc:"Maximum size in bytes accepted incoming and outgoing messages. Default is 100MB."`
+	TLS                *TLS           `sconf:"optional" sconf-doc:"For SMTP/IMAP STARTTLS, direct TLS and HTTPS connections."`
+	SMTPMaxMessageSize int64          `sconf:"optional" sconf-doc:"Maximum size in bytes accepted incoming and outgoing messages. Default is 100MB."`
+	ProxyProtocol      *ProxyProtocol `sconf:"optional" sconf-doc:"Require a PROXY protocol header (version 1 or 2) at the start of incoming connections, as sent by TCP load balancers like HAProxy. The client address from the header is used instead of the address of the load balancer, e.g. for SPF, iprev, DNSBL, reputation and rate limiting."`
 	SMTP               struct {
 		Enabled         bool
 		Port            int          `sconf:"optional" sconf-doc:"Default 25."`
 		NoSTARTTLS      bool         `sconf:"optional" sconf-doc:"Do not offer STARTTLS to secure the connection. Not recommended."`
 		RequireSTARTTLS bool         `sconf:"optional" sconf-doc:"Do not accept incoming messages if STARTTLS is not active. Can be used in combination with a strict MTA-STS policy. A remote SMTP server may not support TLS and may not be able to deliver messages."`
 		DNSBLs          []string     `sconf:"optional" sconf-doc:"Addresses of DNS block lists for incoming messages. Block lists are only consulted for connections/messages without enough reputation to make an accept/reject decision. This prevents sending IPs of all communications to the block list provider. If any of the listed DNSBLs contains a requested IP address, the message is rejected as spam. The DNSBLs are checked for healthiness before use, at most once per 4 hours. Example DNSBLs: sbl.spamhaus.org, bl.spamcop.net"`
+		Limits          *Limits      `sconf:"optional" sconf-doc:"Limits for incoming connections."`
 		DNSBLZones      []dns.Domain `sconf:"-"`
 	} `sconf:"optional"`
 	Submission struct {
 		Enabled           bool
-		Port              int  `sconf:"optional" sconf-doc:"Default 587."`
-		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Do not require STARTTLS. Since users must login, this means password may be sent without encryption. Not recommended."`
+		Port              int     `sconf:"optional" sconf-doc:"Default 587."`
+		NoRequireSTARTTLS bool    `sconf:"optional" sconf-doc:"Do not require STARTTLS. Since users must login, this means password may be sent without encryption. Not recommended."`
+		Limits            *Limits `sconf:"optional" sconf-doc:"Limits for incoming connections and authentication attempts. Also applies to Submissions."`
 	} `sconf:"optional" sconf-doc:"SMTP for submitting email, e.g. by email applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS command. Prefer using Submissions which is always a TLS connection."`
 	Submissions struct {
 		Enabled bool
 		Port    int `sconf:"optional" sconf-doc:"Default 465."`
 	} `sconf:"optional" sconf-doc:"SMTP over TLS for submitting email, by email applications. Requires a TLS config."`
+	LMTP struct {
+		Enabled           bool
+		Port              int      `sconf:"optional" sconf-doc:"TCP port to listen on at the IPs of the listener. Default 24. Not used if UnixSocket is set."`
+		UnixSocket        string   `sconf:"optional" sconf-doc:"If set, listen on this unix domain socket instead of a TCP port, e.g. /var/spool/postfix/private/mox-lmtp. Relative paths are relative to the data directory. Any existing file at this path is removed at startup. The socket is accessible for all users, access must be restricted through permissions of the directory."`
+		TrustedIPs        []string `sconf:"optional" sconf-doc:"IP addresses or networks in CIDR notation of the relays that are allowed to connect to the TCP port, e.g. 127.0.0.1 or 10.0.0.0/8. Connections from other IPs are closed. Required unless UnixSocket is set."`
+		TrustedAuthServID string   `sconf:"optional" sconf-doc:"If set, the first Authentication-Results header with this authserv-id, typically the hostname of the relay, is trusted. Its spf, dkim and dmarc results are used for rulesets with VerifiedDomain and stored with the message. If not set, messages are delivered without verified sender information."`
+
+		TrustedNets []*net.IPNet `sconf:"-" json:"-"` // Parsed from TrustedIPs.
+	} `sconf:"optional" sconf-doc:"LMTP (RFC 2033) for delivering messages from a trusted relay, e.g. an existing Postfix MTA, to local accounts. Messages are delivered according to the rulesets of the destination, without spam filtering or rate limiting, that is left to the relay. Recipients must exist, and a status for each recipient is returned after DATA. Messages for destinations with ForwardTo are forwarded like messages delivered over SMTP. Only connections from TrustedIPs are accepted on the TCP port, prefer a unix domain socket."`
 	IMAP struct {
 		Enabled           bool
-		Port              int  `sconf:"optional" sconf-doc:"Default 143."`
-		NoRequireSTARTTLS bool `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+		Port              int     `sconf:"optional" sconf-doc:"Default 143."`
+		NoRequireSTARTTLS bool    `sconf:"optional" sconf-doc:"Enable this only when the connection is otherwise encrypted (e.g. through a VPN)."`
+		Limits            *Limits `sconf:"optional" sconf-doc:"Limits for incoming connections and authentication attempts. Also applies to IMAPS."`
 	} `sconf:"optional" sconf-doc:"IMAP for reading email, by email applications. Starts out in plain text, can be upgraded to TLS with the STARTTLS command. Prefer using IMAPS instead which is always a TLS connection."`
 	IMAPS struct {
 		Enabled bool
@@ -170,18 +224,72 @@ type Listener struct {
 	} `sconf:"optional" sconf-doc:"All configured WebHandlers will serve on an enabled listener. Either ACME must be configured, or for each WebHandler domain a TLS certificate must be configured."`
 }
 
+// Limits for incoming connections of a service on a listener. Limits are
+// specified for three classes of IPs: the IP address itself, its IPv4 /26 or IPv6
+// /48 network, and its IPv4 /21 or IPv6 /32 network. Unset fields get the default
+// values.
+type Limits struct {
+	ConnectionRate []WindowLimit `sconf:"optional" sconf-doc:"Maximum number of new connections per window. Default: 300, 900, 2700 per minute."`
+	Connections    []int64       `sconf:"optional" sconf-doc:"Maximum number of concurrent connections, with three values for the IP and its two networks. Default: 30, 90, 270."`
+	AuthFailures   []WindowLimit `sconf:"optional" sconf-doc:"Maximum number of failed authentication attempts per window. Once reached, new connections are refused. If not set, failures are tracked together with other services, including the web interfaces, with limits 10, 30, 90 per minute and 50, 150, 450 per day."`
+	AllowIPs       []string      `sconf:"optional" sconf-doc:"IP addresses or networks in CIDR notation that are exempt from limiting, e.g. 192.0.2.10 or 2001:db8::/32. For SMTP, the per-account incoming message rate limits are not applied either."`
+
+	AllowNets []*net.IPNet `sconf:"-" json:"-"` // Parsed from AllowIPs.
+}
+
+type ProxyProtocol struct {
+	TrustedIPs  []string     `sconf-doc:"IP addresses or networks in CIDR notation of the load balancers. Connections from other IPs are closed."`
+	Services    []string     `sconf:"optional" sconf-doc:"Services that require the PROXY header: smtp, submission, submissions, lmtp, imap, imaps, http, https. Service http applies to all plain HTTP ports of the listener, https to all HTTPS ports. If empty, the header is required for all services."`
+	TrustedNets []*net.IPNet `sconf:"-" json:"-"`
+}
+
+// ProxyProtocolService returns whether the PROXY protocol header is required
+// for service on listener l.
+func (l Listener) ProxyProtocolService(service string) bool {
+	if l.ProxyProtocol == nil {
+		return false
+	}
+	if len(l.ProxyProtocol.Services) == 0 {
+		return true
+	}
+	for _, s := range l.ProxyProtocol.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+type WindowLimit struct {
+	Window time.Duration `sconf-doc:"Duration of the window, e.g. 1m or 24h."`
+	Limits []int64       `sconf-doc:"Exactly three limits, for the IP and its two networks."`
+}
+
 type Domain struct {
-	Description                string  `sconf:"optional" sconf-doc:"Free-form description of domain."`
-	LocalpartCatchallSeparator string  `sconf:"optional" sconf-doc:"If not empty, only the string before the separator is used to for email delivery decisions. For example, if set to \"+\", you+anything@example.com will be delivered to you@example.com."`
-	LocalpartCaseSensitive     bool    `sconf:"optional" sconf-doc:"If set, upper/lower case is relevant for email delivery."`
-	DKIM                       DKIM    `sconf:"optional" sconf-doc:"With DKIM signing, a domain is taking responsibility for (content of) emails it sends, letting receiving mail servers build up a (hopefully positive) reputation of the domain, which can help with mail delivery."`
-	DMARC                      *DMARC  `sconf:"optional" sconf-doc:"With DMARC, a domain publishes, in DNS, a policy on how other mail servers should handle incoming messages with the From-header matching this domain and/or subdomain (depending on the configured alignment). Receiving mail servers use this to build up a reputation of this domain, which can help with mail delivery. A domain can also publish an email address to which reports about DMARC verification results can be sent by verifying mail servers, useful for monitoring. Incoming DMARC reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
-	MTASTS                     *MTASTS `sconf:"optional" sconf-doc:"With MTA-STS a domain publishes, in DNS, presence of a policy for using/requiring TLS for SMTP connections. The policy is served over HTTPS."`
-	TLSRPT                     *TLSRPT `sconf:"optional" sconf-doc:"With TLSRPT a domain specifies in DNS where reports about encountered SMTP TLS behaviour should be sent. Useful for monitoring. Incoming TLS reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
+	Description                string            `sconf:"optional" sconf-doc:"Free-form description of domain."`
+	LocalpartCatchallSeparator string            `sconf:"optional" sconf-doc:"If not empty, only the string before the separator is used to for email delivery decisions. For example, if set to \"+\", you+anything@example.com will be delivered to you@example.com."`
+	LocalpartCaseSensitive     bool              `sconf:"optional" sconf-doc:"If set, upper/lower case is relevant for email delivery."`
+	DKIM                       DKIM              `sconf:"optional" sconf-doc:"With DKIM signing, a domain is taking responsibility for (content of) emails it sends, letting receiving mail servers build up a (hopefully positive) reputation of the domain, which can help with mail delivery."`
+	DMARC                      *DMARC            `sconf:"optional" sconf-doc:"With DMARC, a domain publishes, in DNS, a policy on how other mail servers should handle incoming messages with the From-header matching this domain and/or subdomain (depending on the configured alignment). Receiving mail servers use this to build up a reputation of this domain, which can help with mail delivery. A domain can also publish an email address to which reports about DMARC verification results can be sent by verifying mail servers, useful for monitoring. Incoming DMARC reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
+	MTASTS                     *MTASTS           `sconf:"optional" sconf-doc:"With MTA-STS a domain publishes, in DNS, presence of a policy for using/requiring TLS for SMTP connections. The policy is served over HTTPS."`
+	TLSRPT                     *TLSRPT           `sconf:"optional" sconf-doc:"With TLSRPT a domain specifies in DNS where reports about encountered SMTP TLS behaviour should be sent. Useful for monitoring. Incoming TLS reports are automatically parsed, validated, added to metrics and stored in the reporting database for later display in the admin web pages."`
+	Aliases                    map[string]Alias  `sconf:"optional" sconf-doc:"Aliases that expand to multiple addresses, e.g. for a team or a simple mailing list. Keys are localparts, which must be in canonical form: without catchall separator, and lower case unless the domain is configured as case sensitive. An address cannot be both an alias and an account destination."`
+	OutgoingIdentity           *OutgoingIdentity `sconf:"optional" sconf-doc:"Local IPs and hostname to use when delivering messages with an SMTP MAIL FROM address in this domain to remote mail servers, e.g. to keep the sending reputation of domains separate. Takes precedence over the OutgoingIdentity of the account that submitted the message."`
 
 	Domain dns.Domain `sconf:"-" json:"-"`
 }
 
+// Alias delivers incoming messages to multiple local and/or external addresses.
+type Alias struct {
+	Addresses       []string `sconf-doc:"Addresses of members to deliver messages for the alias to. Addresses of local accounts are delivered to the account, with regular junk filtering. Messages for other addresses are forwarded with the SMTP MAIL FROM address rewritten with the Sender Rewriting Scheme (SRS), so SPF checks at receiving mail servers pass and bounces can be relayed to the original sender. Messages are only forwarded if they would be accepted for local delivery, as determined with the account of a local member, or the postmaster account if the alias has no local members. A member that is also a recipient directly or through another alias gets the message once. Members cannot be aliases themselves."`
+	PostPolicy      string   `sconf:"optional" sconf-doc:"Who may send messages to the alias. Either members (default): the SPF-verified SMTP MAIL FROM address or DMARC-verified message From address must be a member; anyone; or authenticated: the SPF-verified SMTP MAIL FROM address or DMARC-verified message From address must be in a domain of this server, i.e. the message was sent by an authenticated user."`
+	ListHeaders     bool     `sconf:"optional" sconf-doc:"If set, List-Id, List-Post and List-Unsubscribe headers are added to messages, as is done by mailing lists. Recipients can use them for filtering, and mail clients can offer list actions. Messages with a List-Id header of this alias are rejected as mail loop."`
+	ListUnsubscribe string   `sconf:"optional" sconf-doc:"Value for the List-Unsubscribe header, e.g. <mailto:owner@example.org?subject=unsubscribe>. If empty, a mailto URI for the postmaster of the domain is used."`
+
+	Address         smtp.Address   `sconf:"-" json:"-"` // Of the alias itself.
+	ParsedAddresses []smtp.Address `sconf:"-" json:"-"`
+}
+
 type DMARC struct {
 	Localpart string `sconf-doc:"Address-part before the @ that accepts DMARC reports. Must be non-internationalized. Recommended value: dmarc-reports."`
 	Account   string `sconf-doc:"Account to deliver to."`
@@ -243,14 +351,48 @@ type Account struct {
 		NeutralMailboxRegexp string `sconf:"optional" sconf-doc:"Example: ^(inbox|neutral|postmaster|dmarc|tlsrpt|rejects), and you may wish to add trash depending on how you use it, or leave this empty."`
 		NotJunkMailboxRegexp string `sconf:"optional" sconf-doc:"Example: .* or an empty string."`
 	} `sconf:"optional" sconf-doc:"Automatically set $Junk and $NotJunk flags based on mailbox messages are delivered/moved/copied to. Email clients typically have too limited functionality to conveniently set these flags, especially $NonJunk, but they can all move messages to a different mailbox, so this helps them."`
-	JunkFilter                   *JunkFilter `sconf:"optional" sconf-doc:"Content-based filtering, using the junk-status of individual messages to rank words in such messages as spam or ham. It is recommended you always set the applicable (non)-junk status on messages, and that you do not empty your Trash because those messages contain valuable ham/spam training information."` // todo: sane defaults for junkfilter
-	MaxOutgoingMessagesPerDay    int         `sconf:"optional" sconf-doc:"Maximum number of outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 1000."`
-	MaxFirstTimeRecipientsPerDay int         `sconf:"optional" sconf-doc:"Maximum number of first-time recipients in outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 200."`
+	JunkFilter                   *JunkFilter                 `sconf:"optional" sconf-doc:"Content-based filtering, using the junk-status of individual messages to rank words in such messages as spam or ham. It is recommended you always set the applicable (non)-junk status on messages, and that you do not empty your Trash because those messages contain valuable ham/spam training information."` // todo: sane defaults for junkfilter
+	MaxOutgoingMessagesPerDay    int                         `sconf:"optional" sconf-doc:"Maximum number of outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 1000."`
+	MaxFirstTimeRecipientsPerDay int                         `sconf:"optional" sconf-doc:"Maximum number of first-time recipients in outgoing messages for this account in a 24 hour window. This limits the damage to recipients and the reputation of this mail server in case of account compromise. Default 200."`
+	SubmissionFromPolicy         string                      `sconf:"optional" sconf-doc:"Policy for the addresses in the From and Sender headers of messages submitted by this account. With \"strict\", the default, the From address and the Sender address, if present, must be addresses of this account, i.e. match one of its destinations (taking the catchall separator into account), or be listed in SubmissionAllowedFrom. With \"sender\", the From address may also be an address of another account in a configured domain, but only if a Sender header with an address of this account is present, e.g. for sending on behalf of someone else."`
+	SubmissionAllowedFrom        []string                    `sconf:"optional" sconf-doc:"Additional email addresses this account may use in the From and Sender headers of submitted messages, and as SMTP MAIL FROM, e.g. for shared identities like info@ that are delivered to another account. Addresses must be in a configured domain."`
+	OutgoingIdentity             *OutgoingIdentity           `sconf:"optional" sconf-doc:"Local IPs and hostname to use when delivering messages submitted by this account to remote mail servers. Not used for messages with an SMTP MAIL FROM address in a domain that has its own OutgoingIdentity."`
+	OutgoingWebhook              *OutgoingWebhook            `sconf:"optional" sconf-doc:"If set, an HTTP webhook is called for events about messages submitted by this account: successful delivery, delayed delivery (for each temporary failure), permanent failure, and DSNs received later from remote mail servers that are matched to an outgoing message by message-id."`
+	MailboxRetention             map[string]MailboxRetention `sconf:"optional" sconf-doc:"Retention policies for mailboxes, keys are mailbox names, e.g. Trash and Junk. Messages older than the retention period are expunged automatically, checked about every hour. Expunged messages are not untrained from the junk filter, so their training information remains. Submailboxes are not affected. An Age of 0 keeps messages in the mailbox, e.g. to exempt Inbox from DefaultMailboxRetention."`
+	DefaultMailboxRetention      *MailboxRetention           `sconf:"optional" sconf-doc:"Retention policy for all mailboxes of the account, including submailboxes, that are not listed in MailboxRetention."`
+	EncryptMessages              bool                        `sconf:"optional" sconf-doc:"If set, message files are encrypted at rest. A key pair is created when the password is set, at the first login with the password after enabling, e.g. over IMAP with LOGIN or AUTHENTICATE PLAIN, SMTP submission with AUTH PLAIN, or the account web page, or with \"mox encrypt -password\". Until the key pair exists, incoming messages are refused with a temporary error instead of being stored unencrypted. New messages are encrypted with the public key, also while nobody is logged in. Reading messages requires the private key, which is sealed with the account password and unsealed during login. IMAP authentication with SCRAM or CRAM-MD5 is refused while the account is locked, i.e. not in use by a session authenticated with the password. Use \"mox encrypt\" to encrypt existing messages. The password can only be changed while the account is unlocked, e.g. through the account web page: an administrator cannot reset the password without losing access to the encrypted messages. Of the account database, the message contents are encrypted too: the received headers are stored in the encrypted message file, and the parsed message structure with the subject, addresses and MIME parts is encrypted, and decrypted for each message that is accessed, e.g. for IMAP FETCH and SEARCH, which is slower. Metadata needed for deliveries while the account is locked is not encrypted: the envelope and message From addresses, recipient addresses, remote IPs, EHLO and DKIM domains used for reputation, the Message-ID of rejected messages, flags, sizes, times and mailbox names. The junk filter database, with words from messages, is not encrypted either: don't configure a junk filter for accounts that must not store message contents unencrypted."`
+	CompressMessages             bool                        `sconf:"optional" sconf-doc:"If set, newly delivered messages are stored compressed on disk, if compression makes them smaller. Compressed and uncompressed message files are read transparently. Use \"mox compress\" to compress existing messages. Note that backups hardlinking message files still work, but tools reading message files directly (instead of through mox export) will see the compressed form."`
 
 	DNSDomain      dns.Domain     `sconf:"-"` // Parsed form of Domain.
 	JunkMailbox    *regexp.Regexp `sconf:"-" json:"-"`
 	NeutralMailbox *regexp.Regexp `sconf:"-" json:"-"`
 	NotJunkMailbox *regexp.Regexp `sconf:"-" json:"-"`
+
+	SubmissionAllowedFromCanonical map[string]struct{} `sconf:"-" json:"-"` // Canonical addresses from SubmissionAllowedFrom.
+}
+
+// OutgoingIdentity is the local IPs and hostname used for delivering messages to
+// remote mail servers, instead of the IPs of the SMTP listeners and the hostname
+// of the mox instance.
+type OutgoingIdentity struct {
+	IPs      []string `sconf-doc:"Local IPv4 and/or IPv6 addresses to connect from. The first IP of the address family of the remote mail server is used. If no IP of that family is configured, the IPs of the SMTP listeners are used. IPs must be configured on this machine. For each IP, reverse DNS should resolve to Hostname, and the SPF records of the sending domains should allow it."`
+	Hostname string   `sconf:"optional" sconf-doc:"Hostname to identify with in the SMTP EHLO command, in IDNA form. Should resolve to the IPs, and the IPs should have a reverse DNS name of this hostname. Default: the hostname of this mox instance."`
+
+	ParsedIPs      []net.IP   `sconf:"-" json:"-"`
+	HostnameDomain dns.Domain `sconf:"-" json:"-"`
+}
+
+// OutgoingWebhook is an HTTP endpoint that receives events about outgoing
+// messages of an account.
+type OutgoingWebhook struct {
+	URL    string   `sconf-doc:"URL that events are POSTed to, as JSON. Must have scheme http or https. A response with a 2xx status code indicates the event was processed. Other responses or errors cause the call to be retried with increasing backoff, for up to a day."`
+	Secret string   `sconf-doc:"Secret key for signing the requests. The current time in unix seconds is sent in the Mox-Webhook-Timestamp header. The HMAC-SHA256 with this secret over the timestamp, a dot, and the request body is sent in the Mox-Webhook-Signature header as sha256= followed by the hexadecimal signature. Receivers should verify the signature, and reject requests with an old timestamp to prevent replays."`
+	Events []string `sconf:"optional" sconf-doc:"Events to call the webhook for. Valid values: delivered, delayed, failed, incomingdsn. Default: all events."`
+}
+
+type MailboxRetention struct {
+	Age   time.Duration `sconf-doc:"Messages older than this period are expunged from the mailbox, e.g. 720h for 30 days. Zero keeps all messages."`
+	Since string        `sconf:"optional" sconf-doc:"Time from which the age of a message is calculated: \"received\", the default, for the time the message was received; or \"moved\", for the time the message was moved or copied into the mailbox, falling back to the time of receipt for messages that were delivered into the mailbox directly."`
 }
 
 type JunkFilter struct {
@@ -262,15 +404,24 @@ type Destination struct {
 	Mailbox  string    `sconf:"optional" sconf-doc:"Mailbox to deliver to if none of Rulesets match. Default: Inbox."`
 	Rulesets []Ruleset `sconf:"optional" sconf-doc:"Delivery rules based on message and SMTP transaction. You may want to match each mailing list by SMTP MailFrom address, VerifiedDomain and/or List-ID header (typically <listname.example.org> if the list address is listname@example.org), delivering them to their own mailbox."`
 
-	DMARCReports bool `sconf:"-" json:"-"`
-	TLSReports   bool `sconf:"-" json:"-"`
+	ForwardTo       []string `sconf:"optional" sconf-doc:"Email addresses to forward incoming messages to, e.g. the new address of someone who left. Messages are forwarded with the SMTP MAIL FROM address rewritten with the Sender Rewriting Scheme (SRS) to an address in the domain of this destination, so SPF checks at the receiving mail server pass. Bounces to rewritten addresses are relayed to the original sender. Messages that are rejected or classified as junk (delivered to a mailbox with the \\Junk special-use flag, or matching the account's AutomaticJunkFlags configuration) are not forwarded."`
+	ForwardKeepCopy bool     `sconf:"optional" sconf-doc:"If set, forwarded messages are also delivered to the local mailbox. Otherwise, only messages that are not forwarded, such as messages classified as junk, are delivered locally."`
+
+	DMARCReports       bool           `sconf:"-" json:"-"`
+	TLSReports         bool           `sconf:"-" json:"-"`
+	ForwardToAddresses []smtp.Address `sconf:"-" json:"-"` // Parsed ForwardTo.
 }
 
 // Equal returns whether d and o are equal, only looking at their user-changeable fields.
 func (d Destination) Equal(o Destination) bool {
-	if d.Mailbox != o.Mailbox || len(d.Rulesets) != len(o.Rulesets) {
+	if d.Mailbox != o.Mailbox || len(d.Rulesets) != len(o.Rulesets) || d.ForwardKeepCopy != o.ForwardKeepCopy || len(d.ForwardTo) != len(o.ForwardTo) {
 		return false
 	}
+	for i, s := range d.ForwardTo {
+		if s != o.ForwardTo[i] {
+			return false
+		}
+	}
 	for i, rs := range d.Rulesets {
 		if !rs.Equal(o.Rulesets[i]) {
 			return false
@@ -145,6 +145,24 @@ describe-static" and "mox config describe-domains":
 			# (optional)
 			SMTPMaxMessageSize: 0
 
+			# Require a PROXY protocol header (version 1 or 2) at the start of incoming
+			# connections, as sent by TCP load balancers like HAProxy. The client address from
+			# the header is used instead of the address of the load balancer, e.g. for SPF,
+			# iprev, DNSBL, reputation and rate limiting. (optional)
+			ProxyProtocol:
+
+				# IP addresses or networks in CIDR notation of the load balancers. Connections
+				# from other IPs are closed.
+				TrustedIPs:
+					-
+
+				# Services that require the PROXY header: smtp, submission, submissions, lmtp,
+				# imap, imaps, http, https. Service http applies to all plain HTTP ports of the
+				# listener, https to all HTTPS ports. If empty, the header is required for all
+				# services. (optional)
+				Services:
+					-
+
 			# (optional)
 			SMTP:
 				Enabled: false
@@ -170,6 +188,46 @@ describe-static" and "mox config describe-domains":
 				DNSBLs:
 					-
 
+				# Limits for incoming connections. (optional)
+				Limits:
+
+					# Maximum number of new connections per window. Default: 300, 900, 2700 per
+					# minute. (optional)
+					ConnectionRate:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# Maximum number of concurrent connections, with three values for the IP and its
+					# two networks. Default: 30, 90, 270. (optional)
+					Connections:
+						- 0
+
+					# Maximum number of failed authentication attempts per window. Once reached, new
+					# connections are refused. If not set, failures are tracked together with other
+					# services, including the web interfaces, with limits 10, 30, 90 per minute and
+					# 50, 150, 450 per day. (optional)
+					AuthFailures:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# IP addresses or networks in CIDR notation that are exempt from limiting, e.g.
+					# 192.0.2.10 or 2001:db8::/32. For SMTP, the per-account incoming message rate
+					# limits are not applied either. (optional)
+					AllowIPs:
+						-
+
 			# SMTP for submitting email, e.g. by email applications. Starts out in plain text,
 			# can be upgraded to TLS with the STARTTLS command. Prefer using Submissions which
 			# is always a TLS connection. (optional)
@@ -183,6 +241,47 @@ describe-static" and "mox config describe-domains":
 				# without encryption. Not recommended. (optional)
 				NoRequireSTARTTLS: false
 
+				# Limits for incoming connections and authentication attempts. Also applies to
+				# Submissions. (optional)
+				Limits:
+
+					# Maximum number of new connections per window. Default: 300, 900, 2700 per
+					# minute. (optional)
+					ConnectionRate:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# Maximum number of concurrent connections, with three values for the IP and its
+					# two networks. Default: 30, 90, 270. (optional)
+					Connections:
+						- 0
+
+					# Maximum number of failed authentication attempts per window. Once reached, new
+					# connections are refused. If not set, failures are tracked together with other
+					# services, including the web interfaces, with limits 10, 30, 90 per minute and
+					# 50, 150, 450 per day. (optional)
+					AuthFailures:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# IP addresses or networks in CIDR notation that are exempt from limiting, e.g.
+					# 192.0.2.10 or 2001:db8::/32. For SMTP, the per-account incoming message rate
+					# limits are not applied either. (optional)
+					AllowIPs:
+						-
+
 			# SMTP over TLS for submitting email, by email applications. Requires a TLS
 			# config. (optional)
 			Submissions:
@@ -191,6 +290,39 @@ describe-static" and "mox config describe-domains":
 				# Default 465. (optional)
 				Port: 0
 
+			# LMTP (RFC 2033) for delivering messages from a trusted relay, e.g. an existing
+			# Postfix MTA, to local accounts. Messages are delivered according to the rulesets
+			# of the destination, without spam filtering or rate limiting, that is left to the
+			# relay. Recipients must exist, and a status for each recipient is returned after
+			# DATA. Messages for destinations with ForwardTo are forwarded like messages
+			# delivered over SMTP. Only connections from TrustedIPs are accepted on the TCP
+			# port, prefer a unix domain socket. (optional)
+			LMTP:
+				Enabled: false
+
+				# TCP port to listen on at the IPs of the listener. Default 24. Not used if
+				# UnixSocket is set. (optional)
+				Port: 0
+
+				# If set, listen on this unix domain socket instead of a TCP port, e.g.
+				# /var/spool/postfix/private/mox-lmtp. Relative paths are relative to the data
+				# directory. Any existing file at this path is removed at startup. The socket is
+				# accessible for all users, access must be restricted through permissions of the
+				# directory. (optional)
+				UnixSocket:
+
+				# IP addresses or networks in CIDR notation of the relays that are allowed to
+				# connect to the TCP port, e.g. 127.0.0.1 or 10.0.0.0/8. Connections from other
+				# IPs are closed. Required unless UnixSocket is set. (optional)
+				TrustedIPs:
+					-
+
+				# If set, the first Authentication-Results header with this authserv-id, typically
+				# the hostname of the relay, is trusted. Its spf, dkim and dmarc results are used
+				# for rulesets with VerifiedDomain and stored with the message. If not set,
+				# messages are delivered without verified sender information. (optional)
+				TrustedAuthServID:
+
 			# IMAP for reading email, by email applications. Starts out in plain text, can be
 			# upgraded to TLS with the STARTTLS command. Prefer using IMAPS instead which is
 			# always a TLS connection. (optional)
@@ -204,6 +336,47 @@ describe-static" and "mox config describe-domains":
 				# VPN). (optional)
 				NoRequireSTARTTLS: false
 
+				# Limits for incoming connections and authentication attempts. Also applies to
+				# IMAPS. (optional)
+				Limits:
+
+					# Maximum number of new connections per window. Default: 300, 900, 2700 per
+					# minute. (optional)
+					ConnectionRate:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# Maximum number of concurrent connections, with three values for the IP and its
+					# two networks. Default: 30, 90, 270. (optional)
+					Connections:
+						- 0
+
+					# Maximum number of failed authentication attempts per window. Once reached, new
+					# connections are refused. If not set, failures are tracked together with other
+					# services, including the web interfaces, with limits 10, 30, 90 per minute and
+					# 50, 150, 450 per day. (optional)
+					AuthFailures:
+						-
+
+							# Duration of the window, e.g. 1m or 24h.
+							Window: 0s
+
+							# Exactly three limits, for the IP and its two networks.
+							Limits:
+								- 0
+
+					# IP addresses or networks in CIDR notation that are exempt from limiting, e.g.
+					# 192.0.2.10 or 2001:db8::/32. For SMTP, the per-account incoming message rate
+					# limits are not applied either. (optional)
+					AllowIPs:
+						-
+
 			# IMAP over TLS for reading email, by email applications. Requires a TLS config.
 			# (optional)
 			IMAPS:
@@ -339,6 +512,95 @@ describe-static" and "mox config describe-domains":
 	DefaultMailboxes:
 		-
 
+	# Settings for the queue of outgoing messages. (optional)
+	Queue:
+
+		# Intervals between delivery attempts for a message that failed with a temporary
+		# error. The first attempt is made immediately. If the last interval has passed
+		# and delivery failed again, the message fails permanently. Default: 7m30s, 15m,
+		# 30m, 1h, 2h, 4h, 8h. Each interval gets a few seconds of jitter. (optional)
+		RetrySchedule:
+			- 0s
+
+		# Maximum time a message stays in the queue after it was added, e.g. 48h. If a
+		# next attempt would be scheduled after this time, the message fails permanently
+		# instead. Default: no limit, only the RetrySchedule determines when delivery is
+		# given up. (optional)
+		MaxLifetime: 0s
+
+		# Time after queueing a message after which the sender is sent a DSN that delivery
+		# is delayed. It is sent once, after the first failed delivery attempt after this
+		# time. Default: 1h30m, which is after the 5th attempt with the default
+		# RetrySchedule. (optional)
+		DelayDSNAfter: 0s
+
+		# Overrides of retry settings per recipient domain, e.g. for faster retries to
+		# partner domains. The key is a domain name, subdomains do not match. (optional)
+		DomainPolicies:
+			x:
+
+				# Intervals between delivery attempts, see Queue. (optional)
+				RetrySchedule:
+					- 0s
+
+				# Maximum time in queue, see Queue. (optional)
+				MaxLifetime: 0s
+
+				# Time after which a delayed DSN is sent, see Queue. (optional)
+				DelayDSNAfter: 0s
+
+		# Maximum number of concurrent deliveries to a single recipient domain, for
+		# domains without Concurrency in DestinationLimits. Default: 1. (optional)
+		DefaultConcurrency: 0
+
+		# Limits for deliveries to a destination. The key is a recipient domain or the
+		# host name of an MX host. Limits for a recipient domain apply to deliveries of
+		# messages for that domain. Limits for an MX host apply to connections to that
+		# host, for all recipient domains it handles, e.g. for large providers hosting
+		# many domains. (optional)
+		DestinationLimits:
+			x:
+
+				# Maximum number of concurrent deliveries. For a recipient domain, the default is
+				# DefaultConcurrency. For an MX host, the default is no limit. (optional)
+				Concurrency: 0
+
+				# Maximum number of deliveries started per minute. Default: no limit. (optional)
+				MessagesPerMinute: 0
+
+		# If a remote server responds with a temporary 421 or 451 error code, e.g. because
+		# we are sending too many messages, no further deliveries are started to the
+		# recipient domain and the MX host for this duration. Default: 5m. (optional)
+		ThrottleBackoff: 0s
+
+		# Maximum time a message submitted with the SMTP FUTURERELEASE extension (RFC
+		# 4865) can be held before delivery. Clients request a hold with the HOLDFOR or
+		# HOLDUNTIL parameter to MAIL FROM. Default: 720h (30 days). A negative value,
+		# e.g. -1s, disables FUTURERELEASE. (optional)
+		MaxFutureRelease: 0s
+
+		# How long to keep a record of messages that were delivered or failed permanently,
+		# with details of the final delivery attempt. History can be searched with "mox
+		# queue history", the admin web interface, and accounts can see the status of
+		# their own messages in the account web interface. Default: 168h (7 days). A
+		# negative value, e.g. -1s, disables keeping history. (optional)
+		HistoryRetention: 0s
+
+	# Restrictions for connections to remote IMAP servers when importing messages,
+	# through the account web interface or "mox import imap". (optional)
+	IMAPImport:
+
+		# Allow connecting to loopback, private and link-local IP addresses, e.g. for
+		# importing from a server on the local network. By default, connections to such
+		# IPs are refused: users could otherwise use imports to probe internal services.
+		# (optional)
+		AllowPrivateIPs: false
+
+		# Ports that can be connected to, in addition to the standard IMAP ports 993 and
+		# 143. (optional)
+		AllowPorts:
+			- 0
+
 # domains.conf
 
 	# Domains for which email is accepted. For internationalized domains, use their
@@ -461,6 +723,62 @@ describe-static" and "mox config describe-domains":
 				# Mailbox to deliver to, e.g. TLSRPT.
 				Mailbox:
 
+			# Aliases that expand to multiple addresses, e.g. for a team or a simple mailing
+			# list. Keys are localparts, which must be in canonical form: without catchall
+			# separator, and lower case unless the domain is configured as case sensitive. An
+			# address cannot be both an alias and an account destination. (optional)
+			Aliases:
+				x:
+
+					# Addresses of members to deliver messages for the alias to. Addresses of local
+					# accounts are delivered to the account, with regular junk filtering. Messages for
+					# other addresses are forwarded with the SMTP MAIL FROM address rewritten with the
+					# Sender Rewriting Scheme (SRS), so SPF checks at receiving mail servers pass and
+					# bounces can be relayed to the original sender. Messages are only forwarded if
+					# they would be accepted for local delivery, as determined with the account of a
+					# local member, or the postmaster account if the alias has no local members. A
+					# member that is also a recipient directly or through another alias gets the
+					# message once. Members cannot be aliases themselves.
+					Addresses:
+						-
+
+					# Who may send messages to the alias. Either members (default): the SPF-verified
+					# SMTP MAIL FROM address or DMARC-verified message From address must be a member;
+					# anyone; or authenticated: the SPF-verified SMTP MAIL FROM address or
+					# DMARC-verified message From address must be in a domain of this server, i.e. the
+					# message was sent by an authenticated user. (optional)
+					PostPolicy:
+
+					# If set, List-Id, List-Post and List-Unsubscribe headers are added to messages,
+					# as is done by mailing lists. Recipients can use them for filtering, and mail
+					# clients can offer list actions. Messages with a List-Id header of this alias are
+					# rejected as mail loop. (optional)
+					ListHeaders: false
+
+					# Value for the List-Unsubscribe header, e.g.
+					# <mailto:owner@example.org?subject=unsubscribe>. If empty, a mailto URI for the
+					# postmaster of the domain is used. (optional)
+					ListUnsubscribe:
+
+			# Local IPs and hostname to use when delivering messages with an SMTP MAIL FROM
+			# address in this domain to remote mail servers, e.g. to keep the sending
+			# reputation of domains separate. Takes precedence over the OutgoingIdentity of
+			# the account that submitted the message. (optional)
+			OutgoingIdentity:
+
+				# Local IPv4 and/or IPv6 addresses to connect from. The first IP of the address
+				# family of the remote mail server is used. If no IP of that family is configured,
+				# the IPs of the SMTP listeners are used. IPs must be configured on this machine.
+				# For each IP, reverse DNS should resolve to Hostname, and the SPF records of the
+				# sending domains should allow it.
+				IPs:
+					-
+
+				# Hostname to identify with in the SMTP EHLO command, in IDNA form. Should resolve
+				# to the IPs, and the IPs should have a reverse DNS name of this hostname.
+				# Default: the hostname of this mox instance. (optional)
+				Hostname:
+
 	# Accounts to which email can be delivered. An account can accept email for
 	# multiple domains, for multiple localparts, and deliver to multiple mailboxes.
 	Accounts:
@@ -522,6 +840,22 @@ describe-static" and "mox config describe-domains":
 							# Mailbox to deliver to if this ruleset matches.
 							Mailbox:
 
+					# Email addresses to forward incoming messages to, e.g. the new address of someone
+					# who left. Messages are forwarded with the SMTP MAIL FROM address rewritten with
+					# the Sender Rewriting Scheme (SRS) to an address in the domain of this
+					# destination, so SPF checks at the receiving mail server pass. Bounces to
+					# rewritten addresses are relayed to the original sender. Messages that are
+					# rejected or classified as junk (delivered to a mailbox with the \Junk
+					# special-use flag, or matching the account's AutomaticJunkFlags configuration)
+					# are not forwarded. (optional)
+					ForwardTo:
+						-
+
+					# If set, forwarded messages are also delivered to the local mailbox. Otherwise,
+					# only messages that are not forwarded, such as messages classified as junk, are
+					# delivered locally. (optional)
+					ForwardKeepCopy: false
+
 			# If configured, messages classified as weakly spam are rejected with instructions
 			# to retry delivery, but this time with a signed token added to the subject.
 			# During the next delivery attempt, the signed token will bypass the spam filter.
@@ -611,6 +945,131 @@ describe-static" and "mox config describe-domains":
 			# this mail server in case of account compromise. Default 200. (optional)
 			MaxFirstTimeRecipientsPerDay: 0
 
+			# Policy for the addresses in the From and Sender headers of messages submitted by
+			# this account. With "strict", the default, the From address and the Sender
+			# address, if present, must be addresses of this account, i.e. match one of its
+			# destinations (taking the catchall separator into account), or be listed in
+			# SubmissionAllowedFrom. With "sender", the From address may also be an address of
+			# another account in a configured domain, but only if a Sender header with an
+			# address of this account is present, e.g. for sending on behalf of someone else.
+			# (optional)
+			SubmissionFromPolicy:
+
+			# Additional email addresses this account may use in the From and Sender headers
+			# of submitted messages, and as SMTP MAIL FROM, e.g. for shared identities like
+			# info@ that are delivered to another account. Addresses must be in a configured
+			# domain. (optional)
+			SubmissionAllowedFrom:
+				-
+
+			# Local IPs and hostname to use when delivering messages submitted by this account
+			# to remote mail servers. Not used for messages with an SMTP MAIL FROM address in
+			# a domain that has its own OutgoingIdentity. (optional)
+			OutgoingIdentity:
+
+				# Local IPv4 and/or IPv6 addresses to connect from. The first IP of the address
+				# family of the remote mail server is used. If no IP of that family is configured,
+				# the IPs of the SMTP listeners are used. IPs must be configured on this machine.
+				# For each IP, reverse DNS should resolve to Hostname, and the SPF records of the
+				# sending domains should allow it.
+				IPs:
+					-
+
+				# Hostname to identify with in the SMTP EHLO command, in IDNA form. Should resolve
+				# to the IPs, and the IPs should have a reverse DNS name of this hostname.
+				# Default: the hostname of this mox instance. (optional)
+				Hostname:
+
+			# If set, an HTTP webhook is called for events about messages submitted by this
+			# account: successful delivery, delayed delivery (for each temporary failure),
+			# permanent failure, and DSNs received later from remote mail servers that are
+			# matched to an outgoing message by message-id. (optional)
+			OutgoingWebhook:
+
+				# URL that events are POSTed to, as JSON. Must have scheme http or https. A
+				# response with a 2xx status code indicates the event was processed. Other
+				# responses or errors cause the call to be retried with increasing backoff, for up
+				# to a day.
+				URL:
+
+				# Secret key for signing the requests. The current time in unix seconds is sent in
+				# the Mox-Webhook-Timestamp header. The HMAC-SHA256 with this secret over the
+				# timestamp, a dot, and the request body is sent in the Mox-Webhook-Signature
+				# header as sha256= followed by the hexadecimal signature. Receivers should verify
+				# the signature, and reject requests with an old timestamp to prevent replays.
+				Secret:
+
+				# Events to call the webhook for. Valid values: delivered, delayed, failed,
+				# incomingdsn. Default: all events. (optional)
+				Events:
+					-
+
+			# Retention policies for mailboxes, keys are mailbox names, e.g. Trash and Junk.
+			# Messages older than the retention period are expunged automatically, checked
+			# about every hour. Expunged messages are not untrained from the junk filter, so
+			# their training information remains. Submailboxes are not affected. An Age of 0
+			# keeps messages in the mailbox, e.g. to exempt Inbox from
+			# DefaultMailboxRetention. (optional)
+			MailboxRetention:
+				x:
+
+					# Messages older than this period are expunged from the mailbox, e.g. 720h for 30
+					# days. Zero keeps all messages.
+					Age: 0s
+
+					# Time from which the age of a message is calculated: "received", the default, for
+					# the time the message was received; or "moved", for the time the message was
+					# moved or copied into the mailbox, falling back to the time of receipt for
+					# messages that were delivered into the mailbox directly. (optional)
+					Since:
+
+			# Retention policy for all mailboxes of the account, including submailboxes, that
+			# are not listed in MailboxRetention. (optional)
+			DefaultMailboxRetention:
+
+				# Messages older than this period are expunged from the mailbox, e.g. 720h for 30
+				# days. Zero keeps all messages.
+				Age: 0s
+
+				# Time from which the age of a message is calculated: "received", the default, for
+				# the time the message was received; or "moved", for the time the message was
+				# moved or copied into the mailbox, falling back to the time of receipt for
+				# messages that were delivered into the mailbox directly. (optional)
+				Since:
+
+			# If set, message files are encrypted at rest. A key pair is created when the
+			# password is set, at the first login with the password after enabling, e.g. over
+			# IMAP with LOGIN or AUTHENTICATE PLAIN, SMTP submission with AUTH PLAIN, or the
+			# account web page, or with "mox encrypt -password". Until the key pair exists,
+			# incoming messages are refused with a temporary error instead of being stored
+			# unencrypted. New messages are encrypted with the public key, also while nobody
+			# is logged in. Reading messages requires the private key, which is sealed with
+			# the account password and unsealed during login. IMAP authentication with SCRAM
+			# or CRAM-MD5 is refused while the account is locked, i.e. not in use by a session
+			# authenticated with the password. Use "mox encrypt" to encrypt existing messages.
+			# The password can only be changed while the account is unlocked, e.g. through the
+			# account web page: an administrator cannot reset the password without losing
+			# access to the encrypted messages. Of the account database, the message contents
+			# are encrypted too: the received headers are stored in the encrypted message
+			# file, and the parsed message structure with the subject, addresses and MIME
+			# parts is encrypted, and decrypted for each message that is accessed, e.g. for
+			# IMAP FETCH and SEARCH, which is slower. Metadata needed for deliveries while the
+			# account is locked is not encrypted: the envelope and message From addresses,
+			# recipient addresses, remote IPs, EHLO and DKIM domains used for reputation, the
+			# Message-ID of rejected messages, flags, sizes, times and mailbox names. The junk
+			# filter database, with words from messages, is not encrypted either: don't
+			# configure a junk filter for accounts that must not store message contents
+			# unencrypted. (optional)
+			EncryptMessages: false
+
+			# If set, newly delivered messages are stored compressed on disk, if compression
+			# makes them smaller. Compressed and uncompressed message files are read
+			# transparently. Use "mox compress" to compress existing messages. Note that
+			# backups hardlinking message files still work, but tools reading message files
+			# directly (instead of through mox export) will see the compressed form.
+			# (optional)
+			CompressMessages: false
+
 	# Redirect all requests from domain (key) to domain (value). Always redirects to
 	# HTTPS. For plain HTTP redirects, use a WebHandler with a WebRedirect. (optional)
 	WebDomainRedirects:
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
@@ -267,6 +269,55 @@ func (s *ctlreader) xcheck(err error, msg string) {
 }
 
 // servectl handles requests on the unix domain socket "ctl", e.g. for graceful shutdown, local mail delivery.
+// xreadQueueFilter reads a filter for messages in the queue, as written by
+// queueFilterArgs.xwrite.
+//
+// protocol:
+// > id, or 0
+// > account
+// > from
+// > to
+// > queued before, RFC3339 or empty
+// > queued after, RFC3339 or empty
+// > last error substring
+// > minimum attempts
+func (c *ctl) xreadQueueFilter() (queue.Filter, error) {
+	idstr := c.xread()
+	var f queue.Filter
+	f.Account = c.xread()
+	f.From = c.xread()
+	f.To = c.xread()
+	beforestr := c.xread()
+	afterstr := c.xread()
+	f.LastError = c.xread()
+	attemptsstr := c.xread()
+
+	id, err := strconv.ParseInt(idstr, 10, 64)
+	if err != nil {
+		return f, fmt.Errorf("parsing id: %v", err)
+	}
+	if id > 0 {
+		f.IDs = []int64{id}
+	}
+	parseTime := func(s string) (*time.Time, error) {
+		if s == "" {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		return &t, err
+	}
+	if f.QueuedBefore, err = parseTime(beforestr); err != nil {
+		return f, fmt.Errorf("parsing queued before: %v", err)
+	}
+	if f.QueuedAfter, err = parseTime(afterstr); err != nil {
+		return f, fmt.Errorf("parsing queued after: %v", err)
+	}
+	if f.MinAttempts, err = strconv.Atoi(attemptsstr); err != nil {
+		return f, fmt.Errorf("parsing minimum attempts: %v", err)
+	}
+	return f, nil
+}
+
 func servectl(ctx context.Context, log *mlog.Log, conn net.Conn, shutdown func()) {
 	log.Debug("ctl connection")
 
@@ -383,10 +434,13 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 	case "queue":
 		/* protocol:
 		> "queue"
+		> filter, see xreadQueueFilter
 		< "ok"
 		< stream
 		*/
-		qmsgs, err := queue.List(ctx)
+		f, err := ctl.xreadQueueFilter()
+		ctl.xcheck(err, "parsing filter")
+		qmsgs, err := queue.List(ctx, f, queue.Page{})
 		ctl.xcheck(err, "listing queue")
 		ctl.xwriteok()
 
@@ -397,7 +451,14 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 			if qm.LastAttempt != nil {
 				lastAttempt = time.Since(*qm.LastAttempt).Round(time.Second).String()
 			}
-			fmt.Fprintf(xw, "%5d %s from:%s to:%s next %s last %s error %q\n", qm.ID, qm.Queued.Format(time.RFC3339), qm.Sender().LogString(), qm.Recipient().LogString(), -time.Since(qm.NextAttempt).Round(time.Second), lastAttempt, qm.LastError)
+			var hold string
+			if qm.Hold {
+				hold = " (held)"
+			}
+			if qm.Attempts == 0 && qm.FutureRelease.After(time.Now()) {
+				hold += " (release " + qm.FutureRelease.Format(time.RFC3339) + ")"
+			}
+			fmt.Fprintf(xw, "%5d %s from:%s to:%s attempts %d next %s last %s error %q%s\n", qm.ID, qm.Queued.Format(time.RFC3339), qm.Sender().LogString(), qm.Recipient().LogString(), qm.Attempts, -time.Since(qm.NextAttempt).Round(time.Second), lastAttempt, qm.LastError, hold)
 		}
 		if len(qmsgs) == 0 {
 			fmt.Fprint(xw, "(empty)\n")
@@ -407,29 +468,26 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 	case "queuekick", "queuedrop":
 		/* protocol:
 		> "queuekick" or "queuedrop"
-		> id
-		> todomain
-		> recipient
+		> filter, see xreadQueueFilter
 		< count
 		< "ok" or error
 		*/
 
-		idstr := ctl.xread()
-		todomain := ctl.xread()
-		recipient := ctl.xread()
-		id, err := strconv.ParseInt(idstr, 10, 64)
+		f, err := ctl.xreadQueueFilter()
 		if err != nil {
 			ctl.xwrite("0")
-			ctl.xcheck(err, "parsing id")
+			ctl.xcheck(err, "parsing filter")
 		}
 
 		var count int
 		if cmd == "queuekick" {
-			count, err = queue.Kick(ctx, id, todomain, recipient)
-			ctl.xcheck(err, "kicking queue")
+			count, err = queue.Kick(ctx, f)
 		} else {
-			count, err = queue.Drop(ctx, id, todomain, recipient)
-			ctl.xcheck(err, "dropping messages from queue")
+			count, err = queue.Drop(ctx, f)
+		}
+		if err != nil {
+			ctl.xwrite("0")
+			ctl.xcheck(err, "changing messages in queue")
 		}
 		ctl.xwrite(fmt.Sprintf("%d", count))
 		ctl.xwriteok()
@@ -456,10 +514,199 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 		ctl.xwriteok()
 		ctl.xstreamfrom(mr)
 
+	case "queueholdruleslist":
+		/* protocol:
+		> "queueholdruleslist"
+		< "ok"
+		< stream
+		*/
+		l, err := queue.HoldRuleList(ctx)
+		ctl.xcheck(err, "listing hold rules")
+		ctl.xwriteok()
+		xw := ctl.writer()
+		fmt.Fprintln(xw, "hold rules:")
+		for _, hr := range l {
+			if hr.All() {
+				fmt.Fprintf(xw, "id %d: all messages\n", hr.ID)
+				continue
+			}
+			var elems []string
+			if hr.Account != "" {
+				elems = append(elems, fmt.Sprintf("account %q", hr.Account))
+			}
+			if !hr.SenderDomain.IsZero() {
+				elems = append(elems, fmt.Sprintf("sender domain %q", hr.SenderDomain.Name()))
+			}
+			if !hr.RecipientDomain.IsZero() {
+				elems = append(elems, fmt.Sprintf("recipient domain %q", hr.RecipientDomain.Name()))
+			}
+			if hr.MinSize > 0 {
+				elems = append(elems, fmt.Sprintf("min size %d", hr.MinSize))
+			}
+			fmt.Fprintf(xw, "id %d: %s\n", hr.ID, strings.Join(elems, ", "))
+		}
+		if len(l) == 0 {
+			fmt.Fprint(xw, "(none)\n")
+		}
+		xw.xclose()
+
+	case "queueholdrulesadd":
+		/* protocol:
+		> "queueholdrulesadd"
+		> account
+		> senderdomain
+		> recipientdomain
+		> minsize
+		< "ok" or error
+		*/
+		var hr queue.HoldRule
+		hr.Account = ctl.xread()
+		senderdomstr := ctl.xread()
+		rcptdomstr := ctl.xread()
+		minsizestr := ctl.xread()
+		var err error
+		if senderdomstr != "" {
+			hr.SenderDomain, err = dns.ParseDomain(senderdomstr)
+			ctl.xcheck(err, "parsing sender domain")
+		}
+		if rcptdomstr != "" {
+			hr.RecipientDomain, err = dns.ParseDomain(rcptdomstr)
+			ctl.xcheck(err, "parsing recipient domain")
+		}
+		hr.MinSize, err = strconv.ParseInt(minsizestr, 10, 64)
+		ctl.xcheck(err, "parsing minimum size")
+		hr, err = queue.HoldRuleAdd(ctx, log, hr)
+		ctl.xcheck(err, "add hold rule")
+		ctl.xwriteok()
+
+	case "queueholdrulesremove":
+		/* protocol:
+		> "queueholdrulesremove"
+		> id
+		< "ok" or error
+		*/
+		id, err := strconv.ParseInt(ctl.xread(), 10, 64)
+		ctl.xcheck(err, "parsing id")
+		err = queue.HoldRuleRemove(ctx, log, id)
+		ctl.xcheck(err, "remove hold rule")
+		ctl.xwriteok()
+
+	case "queuehold", "queuerelease":
+		/* protocol:
+		> "queuehold" or "queuerelease"
+		> filter, see xreadQueueFilter
+		< count
+		< "ok" or error
+		*/
+		f, err := ctl.xreadQueueFilter()
+		if err != nil {
+			ctl.xwrite("0")
+			ctl.xcheck(err, "parsing filter")
+		}
+		count, err := queue.HoldSet(ctx, f, cmd == "queuehold")
+		if err != nil {
+			ctl.xwrite("0")
+			ctl.xcheck(err, "setting hold on messages in queue")
+		}
+		ctl.xwrite(fmt.Sprintf("%d", count))
+		ctl.xwriteok()
+
+	case "queuereschedule":
+		/* protocol:
+		> "queuereschedule"
+		> filter, see xreadQueueFilter
+		> release time in RFC3339 format, or empty for immediate delivery
+		< count
+		< "ok" or error
+		*/
+		f, err := ctl.xreadQueueFilter()
+		releasestr := ctl.xread()
+		if err != nil {
+			ctl.xwrite("0")
+			ctl.xcheck(err, "parsing filter")
+		}
+		var release time.Time
+		if releasestr != "" {
+			release, err = time.Parse(time.RFC3339, releasestr)
+			if err != nil {
+				ctl.xwrite("0")
+				ctl.xcheck(err, "parsing release time")
+			}
+		}
+		count, err := queue.Reschedule(ctx, f, release)
+		if err != nil {
+			ctl.xwrite("0")
+			ctl.xcheck(err, "rescheduling messages in queue")
+		}
+		ctl.xwrite(fmt.Sprintf("%d", count))
+		ctl.xwriteok()
+
+	case "queuehistory":
+		/* protocol:
+		> "queuehistory"
+		> account
+		> from
+		> to
+		> result, "success", "failure" or empty
+		> limit
+		< "ok"
+		< stream
+		*/
+		var f queue.HistoryFilter
+		f.Account = ctl.xread()
+		f.From = ctl.xread()
+		f.To = ctl.xread()
+		result := ctl.xread()
+		limitstr := ctl.xread()
+		switch result {
+		case "":
+		case "success", "failure":
+			success := result == "success"
+			f.Success = &success
+		default:
+			ctl.xcheck(fmt.Errorf("unknown result %q, must be success or failure", result), "parsing result")
+		}
+		limit, err := strconv.Atoi(limitstr)
+		ctl.xcheck(err, "parsing limit")
+		f.Limit = limit
+		l, err := queue.HistoryList(ctx, f)
+		ctl.xcheck(err, "listing queue history")
+		ctl.xwriteok()
+
+		xw := ctl.writer()
+		fmt.Fprintln(xw, "history:")
+		for _, mr := range l {
+			result := "failure"
+			if mr.Success {
+				result = "success"
+			}
+			fmt.Fprintf(xw, "%5d %s %s from:%s to:%s attempts %d", mr.ID, mr.Retired.Format(time.RFC3339), result, mr.Sender().LogString(), mr.Recipient().LogString(), mr.Attempts)
+			if mr.RemoteMX != "" {
+				fmt.Fprintf(xw, " mx %s", mr.RemoteMX)
+			}
+			if mr.RemoteIP != "" {
+				fmt.Fprintf(xw, " ip %s", mr.RemoteIP)
+			}
+			if mr.TLSMode != "" {
+				fmt.Fprintf(xw, " tls %s", mr.TLSMode)
+				if mr.TLSVersion != "" {
+					fmt.Fprintf(xw, " %s", mr.TLSVersion)
+				}
+			}
+			fmt.Fprintf(xw, " response %q\n", mr.Response)
+		}
+		if len(l) == 0 {
+			fmt.Fprint(xw, "(empty)\n")
+		}
+		xw.xclose()
+
 	case "importmaildir", "importmbox":
 		mbox := cmd == "importmbox"
 		importctl(ctx, ctl, mbox)
 
+	case "importimap":
+		importIMAPCtl(ctx, ctl)
+
 	case "domainadd":
 		/* protocol:
 		> "domainadd"
@@ -514,6 +761,53 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 		ctl.xcheck(err, "removing account")
 		ctl.xwriteok()
 
+	case "accountrename":
+		/* protocol:
+		> "accountrename"
+		> account
+		> newname
+		< "ok" or error
+		*/
+		account := ctl.xread()
+		newName := ctl.xread()
+		err := store.RenameAccount(ctx, ctl.log, account, newName)
+		ctl.xcheck(err, "renaming account")
+		err = queue.RenameAccount(ctx, ctl.log, account, newName)
+		ctl.xcheck(err, "account renamed, but renaming account in queue")
+		ctl.xwriteok()
+
+	case "accountmovemailbox":
+		/* protocol:
+		> "accountmovemailbox"
+		> account
+		> mailbox
+		> destination account
+		< "ok" or error
+		< count
+		*/
+		account := ctl.xread()
+		mailbox := ctl.xread()
+		dstAccount := ctl.xread()
+		src, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := src.Close()
+			log.Check(err, "closing account after moving mailbox")
+		}()
+		dst, err := store.OpenAccount(dstAccount)
+		ctl.xcheck(err, "open destination account")
+		defer func() {
+			err := dst.Close()
+			log.Check(err, "closing account after moving mailbox")
+		}()
+		n, err := store.MoveMailboxTree(ctl.log, src, dst, mailbox)
+		if err != nil && n > 0 {
+			err = fmt.Errorf("%w (after moving %d messages)", err, n)
+		}
+		ctl.xcheck(err, "moving mailbox")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
 	case "addressadd":
 		/* protocol:
 		> "addressadd"
@@ -538,6 +832,144 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 		ctl.xcheck(err, "removing address")
 		ctl.xwriteok()
 
+	case "addressmove":
+		/* protocol:
+		> "addressmove"
+		> address
+		> account
+		> "messages" or ""
+		< "ok" or error
+		< count
+		*/
+		address := ctl.xread()
+		account := ctl.xread()
+		moveMessages := ctl.xread() == "messages"
+		n, err := store.MoveAddress(ctx, ctl.log, address, account, moveMessages)
+		ctl.xcheck(err, "moving address")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
+	case "aliaslist":
+		/* protocol:
+		> "aliaslist"
+		> domain
+		< "ok" or error
+		< stream
+		*/
+		domain := ctl.xread()
+		d, err := dns.ParseDomain(domain)
+		ctl.xcheck(err, "parsing domain")
+		dc, ok := mox.Conf.Domain(d)
+		if !ok {
+			ctl.xerror("no such domain")
+		}
+		ctl.xwriteok()
+		xw := ctl.writer()
+		l := make([]string, 0, len(dc.Aliases))
+		for lp := range dc.Aliases {
+			l = append(l, lp)
+		}
+		sort.Strings(l)
+		for _, lp := range l {
+			fmt.Fprintln(xw, smtp.NewAddress(smtp.Localpart(lp), d).Pack(true))
+		}
+		xw.xclose()
+
+	case "aliasprint":
+		/* protocol:
+		> "aliasprint"
+		> address
+		< "ok" or error
+		< stream
+		*/
+		address := ctl.xread()
+		addr, err := smtp.ParseAddress(address)
+		ctl.xcheck(err, "parsing address")
+		alias, _, ok := mox.FindAlias(addr.Localpart, addr.Domain)
+		if !ok {
+			ctl.xerror("no such alias")
+		}
+		ctl.xwriteok()
+		xw := ctl.writer()
+		postPolicy := alias.PostPolicy
+		if postPolicy == "" {
+			postPolicy = "members"
+		}
+		fmt.Fprintf(xw, "# postpolicy: %s\n", postPolicy)
+		fmt.Fprintf(xw, "# listheaders: %v\n", alias.ListHeaders)
+		if alias.ListUnsubscribe != "" {
+			fmt.Fprintf(xw, "# listunsubscribe: %s\n", alias.ListUnsubscribe)
+		}
+		for _, a := range alias.Addresses {
+			fmt.Fprintln(xw, a)
+		}
+		xw.xclose()
+
+	case "aliasadd":
+		/* protocol:
+		> "aliasadd"
+		> address
+		> json alias
+		< "ok" or error
+		*/
+		address := ctl.xread()
+		line := ctl.xread()
+		var alias config.Alias
+		err := json.Unmarshal([]byte(line), &alias)
+		ctl.xcheck(err, "parsing json")
+		err = mox.AliasAdd(ctx, address, alias)
+		ctl.xcheck(err, "adding alias")
+		ctl.xwriteok()
+
+	case "aliasupdate":
+		/* protocol:
+		> "aliasupdate"
+		> address
+		> postpolicy
+		> listheaders ("true" or "false")
+		> listunsubscribe
+		< "ok" or error
+		*/
+		address := ctl.xread()
+		postPolicy := ctl.xread()
+		listHeaders := ctl.xread()
+		listUnsubscribe := ctl.xread()
+		err := mox.AliasUpdate(ctx, address, postPolicy, listHeaders == "true", listUnsubscribe)
+		ctl.xcheck(err, "updating alias")
+		ctl.xwriteok()
+
+	case "aliasrm":
+		/* protocol:
+		> "aliasrm"
+		> address
+		< "ok" or error
+		*/
+		address := ctl.xread()
+		err := mox.AliasRemove(ctx, address)
+		ctl.xcheck(err, "removing alias")
+		ctl.xwriteok()
+
+	case "aliasaddaddr", "aliasrmaddr":
+		/* protocol:
+		> "aliasaddaddr" or "aliasrmaddr"
+		> address
+		> json addresses
+		< "ok" or error
+		*/
+		address := ctl.xread()
+		line := ctl.xread()
+		var addresses []string
+		err := json.Unmarshal([]byte(line), &addresses)
+		ctl.xcheck(err, "parsing json")
+		if cmd == "aliasaddaddr" {
+			err = mox.AliasAddressesAdd(ctx, address, addresses)
+			ctl.xcheck(err, "adding addresses to alias")
+		} else {
+			err = mox.AliasAddressesRemove(ctx, address, addresses)
+			ctl.xcheck(err, "removing addresses from alias")
+		}
+		ctl.xwriteok()
+
 	case "loglevels":
 		/* protocol:
 		> "loglevels"
@@ -641,6 +1073,117 @@ func servectlcmd(ctx context.Context, log *mlog.Log, ctl *ctl, shutdown func())
 
 		ctl.xwriteok()
 
+	case "compress":
+		/* protocol:
+		> "compress"
+		> account, or empty for all accounts
+		< "ok" or error
+		< stream
+		*/
+		account := ctl.xread()
+		accounts := mox.Conf.Accounts()
+		if account != "" {
+			if _, ok := mox.Conf.Account(account); !ok {
+				ctl.xerror("account not found")
+			}
+			accounts = []string{account}
+		}
+		ctl.xwriteok()
+
+		xw := ctl.writer()
+		for _, name := range accounts {
+			acc, err := store.OpenAccount(name)
+			if err != nil {
+				fmt.Fprintf(xw, "%s: open account: %v\n", name, err)
+				continue
+			}
+			stats, err := acc.CompressMessages(ctl.log)
+			if err != nil {
+				fmt.Fprintf(xw, "%s: compressing messages: %v\n", name, err)
+			}
+			var saved int64
+			if stats.Original > 0 {
+				saved = 100 * (stats.Original - stats.Stored) / stats.Original
+			}
+			fmt.Fprintf(xw, "%s: %d messages, %d files compressed from %d to %d bytes (%d%% saved)\n", name, stats.Messages, stats.Compressed, stats.Original, stats.Stored, saved)
+			err = acc.Close()
+			ctl.log.Check(err, "closing account after compressing messages")
+		}
+		xw.xclose()
+
+	case "encrypt":
+		/* protocol:
+		> "encrypt"
+		> account
+		> password, or "" if not creating a key pair
+		< "ok" or error
+		< count
+		*/
+		account := ctl.xread()
+		password := ctl.xread()
+		acc, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after encrypting messages")
+		}()
+		if password != "" {
+			err := acc.UnlockWithPassword(password)
+			ctl.xcheck(err, "unlocking account with password")
+		}
+		n, err := acc.EncryptMessages(ctl.log)
+		if err != nil && n > 0 {
+			err = fmt.Errorf("%w (after encrypting %d messages)", err, n)
+		}
+		ctl.xcheck(err, "encrypting messages")
+		ctl.xwriteok()
+		ctl.xwrite(fmt.Sprintf("%d", n))
+
+	case "accountcheck":
+		/* protocol:
+		> "accountcheck"
+		> account
+		> "repair" or ""
+		< "ok" or error
+		< stream
+		*/
+		account := ctl.xread()
+		repair := ctl.xread() == "repair"
+		acc, err := store.OpenAccount(account)
+		ctl.xcheck(err, "open account")
+		defer func() {
+			err := acc.Close()
+			log.Check(err, "closing account after consistency check")
+		}()
+
+		var stats store.CheckStats
+		acc.WithWLock(func() {
+			stats, err = acc.CheckConsistency(ctl.log, repair)
+		})
+		ctl.xcheck(err, "checking account consistency")
+		ctl.xwriteok()
+		xw := ctl.writer()
+		for _, s := range stats.Problems {
+			fmt.Fprintln(xw, s)
+		}
+		fmt.Fprintf(xw, "%d messages checked, %d problems found, %d repaired\n", stats.Messages, len(stats.Problems), stats.Repaired)
+		xw.xclose()
+
+	case "dedup":
+		/* protocol:
+		> "dedup"
+		< "ok" or error
+		< stream
+		*/
+		ctl.xwriteok()
+		xw := ctl.writer()
+		stats, err := store.DedupMessageFiles(ctl.log, mox.Conf.Accounts())
+		if err != nil {
+			fmt.Fprintf(xw, "deduplicating message files: %v\n", err)
+		}
+		fmt.Fprintf(xw, "%d message files, %d already shared, %d duplicates replaced with hardlinks, %d bytes saved\n", stats.Files, stats.Shared, stats.Duplicates, stats.Saved)
+		xw.xclose()
+
 	case "backup":
 		backupctl(ctx, ctl)
 
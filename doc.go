@@ -19,17 +19,26 @@ low-maintenance self-hosted email.
 	mox setaccountpassword address
 	mox setadminpassword
 	mox loglevels [level [pkg]]
-	mox queue list
-	mox queue kick [-id id] [-todomain domain] [-recipient address]
-	mox queue drop [-id id] [-todomain domain] [-recipient address]
+	mox queue list [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	mox queue kick [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	mox queue drop [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
 	mox queue dump id
+	mox queue hold [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	mox queue release [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	mox queue holdrules list
+	mox queue holdrules add [-account account] [-senderdom domain] [-recipientdom domain] [-minsize bytes]
+	mox queue holdrules remove ruleid
+	mox queue history [-account account] [-from address] [-to address] [-result success|failure] [-limit n]
+	mox queue reschedule [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n] [-at time | -in duration]
 	mox import maildir accountname mailboxname maildir
 	mox import mbox accountname mailboxname mbox
-	mox export maildir dst-dir account-path [mailbox]
-	mox export mbox dst-dir account-path [mailbox]
+	mox import imap [-starttls] accountname host username
+	mox export maildir [flags] dst account-path [mailbox]
+	mox export mbox [flags] dst account-path [mailbox]
 	mox localserve
 	mox help [command ...]
-	mox backup dest-dir
+	mox backup [-incremental previous-backup-dir] dest-dir
+	mox restore [-account name] backup-dir
 	mox verifydata data-dir
 	mox config test
 	mox config dnscheck domain
@@ -38,8 +47,19 @@ low-maintenance self-hosted email.
 	mox config describe-static >mox.conf
 	mox config account add account address
 	mox config account rm account
+	mox config account rename account newname
+	mox account check [-repair] account
+	mox account movemailbox account mailbox destaccount
 	mox config address add address account
 	mox config address rm address
+	mox config address move [-messages] address account
+	mox config alias list domain
+	mox config alias print alias
+	mox config alias add alias@domain rcpt1@domain ...
+	mox config alias update alias@domain
+	mox config alias rm alias@domain
+	mox config alias addaddr alias@domain rcpt1@domain ...
+	mox config alias rmaddr alias@domain rcpt1@domain ...
 	mox config domain add domain account [localpart]
 	mox config domain rm domain
 	mox config describe-sendmail >/etc/moxsubmit.conf
@@ -61,6 +81,9 @@ low-maintenance self-hosted email.
 	mox dnsbl checkhealth zone
 	mox mtasts lookup domain
 	mox retrain accountname
+	mox compress [account]
+	mox encrypt [-password] account
+	mox dedup
 	mox sendmail [-Fname] [ignoredflags] [-t] [<message]
 	mox spf check domain ip
 	mox spf lookup domain
@@ -176,12 +199,31 @@ Valid labels: error, info, debug, trace, traceauth, tracedata.
 
 # mox queue list
 
-List messages in the delivery queue.
+List matching messages in the delivery queue.
 
 This prints the message with its ID, last and next delivery attempts, last
 error.
 
-	usage: mox queue list
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
+
+	usage: mox queue list [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	  -account string
+	    	account that queued the message
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
+	  -id int
+	    	id of message in queue
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
+	  -to string
+	    	recipient address or @domain
 
 # mox queue kick
 
@@ -192,13 +234,31 @@ retry after 7.5 minutes, and doubling each time. Kicking messages sets their
 next scheduled attempt to now, it can cause delivery to fail earlier than
 without rescheduling.
 
-	usage: mox queue kick [-id id] [-todomain domain] [-recipient address]
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain. Flags -todomain and -recipient of older
+versions are still accepted, as aliases for -to.
+
+	usage: mox queue kick [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	  -account string
+	    	account that queued the message
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
 	  -id int
 	    	id of message in queue
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
 	  -recipient string
-	    	recipient email address
+	    	recipient address, same as -to address
+	  -to string
+	    	recipient address or @domain
 	  -todomain string
-	    	destination domain of messages
+	    	recipient domain, same as -to @domain
 
 # mox queue drop
 
@@ -207,13 +267,31 @@ Remove matching messages from the queue.
 Dangerous operation, this completely removes the message. If you want to store
 the message, use "queue dump" before removing.
 
-	usage: mox queue drop [-id id] [-todomain domain] [-recipient address]
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain. Flags -todomain and -recipient of older
+versions are still accepted, as aliases for -to.
+
+	usage: mox queue drop [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	  -account string
+	    	account that queued the message
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
 	  -id int
 	    	id of message in queue
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
 	  -recipient string
-	    	recipient email address
+	    	recipient address, same as -to address
+	  -to string
+	    	recipient address or @domain
 	  -todomain string
-	    	destination domain of messages
+	    	recipient domain, same as -to @domain
 
 # mox queue dump
 
@@ -223,6 +301,150 @@ The message is printed to stdout and is in standard internet mail format.
 
 	usage: mox queue dump id
 
+# mox queue hold
+
+Mark matching messages in the queue as held.
+
+Delivery of held messages is not attempted until they are released. Messages
+can be inspected with "queue dump" and removed with "queue drop" while held.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
+
+	usage: mox queue hold [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	  -account string
+	    	account that queued the message
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
+	  -id int
+	    	id of message in queue
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
+	  -to string
+	    	recipient address or @domain
+
+# mox queue release
+
+Release matching held messages in the queue for delivery.
+
+Messages are delivered when their next attempt is due, which may be
+immediately.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
+
+	usage: mox queue release [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]
+	  -account string
+	    	account that queued the message
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
+	  -id int
+	    	id of message in queue
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
+	  -to string
+	    	recipient address or @domain
+
+# mox queue holdrules list
+
+List hold rules for the delivery queue.
+
+Newly queued messages matching a hold rule are marked as held.
+
+	usage: mox queue holdrules list
+
+# mox queue holdrules add
+
+Add hold rule for the delivery queue.
+
+Newly queued messages matching all specified conditions are marked as held. A
+rule without conditions holds all newly queued messages. Messages already in
+the queue are not affected, use "queue hold" for those.
+
+	usage: mox queue holdrules add [-account account] [-senderdom domain] [-recipientdom domain] [-minsize bytes]
+	  -account string
+	    	account that queued the message
+	  -minsize int
+	    	minimum size of message in bytes
+	  -recipientdom string
+	    	domain of recipient address
+	  -senderdom string
+	    	domain of sender address
+
+# mox queue holdrules remove
+
+Remove hold rule for the delivery queue.
+
+Messages held due to the rule are not released, use "queue release" for those.
+
+	usage: mox queue holdrules remove ruleid
+
+# mox queue history
+
+List history of messages removed from the delivery queue.
+
+Messages are kept in the history after successful delivery or a permanent
+failure, for the configured history retention period. For each message, details
+about the final delivery attempt are shown: the remote MX host and IP, TLS mode
+and version, and the final SMTP response or error. Most recent messages are
+listed first.
+
+	usage: mox queue history [-account account] [-from address] [-to address] [-result success|failure] [-limit n]
+	  -account string
+	    	account that queued the message
+	  -from string
+	    	sender address or @domain
+	  -limit int
+	    	maximum number of messages to list, 0 for all (default 100)
+	  -result string
+	    	only messages with this result, success or failure
+	  -to string
+	    	recipient address or @domain
+
+# mox queue reschedule
+
+Change the release time of messages submitted with FUTURERELEASE.
+
+Messages matching all specified conditions that were submitted with
+FUTURERELEASE and have not had a delivery attempt yet are rescheduled to be delivered at the time specified with -at (in RFC3339
+format, e.g. 2023-06-01T09:00:00Z), or after the duration specified with -in.
+Without -at and -in, the future release is cancelled and delivery is attempted
+immediately.
+
+	usage: mox queue reschedule [-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n] [-at time | -in duration]
+	  -account string
+	    	account that queued the message
+	  -at string
+	    	new release time, in RFC3339 format
+	  -error string
+	    	only messages with last delivery error containing text, case-insensitive
+	  -from string
+	    	sender address or @domain
+	  -id int
+	    	id of message in queue
+	  -in duration
+	    	new release time as duration from now
+	  -minattempts int
+	    	only messages with at least this many delivery attempts
+	  -newerthan duration
+	    	only messages queued less than duration ago
+	  -olderthan duration
+	    	only messages queued longer than duration ago
+	  -to string
+	    	recipient address or @domain
+
 # mox import maildir
 
 Import a maildir into an account.
@@ -261,11 +483,51 @@ to be accepted, unless other reputation signals prevent that.
 Users can also import mailboxes/messages through the account web page by
 uploading a zip or tgz file with mbox and/or maildirs.
 
+For mbox files from Google Takeout, flags are set based on the labels in the
+X-Gmail-Labels headers, e.g. "Opened" and "Starred". All messages are imported
+into the single mailbox. To import messages into a mailbox per label, upload the
+Takeout file on the account web page.
+
 The mailbox is read by the mox process, so make sure it has access to the
 maildir directories/files.
 
 	usage: mox import mbox accountname mailboxname mbox
 
+# mox import imap
+
+Import all mailboxes and messages from a remote IMAP server into an account.
+
+Mailboxes are created as needed. Messages are imported with their flags,
+keywords known to mox (like $Forwarded and $Junk), and received (internal) date.
+Mailboxes with a special-use flag, like \Sent, are imported into the mailboxes
+with the same special-use flag in the account.
+
+The password for the remote account is read from stdin.
+
+Host is a hostname with an optional port. By default TLS is used immediately,
+on port 993. With -starttls, the connection starts without TLS on port 143, and
+is switched to TLS with STARTTLS. Only ports 993 and 143 and public IPs can be
+connected to, unless allowed with IMAPImport in mox.conf.
+
+The progress is kept in the account. If the import is interrupted, it can be
+started again. The import can also be repeated, e.g. until the account is
+switched over to mox: only messages not imported earlier are fetched, and flag
+changes on the remote server to earlier imported messages are applied.
+
+By default, messages will train the junk filter based on their flags and, if
+"automatic junk flags" configuration is set, based on mailbox naming.
+
+If the destination mailbox is "Sent", the recipients of the messages are added
+to the message metadata, causing later incoming messages from these recipients
+to be accepted, unless other reputation signals prevent that.
+
+Users can also import mailboxes/messages through the account web page by
+uploading a zip or tgz file with mbox and/or maildirs.
+
+	usage: mox import imap [-starttls] accountname host username
+	  -starttls
+	    	connect without tls and switch to tls with starttls
+
 # mox export maildir
 
 Export one or all mailboxes from an account in maildir format.
@@ -275,7 +537,31 @@ database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page.
 
-	usage: mox export maildir dst-dir account-path [mailbox]
+If dst ends with .zip, .tgz, .tar.gz or .tar, the messages are written to a new
+archive file of that type. Otherwise dst is a directory.
+
+Messages can be selected by received time with -start and -end, a date
+(2006-01-02, inclusive) or time (RFC3339), by sender or recipient with -from and
+-to, and by text in headers or text parts with -search. Sender and recipient
+match, case-insensitive, on addresses in the message headers and on the SMTP
+MAIL FROM and RCPT TO. With -manifest, a file manifest.json is added with
+metadata about each exported message, such as its mailbox and path in the
+export, flags, received time and authentication results from delivery, e.g. for
+legal holds.
+
+	usage: mox export maildir [flags] dst account-path [mailbox]
+	  -end string
+	    	only messages received before this time, or on or before this date
+	  -from string
+	    	only messages with this text in a from address
+	  -manifest
+	    	add manifest.json with metadata about the exported messages
+	  -search string
+	    	only messages with this text in headers or text
+	  -start string
+	    	only messages received at or after this date or time
+	  -to string
+	    	only messages with this text in a to/cc/bcc address
 
 # mox export mbox
 
@@ -292,7 +578,31 @@ For mbox export, "mboxrd" is used where message lines starting with the magic
 "From " string are escaped by prepending a >. All ">*From " are escaped,
 otherwise reconstructing the original could lose a ">".
 
-	usage: mox export mbox dst-dir account-path [mailbox]
+If dst ends with .zip, .tgz, .tar.gz or .tar, the messages are written to a new
+archive file of that type. Otherwise dst is a directory.
+
+Messages can be selected by received time with -start and -end, a date
+(2006-01-02, inclusive) or time (RFC3339), by sender or recipient with -from and
+-to, and by text in headers or text parts with -search. Sender and recipient
+match, case-insensitive, on addresses in the message headers and on the SMTP
+MAIL FROM and RCPT TO. With -manifest, a file manifest.json is added with
+metadata about each exported message, such as its mailbox and path in the
+export, flags, received time and authentication results from delivery, e.g. for
+legal holds.
+
+	usage: mox export mbox [flags] dst account-path [mailbox]
+	  -end string
+	    	only messages received before this time, or on or before this date
+	  -from string
+	    	only messages with this text in a from address
+	  -manifest
+	    	add manifest.json with metadata about the exported messages
+	  -search string
+	    	only messages with this text in headers or text
+	  -start string
+	    	only messages received at or after this date or time
+	  -to string
+	    	only messages with this text in a to/cc/bcc address
 
 # mox localserve
 
@@ -351,6 +661,15 @@ increases the odds hardlinking succeeds: the default systemd service file
 specifically mounts the data directory, causing attempts to hardlink outside it
 to fail with an error about cross-device linking.
 
+With -incremental, message files that are also present, unchanged, in an
+earlier backup directory are hardlinked from that backup instead of from the
+data directory. A message file is unchanged if it is the same file as in the
+data directory (hardlinked), or has the same size and modification time. Only
+message files added or changed since the earlier backup are copied when the
+backup destination is on a different file system than the data directory. Databases are always snapshotted in full. Each incremental backup
+is a complete backup by itself: earlier backups can be removed without
+affecting later backups.
+
 All files in the data directory that aren't recognized (i.e. other than known
 database files, message files, an acme directory, the "tmp" directory, etc),
 are stored, but with a warning.
@@ -358,11 +677,10 @@ are stored, but with a warning.
 A clean successful backup does not print any output by default. Use the
 -verbose flag for details, including timing.
 
-To restore a backup, first shut down mox, move away the old data directory and
-move an earlier backed up directory in its place, run "mox verifydata",
-possibly with the "-fix" option, and restart mox. After the restore, you may
-also want to run "mox bumpuidvalidity" for each account for which messages in a
-mailbox changed, to force IMAP clients to synchronize mailbox state.
+To restore a backup, shut down mox and use "mox restore", see its help for
+details. After the restore, you may also want to run "mox bumpuidvalidity" for
+each account for which messages in a mailbox changed, to force IMAP clients to
+synchronize mailbox state.
 
 Before upgrading, to check if the upgrade will likely succeed, first make a
 backup, then use the new mox binary to run "mox verifydata" on the backup. This
@@ -370,10 +688,38 @@ can change the backup files (e.g. upgrade database files, move away
 unrecognized message files), so you should make a new backup before actually
 upgrading.
 
-	usage: mox backup dest-dir
+	usage: mox backup [-incremental previous-backup-dir] dest-dir
+	  -incremental string
+	    	earlier backup directory to hardlink unchanged message files from
 	  -verbose
 	    	print progress
 
+# mox restore
+
+Restore a backup made with "mox backup" into the data directory.
+
+Mox must not be running during a restore. The backup directory is first copied
+to a staging directory next to the data directory, the staging copy is then
+verified like "mox verifydata -fix" does, and only if no errors were found is
+it moved into place. The backup directory itself is not modified. Message files
+are hardlinked from the backup when possible, all other files, including
+database files, are copied.
+
+Without -account, the entire data directory is replaced. The old data directory
+is kept, renamed with a ".replaced-<timestamp>" suffix.
+
+With -account, only the files of that account are restored, other accounts,
+the queue and other databases are left as is. The account must be present in
+the configuration file. The old account directory is moved to
+"moved/accounts/<account>.replaced-<timestamp>" in the data directory.
+
+After restoring, you may want to run "mox bumpuidvalidity" for each restored
+account to force IMAP clients to synchronize mailbox state.
+
+	usage: mox restore [-account name] backup-dir
+	  -account string
+	    	only restore the files for this account
+
 # mox verifydata
 
 Verify the contents of a data directory, typically of a backup.
@@ -465,6 +811,54 @@ these addresses will be rejected.
 
 	usage: mox config account rm account
 
+# mox config account rename
+
+Rename an account and reload the configuration.
+
+The data directory of the account is renamed, and references to the account in
+the configuration, such as for DMARC and TLS reports of domains, are updated.
+Messages in the queue from the account, and hold rules for the account, are
+updated too. The account cannot be renamed while it is in use, e.g. by IMAP
+sessions. The postmaster account, configured in mox.conf, cannot be renamed
+while mox is running.
+
+	usage: mox config account rename account newname
+
+# mox account check
+
+Check the consistency of an account while mox is running, and optionally repair.
+
+The checks:
+- Each message in the database has a message file with the size of the message.
+- Message UIDs are unique within a mailbox, and below the UIDNEXT of the mailbox.
+- The parsed form of each message stored in the database can be decoded.
+- Junk filter training of each message matches its junk/nonjunk flags.
+- Each file in the message directory belongs to a message in the database.
+
+With -repair, problems are fixed where possible: messages are parsed again and
+(re)trained, UIDs in a mailbox with bad UIDs are reassigned and the mailbox gets
+a new UIDVALIDITY (causing IMAP clients to resynchronize), and message files not
+belonging to a message are delivered to the "lost+found" mailbox. Missing message
+files cannot be repaired.
+
+The account is locked for the duration of the check, so deliveries and IMAP
+sessions for the account wait. Also see "mox verifydata", for checking a backup.
+
+	usage: mox account check [-repair] account
+	  -repair
+	    	repair problems
+
+# mox account movemailbox
+
+Move a mailbox and its child mailboxes, with their messages, to another account.
+
+Messages are moved to mailboxes with the same names in the destination account,
+which are created if needed. The mailboxes are removed from the source account,
+except the Inbox, which is only emptied. Both accounts remain usable, but are
+locked while moving. Junk filters of both accounts are updated.
+
+	usage: mox account movemailbox account mailbox destaccount
+
 # mox config address add
 
 Adds an address to an account and reloads the configuration.
@@ -482,6 +876,78 @@ Incoming email for this address will be rejected after removing an address.
 
 	usage: mox config address rm address
 
+# mox config address move
+
+Move an address to another account and reload the configuration.
+
+The delivery settings of the address, such as rulesets, are moved along. With
+-messages, existing messages delivered to the address (based on the SMTP RCPT TO
+address) are moved to mailboxes with the same names in the other account.
+Messages cannot be moved for catchall addresses.
+
+	usage: mox config address move [-messages] address account
+	  -messages
+	    	also move messages delivered to the address
+
+# mox config alias list
+
+List aliases for domain.
+
+	usage: mox config alias list domain
+
+# mox config alias print
+
+Print settings and members of alias.
+
+	usage: mox config alias print alias
+
+# mox config alias add
+
+Add new alias with one or more addresses and reload the configuration.
+
+Members can be local addresses or addresses at external domains. Messages to
+external members are forwarded with SRS.
+
+	usage: mox config alias add alias@domain rcpt1@domain ...
+	  -listheaders
+	    	add mailing list headers like List-Id to delivered messages
+	  -listunsubscribe string
+	    	value for List-Unsubscribe header, including angle brackets
+	  -postpolicy string
+	    	who can send to the alias: members (default), anyone or authenticated
+
+# mox config alias update
+
+Update settings of an alias and reload the configuration.
+
+All settings are replaced by the values from the flags.
+
+	usage: mox config alias update alias@domain
+	  -listheaders
+	    	add mailing list headers like List-Id to delivered messages
+	  -listunsubscribe string
+	    	value for List-Unsubscribe header, including angle brackets
+	  -postpolicy string
+	    	who can send to the alias: members (default), anyone or authenticated
+
+# mox config alias rm
+
+Remove alias and reload the configuration.
+
+	usage: mox config alias rm alias@domain
+
+# mox config alias addaddr
+
+Add addresses to alias and reload the configuration.
+
+	usage: mox config alias addaddr alias@domain rcpt1@domain ...
+
+# mox config alias rmaddr
+
+Remove addresses from alias and reload the configuration.
+
+	usage: mox config alias rmaddr alias@domain rcpt1@domain ...
+
 # mox config domain add
 
 Adds a new domain to the configuration and reloads the configuration.
@@ -685,6 +1151,57 @@ implementation has changed.
 
 	usage: mox retrain accountname
 
+# mox compress
+
+Compress existing message files of an account, or all accounts.
+
+Message files are compressed one at a time while mox is running, and the
+account remains usable. Message files that are already compressed, or that
+don't become smaller when compressed, are left as is. Compressed message files
+are decompressed transparently when read.
+
+To compress newly delivered messages, set CompressMessages for the account in
+the configuration file.
+
+	usage: mox compress [account]
+
+# mox encrypt
+
+Encrypt existing message files of an account.
+
+Encryption at rest must be enabled for the account with EncryptMessages in the
+configuration file. The key pair for the account is created when the password
+is set, at the first login with the password after enabling encryption, or by
+this command with -password, which reads the current account password from
+stdin. Until the key pair exists, incoming messages for the account are refused
+with a temporary error instead of being stored unencrypted.
+
+Message files are encrypted with the public key of the account, one at a time
+while mox is running. The received headers and parsed message structure of the
+messages in the account database are encrypted along with the message files.
+The account does not have to be unlocked. Messages that are already encrypted
+are left as is.
+
+	usage: mox encrypt [-password] account
+	  -password
+	    	read account password from stdin, to create the key pair if needed
+
+# mox dedup
+
+Store message files with identical contents only once.
+
+Message files of all accounts are compared, and duplicates are replaced with a
+hardlink to a single file. Removing a message, e.g. on expunge, only frees the
+disk space when no other message references the file. Mox already stores an
+incoming message delivered to multiple local recipients once. This command is
+useful after importing the same messages into multiple accounts.
+
+Files are compared while mox is running, and the accounts remain usable.
+Encrypted message files are never identical between accounts, and are not
+shared. Backups made with "mox backup" keep the sharing.
+
+	usage: mox dedup
+
 # mox sendmail
 
 Sendmail is a drop-in replacement for /usr/sbin/sendmail to deliver emails sent by unix processes like cron.
@@ -67,6 +67,10 @@ type Message struct {
 	// Original message or headers to include in DSN as third MIME part.
 	// Optional. Only used for generating DSNs, not set for parsed DNSs.
 	Original []byte
+
+	// Message-ID header of the original message, from the optional third MIME
+	// part. Only set for parsed DSNs.
+	OriginalMessageID string
 }
 
 // Action is a field in a DSN.
@@ -98,7 +98,7 @@ func TestDSN(t *testing.T) {
 			},
 		},
 
-		Original: []byte("Subject: test\r\n"),
+		Original: []byte("Message-Id: <test@mox.example>\r\nSubject: test\r\n"),
 	}
 	msgbuf, err := m.Compose(log, false)
 	if err != nil {
@@ -112,6 +112,8 @@ func TestDSN(t *testing.T) {
 	tcompare(t, part.Parts[2].ContentTypeParams["charset"], "")
 	tcompareReader(t, part.Parts[2].Reader(), m.Original)
 	tcompare(t, pmsg.Recipients[0].FinalRecipient, m.Recipients[0].FinalRecipient)
+	tcompare(t, pmsg.OriginalMessageID, "<test@mox.example>")
+	tcompare(t, pmsg.Recipients[0].Action, m.Recipients[0].Action)
 	// todo: test more fields
 
 	msgbufutf8, err := m.Compose(log, true)
@@ -97,6 +97,13 @@ func Parse(r io.ReaderAt) (*Message, *message.Part, error) {
 		return nil, nil, fmt.Errorf("invalid content-type %q for optional third part with original message/headers", ct)
 	}
 
+	// Both the original message and the original headers start with a header
+	// section. We only need the Message-ID, to match the DSN to the original message,
+	// so we ignore errors about malformed headers.
+	if h, err := textproto.NewReader(bufio.NewReader(p2.Reader())).ReadMIMEHeader(); err == nil || len(h) > 0 {
+		m.OriginalMessageID = h.Get("Message-Id")
+	}
+
 	return m, &part, nil
 }
 
@@ -219,6 +226,7 @@ func parseRecipientHeader(mr *textproto.Reader, utf8 bool) (Recipient, error) {
 			if !ok {
 				err = fmt.Errorf("unrecognized action %q", v)
 			}
+			r.Action = a
 		case "Status":
 			// todo: parse the enhanced status code?
 			r.Status = v
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
 	"context"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/mjl-/bstore"
@@ -13,20 +18,19 @@ import (
 )
 
 func cmdExportMaildir(c *cmd) {
-	c.params = "dst-dir account-path [mailbox]"
+	c.params = "[flags] dst account-path [mailbox]"
 	c.help = `Export one or all mailboxes from an account in maildir format.
 
 Export bypasses a running mox instance. It opens the account mailbox/message
 database file directly. This may block if a running mox instance also has the
 database open, e.g. for IMAP connections. To export from a running instance, use
 the accounts web page.
-`
-	args := c.Parse()
-	xcmdExport(false, args, c)
+` + exportCommonHelp
+	xcmdExport(false, c)
 }
 
 func cmdExportMbox(c *cmd) {
-	c.params = "dst-dir account-path [mailbox]"
+	c.params = "[flags] dst account-path [mailbox]"
 	c.help = `Export messages from one or all mailboxes in an account in mbox format.
 
 Using mbox is not recommended. Maildir is a better format.
@@ -39,21 +43,51 @@ the accounts web page.
 For mbox export, "mboxrd" is used where message lines starting with the magic
 "From " string are escaped by prepending a >. All ">*From " are escaped,
 otherwise reconstructing the original could lose a ">".
-`
-	args := c.Parse()
-	xcmdExport(true, args, c)
+` + exportCommonHelp
+	xcmdExport(true, c)
 }
 
-func xcmdExport(mbox bool, args []string, c *cmd) {
+const exportCommonHelp = `
+If dst ends with .zip, .tgz, .tar.gz or .tar, the messages are written to a new
+archive file of that type. Otherwise dst is a directory.
+
+Messages can be selected by received time with -start and -end, a date
+(2006-01-02, inclusive) or time (RFC3339), by sender or recipient with -from and
+-to, and by text in headers or text parts with -search. Sender and recipient
+match, case-insensitive, on addresses in the message headers and on the SMTP
+MAIL FROM and RCPT TO. With -manifest, a file manifest.json is added with
+metadata about each exported message, such as its mailbox and path in the
+export, flags, received time and authentication results from delivery, e.g. for
+legal holds.
+`
+
+func xcmdExport(mbox bool, c *cmd) {
+	var opts store.ExportOptions
+	var start, end string
+	c.flag.StringVar(&start, "start", "", "only messages received at or after this date or time")
+	c.flag.StringVar(&end, "end", "", "only messages received before this time, or on or before this date")
+	c.flag.StringVar(&opts.From, "from", "", "only messages with this text in a from address")
+	c.flag.StringVar(&opts.To, "to", "", "only messages with this text in a to/cc/bcc address")
+	c.flag.StringVar(&opts.Search, "search", "", "only messages with this text in headers or text")
+	c.flag.BoolVar(&opts.Manifest, "manifest", false, "add manifest.json with metadata about the exported messages")
+	args := c.Parse()
 	if len(args) != 2 && len(args) != 3 {
 		c.Usage()
 	}
 
 	dst := args[0]
 	accountDir := args[1]
-	var mailbox string
 	if len(args) == 3 {
-		mailbox = args[2]
+		opts.Mailbox = args[2]
+	}
+	var err error
+	if start != "" {
+		opts.Start, err = store.ParseExportTime(start, false)
+		xcheckf(err, "parsing start")
+	}
+	if end != "" {
+		opts.End, err = store.ParseExportTime(end, true)
+		xcheckf(err, "parsing end")
 	}
 
 	dbpath := filepath.Join(accountDir, "index.db")
@@ -65,9 +99,32 @@ func xcmdExport(mbox bool, args []string, c *cmd) {
 		}
 	}()
 
-	a := store.DirArchiver{Dir: dst}
-	err = store.ExportMessages(context.Background(), mlog.New("export"), db, accountDir, a, !mbox, mailbox)
+	var a store.Archiver = store.DirArchiver{Dir: dst}
+	var f *os.File
+	var gzw *gzip.Writer
+	if strings.HasSuffix(dst, ".zip") || strings.HasSuffix(dst, ".tgz") || strings.HasSuffix(dst, ".tar.gz") || strings.HasSuffix(dst, ".tar") {
+		f, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+		xcheckf(err, "creating archive file")
+		switch {
+		case strings.HasSuffix(dst, ".zip"):
+			a = store.ZipArchiver{Writer: zip.NewWriter(f)}
+		case strings.HasSuffix(dst, ".tar"):
+			a = store.TarArchiver{Writer: tar.NewWriter(f)}
+		default:
+			gzw = gzip.NewWriter(f)
+			a = store.TarArchiver{Writer: tar.NewWriter(gzw)}
+		}
+	}
+	err = store.ExportMessages(context.Background(), mlog.New("export"), db, accountDir, nil, a, !mbox, opts)
 	xcheckf(err, "exporting messages")
 	err = a.Close()
 	xcheckf(err, "closing archiver")
+	if gzw != nil {
+		err = gzw.Close()
+		xcheckf(err, "closing gzip writer")
+	}
+	if f != nil {
+		err = f.Close()
+		xcheckf(err, "closing archive file")
+	}
 }
@@ -26,6 +26,7 @@ import (
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxvar"
+	"github.com/mjl-/mox/queue"
 	"github.com/mjl-/mox/store"
 )
 
@@ -197,6 +198,29 @@ func accountHandle(w http.ResponseWriter, r *http.Request) {
 		maildir := strings.Contains(r.URL.Path, "maildir")
 		tgz := strings.Contains(r.URL.Path, ".tgz")
 
+		// Optional parameters to select messages and add a manifest.
+		q := r.URL.Query()
+		opts := store.ExportOptions{
+			Mailbox:  q.Get("mailbox"),
+			From:     q.Get("from"),
+			To:       q.Get("to"),
+			Search:   q.Get("search"),
+			Manifest: q.Get("manifest") != "",
+		}
+		var err error
+		if s := q.Get("start"); s != "" {
+			if opts.Start, err = store.ParseExportTime(s, false); err != nil {
+				http.Error(w, "400 - bad request - parsing start: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := q.Get("end"); s != "" {
+			if opts.End, err = store.ParseExportTime(s, true); err != nil {
+				http.Error(w, "400 - bad request - parsing end: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		acc, err := store.OpenAccount(accName)
 		if err != nil {
 			log.Errorx("open account for export", err)
@@ -226,7 +250,7 @@ func accountHandle(w http.ResponseWriter, r *http.Request) {
 			err := archiver.Close()
 			log.Check(err, "exporting mail close")
 		}()
-		if err := store.ExportMessages(r.Context(), log, acc.DB, acc.Dir, archiver, maildir, ""); err != nil {
+		if err := store.ExportMessages(r.Context(), log, acc.DB, acc.Dir, acc.MessageKey(), archiver, maildir, opts); err != nil {
 			log.Errorx("exporting mail", err)
 		}
 
@@ -351,8 +375,36 @@ func (Account) DestinationSave(ctx context.Context, destName string, oldDest, ne
 	xcheckf(ctx, err, "saving destination")
 }
 
+// OutgoingHistory returns the most recent messages sent by the account that were
+// delivered or failed permanently, with details of the final delivery attempt.
+func (Account) OutgoingHistory(ctx context.Context) []queue.MsgRetired {
+	accountName := ctx.Value(authCtxKey).(string)
+	l, err := queue.HistoryList(ctx, queue.HistoryFilter{Account: accountName, Limit: 100})
+	xcheckf(ctx, err, "listing outgoing delivery history")
+	return l
+}
+
+// ImportIMAP starts an import of all mailboxes and messages from a remote IMAP
+// server, see store.ImportIMAP. Host is a hostname with optional port. Without
+// startTLS, TLS is used immediately. Only the standard IMAP ports and public IPs
+// can be connected to, unless the configuration allows more. Messages imported
+// earlier from the same server and username are not imported again, so an import
+// can be repeated. The returned token is used to follow the progress, as with
+// uploaded imports.
+func (Account) ImportIMAP(ctx context.Context, host string, startTLS bool, username, password string) string {
+	accountName := ctx.Value(authCtxKey).(string)
+	src := store.IMAPImportSource{Host: host, StartTLS: startTLS, Username: username, Password: password}
+	token, err := importIMAPStart(ctx, xlog.WithContext(ctx), accountName, src)
+	if err != nil {
+		panic(&sherpa.Error{Code: "user:error", Message: "starting import: " + err.Error()})
+	}
+	return token
+}
+
 // ImportAbort aborts an import that is in progress. If the import exists and isn't
-// finished, no changes will have been made by the import.
+// finished, no changes will have been made by an import of an uploaded file. For
+// imports from an IMAP server, messages imported so far are kept, and a next
+// import continues where the aborted import stopped.
 func (Account) ImportAbort(ctx context.Context, importToken string) error {
 	req := importAbortRequest{importToken, make(chan error)}
 	importers.Abort <- req
@@ -39,6 +39,7 @@ import (
 	"github.com/mjl-/mox/dmarcrpt"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dnsbl"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	mox "github.com/mjl-/mox/mox-"
@@ -221,6 +222,21 @@ type IPRevCheckResult struct {
 	Result
 }
 
+// OutgoingIdentity is a configured outgoing identity relevant for the domain, with
+// the forward and reverse DNS names found for it.
+type OutgoingIdentity struct {
+	Source   string              // "domain" or "account <name>".
+	Hostname dns.Domain          // Hostname used in EHLO, IPs must resolve back to this.
+	IPs      []string            // Configured local IPs.
+	HostIPs  []string            // IPs the hostname resolves to.
+	IPNames  map[string][]string // IP to names.
+}
+
+type OutgoingIdentityCheckResult struct {
+	Identities []OutgoingIdentity
+	Result
+}
+
 type MX struct {
 	Host string
 	Pref int
@@ -314,6 +330,7 @@ type AutodiscoverCheckResult struct {
 type CheckResult struct {
 	Domain       string
 	IPRev        IPRevCheckResult
+	Outgoing     OutgoingIdentityCheckResult
 	MX           MXCheckResult
 	TLS          TLSCheckResult
 	SPF          SPFCheckResult
@@ -509,6 +526,87 @@ func checkDomain(ctx context.Context, resolver dns.Resolver, dialer *net.Dialer,
 		}
 	}()
 
+	// Outgoing identities, configured local IPs and EHLO hostname for delivering
+	// messages. If the domain has an identity, it is used for all messages from the
+	// domain. Otherwise, identities of accounts with addresses in the domain apply.
+	wg.Add(1)
+	go func() {
+		defer logPanic(ctx)
+		defer wg.Done()
+
+		var idents []OutgoingIdentity
+		var configs []*config.OutgoingIdentity
+		if domConf.OutgoingIdentity != nil {
+			idents = append(idents, OutgoingIdentity{Source: "domain"})
+			configs = append(configs, domConf.OutgoingIdentity)
+		} else {
+			accs := map[string]struct{}{}
+			for _, name := range mox.Conf.DomainLocalparts(domain) {
+				accs[name] = struct{}{}
+			}
+			var accNames []string
+			for name := range accs {
+				accNames = append(accNames, name)
+			}
+			sort.Strings(accNames)
+			for _, name := range accNames {
+				if accConf, ok := mox.Conf.Account(name); ok && accConf.OutgoingIdentity != nil {
+					idents = append(idents, OutgoingIdentity{Source: "account " + name})
+					configs = append(configs, accConf.OutgoingIdentity)
+				}
+			}
+		}
+
+		for i, ident := range configs {
+			oi := &idents[i]
+			oi.Hostname = ident.HostnameDomain
+			if oi.Hostname.IsZero() {
+				oi.Hostname = mox.Conf.Static.HostnameDomain
+			}
+			oi.IPs = ident.IPs
+			oi.IPNames = map[string][]string{}
+
+			hostIPs, err := resolver.LookupIP(ctx, "ip", oi.Hostname.ASCII+".")
+			if err != nil {
+				addf(&r.Outgoing.Errors, "Looking up IPs for hostname %s of %s outgoing identity: %s", oi.Hostname, oi.Source, err)
+			}
+			for _, ip := range hostIPs {
+				oi.HostIPs = append(oi.HostIPs, ip.String())
+			}
+
+			for _, ip := range ident.ParsedIPs {
+				var found bool
+				for _, hip := range hostIPs {
+					found = found || ip.Equal(hip)
+				}
+				if !found && err == nil {
+					addf(&r.Outgoing.Errors, "Hostname %s of %s outgoing identity does not resolve to IP %s, which will cause other mail servers to fail the iprev check for messages from this IP.", oi.Hostname, oi.Source, ip)
+				}
+
+				addrs, err := resolver.LookupAddr(ctx, ip.String())
+				if err != nil {
+					addf(&r.Outgoing.Errors, "Looking up reverse name for %s of %s outgoing identity: %v", ip, oi.Source, err)
+					continue
+				}
+				var match bool
+				for i, a := range addrs {
+					a = strings.TrimRight(a, ".")
+					addrs[i] = a
+					if ad, err := dns.ParseDomain(a); err == nil && ad == oi.Hostname {
+						match = true
+					}
+				}
+				if !match {
+					addf(&r.Outgoing.Errors, "Reverse name(s) %s for IP %s of %s outgoing identity do not match hostname %s, which will cause other mail servers to reject messages from this IP.", strings.Join(addrs, ","), ip, oi.Source, oi.Hostname)
+				}
+				oi.IPNames[ip.String()] = addrs
+			}
+
+			addf(&r.Outgoing.Instructions, "Ensure hostname %s has A and/or AAAA records for IPs %s, and the IPs have reverse address %s. The SPF records of the domains used in the SMTP MAIL FROM of messages must allow these IPs.", oi.Hostname.ASCII, strings.Join(ident.IPs, ", "), oi.Hostname.ASCII)
+		}
+		r.Outgoing.Identities = idents
+	}()
+
 	// MX
 	wg.Add(1)
 	go func() {
@@ -941,7 +1039,7 @@ Ensure a DNS TXT record like the following exists:
 					continue
 				}
 				if _, ok := mxs[mx.Domain]; !ok {
-					addf(&r.MTASTS.Warnings, "MX %q in MTA-STS policy is not in MX record.", mx)
+					addf(&r.MTASTS.Warnings, "MX %q in MTA-STS policy is not in MX record.", mx.LogString())
 				}
 			}
 		}
@@ -1457,6 +1555,17 @@ func (Admin) AccountRemove(ctx context.Context, accountName string) {
 	xcheckf(ctx, err, "removing account")
 }
 
+// AccountRename renames an account, including its data directory, references in
+// the configuration, and messages in the queue, and reloads the configuration. The
+// account cannot be renamed while it is in use, e.g. by IMAP sessions.
+func (Admin) AccountRename(ctx context.Context, accountName, newName string) {
+	log := xlog.WithContext(ctx)
+	err := store.RenameAccount(ctx, log, accountName, newName)
+	xcheckf(ctx, err, "renaming account")
+	err = queue.RenameAccount(ctx, log, accountName, newName)
+	xcheckf(ctx, err, "account renamed, but renaming account in queue")
+}
+
 // AddressAdd adds a new address to the account, which must already exist.
 func (Admin) AddressAdd(ctx context.Context, address, accountName string) {
 	err := mox.AddressAdd(ctx, address, accountName)
@@ -1469,6 +1578,59 @@ func (Admin) AddressRemove(ctx context.Context, address string) {
 	xcheckf(ctx, err, "removing address")
 }
 
+// AddressMove moves an existing address to another account, and optionally the
+// messages delivered to the address. Returns the number of messages moved.
+func (Admin) AddressMove(ctx context.Context, address, accountName string, moveMessages bool) int {
+	n, err := store.MoveAddress(ctx, xlog.WithContext(ctx), address, accountName, moveMessages)
+	xcheckf(ctx, err, "moving address")
+	return n
+}
+
+// DomainAliases returns the aliases configured for a domain, keyed by localpart.
+func (Admin) DomainAliases(ctx context.Context, domain string) map[string]config.Alias {
+	d, err := dns.ParseDomain(domain)
+	xcheckf(ctx, err, "parse domain")
+	dc, ok := mox.Conf.Domain(d)
+	if !ok {
+		xcheckf(ctx, errors.New("no such domain"), "looking up domain")
+	}
+	if dc.Aliases == nil {
+		return map[string]config.Alias{}
+	}
+	return dc.Aliases
+}
+
+// AliasAdd adds a new alias with its member addresses. The domain of the alias
+// must already exist.
+func (Admin) AliasAdd(ctx context.Context, address string, alias config.Alias) {
+	err := mox.AliasAdd(ctx, address, alias)
+	xcheckf(ctx, err, "adding alias")
+}
+
+// AliasUpdate updates the posting policy and list headers settings of an alias.
+func (Admin) AliasUpdate(ctx context.Context, address, postPolicy string, listHeaders bool, listUnsubscribe string) {
+	err := mox.AliasUpdate(ctx, address, postPolicy, listHeaders, listUnsubscribe)
+	xcheckf(ctx, err, "updating alias")
+}
+
+// AliasRemove removes an alias.
+func (Admin) AliasRemove(ctx context.Context, address string) {
+	err := mox.AliasRemove(ctx, address)
+	xcheckf(ctx, err, "removing alias")
+}
+
+// AliasAddressesAdd adds member addresses to an alias.
+func (Admin) AliasAddressesAdd(ctx context.Context, address string, addresses []string) {
+	err := mox.AliasAddressesAdd(ctx, address, addresses)
+	xcheckf(ctx, err, "adding addresses to alias")
+}
+
+// AliasAddressesRemove removes member addresses from an alias.
+func (Admin) AliasAddressesRemove(ctx context.Context, address string, addresses []string) {
+	err := mox.AliasAddressesRemove(ctx, address, addresses)
+	xcheckf(ctx, err, "removing addresses from alias")
+}
+
 // SetPassword saves a new password for an account, invalidating the previous password.
 // Sessions are not interrupted, and will keep working. New login attempts must use the new password.
 // Password must be at least 8 characters.
@@ -1503,13 +1665,44 @@ func (Admin) ClientConfigDomain(ctx context.Context, domain string) mox.ClientCo
 	return cc
 }
 
-// QueueList returns the messages currently in the outgoing queue.
-func (Admin) QueueList(ctx context.Context) []queue.Msg {
-	l, err := queue.List(ctx)
+// QueueList returns the messages in the outgoing queue matching the filter, in
+// the range selected by page, ordered by ID.
+func (Admin) QueueList(ctx context.Context, filter queue.Filter, page queue.Page) []queue.Msg {
+	l, err := queue.List(ctx, filter, page)
 	xcheckf(ctx, err, "listing messages in queue")
 	return l
 }
 
+// QueueMsgDetails holds the header of a message in the queue and the SMTP
+// transcript of its last delivery attempt.
+type QueueMsgDetails struct {
+	Msg        queue.Msg
+	Header     string // Message header section, including final empty line.
+	Transcript string // SMTP protocol lines of last delivery attempt. Empty if no connection was made.
+}
+
+// QueueMsg returns a message in the queue, with its header and the SMTP
+// transcript of the last delivery attempt.
+func (Admin) QueueMsg(ctx context.Context, id int64) QueueMsgDetails {
+	l, err := queue.List(ctx, queue.Filter{IDs: []int64{id}}, queue.Page{})
+	xcheckf(ctx, err, "get message from queue")
+	if len(l) == 0 {
+		xcheckf(ctx, errors.New("not found"), "get message from queue")
+	}
+	m := l[0]
+
+	mr, err := queue.OpenMessage(ctx, id)
+	xcheckf(ctx, err, "open message")
+	defer func() {
+		err := mr.Close()
+		xlog.WithContext(ctx).Check(err, "closing message from queue")
+	}()
+	header, err := message.ReadHeaders(bufio.NewReader(mr))
+	xcheckf(ctx, err, "reading message header")
+
+	return QueueMsgDetails{m, string(header), m.LastTranscript}
+}
+
 // QueueSize returns the number of messages currently in the outgoing queue.
 func (Admin) QueueSize(ctx context.Context) int {
 	n, err := queue.Count(ctx)
@@ -1517,22 +1710,94 @@ func (Admin) QueueSize(ctx context.Context) int {
 	return n
 }
 
-// QueueKick initiates delivery of a message from the queue.
-func (Admin) QueueKick(ctx context.Context, id int64) {
-	n, err := queue.Kick(ctx, id, "", "")
-	if err == nil && n == 0 {
-		err = errors.New("message not found")
+// xcheckQueueFilter aborts the request if filter has no conditions and all is
+// false, so a mistake in a client cannot affect all messages in the queue.
+func xcheckQueueFilter(f queue.Filter, all bool) {
+	empty := len(f.IDs) == 0 && f.Account == "" && f.From == "" && f.To == "" && f.Hold == nil && f.QueuedBefore == nil && f.QueuedAfter == nil && f.LastError == "" && f.MinAttempts == 0
+	if empty && !all {
+		panic(&sherpa.Error{Code: "user:error", Message: "empty filter would match all messages in the queue, set all to confirm"})
 	}
-	xcheckf(ctx, err, "kick message in queue")
 }
 
-// QueueDrop removes a message from the queue.
-func (Admin) QueueDrop(ctx context.Context, id int64) {
-	n, err := queue.Drop(ctx, id, "", "")
-	if err == nil && n == 0 {
-		err = errors.New("message not found")
+// QueueKick initiates delivery of messages matching the filter. Held messages
+// are not delivered until released. An empty filter, matching all messages, is
+// only allowed if all is set. Returns the number of messages kicked.
+func (Admin) QueueKick(ctx context.Context, filter queue.Filter, all bool) int {
+	xcheckQueueFilter(filter, all)
+	n, err := queue.Kick(ctx, filter)
+	xcheckf(ctx, err, "kick messages in queue")
+	return n
+}
+
+// QueueDrop removes messages matching the filter from the queue. An empty
+// filter, matching all messages, is only allowed if all is set. Returns the
+// number of messages removed.
+func (Admin) QueueDrop(ctx context.Context, filter queue.Filter, all bool) int {
+	xcheckQueueFilter(filter, all)
+	n, err := queue.Drop(ctx, filter)
+	xcheckf(ctx, err, "drop messages from queue")
+	return n
+}
+
+// QueueHoldSet marks messages matching the filter as held, or releases them for
+// delivery. Returns the number of changed messages.
+func (Admin) QueueHoldSet(ctx context.Context, filter queue.Filter, hold bool) int {
+	n, err := queue.HoldSet(ctx, filter, hold)
+	xcheckf(ctx, err, "changing hold on messages in queue")
+	return n
+}
+
+// QueueHoldRuleList lists the hold rules for newly queued messages.
+func (Admin) QueueHoldRuleList(ctx context.Context) []queue.HoldRule {
+	l, err := queue.HoldRuleList(ctx)
+	xcheckf(ctx, err, "listing hold rules")
+	return l
+}
+
+// QueueHoldRuleAdd adds a hold rule. Newly queued messages matching all nonempty
+// conditions are marked as held.
+func (Admin) QueueHoldRuleAdd(ctx context.Context, account, senderDomain, recipientDomain string, minSize int64) queue.HoldRule {
+	hr := queue.HoldRule{Account: account, MinSize: minSize}
+	var err error
+	if senderDomain != "" {
+		hr.SenderDomain, err = dns.ParseDomain(senderDomain)
+		xcheckf(ctx, err, "parsing sender domain")
+	}
+	if recipientDomain != "" {
+		hr.RecipientDomain, err = dns.ParseDomain(recipientDomain)
+		xcheckf(ctx, err, "parsing recipient domain")
 	}
-	xcheckf(ctx, err, "drop message from queue")
+	log := xlog.WithContext(ctx)
+	hr, err = queue.HoldRuleAdd(ctx, log, hr)
+	xcheckf(ctx, err, "adding hold rule")
+	return hr
+}
+
+// QueueHoldRuleRemove removes a hold rule. Messages held by the rule are not
+// released.
+func (Admin) QueueHoldRuleRemove(ctx context.Context, holdRuleID int64) {
+	log := xlog.WithContext(ctx)
+	err := queue.HoldRuleRemove(ctx, log, holdRuleID)
+	xcheckf(ctx, err, "removing hold rule")
+}
+
+// QueueReschedule changes the future release time of messages matching the
+// filter that were submitted with a future release and have not had a delivery
+// attempt yet. A zero or past release time
+// cancels the future release, and messages are delivered immediately.
+// Returns the number of messages changed.
+func (Admin) QueueReschedule(ctx context.Context, filter queue.Filter, release time.Time) int {
+	n, err := queue.Reschedule(ctx, filter, release)
+	xcheckf(ctx, err, "rescheduling messages in queue")
+	return n
+}
+
+// QueueHistory returns messages removed from the queue after delivery or
+// permanent failure, matching the filter, most recent first.
+func (Admin) QueueHistory(ctx context.Context, filter queue.HistoryFilter) []queue.MsgRetired {
+	l, err := queue.HistoryList(ctx, filter)
+	xcheckf(ctx, err, "listing queue history")
+	return l
 }
 
 // LogLevels returns the current log levels.
@@ -11,9 +11,12 @@ import (
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/mjl-/sherpa"
+
 	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
 )
 
 func init() {
@@ -128,6 +131,45 @@ func TestCheckDomain(t *testing.T) {
 	checkDomain(context.Background(), resolver, dialer, "mox.example")
 	// todo: check returned data
 
+	// Outgoing identity with consistent forward and reverse DNS.
+	domain.OutgoingIdentity = &config.OutgoingIdentity{
+		IPs:            []string{"10.0.0.1"},
+		ParsedIPs:      []net.IP{net.ParseIP("10.0.0.1")},
+		HostnameDomain: dns.Domain{ASCII: "out.mox.example"},
+	}
+	mox.Conf.Dynamic.Domains["mox.example"] = domain
+	resolver.A["out.mox.example."] = []string{"10.0.0.1"}
+	resolver.PTR = map[string][]string{"10.0.0.1": {"out.mox.example."}}
+	r := checkDomain(context.Background(), resolver, dialer, "mox.example")
+	if len(r.Outgoing.Errors) != 0 || len(r.Outgoing.Identities) != 1 || r.Outgoing.Identities[0].Source != "domain" {
+		t.Fatalf("unexpected outgoing check result %#v", r.Outgoing)
+	}
+
+	// Reverse DNS not matching.
+	resolver.PTR["10.0.0.1"] = []string{"other.example."}
+	r = checkDomain(context.Background(), resolver, dialer, "mox.example")
+	if len(r.Outgoing.Errors) != 1 {
+		t.Fatalf("expected 1 error for outgoing check, got %v", r.Outgoing.Errors)
+	}
+
 	Admin{}.Domains(context.Background())        // todo: check results
 	dnsblsStatus(context.Background(), resolver) // todo: check results
 }
+
+func TestQueueFilterAll(t *testing.T) {
+	// An empty filter matches all messages, it must be explicitly allowed.
+	xcheck := func(f queue.Filter, all bool, expErr bool) {
+		t.Helper()
+		defer func() {
+			x := recover()
+			if err, ok := x.(*sherpa.Error); (x != nil) != expErr || x != nil && (!ok || err.Code != "user:error") {
+				t.Fatalf("got panic %v, expected error %v", x, expErr)
+			}
+		}()
+		xcheckQueueFilter(f, all)
+	}
+	xcheck(queue.Filter{}, false, true)
+	xcheck(queue.Filter{}, true, false)
+	xcheck(queue.Filter{IDs: []int64{1}}, false, false)
+	xcheck(queue.Filter{To: "@mox.example"}, false, false)
+}
@@ -8,6 +8,7 @@ import (
 	"compress/gzip"
 	"context"
 	cryptrand "crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,9 +24,11 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/imapclient"
 	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/store"
 )
 
@@ -73,6 +76,7 @@ func importManage() {
 		MailboxCounts map[string]int
 		Problems      []string
 		Done          *time.Time
+		DoneEvent     importDone
 		Aborted       *time.Time
 		Listeners     map[*importListener]struct{}
 		Cancel        func()
@@ -109,7 +113,7 @@ func importManage() {
 					sendEvent("problem", importProblem{p})
 				}
 				if s.Done != nil {
-					sendEvent("done", importDone{})
+					sendEvent("done", s.DoneEvent)
 				} else if s.Aborted != nil {
 					sendEvent("aborted", importAborted{})
 				}
@@ -147,6 +151,7 @@ func importManage() {
 				case importDone:
 					now := time.Now()
 					s.Done = &now
+					s.DoneEvent = x
 				case importAborted:
 					now := time.Now()
 					s.Aborted = &now
@@ -187,9 +192,22 @@ type importCount struct {
 type importProblem struct {
 	Message string
 }
-type importDone struct{}
+type importDone struct {
+	Summary string // Optional, e.g. for imports from Google Takeout.
+}
 type importAborted struct{}
 
+// importSendEvent sends an event for an import to the listeners.
+func importSendEvent(log *mlog.Log, token, kind string, v any) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Errorx("marshal event", err, mlog.Field("kind", kind), mlog.Field("event", v))
+		return
+	}
+	ssemsg := fmt.Sprintf("event: %s\ndata: %s\n\n", kind, buf)
+	importers.Events <- importEvent{token, []byte(ssemsg), v, nil}
+}
+
 // importStart prepare the import and launches the goroutine to actually import.
 // importStart is responsible for closing f.
 func importStart(log *mlog.Log, accName string, f *os.File, skipMailboxPrefix string) (string, error) {
@@ -287,13 +305,7 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 	}
 
 	sendEvent := func(kind string, v any) {
-		buf, err := json.Marshal(v)
-		if err != nil {
-			log.Errorx("marshal event", err, mlog.Field("kind", kind), mlog.Field("event", v))
-			return
-		}
-		ssemsg := fmt.Sprintf("event: %s\ndata: %s\n\n", kind, buf)
-		importers.Events <- importEvent{token, []byte(ssemsg), v, nil}
+		importSendEvent(log, token, kind, v)
 	}
 
 	problemf := func(format string, args ...any) {
@@ -385,17 +397,12 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 	}
 
 	openTrainMessage := func(m *store.Message) {
-		path := acc.MessagePath(m.ID)
-		f, err := os.Open(path)
-		if err != nil {
-			problemf("opening message again for training junk filter: %v (continuing)", err)
-			return
-		}
+		mr := acc.MessageReader(*m)
 		defer func() {
-			err := f.Close()
-			log.Check(err, "closing file after training junkfilter")
+			err := mr.Close()
+			log.Check(err, "closing message after training junkfilter")
 		}()
-		p, err := m.LoadPart(f)
+		p, err := m.LoadPart(mr)
 		if err != nil {
 			problemf("loading parsed message again for training junk filter: %v (continuing)", err)
 			return
@@ -459,9 +466,18 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 		return mb
 	}
 
-	xdeliver := func(mb store.Mailbox, m *store.Message, f *os.File, pos string) {
+	// Messages from a Google Takeout mbox are delivered to a mailbox for each of their
+	// labels, the message file is shared. Messages are present in multiple mbox files
+	// if Takeout exported labels separately, we only import them once.
+	var gmailSpecialUse map[string]string
+	gmailSeen := map[[sha256.Size]byte]bool{}
+	var gmailMessages, gmailDuplicates, gmailDeliveries int
+
+	// xdeliver delivers the message in f to mb. If consume is set, f is removed
+	// and closed.
+	xdeliver := func(mb store.Mailbox, m *store.Message, f *os.File, pos string, consume bool) {
 		defer func() {
-			if f != nil {
+			if f != nil && consume {
 				err := os.Remove(f.Name())
 				log.Check(err, "removing temporary message file for delivery")
 				err = f.Close()
@@ -495,10 +511,9 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 			trainMessage(m, p, pos)
 		}
 
-		const consumeFile = true
 		const sync = false
 		const notrain = true
-		if err := acc.DeliverMessage(log, tx, m, f, consumeFile, mb.Sent, sync, notrain); err != nil {
+		if err := acc.DeliverMessage(log, tx, m, f, consume, mb.Sent, sync, notrain); err != nil {
 			problemf("delivering message %s: %s (continuing)", pos, err)
 			return
 		}
@@ -512,12 +527,46 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 		f = nil
 	}
 
+	ximportGmail := func(labels []string, m *store.Message, f *os.File, pos string) {
+		if gmailSpecialUse == nil {
+			var err error
+			gmailSpecialUse, err = store.SpecialUseMailboxes(tx)
+			ximportcheckf(err, "listing special-use mailboxes")
+		}
+
+		h := sha256.New()
+		_, err := io.Copy(h, &moxio.AtReader{R: f})
+		ximportcheckf(err, "reading message")
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		if gmailSeen[sum] {
+			gmailDuplicates++
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary message file for duplicate message")
+			err = f.Close()
+			log.Check(err, "closing temporary message file for duplicate message")
+			return
+		}
+		gmailSeen[sum] = true
+		gmailMessages++
+
+		mailboxes := store.GmailLabelMailboxes(labels, gmailSpecialUse)
+		for i, name := range mailboxes {
+			mb := xensureMailbox(name)
+			mc := *m
+			last := i == len(mailboxes)-1
+			xdeliver(mb, &mc, f, pos, last)
+			gmailDeliveries++
+		}
+	}
+
 	ximportMbox := func(mailbox, filename string, r io.Reader) {
 		if mailbox == "" {
 			problemf("empty mailbox name for mbox file %s (skipping)", filename)
 			return
 		}
-		mb := xensureMailbox(mailbox)
+		// The mailbox is created when we encounter a message without gmail labels.
+		var mb *store.Mailbox
 
 		mr := store.NewMboxReader(store.CreateMessageTemp, filename, r, log)
 		for {
@@ -528,7 +577,15 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 				ximportcheckf(err, "next message in mbox file")
 			}
 
-			xdeliver(mb, m, mf, pos)
+			if labels := mr.GmailLabels(); labels != nil {
+				ximportGmail(labels, m, mf, pos)
+				continue
+			}
+			if mb == nil {
+				xmb := xensureMailbox(mailbox)
+				mb = &xmb
+			}
+			xdeliver(*mb, m, mf, pos, true)
 		}
 	}
 
@@ -619,7 +676,7 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 			Flags:    flags,
 			Size:     size,
 		}
-		xdeliver(mb, &m, f, filename)
+		xdeliver(mb, &m, f, filename, true)
 		f = nil
 		if keepFlags != "" {
 			if _, ok := mailboxMissingKeywordMessages[mailbox]; !ok {
@@ -749,6 +806,11 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 	ximportcheckf(err, "commit")
 	deliveredIDs = nil
 
+	var summary string
+	if gmailMessages > 0 {
+		summary = fmt.Sprintf("Imported %d messages with Gmail labels, delivered %d times to mailboxes for the labels, skipped %d duplicate messages.", gmailMessages, gmailDeliveries, gmailDuplicates)
+	}
+
 	if jf != nil {
 		if err := jf.Close(); err != nil {
 			problemf("saving changes of training junk filter: %v (continuing)", err)
@@ -765,7 +827,76 @@ func importMessages(ctx context.Context, log *mlog.Log, token string, acc *store
 	log.Check(err, "closing account after import")
 	acc = nil
 
-	sendEvent("done", importDone{})
+	sendEvent("done", importDone{summary})
+}
+
+// importIMAPStart connects to the remote IMAP server and launches the goroutine
+// that imports its messages.
+func importIMAPStart(ctx context.Context, log *mlog.Log, accName string, src store.IMAPImportSource) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := cryptrand.Read(buf); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", buf)
+
+	acc, err := store.OpenAccount(accName)
+	if err != nil {
+		return "", fmt.Errorf("open acount: %v", err)
+	}
+	c, err := store.IMAPImportConnect(ctx, log, src)
+	if err != nil {
+		xerr := acc.Close()
+		log.Check(xerr, "closing account")
+		return "", err
+	}
+
+	// Ensure token is registered before returning, with context that can be canceled.
+	ictx, cancel := context.WithCancel(mox.Shutdown)
+	importers.Events <- importEvent{token, []byte(": keepalive\n\n"), nil, cancel}
+
+	log.Info("starting imap import", mlog.Field("source", src.String()))
+	go importIMAPMessages(ictx, log.WithCid(mox.Cid()), token, acc, c, src.String())
+
+	return token, nil
+}
+
+// importIMAPMessages imports the messages from the remote IMAP server.
+// importIMAPMessages is responsible for closing acc and c.
+func importIMAPMessages(ctx context.Context, log *mlog.Log, token string, acc *store.Account, c *imapclient.Conn, source string) {
+	defer func() {
+		err := c.Close()
+		log.Check(err, "closing imap connection")
+		err = acc.Close()
+		log.Check(err, "closing account")
+
+		x := recover()
+		if x != nil {
+			log.Error("import panic", mlog.Field("err", x))
+			debug.PrintStack()
+		}
+	}()
+
+	progress := store.IMAPImportProgress{
+		Count: func(mailbox string, count int) {
+			importSendEvent(log, token, "count", importCount{mailbox, count})
+		},
+		Problem: func(msg string) {
+			importSendEvent(log, token, "problem", importProblem{msg})
+		},
+	}
+	stats, err := acc.ImportIMAP(ctx, log, c, source, progress)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorx("imap import error", err)
+			importSendEvent(log, token, "problem", importProblem{fmt.Sprintf("%s (aborting)", err)})
+		}
+		importSendEvent(log, token, "aborted", importAborted{})
+		return
+	}
+	_, _, err = c.Logout()
+	log.Check(err, "imap logout")
+	log.Info("imap import done", mlog.Field("mailboxes", stats.Mailboxes), mlog.Field("messages", stats.Messages), mlog.Field("flagschanged", stats.FlagsChanged))
+	importSendEvent(log, token, "done", importDone{})
 }
 
 func flagSet(flags *store.Flags, word string) {
@@ -526,6 +526,7 @@ func listen1(ip string, port int, tlsConfig *tls.Config, name string, kinds []st
 		if err != nil {
 			xlog.Fatalx("http: listen", err, mlog.Field("addr", addr))
 		}
+		ln = mox.ProxyListener(mox.Conf.Static.Listeners[name], protocol, ln)
 	} else {
 		protocol = "https"
 		if os.Getuid() == 0 {
@@ -535,6 +536,7 @@ func listen1(ip string, port int, tlsConfig *tls.Config, name string, kinds []st
 		if err != nil {
 			xlog.Fatalx("https: listen", err, mlog.Field("addr", addr))
 		}
+		ln = mox.ProxyListener(mox.Conf.Static.Listeners[name], protocol, ln)
 		ln = tls.NewListener(ln, tlsConfig)
 	}
 
@@ -129,7 +129,7 @@ func FuzzServer(f *testing.F) {
 
 			err = serverConn.SetDeadline(time.Now().Add(time.Second))
 			flog(err, "set server deadline")
-			serve("test", cid, nil, serverConn, false, true)
+			serve("test", cid, nil, serverConn, false, true, defaultLimiters)
 			cid++
 		}
 
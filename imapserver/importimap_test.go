@@ -0,0 +1,111 @@
+package imapserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/store"
+)
+
+// Import messages from the imap server into another account, as a remote server
+// for store.ImportIMAP.
+func TestImportIMAP(t *testing.T) {
+	tc := start(t)
+	defer tc.close()
+
+	tc.client.Login("mjl@mox.example", "testtest")
+	received := time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC)
+	tc.client.Append("inbox", []string{`\Seen`}, &received, []byte(exampleMsg))
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	tc.client.Create("Lists/a")
+	tc.client.Append("Lists/a", []string{`$Forwarded`}, nil, []byte(exampleMsg))
+
+	acc, err := store.OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer func() {
+		err := acc.Close()
+		tcheck(t, err, "close account")
+	}()
+
+	log := mlog.New("imapserver")
+	ctx := context.Background()
+	xImport := func(expMessages, expFlagsChanged int) {
+		t.Helper()
+		stats, err := acc.ImportIMAP(ctx, log, tc.client, "test", store.IMAPImportProgress{})
+		tcheck(t, err, "import imap")
+		if stats.Messages != expMessages || stats.FlagsChanged != expFlagsChanged {
+			t.Fatalf("got stats %#v, expected %d messages and %d flags changed", stats, expMessages, expFlagsChanged)
+		}
+	}
+	xmessages := func(mailbox string) []store.Message {
+		t.Helper()
+		var msgs []store.Message
+		err := acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			tcheck(t, err, "find mailbox")
+			if mb == nil {
+				t.Fatalf("mailbox %q not found", mailbox)
+			}
+			msgs, err = bstore.QueryTx[store.Message](tx).FilterNonzero(store.Message{MailboxID: mb.ID}).SortAsc("UID").List()
+			return err
+		})
+		tcheck(t, err, "list messages")
+		return msgs
+	}
+
+	xImport(3, 0)
+	inbox := xmessages("Inbox")
+	if len(inbox) != 2 || inbox[0].Flags != (store.Flags{Seen: true}) || !inbox[0].Received.Equal(received) || inbox[1].Flags != (store.Flags{}) {
+		t.Fatalf("unexpected inbox messages after import: %#v", inbox)
+	}
+	if msgs := xmessages("Lists/a"); len(msgs) != 1 || msgs[0].Flags != (store.Flags{Forwarded: true}) {
+		t.Fatalf("unexpected messages in Lists/a after import: %#v", msgs)
+	}
+
+	// Nothing new.
+	xImport(0, 0)
+
+	// Flag changes on the remote server are applied, local flag changes are kept.
+	err = acc.DB.Write(ctx, func(tx *bstore.Tx) error {
+		m := inbox[1]
+		m.Flags.Answered = true
+		return tx.Update(&m)
+	})
+	tcheck(t, err, "update flags")
+	tc.client.Select("inbox")
+	tc.client.StoreFlagsAdd("1:2", true, `\Flagged`)
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	xImport(1, 2)
+	inbox = xmessages("Inbox")
+	if len(inbox) != 3 || inbox[0].Flags != (store.Flags{Seen: true, Flagged: true}) || inbox[1].Flags != (store.Flags{Answered: true, Flagged: true}) {
+		t.Fatalf("unexpected inbox messages after second import: %#v", inbox)
+	}
+
+	// After a UIDValidity change of the remote mailbox, all its messages are fetched
+	// again, but previously imported messages are recognized by Message-ID and size.
+	src, err := store.OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer func() {
+		err := src.Close()
+		tcheck(t, err, "close account")
+	}()
+	err = src.DB.Write(ctx, func(tx *bstore.Tx) error {
+		mb, err := src.MailboxFind(tx, "Inbox")
+		if err != nil {
+			return err
+		}
+		mb.UIDValidity++
+		return tx.Update(mb)
+	})
+	tcheck(t, err, "change uidvalidity")
+	tc.client.Append("inbox", nil, nil, []byte(exampleMsg))
+	xImport(1, 0)
+	if inbox := xmessages("Inbox"); len(inbox) != 4 {
+		t.Fatalf("got %d inbox messages after import with new uidvalidity, expected 4", len(inbox))
+	}
+	xImport(0, 0)
+}
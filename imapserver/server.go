@@ -48,7 +48,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -71,7 +70,6 @@ import (
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/moxio"
 	"github.com/mjl-/mox/moxvar"
-	"github.com/mjl-/mox/ratelimit"
 	"github.com/mjl-/mox/scram"
 	"github.com/mjl-/mox/store"
 )
@@ -103,7 +101,9 @@ var (
 	)
 )
 
-var limiterConnectionrate, limiterConnections *ratelimit.Limiter
+// Limiters for listeners without configured limits. Shared between those
+// listeners.
+var defaultLimiters *mox.Limiters
 
 func init() {
 	// Also called by tests, so they don't trigger the rate limiter.
@@ -112,22 +112,7 @@ func init() {
 
 func limitersInit() {
 	mox.LimitersInit()
-	limiterConnectionrate = &ratelimit.Limiter{
-		WindowLimits: []ratelimit.WindowLimit{
-			{
-				Window: time.Minute,
-				Limits: [...]int64{300, 900, 2700},
-			},
-		},
-	}
-	limiterConnections = &ratelimit.Limiter{
-		WindowLimits: []ratelimit.WindowLimit{
-			{
-				Window: time.Duration(math.MaxInt64), // All of time.
-				Limits: [...]int64{30, 90, 270},
-			},
-		},
-	}
+	defaultLimiters = mox.NewLimiters(nil)
 }
 
 // Delay after bad/suspicious behaviour. Tests set these to zero.
@@ -172,6 +157,8 @@ type conn struct {
 	tlsConfig         *tls.Config // TLS config to use for handshake.
 	remoteIP          net.IP
 	noRequireSTARTTLS bool
+	limiters          *mox.Limiters
+	ratelimitExempt   bool   // Whether remoteIP is allowlisted in the limiters.
 	cmd               string // Currently executing, for deciding to applyChanges and logging.
 	cmdMetric         string // Currently executing, for metrics.
 	cmdStart          time.Time
@@ -309,17 +296,23 @@ func Listen() {
 			tlsConfig = listener.TLS.Config
 		}
 
+		// IMAP and IMAPS share limiters.
+		limiters := defaultLimiters
+		if listener.IMAP.Limits != nil {
+			limiters = mox.NewLimiters(listener.IMAP.Limits)
+		}
+
 		if listener.IMAP.Enabled {
 			port := config.Port(listener.IMAP.Port, 143)
 			for _, ip := range listener.IPs {
-				listen1("imap", name, ip, port, tlsConfig, false, listener.IMAP.NoRequireSTARTTLS)
+				listen1("imap", name, ip, port, tlsConfig, false, listener.IMAP.NoRequireSTARTTLS, limiters)
 			}
 		}
 
 		if listener.IMAPS.Enabled {
 			port := config.Port(listener.IMAPS.Port, 993)
 			for _, ip := range listener.IPs {
-				listen1("imaps", name, ip, port, tlsConfig, true, false)
+				listen1("imaps", name, ip, port, tlsConfig, true, false, limiters)
 			}
 		}
 	}
@@ -327,7 +320,7 @@ func Listen() {
 
 var servers []func()
 
-func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS bool) {
+func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config, xtls, noRequireSTARTTLS bool, limiters *mox.Limiters) {
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 	if os.Getuid() == 0 {
 		xlog.Print("listening for imap", mlog.Field("listener", listenerName), mlog.Field("addr", addr), mlog.Field("protocol", protocol))
@@ -337,6 +330,7 @@ func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config,
 	if err != nil {
 		xlog.Fatalx("imap: listen for imap", err, mlog.Field("protocol", protocol), mlog.Field("listener", listenerName))
 	}
+	ln = mox.ProxyListener(mox.Conf.Static.Listeners[listenerName], protocol, ln)
 	if xtls {
 		ln = tls.NewListener(ln, tlsConfig)
 	}
@@ -350,7 +344,7 @@ func listen1(protocol, listenerName, ip string, port int, tlsConfig *tls.Config,
 			}
 
 			metricIMAPConnection.WithLabelValues(protocol).Inc()
-			go serve(listenerName, mox.Cid(), tlsConfig, conn, xtls, noRequireSTARTTLS)
+			go serve(listenerName, mox.Cid(), tlsConfig, conn, xtls, noRequireSTARTTLS, limiters)
 		}
 	}
 
@@ -584,7 +578,7 @@ func (c *conn) xreadliteral(size int64, sync bool) string {
 
 var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
 
-func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool) {
+func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, xtls, noRequireSTARTTLS bool, limiters *mox.Limiters) {
 	var remoteIP net.IP
 	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
 		remoteIP = a.IP
@@ -601,6 +595,8 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 		tlsConfig:         tlsConfig,
 		remoteIP:          remoteIP,
 		noRequireSTARTTLS: noRequireSTARTTLS,
+		limiters:          limiters,
+		ratelimitExempt:   limiters.Exempt(remoteIP),
 		enabled:           map[capability]bool{},
 		cmd:               "(greeting)",
 		cmdStart:          time.Now(),
@@ -671,25 +667,31 @@ func serve(listenerName string, cid int64, tlsConfig *tls.Config, nc net.Conn, x
 	default:
 	}
 
-	if !limiterConnectionrate.Add(c.remoteIP, time.Now(), 1) {
-		c.writelinef("* BYE connection rate from your ip or network too high, slow down please")
-		return
-	}
+	if c.ratelimitExempt {
+		c.log.Debug("remote ip is exempt from rate limiting", mlog.Field("remoteip", c.remoteIP))
+	} else {
+		if !c.limiters.ConnectionRate.Add(c.remoteIP, time.Now(), 1) {
+			metrics.ConnectionRatelimitedInc("imap", "connectionrate")
+			c.writelinef("* BYE connection rate from your ip or network too high, slow down please")
+			return
+		}
 
-	// If remote IP/network resulted in too many authentication failures, refuse to serve.
-	if !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
-		metrics.AuthenticationRatelimitedInc("imap")
-		c.log.Debug("refusing connection due to many auth failures", mlog.Field("remoteip", c.remoteIP))
-		c.writelinef("* BYE too many auth failures")
-		return
-	}
+		// If remote IP/network resulted in too many authentication failures, refuse to serve.
+		if !c.limiters.FailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+			metrics.AuthenticationRatelimitedInc("imap")
+			c.log.Debug("refusing connection due to many auth failures", mlog.Field("remoteip", c.remoteIP))
+			c.writelinef("* BYE too many auth failures")
+			return
+		}
 
-	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
-		c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
-		c.writelinef("* BYE too many open connections from your ip or network")
-		return
+		if !c.limiters.Connections.Add(c.remoteIP, time.Now(), 1) {
+			metrics.ConnectionRatelimitedInc("imap", "connections")
+			c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
+			c.writelinef("* BYE too many open connections from your ip or network")
+			return
+		}
+		defer c.limiters.Connections.Add(c.remoteIP, time.Now(), -1)
 	}
-	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
 
 	// We register and unregister the original connection, in case it c.conn is
 	// replaced with a TLS connection later on.
@@ -1458,18 +1460,24 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("imap", authVariant, authResult)
-		switch authResult {
-		case "ok":
-			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
-		default:
-			mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
-		}
+		c.limitAuth(authResult == "ok")
 	}()
 
 	// Request syntax: ../rfc/9051:6341 ../rfc/3501:4561
 	p.xspace()
 	authType := p.xatom()
 
+	// Encrypted messages cannot be read without unlocking the account with the
+	// password, which we don't get with CRAM-MD5 and SCRAM.
+	xcheckUnlocked := func(acc *store.Account, username string) {
+		if locked, err := acc.Locked(); err != nil {
+			xserverErrorf("checking if account is locked: %v", err)
+		} else if locked {
+			c.log.Info("refusing authentication without password for locked account with encrypted messages", mlog.Field("username", username))
+			xusercodeErrorf("AUTHENTICATIONFAILED", "account with encrypted messages is locked, authenticate with password, e.g. with PLAIN, to unlock")
+		}
+	}
+
 	xreadInitial := func() []byte {
 		var line string
 		if p.empty() {
@@ -1609,6 +1617,7 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 			c.log.Info("failed authentication attempt", mlog.Field("username", addr), mlog.Field("remote", c.remoteIP))
 			xusercodeErrorf("AUTHENTICATIONFAILED", "bad credentials")
 		}
+		xcheckUnlocked(acc, addr)
 
 		c.account = acc
 		acc = nil // Cancel cleanup.
@@ -1689,6 +1698,7 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 		// Client must still respond, but there is nothing to say. See ../rfc/9051:6221
 		// The message should be empty. todo: should we require it is empty?
 		xreadContinuation()
+		xcheckUnlocked(acc, ss.Authentication)
 
 		c.account = acc
 		acc = nil // Cancel cleanup.
@@ -1706,6 +1716,19 @@ func (c *conn) cmdAuthenticate(tag, cmd string, p *parser) {
 	c.writeresultf("%s OK [CAPABILITY %s] authenticate done", tag, c.capabilities())
 }
 
+// limitAuth resets the counter for failed authentications on success, or
+// increases it on failure.
+func (c *conn) limitAuth(ok bool) {
+	if c.ratelimitExempt {
+		return
+	}
+	if ok {
+		c.limiters.FailedAuth.Reset(c.remoteIP, time.Now())
+	} else {
+		c.limiters.FailedAuth.Add(c.remoteIP, time.Now(), 1)
+	}
+}
+
 // Login logs in with username and password.
 //
 // Status: Not authenticated.
@@ -1715,6 +1738,7 @@ func (c *conn) cmdLogin(tag, cmd string, p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("imap", "login", authResult)
+		c.limitAuth(authResult == "ok")
 	}()
 
 	// todo: get this line logged with traceauth. the plaintext password is included on the command line, which we've already read (before dispatching to this function).
@@ -2992,6 +3016,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 
 			// Insert new messages into database.
 			var origMsgIDs, newMsgIDs []int64
+			now := time.Now()
 			for i, uid := range uids {
 				m, ok := msgs[uid]
 				if !ok {
@@ -3002,6 +3027,7 @@ func (c *conn) cmdxCopy(isUID bool, tag, cmd string, p *parser) {
 				m.ID = 0
 				m.UID = uidFirst + store.UID(i)
 				m.MailboxID = mbDst.ID
+				m.Moved = now
 				if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
 					// Incorrectly delivered to Rejects mailbox. Adjust MailboxOrigID so this message
 					// is used for reputation calculation during future deliveries.
@@ -3161,12 +3187,14 @@ func (c *conn) cmdxMove(isUID bool, tag, cmd string, p *parser) {
 			}
 
 			conf, _ := c.account.Conf()
+			now := time.Now()
 			for i := range msgs {
 				m := &msgs[i]
 				if m.UID != uids[i] {
 					xserverErrorf("internal error: got uid %d, expected %d, for index %d", m.UID, uids[i], i)
 				}
 				m.MailboxID = mbDst.ID
+				m.Moved = now
 				if mbSrc.Name == conf.RejectsMailbox && m.MailboxDestinedID != 0 {
 					// Incorrectly delivered to Rejects mailbox. Adjust MailboxOrigID so this message
 					// is used for reputation calculation during future deliveries.
@@ -341,7 +341,7 @@ func startArgs(t *testing.T, first, isTLS, allowLoginWithoutTLS bool) *testconn
 	connCounter++
 	cid := connCounter
 	go func() {
-		serve("test", cid, tlsConfig, serverConn, isTLS, allowLoginWithoutTLS)
+		serve("test", cid, tlsConfig, serverConn, isTLS, allowLoginWithoutTLS, defaultLimiters)
 		close(switchDone)
 		close(done)
 	}()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -55,6 +56,10 @@ func cmdImportMbox(c *cmd) {
 Using mbox is not recommended, maildir is a better defined format.
 
 ` + importCommonHelp + `
+For mbox files from Google Takeout, flags are set based on the labels in the
+X-Gmail-Labels headers, e.g. "Opened" and "Starred". All messages are imported
+into the single mailbox. To import messages into a mailbox per label, upload the
+Takeout file on the account web page.
 
 The mailbox is read by the mox process, so make sure it has access to the
 maildir directories/files.
@@ -335,3 +340,127 @@ func importctl(ctx context.Context, ctl *ctl, mbox bool) {
 	ctl.xwriteok()
 	ctl.xwrite(fmt.Sprintf("%d", n))
 }
+
+func cmdImportIMAP(c *cmd) {
+	c.params = "[-starttls] accountname host username"
+	c.help = `Import all mailboxes and messages from a remote IMAP server into an account.
+
+Mailboxes are created as needed. Messages are imported with their flags,
+keywords known to mox (like $Forwarded and $Junk), and received (internal) date.
+Mailboxes with a special-use flag, like \Sent, are imported into the mailboxes
+with the same special-use flag in the account.
+
+The password for the remote account is read from stdin.
+
+Host is a hostname with an optional port. By default TLS is used immediately,
+on port 993. With -starttls, the connection starts without TLS on port 143, and
+is switched to TLS with STARTTLS. Only ports 993 and 143 and public IPs can be
+connected to, unless allowed with IMAPImport in mox.conf.
+
+The progress is kept in the account. If the import is interrupted, it can be
+started again. The import can also be repeated, e.g. until the account is
+switched over to mox: only messages not imported earlier are fetched, and flag
+changes on the remote server to earlier imported messages are applied.
+
+` + importCommonHelp
+	var startTLS bool
+	c.flag.BoolVar(&startTLS, "starttls", false, "connect without tls and switch to tls with starttls")
+	args := c.Parse()
+	if len(args) != 3 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	xcheckf(err, "reading password from stdin")
+	password := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+	ctl := xctl()
+	ctl.xwrite("importimap")
+	ctl.xwrite(args[0])
+	ctl.xwrite(args[1])
+	if startTLS {
+		ctl.xwrite("starttls")
+	} else {
+		ctl.xwrite("")
+	}
+	ctl.xwrite(args[2])
+	ctl.xwrite(password)
+	ctl.xreadok()
+	fmt.Fprintln(os.Stderr, "importing...")
+	for {
+		line := ctl.xread()
+		if strings.HasPrefix(line, "count ") {
+			t := strings.SplitN(line[len("count "):], " ", 2)
+			if len(t) == 2 {
+				fmt.Fprintf(os.Stderr, "%s: %s...\n", t[1], t[0])
+			}
+			continue
+		} else if strings.HasPrefix(line, "problem ") {
+			fmt.Fprintf(os.Stderr, "problem: %s\n", line[len("problem "):])
+			continue
+		}
+		if line != "ok" {
+			log.Fatalf("import, expected ok, got %q", line)
+		}
+		break
+	}
+	fmt.Fprintln(os.Stderr, ctl.xread())
+}
+
+func importIMAPCtl(ctx context.Context, ctl *ctl) {
+	/* protocol:
+	> "importimap"
+	> account
+	> host
+	> "starttls" or ""
+	> username
+	> password
+	< "ok" or error
+	< "count" count mailbox, or "problem" message (zero or more times)
+	< "ok" when done, or error
+	< summary of imported messages (only if not error)
+	*/
+	account := ctl.xread()
+	src := store.IMAPImportSource{
+		Host: ctl.xread(),
+	}
+	src.StartTLS = ctl.xread() == "starttls"
+	src.Username = ctl.xread()
+	src.Password = ctl.xread()
+
+	ctl.log.Info("importing messages from imap server", mlog.Field("account", account), mlog.Field("source", src.String()))
+
+	a, err := store.OpenAccount(account)
+	ctl.xcheck(err, "opening account")
+	defer func() {
+		err := a.Close()
+		ctl.log.Check(err, "closing account after import")
+	}()
+
+	c, err := store.IMAPImportConnect(ctx, ctl.log, src)
+	ctl.xcheck(err, "connecting to imap server")
+	defer func() {
+		err := c.Close()
+		ctl.log.Check(err, "closing imap connection")
+	}()
+	ctl.xwriteok()
+
+	progress := store.IMAPImportProgress{
+		Count: func(mailbox string, count int) {
+			ctl.xwrite(fmt.Sprintf("count %d %s", count, mailbox))
+		},
+		Problem: func(msg string) {
+			ctl.xwrite("problem " + strings.ReplaceAll(msg, "\n", " "))
+		},
+	}
+	stats, err := a.ImportIMAP(ctx, ctl.log, c, src.String(), progress)
+	ctl.xcheck(err, "importing")
+	_, _, err = c.Logout()
+	ctl.log.Check(err, "imap logout")
+	ctl.log.Info("imported messages from imap server", mlog.Field("mailboxes", stats.Mailboxes), mlog.Field("messages", stats.Messages), mlog.Field("flagschanged", stats.FlagsChanged))
+
+	ctl.xwriteok()
+	ctl.xwrite(fmt.Sprintf("%d mailboxes, %d messages imported, %d messages with changed flags", stats.Mailboxes, stats.Messages, stats.FlagsChanged))
+}
@@ -82,13 +82,22 @@ var commands = []struct {
 	{"queue kick", cmdQueueKick},
 	{"queue drop", cmdQueueDrop},
 	{"queue dump", cmdQueueDump},
+	{"queue hold", cmdQueueHold},
+	{"queue release", cmdQueueRelease},
+	{"queue holdrules list", cmdQueueHoldrulesList},
+	{"queue holdrules add", cmdQueueHoldrulesAdd},
+	{"queue holdrules remove", cmdQueueHoldrulesRemove},
+	{"queue history", cmdQueueHistory},
+	{"queue reschedule", cmdQueueReschedule},
 	{"import maildir", cmdImportMaildir},
 	{"import mbox", cmdImportMbox},
+	{"import imap", cmdImportIMAP},
 	{"export maildir", cmdExportMaildir},
 	{"export mbox", cmdExportMbox},
 	{"localserve", cmdLocalserve},
 	{"help", cmdHelp},
 	{"backup", cmdBackup},
+	{"restore", cmdRestore},
 	{"verifydata", cmdVerifydata},
 
 	{"config test", cmdConfigTest},
@@ -98,8 +107,19 @@ var commands = []struct {
 	{"config describe-static", cmdConfigDescribeStatic},
 	{"config account add", cmdConfigAccountAdd},
 	{"config account rm", cmdConfigAccountRemove},
+	{"config account rename", cmdConfigAccountRename},
+	{"account check", cmdAccountCheck},
+	{"account movemailbox", cmdAccountMoveMailbox},
 	{"config address add", cmdConfigAddressAdd},
 	{"config address rm", cmdConfigAddressRemove},
+	{"config address move", cmdConfigAddressMove},
+	{"config alias list", cmdConfigAliasList},
+	{"config alias print", cmdConfigAliasPrint},
+	{"config alias add", cmdConfigAliasAdd},
+	{"config alias update", cmdConfigAliasUpdate},
+	{"config alias rm", cmdConfigAliasRemove},
+	{"config alias addaddr", cmdConfigAliasAddaddr},
+	{"config alias rmaddr", cmdConfigAliasRmaddr},
 	{"config domain add", cmdConfigDomainAdd},
 	{"config domain rm", cmdConfigDomainRemove},
 	{"config describe-sendmail", cmdConfigDescribeSendmail},
@@ -123,6 +143,9 @@ var commands = []struct {
 	{"dnsbl checkhealth", cmdDNSBLCheckhealth},
 	{"mtasts lookup", cmdMTASTSLookup},
 	{"retrain", cmdRetrain},
+	{"compress", cmdCompress},
+	{"encrypt", cmdEncrypt},
+	{"dedup", cmdDedup},
 	{"sendmail", cmdSendmail},
 	{"spf check", cmdSPFCheck},
 	{"spf lookup", cmdSPFLookup},
@@ -636,6 +659,31 @@ explicitly, see the setaccountpassword command.
 	fmt.Printf("account added, set a password with \"mox setaccountpassword %s\"\n", args[1])
 }
 
+func cmdConfigAccountRename(c *cmd) {
+	c.params = "account newname"
+	c.help = `Rename an account and reload the configuration.
+
+The data directory of the account is renamed, and references to the account in
+the configuration, such as for DMARC and TLS reports of domains, are updated.
+Messages in the queue from the account, and hold rules for the account, are
+updated too. The account cannot be renamed while it is in use, e.g. by IMAP
+sessions. The postmaster account, configured in mox.conf, cannot be renamed
+while mox is running.
+`
+	args := c.Parse()
+	if len(args) != 2 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("accountrename")
+	ctl.xwrite(args[0])
+	ctl.xwrite(args[1])
+	ctl.xreadok()
+	fmt.Println("account renamed")
+}
+
 func cmdConfigAccountRemove(c *cmd) {
 	c.params = "account"
 	c.help = `Remove an account and reload the configuration.
@@ -697,6 +745,183 @@ Incoming email for this address will be rejected after removing an address.
 	fmt.Println("address removed")
 }
 
+func cmdConfigAddressMove(c *cmd) {
+	c.params = "[-messages] address account"
+	c.help = `Move an address to another account and reload the configuration.
+
+The delivery settings of the address, such as rulesets, are moved along. With
+-messages, existing messages delivered to the address (based on the SMTP RCPT TO
+address) are moved to mailboxes with the same names in the other account.
+Messages cannot be moved for catchall addresses.
+`
+	var messages bool
+	c.flag.BoolVar(&messages, "messages", false, "also move messages delivered to the address")
+	args := c.Parse()
+	if len(args) != 2 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("addressmove")
+	ctl.xwrite(args[0])
+	ctl.xwrite(args[1])
+	if messages {
+		ctl.xwrite("messages")
+	} else {
+		ctl.xwrite("")
+	}
+	ctl.xreadok()
+	n := ctl.xread()
+	if messages {
+		fmt.Printf("address moved, %s messages moved\n", n)
+	} else {
+		fmt.Println("address moved")
+	}
+}
+
+func cmdConfigAliasList(c *cmd) {
+	c.params = "domain"
+	c.help = `List aliases for domain.`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliaslist")
+	ctl.xwrite(args[0])
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdConfigAliasPrint(c *cmd) {
+	c.params = "alias"
+	c.help = `Print settings and members of alias.`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasprint")
+	ctl.xwrite(args[0])
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdConfigAliasAdd(c *cmd) {
+	c.params = "alias@domain rcpt1@domain ..."
+	c.help = `Add new alias with one or more addresses and reload the configuration.
+
+Members can be local addresses or addresses at external domains. Messages to
+external members are forwarded with SRS.
+`
+	var alias config.Alias
+	c.flag.StringVar(&alias.PostPolicy, "postpolicy", "", "who can send to the alias: members (default), anyone or authenticated")
+	c.flag.BoolVar(&alias.ListHeaders, "listheaders", false, "add mailing list headers like List-Id to delivered messages")
+	c.flag.StringVar(&alias.ListUnsubscribe, "listunsubscribe", "", "value for List-Unsubscribe header, including angle brackets")
+	args := c.Parse()
+	if len(args) < 2 {
+		c.Usage()
+	}
+
+	alias.Addresses = args[1:]
+	buf, err := json.Marshal(alias)
+	xcheckf(err, "marshal alias")
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasadd")
+	ctl.xwrite(args[0])
+	ctl.xwrite(string(buf))
+	ctl.xreadok()
+	fmt.Println("alias added")
+}
+
+func cmdConfigAliasUpdate(c *cmd) {
+	c.params = "alias@domain"
+	c.help = `Update settings of an alias and reload the configuration.
+
+All settings are replaced by the values from the flags.
+`
+	var postPolicy, listUnsubscribe string
+	var listHeaders bool
+	c.flag.StringVar(&postPolicy, "postpolicy", "", "who can send to the alias: members (default), anyone or authenticated")
+	c.flag.BoolVar(&listHeaders, "listheaders", false, "add mailing list headers like List-Id to delivered messages")
+	c.flag.StringVar(&listUnsubscribe, "listunsubscribe", "", "value for List-Unsubscribe header, including angle brackets")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasupdate")
+	ctl.xwrite(args[0])
+	ctl.xwrite(postPolicy)
+	ctl.xwrite(fmt.Sprintf("%v", listHeaders))
+	ctl.xwrite(listUnsubscribe)
+	ctl.xreadok()
+	fmt.Println("alias updated")
+}
+
+func cmdConfigAliasRemove(c *cmd) {
+	c.params = "alias@domain"
+	c.help = `Remove alias and reload the configuration.`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasrm")
+	ctl.xwrite(args[0])
+	ctl.xreadok()
+	fmt.Println("alias removed")
+}
+
+func cmdConfigAliasAddaddr(c *cmd) {
+	c.params = "alias@domain rcpt1@domain ..."
+	c.help = `Add addresses to alias and reload the configuration.`
+	args := c.Parse()
+	if len(args) < 2 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasaddaddr")
+	ctl.xwrite(args[0])
+	buf, err := json.Marshal(args[1:])
+	xcheckf(err, "marshal addresses")
+	ctl.xwrite(string(buf))
+	ctl.xreadok()
+	fmt.Println("addresses added")
+}
+
+func cmdConfigAliasRmaddr(c *cmd) {
+	c.params = "alias@domain rcpt1@domain ..."
+	c.help = `Remove addresses from alias and reload the configuration.`
+	args := c.Parse()
+	if len(args) < 2 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("aliasrmaddr")
+	ctl.xwrite(args[0])
+	buf, err := json.Marshal(args[1:])
+	xcheckf(err, "marshal addresses")
+	ctl.xwrite(string(buf))
+	ctl.xreadok()
+	fmt.Println("addresses removed")
+}
+
 func cmdConfigDNSRecords(c *cmd) {
 	c.params = "domain"
 	c.help = `Prints annotated DNS records as zone file that should be created for the domain.
@@ -965,7 +1190,7 @@ new mail deliveries.
 }
 
 func cmdBackup(c *cmd) {
-	c.params = "dest-dir"
+	c.params = "[-incremental previous-backup-dir] dest-dir"
 	c.help = `Creates a backup of the data directory.
 
 Backup creates consistent snapshots of the databases and message files and
@@ -982,6 +1207,15 @@ increases the odds hardlinking succeeds: the default systemd service file
 specifically mounts the data directory, causing attempts to hardlink outside it
 to fail with an error about cross-device linking.
 
+With -incremental, message files that are also present, unchanged, in an
+earlier backup directory are hardlinked from that backup instead of from the
+data directory. A message file is unchanged if it is the same file as in the
+data directory (hardlinked), or has the same size and modification time. Only
+message files added or changed since the earlier backup are copied when the
+backup destination is on a different file system than the data directory. Databases are always snapshotted in full. Each incremental backup
+is a complete backup by itself: earlier backups can be removed without
+affecting later backups.
+
 All files in the data directory that aren't recognized (i.e. other than known
 database files, message files, an acme directory, the "tmp" directory, etc),
 are stored, but with a warning.
@@ -989,11 +1223,10 @@ are stored, but with a warning.
 A clean successful backup does not print any output by default. Use the
 -verbose flag for details, including timing.
 
-To restore a backup, first shut down mox, move away the old data directory and
-move an earlier backed up directory in its place, run "mox verifydata",
-possibly with the "-fix" option, and restart mox. After the restore, you may
-also want to run "mox bumpuidvalidity" for each account for which messages in a
-mailbox changed, to force IMAP clients to synchronize mailbox state.
+To restore a backup, shut down mox and use "mox restore", see its help for
+details. After the restore, you may also want to run "mox bumpuidvalidity" for
+each account for which messages in a mailbox changed, to force IMAP clients to
+synchronize mailbox state.
 
 Before upgrading, to check if the upgrade will likely succeed, first make a
 backup, then use the new mox binary to run "mox verifydata" on the backup. This
@@ -1003,7 +1236,9 @@ upgrading.
 `
 
 	var verbose bool
+	var incremental string
 	c.flag.BoolVar(&verbose, "verbose", false, "print progress")
+	c.flag.StringVar(&incremental, "incremental", "", "earlier backup directory to hardlink unchanged message files from")
 	args := c.Parse()
 	if len(args) != 1 {
 		c.Usage()
@@ -1012,10 +1247,16 @@ upgrading.
 
 	dstDataDir, err := filepath.Abs(args[0])
 	xcheckf(err, "making path absolute")
+	var prevDataDir string
+	if incremental != "" {
+		prevDataDir, err = filepath.Abs(incremental)
+		xcheckf(err, "making path absolute")
+	}
 
 	ctl := xctl()
 	ctl.xwrite("backup")
 	ctl.xwrite(dstDataDir)
+	ctl.xwrite(prevDataDir)
 	if verbose {
 		ctl.xwrite("verbose")
 	} else {
@@ -1120,12 +1361,83 @@ func cmdDeliver(c *cmd) {
 	}
 }
 
+// queueFilterParams describes the flags of queueFilterArgs, for command usage.
+const queueFilterParams = "[-id id] [-account account] [-from address] [-to address] [-olderthan duration] [-newerthan duration] [-error text] [-minattempts n]"
+
+// queueFilterArgs holds the command-line flags for selecting messages in the queue.
+type queueFilterArgs struct {
+	id          int64
+	account     string
+	from        string
+	to          string
+	olderThan   time.Duration
+	newerThan   time.Duration
+	lastError   string
+	minAttempts int
+
+	// Flags of older versions of "queue kick" and "queue drop", aliases for -to.
+	toDomain  string
+	recipient string
+}
+
+func (a *queueFilterArgs) flags(c *cmd) {
+	c.flag.Int64Var(&a.id, "id", 0, "id of message in queue")
+	c.flag.StringVar(&a.account, "account", "", "account that queued the message")
+	c.flag.StringVar(&a.from, "from", "", "sender address or @domain")
+	c.flag.StringVar(&a.to, "to", "", "recipient address or @domain")
+	c.flag.DurationVar(&a.olderThan, "olderthan", 0, "only messages queued longer than duration ago")
+	c.flag.DurationVar(&a.newerThan, "newerthan", 0, "only messages queued less than duration ago")
+	c.flag.StringVar(&a.lastError, "error", "", "only messages with last delivery error containing text, case-insensitive")
+	c.flag.IntVar(&a.minAttempts, "minattempts", 0, "only messages with at least this many delivery attempts")
+}
+
+// legacyFlags adds the -todomain and -recipient flags of older versions of the
+// kick and drop commands, as aliases for -to.
+func (a *queueFilterArgs) legacyFlags(c *cmd) {
+	c.flag.StringVar(&a.toDomain, "todomain", "", "recipient domain, same as -to @domain")
+	c.flag.StringVar(&a.recipient, "recipient", "", "recipient address, same as -to address")
+}
+
+// xwrite writes the filter to the ctl connection, read by ctl.xreadQueueFilter.
+func (a queueFilterArgs) xwrite(ctl *ctl) {
+	ago := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return time.Now().Add(-d).Format(time.RFC3339)
+	}
+	to := a.to
+	if a.toDomain != "" || a.recipient != "" {
+		if to != "" || a.toDomain != "" && a.recipient != "" {
+			log.Fatalf("at most one of -to, -todomain and -recipient can be specified")
+		} else if a.toDomain != "" {
+			to = "@" + a.toDomain
+		} else {
+			to = a.recipient
+		}
+	}
+	ctl.xwrite(fmt.Sprintf("%d", a.id))
+	ctl.xwrite(a.account)
+	ctl.xwrite(a.from)
+	ctl.xwrite(to)
+	ctl.xwrite(ago(a.olderThan))
+	ctl.xwrite(ago(a.newerThan))
+	ctl.xwrite(a.lastError)
+	ctl.xwrite(fmt.Sprintf("%d", a.minAttempts))
+}
+
 func cmdQueueList(c *cmd) {
-	c.help = `List messages in the delivery queue.
+	c.params = queueFilterParams
+	c.help = `List matching messages in the delivery queue.
 
 This prints the message with its ID, last and next delivery attempts, last
 error.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
 `
+	var fa queueFilterArgs
+	fa.flags(c)
 	if len(c.Parse()) != 0 {
 		c.Usage()
 	}
@@ -1133,6 +1445,7 @@ error.
 
 	ctl := xctl()
 	ctl.xwrite("queue")
+	fa.xwrite(ctl)
 	ctl.xreadok()
 	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
 		log.Fatalf("%s", err)
@@ -1140,19 +1453,21 @@ error.
 }
 
 func cmdQueueKick(c *cmd) {
-	c.params = "[-id id] [-todomain domain] [-recipient address]"
+	c.params = queueFilterParams
 	c.help = `Schedule matching messages in the queue for immediate delivery.
 
 Messages deliveries are normally attempted with exponential backoff. The first
 retry after 7.5 minutes, and doubling each time. Kicking messages sets their
 next scheduled attempt to now, it can cause delivery to fail earlier than
 without rescheduling.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain. Flags -todomain and -recipient of older
+versions are still accepted, as aliases for -to.
 `
-	var id int64
-	var todomain, recipient string
-	c.flag.Int64Var(&id, "id", 0, "id of message in queue")
-	c.flag.StringVar(&todomain, "todomain", "", "destination domain of messages")
-	c.flag.StringVar(&recipient, "recipient", "", "recipient email address")
+	var fa queueFilterArgs
+	fa.flags(c)
+	fa.legacyFlags(c)
 	if len(c.Parse()) != 0 {
 		c.Usage()
 	}
@@ -1160,9 +1475,7 @@ without rescheduling.
 
 	ctl := xctl()
 	ctl.xwrite("queuekick")
-	ctl.xwrite(fmt.Sprintf("%d", id))
-	ctl.xwrite(todomain)
-	ctl.xwrite(recipient)
+	fa.xwrite(ctl)
 	count := ctl.xread()
 	line := ctl.xread()
 	if line == "ok" {
@@ -1173,17 +1486,19 @@ without rescheduling.
 }
 
 func cmdQueueDrop(c *cmd) {
-	c.params = "[-id id] [-todomain domain] [-recipient address]"
+	c.params = queueFilterParams
 	c.help = `Remove matching messages from the queue.
 
 Dangerous operation, this completely removes the message. If you want to store
 the message, use "queue dump" before removing.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain. Flags -todomain and -recipient of older
+versions are still accepted, as aliases for -to.
 `
-	var id int64
-	var todomain, recipient string
-	c.flag.Int64Var(&id, "id", 0, "id of message in queue")
-	c.flag.StringVar(&todomain, "todomain", "", "destination domain of messages")
-	c.flag.StringVar(&recipient, "recipient", "", "recipient email address")
+	var fa queueFilterArgs
+	fa.flags(c)
+	fa.legacyFlags(c)
 	if len(c.Parse()) != 0 {
 		c.Usage()
 	}
@@ -1191,15 +1506,13 @@ the message, use "queue dump" before removing.
 
 	ctl := xctl()
 	ctl.xwrite("queuedrop")
-	ctl.xwrite(fmt.Sprintf("%d", id))
-	ctl.xwrite(todomain)
-	ctl.xwrite(recipient)
+	fa.xwrite(ctl)
 	count := ctl.xread()
 	line := ctl.xread()
 	if line == "ok" {
 		fmt.Printf("%s messages dropped\n", count)
 	} else {
-		log.Fatalf("scheduling messages for immediate delivery: %s", line)
+		log.Fatalf("dropping messages from queue: %s", line)
 	}
 }
 
@@ -1224,6 +1537,202 @@ The message is printed to stdout and is in standard internet mail format.
 	}
 }
 
+func cmdQueueHold(c *cmd) {
+	c.params = queueFilterParams
+	c.help = `Mark matching messages in the queue as held.
+
+Delivery of held messages is not attempted until they are released. Messages
+can be inspected with "queue dump" and removed with "queue drop" while held.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
+`
+	cmdQueueHoldSet(c, true)
+}
+
+func cmdQueueRelease(c *cmd) {
+	c.params = queueFilterParams
+	c.help = `Release matching held messages in the queue for delivery.
+
+Messages are delivered when their next attempt is due, which may be
+immediately.
+
+Addresses for -from and -to can be a full address, or of the form @domain to
+match all addresses of the domain.
+`
+	cmdQueueHoldSet(c, false)
+}
+
+func cmdQueueHoldSet(c *cmd, hold bool) {
+	var fa queueFilterArgs
+	fa.flags(c)
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	ctl := xctl()
+	if hold {
+		ctl.xwrite("queuehold")
+	} else {
+		ctl.xwrite("queuerelease")
+	}
+	fa.xwrite(ctl)
+	count := ctl.xread()
+	line := ctl.xread()
+	if line != "ok" {
+		log.Fatalf("changing hold on messages: %s", line)
+	}
+	if hold {
+		fmt.Printf("%s messages held\n", count)
+	} else {
+		fmt.Printf("%s messages released\n", count)
+	}
+}
+
+func cmdQueueHoldrulesList(c *cmd) {
+	c.help = `List hold rules for the delivery queue.
+
+Newly queued messages matching a hold rule are marked as held.
+`
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	ctl := xctl()
+	ctl.xwrite("queueholdruleslist")
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+func cmdQueueHoldrulesAdd(c *cmd) {
+	c.params = "[-account account] [-senderdom domain] [-recipientdom domain] [-minsize bytes]"
+	c.help = `Add hold rule for the delivery queue.
+
+Newly queued messages matching all specified conditions are marked as held. A
+rule without conditions holds all newly queued messages. Messages already in
+the queue are not affected, use "queue hold" for those.
+`
+	var account, senderdom, recipientdom string
+	var minsize int64
+	c.flag.StringVar(&account, "account", "", "account that queued the message")
+	c.flag.StringVar(&senderdom, "senderdom", "", "domain of sender address")
+	c.flag.StringVar(&recipientdom, "recipientdom", "", "domain of recipient address")
+	c.flag.Int64Var(&minsize, "minsize", 0, "minimum size of message in bytes")
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	ctl := xctl()
+	ctl.xwrite("queueholdrulesadd")
+	ctl.xwrite(account)
+	ctl.xwrite(senderdom)
+	ctl.xwrite(recipientdom)
+	ctl.xwrite(fmt.Sprintf("%d", minsize))
+	ctl.xreadok()
+	fmt.Println("hold rule added")
+}
+
+func cmdQueueHoldrulesRemove(c *cmd) {
+	c.params = "ruleid"
+	c.help = `Remove hold rule for the delivery queue.
+
+Messages held due to the rule are not released, use "queue release" for those.
+`
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	ctl := xctl()
+	ctl.xwrite("queueholdrulesremove")
+	ctl.xwrite(args[0])
+	ctl.xreadok()
+	fmt.Println("hold rule removed")
+}
+
+func cmdQueueReschedule(c *cmd) {
+	c.params = queueFilterParams + " [-at time | -in duration]"
+	c.help = `Change the release time of messages submitted with FUTURERELEASE.
+
+Messages matching all specified conditions that were submitted with
+FUTURERELEASE and have not had a delivery attempt yet are rescheduled to be delivered at the time specified with -at (in RFC3339
+format, e.g. 2023-06-01T09:00:00Z), or after the duration specified with -in.
+Without -at and -in, the future release is cancelled and delivery is attempted
+immediately.
+`
+	var fa queueFilterArgs
+	var at string
+	var in time.Duration
+	fa.flags(c)
+	c.flag.StringVar(&at, "at", "", "new release time, in RFC3339 format")
+	c.flag.DurationVar(&in, "in", 0, "new release time as duration from now")
+	if len(c.Parse()) != 0 || at != "" && in != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	var release string
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		xcheckf(err, "parsing release time")
+		release = t.Format(time.RFC3339)
+	} else if in != 0 {
+		release = time.Now().Add(in).Format(time.RFC3339)
+	}
+
+	ctl := xctl()
+	ctl.xwrite("queuereschedule")
+	fa.xwrite(ctl)
+	ctl.xwrite(release)
+	count := ctl.xread()
+	line := ctl.xread()
+	if line != "ok" {
+		log.Fatalf("rescheduling messages: %s", line)
+	}
+	fmt.Printf("%s messages rescheduled\n", count)
+}
+
+func cmdQueueHistory(c *cmd) {
+	c.params = "[-account account] [-from address] [-to address] [-result success|failure] [-limit n]"
+	c.help = `List history of messages removed from the delivery queue.
+
+Messages are kept in the history after successful delivery or a permanent
+failure, for the configured history retention period. For each message, details
+about the final delivery attempt are shown: the remote MX host and IP, TLS mode
+and version, and the final SMTP response or error. Most recent messages are
+listed first.
+`
+	var account, from, to, result string
+	var limit int
+	c.flag.StringVar(&account, "account", "", "account that queued the message")
+	c.flag.StringVar(&from, "from", "", "sender address or @domain")
+	c.flag.StringVar(&to, "to", "", "recipient address or @domain")
+	c.flag.StringVar(&result, "result", "", "only messages with this result, success or failure")
+	c.flag.IntVar(&limit, "limit", 100, "maximum number of messages to list, 0 for all")
+	if len(c.Parse()) != 0 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	ctl := xctl()
+	ctl.xwrite("queuehistory")
+	ctl.xwrite(account)
+	ctl.xwrite(from)
+	ctl.xwrite(to)
+	ctl.xwrite(result)
+	ctl.xwrite(fmt.Sprintf("%d", limit))
+	ctl.xreadok()
+	if _, err := io.Copy(os.Stdout, ctl.reader()); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
 func cmdDKIMGenrsa(c *cmd) {
 	c.params = ">$selector._domainkey.$domain.rsakey.pkcs8.pem"
 	c.help = `Generate a new 2048 bit RSA private key for use with DKIM.
@@ -1755,6 +2264,165 @@ should be used, and how long the policy can be cached.
 	}
 }
 
+func cmdCompress(c *cmd) {
+	c.params = "[account]"
+	c.help = `Compress existing message files of an account, or all accounts.
+
+Message files are compressed one at a time while mox is running, and the
+account remains usable. Message files that are already compressed, or that
+don't become smaller when compressed, are left as is. Compressed message files
+are decompressed transparently when read.
+
+To compress newly delivered messages, set CompressMessages for the account in
+the configuration file.
+`
+	args := c.Parse()
+	if len(args) > 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("compress")
+	if len(args) == 1 {
+		ctl.xwrite(args[0])
+	} else {
+		ctl.xwrite("")
+	}
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdEncrypt(c *cmd) {
+	c.params = "[-password] account"
+	c.help = `Encrypt existing message files of an account.
+
+Encryption at rest must be enabled for the account with EncryptMessages in the
+configuration file. The key pair for the account is created when the password
+is set, at the first login with the password after enabling encryption, or by
+this command with -password, which reads the current account password from
+stdin. Until the key pair exists, incoming messages for the account are refused
+with a temporary error instead of being stored unencrypted.
+
+Message files are encrypted with the public key of the account, one at a time
+while mox is running. The received headers and parsed message structure of the
+messages in the account database are encrypted along with the message files.
+The account does not have to be unlocked. Messages that are already encrypted
+are left as is.
+`
+	var password bool
+	c.flag.BoolVar(&password, "password", false, "read account password from stdin, to create the key pair if needed")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	var pw string
+	if password {
+		fmt.Printf("account password: ")
+		buf := make([]byte, 64)
+		n, err := os.Stdin.Read(buf)
+		xcheckf(err, "reading stdin")
+		pw = strings.TrimSuffix(strings.TrimSuffix(string(buf[:n]), "\r\n"), "\n")
+	}
+	ctl := xctl()
+	ctl.xwrite("encrypt")
+	ctl.xwrite(args[0])
+	ctl.xwrite(pw)
+	ctl.xreadok()
+	fmt.Printf("%s messages encrypted\n", ctl.xread())
+}
+
+func cmdAccountCheck(c *cmd) {
+	c.params = "[-repair] account"
+	c.help = `Check the consistency of an account while mox is running, and optionally repair.
+
+The checks:
+- Each message in the database has a message file with the size of the message.
+- Message UIDs are unique within a mailbox, and below the UIDNEXT of the mailbox.
+- The parsed form of each message stored in the database can be decoded.
+- Junk filter training of each message matches its junk/nonjunk flags.
+- Each file in the message directory belongs to a message in the database.
+
+With -repair, problems are fixed where possible: messages are parsed again and
+(re)trained, UIDs in a mailbox with bad UIDs are reassigned and the mailbox gets
+a new UIDVALIDITY (causing IMAP clients to resynchronize), and message files not
+belonging to a message are delivered to the "lost+found" mailbox. Missing message
+files cannot be repaired.
+
+The account is locked for the duration of the check, so deliveries and IMAP
+sessions for the account wait. Also see "mox verifydata", for checking a backup.
+`
+	var repair bool
+	c.flag.BoolVar(&repair, "repair", false, "repair problems")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("accountcheck")
+	ctl.xwrite(args[0])
+	if repair {
+		ctl.xwrite("repair")
+	} else {
+		ctl.xwrite("")
+	}
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
+func cmdAccountMoveMailbox(c *cmd) {
+	c.params = "account mailbox destaccount"
+	c.help = `Move a mailbox and its child mailboxes, with their messages, to another account.
+
+Messages are moved to mailboxes with the same names in the destination account,
+which are created if needed. The mailboxes are removed from the source account,
+except the Inbox, which is only emptied. Both accounts remain usable, but are
+locked while moving. Junk filters of both accounts are updated.
+`
+	args := c.Parse()
+	if len(args) != 3 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("accountmovemailbox")
+	for _, s := range args {
+		ctl.xwrite(s)
+	}
+	ctl.xreadok()
+	fmt.Printf("%s messages moved\n", ctl.xread())
+}
+
+func cmdDedup(c *cmd) {
+	c.help = `Store message files with identical contents only once.
+
+Message files of all accounts are compared, and duplicates are replaced with a
+hardlink to a single file. Removing a message, e.g. on expunge, only frees the
+disk space when no other message references the file. Mox already stores an
+incoming message delivered to multiple local recipients once. This command is
+useful after importing the same messages into multiple accounts.
+
+Files are compared while mox is running, and the accounts remain usable.
+Encrypted message files are never identical between accounts, and are not
+shared. Backups made with "mox backup" keep the sharing.
+`
+	args := c.Parse()
+	if len(args) != 0 {
+		c.Usage()
+	}
+
+	mustLoadConfig()
+	ctl := xctl()
+	ctl.xwrite("dedup")
+	ctl.xreadok()
+	ctl.xstreamto(os.Stdout)
+}
+
 func cmdRetrain(c *cmd) {
 	c.params = "accountname"
 	c.help = `Recreate and retrain the junk filter for the account.
@@ -1958,9 +2626,8 @@ func cmdEnsureParsed(c *cmd) {
 			if err != nil {
 				log.Printf("parsing message %d: %v (continuing)", m.ID, err)
 			}
-			m.ParsedBuf, err = json.Marshal(p)
-			if err != nil {
-				return fmt.Errorf("marshal parsed message: %v", err)
+			if err := a.SetParsed(tx, &m, p); err != nil {
+				return err
 			}
 			if err := tx.Update(&m); err != nil {
 				return fmt.Errorf("update message: %v", err)
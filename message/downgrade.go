@@ -0,0 +1,313 @@
+package message
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
+)
+
+// ErrDowngradeLocalpart is returned by Downgrade for a message with an address
+// with a non-ASCII localpart in its header, which cannot be represented without
+// SMTPUTF8.
+var ErrDowngradeLocalpart = errors.New("address with non-ascii localpart cannot be downgraded")
+
+// ErrDowngradeAddress is returned by Downgrade for a message with an address
+// header field with non-ASCII text that cannot be parsed. Encoding the field as
+// unstructured text would make the addresses unusable.
+var ErrDowngradeAddress = errors.New("malformed address header with non-ascii text cannot be downgraded")
+
+// Downgrade writes the message in r to w with all 8-bit data converted to 7-bit,
+// for delivery to an SMTP server that does not implement 8BITMIME and/or
+// SMTPUTF8. ../rfc/6152:100 ../rfc/6531:555
+//
+// Leaf parts with 8-bit data in their body are encoded with quoted-printable for
+// text, and base64 otherwise. Embedded messages are downgraded recursively. Header
+// fields with non-ASCII text are rewritten: Domains in address fields are
+// converted to their ASCII (IDNA) form, display names and unstructured text are
+// encoded as MIME encoded-words (RFC 2047), and parameters of Content-Type and
+// Content-Disposition are encoded as in RFC 2231. Addresses with a non-ASCII
+// localpart cannot be downgraded, ErrDowngradeLocalpart is returned for them.
+// ErrDowngradeAddress is returned for address fields that cannot be parsed.
+func Downgrade(w io.Writer, r io.ReaderAt, size int64) error {
+	// A parse error still results in a usable part, with the body as single
+	// non-text part.
+	p, _ := EnsurePart(r, size)
+	bw := bufio.NewWriter(w)
+	if err := downgradePart(bw, &p, true); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func downgradePart(w io.Writer, p *Part, top bool) error {
+	copyRaw := func(start, end int64) error {
+		_, err := io.Copy(w, io.NewSectionReader(p.r, start, end-start))
+		return err
+	}
+
+	cte := strings.ToUpper(strings.TrimSpace(p.ContentTransferEncoding))
+	identity := cte == "" || cte == "7BIT" || cte == "8BIT" || cte == "BINARY"
+
+	// Determine how the body needs to change, and the new content-transfer-encoding.
+	var newCTE string
+	var embedded, reencode bool
+	if identity && len(p.Parts) > 0 {
+		if cte == "8BIT" || cte == "BINARY" {
+			newCTE = "7bit"
+		}
+	} else if identity && p.Message != nil && p.MediaType == "MESSAGE" && p.MediaSubType == "RFC822" {
+		// Encoding other than 7bit/8bit/binary is not allowed for message/rfc822. ../rfc/2046:1305
+		embedded = true
+		if cte == "8BIT" || cte == "BINARY" {
+			newCTE = "7bit"
+		}
+	} else if identity {
+		has8bit, err := reader8bit(p.RawReader())
+		if err != nil {
+			return fmt.Errorf("reading body: %w", err)
+		}
+		if has8bit {
+			reencode = true
+			if p.MediaType == "TEXT" || p.MediaType == "" {
+				newCTE = "quoted-printable"
+			} else {
+				newCTE = "base64"
+			}
+		}
+	}
+
+	if err := downgradeHeader(w, io.NewSectionReader(p.r, p.HeaderOffset, p.BodyOffset-p.HeaderOffset), newCTE); err != nil {
+		return err
+	}
+
+	switch {
+	case len(p.Parts) > 0:
+		// Boundaries, preamble and epilogue are copied as is.
+		offset := p.BodyOffset
+		for i := range p.Parts {
+			pp := &p.Parts[i]
+			if err := copyRaw(offset, pp.HeaderOffset); err != nil {
+				return err
+			}
+			if err := downgradePart(w, pp, false); err != nil {
+				return err
+			}
+			offset = pp.EndOffset
+		}
+		return copyRaw(offset, p.EndOffset)
+
+	case embedded:
+		return downgradePart(w, p.Message, false)
+
+	case reencode && newCTE == "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := io.Copy(qw, p.RawReader()); err != nil {
+			return err
+		}
+		return qw.Close()
+
+	case reencode:
+		lw := &lineWrapper{w: w}
+		bw := base64.NewEncoder(base64.StdEncoding, lw)
+		if _, err := io.Copy(bw, p.RawReader()); err != nil {
+			return err
+		}
+		if err := bw.Close(); err != nil {
+			return err
+		}
+		if top {
+			// Subparts end before the CRLF leading to the boundary, the message must end
+			// with a CRLF.
+			_, err := w.Write([]byte("\r\n"))
+			return err
+		}
+		return nil
+
+	default:
+		return copyRaw(p.BodyOffset, p.EndOffset)
+	}
+}
+
+// downgradeHeader writes the header section in r to w, rewriting fields with
+// non-ASCII text. If newCTE is set, the Content-Transfer-Encoding field is
+// replaced.
+func downgradeHeader(w io.Writer, r io.Reader, newCTE string) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	// Split into fields, each with its continuation lines. The section ends with an
+	// empty line.
+	var fields []string
+	var end string
+	for len(buf) > 0 {
+		n := strings.IndexByte(string(buf), '\n') + 1
+		if n == 0 {
+			n = len(buf)
+		}
+		line := string(buf[:n])
+		buf = buf[n:]
+		if line == "\r\n" || line == "\n" {
+			end = line + string(buf)
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+
+	for _, f := range fields {
+		name, value, hasColon := strings.Cut(f, ":")
+		name = strings.TrimSpace(name)
+		if newCTE != "" && strings.EqualFold(name, "Content-Transfer-Encoding") {
+			continue
+		}
+		if !hasColon || !has8bit(f) {
+			if _, err := io.WriteString(w, f); err != nil {
+				return err
+			}
+			continue
+		}
+		value = strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+		s, err := downgradeField(name, value)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+	}
+	if newCTE != "" {
+		if _, err := fmt.Fprintf(w, "Content-Transfer-Encoding: %s\r\n", newCTE); err != nil {
+			return err
+		}
+	}
+	if end == "" {
+		end = "\r\n"
+	}
+	_, err = io.WriteString(w, end)
+	return err
+}
+
+// downgradeField returns the header field with value in ASCII, folded and ending
+// with CRLF.
+func downgradeField(name, value string) (string, error) {
+	var hw HeaderWriter
+	hw.Add("", name+":")
+
+	switch strings.ToLower(name) {
+	case "from", "sender", "reply-to", "to", "cc", "bcc", "resent-from", "resent-sender", "resent-to", "resent-cc", "resent-bcc":
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %v", ErrDowngradeAddress, name, err)
+		}
+		var l []string
+		for _, a := range addrs {
+			i := strings.LastIndexByte(a.Address, '@')
+			if i < 0 {
+				return "", fmt.Errorf("%w: %q", ErrDowngradeLocalpart, a.Address)
+			}
+			localpart, domain := a.Address[:i], a.Address[i+1:]
+			if has8bit(localpart) {
+				return "", fmt.Errorf("%w: %q", ErrDowngradeLocalpart, a.Address)
+			}
+			if has8bit(domain) {
+				d, err := dns.ParseDomain(domain)
+				if err != nil {
+					return "", fmt.Errorf("parsing domain of address %q: %v", a.Address, err)
+				}
+				domain = d.ASCII
+			}
+			a.Address = localpart + "@" + domain
+			l = append(l, a.String())
+		}
+		for i := range l[:len(l)-1] {
+			l[i] += ","
+		}
+		hw.Add(" ", l...)
+		return hw.String(), nil
+
+	case "content-type", "content-disposition":
+		mt, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			break
+		}
+		if s := mime.FormatMediaType(mt, params); s != "" && !has8bit(s) {
+			hw.Add(" ", strings.Split(s, " ")...)
+			return hw.String(), nil
+		}
+	}
+
+	// Treat as unstructured text. The encoder splits the value into multiple words if
+	// needed.
+	hw.Add(" ", strings.Split(mime.QEncoding.Encode("utf-8", value), " ")...)
+	return hw.String(), nil
+}
+
+func has8bit(s string) bool {
+	for _, c := range []byte(s) {
+		if c&0x80 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func reader8bit(r io.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if c&0x80 != 0 {
+				return true, nil
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// lineWrapper writes CRLF-separated lines of at most 76 characters, as required
+// for base64 content. ../rfc/2045:1395
+type lineWrapper struct {
+	w io.Writer
+	n int // Bytes written on current line.
+}
+
+func (lw *lineWrapper) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		if lw.n == 76 {
+			if _, err := lw.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			lw.n = 0
+		}
+		n := 76 - lw.n
+		if n > len(buf) {
+			n = len(buf)
+		}
+		nn, err := lw.w.Write(buf[:n])
+		written += nn
+		lw.n += nn
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestDowngrade(t *testing.T) {
+	check := func(msg string, expErr error) string {
+		t.Helper()
+		msg = strings.ReplaceAll(msg, "\n", "\r\n")
+		var b bytes.Buffer
+		err := Downgrade(&b, strings.NewReader(msg), int64(len(msg)))
+		if expErr != nil {
+			if err == nil || !errors.Is(err, expErr) {
+				t.Fatalf("got err %v, expected %v", err, expErr)
+			}
+			return ""
+		}
+		tcheck(t, err, "downgrade")
+		for i, c := range b.Bytes() {
+			if c&0x80 != 0 {
+				t.Fatalf("8bit data at offset %d in downgraded message:\n%s", i, b.String())
+			}
+		}
+		return b.String()
+	}
+
+	// Messages without 8bit data are not changed.
+	const plain = "From: <mjl@mox.example>\nSubject: test\n\ntest\n"
+	tcompare(t, check(plain, nil), strings.ReplaceAll(plain, "\n", "\r\n"))
+
+	const msg = `From: Mjél <mjl@møx.example>
+To: <remote@example.org>, "Other" <other@example.org>
+Subject: héllo
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary=x
+
+--x
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: 8bit
+
+héllo wörld
+--x
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename="résumé.bin"
+
+ÿÿÿ
+--x--
+`
+	s := check(msg, nil)
+	p, err := Parse(strings.NewReader(s))
+	tcheck(t, err, "parse downgraded message")
+	err = p.Walk(nil)
+	tcheck(t, err, "walk downgraded message")
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(p.Envelope.Subject)
+	tcheck(t, err, "decode subject")
+	tcompare(t, subject, "héllo")
+	tcompare(t, len(p.Envelope.From), 1)
+	from := p.Envelope.From[0]
+	name, err := dec.DecodeHeader(from.Name)
+	tcheck(t, err, "decode from name")
+	tcompare(t, []string{name, from.User, from.Host}, []string{"Mjél", "mjl", "xn--mx-lka.example"})
+	tcompare(t, len(p.Envelope.To), 2)
+	tcompare(t, len(p.Parts), 2)
+	tcompare(t, p.Parts[0].ContentTransferEncoding, "QUOTED-PRINTABLE")
+	buf, err := io.ReadAll(p.Parts[0].Reader())
+	tcheck(t, err, "read text part")
+	tcompare(t, string(buf), "héllo wörld")
+	tcompare(t, p.Parts[1].ContentTransferEncoding, "BASE64")
+	buf, err = io.ReadAll(p.Parts[1].Reader())
+	tcheck(t, err, "read attachment")
+	tcompare(t, string(buf), "ÿÿÿ")
+	h, err := p.Parts[1].Header()
+	tcheck(t, err, "parse attachment header")
+	if cd := h.Get("Content-Disposition"); !strings.Contains(cd, "filename*=utf-8''r%C3%A9sum%C3%A9.bin") {
+		t.Fatalf("unexpected content-disposition %q", cd)
+	}
+
+	// Single part non-text message.
+	s = check("Content-Type: image/png\n\n\x89PNG\n", nil)
+	if !strings.HasSuffix(s, "Content-Transfer-Encoding: base64\r\n\r\niVBORw0K\r\n") {
+		t.Fatalf("unexpected downgraded message %q", s)
+	}
+
+	// Non-ASCII localparts cannot be downgraded.
+	check("From: <møx@mox.example>\n\ntest\n", ErrDowngradeLocalpart)
+	check("To: Mjél <mjl@mox.example\n\ntest\n", ErrDowngradeAddress)
+}
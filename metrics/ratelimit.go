@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricConnectionRatelimited = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_connection_ratelimited_total",
+		Help: "Incoming connections refused due to rate limiting. Refusals due to authentication failures are counted in mox_authentication_ratelimited_total.",
+	},
+	[]string{
+		"kind",  // smtp, submission, imap
+		"limit", // connectionrate, connections
+	},
+)
+
+func ConnectionRatelimitedInc(kind, limit string) {
+	metricConnectionRatelimited.WithLabelValues(kind, limit).Inc()
+}
@@ -642,6 +642,67 @@ func AccountRemove(ctx context.Context, account string) (rerr error) {
 	return nil
 }
 
+// AccountRename changes the name of an account in the configuration, including
+// the references to the account for DMARC and TLS reports of domains, and reloads
+// the configuration. The data directory of the account is not renamed, see
+// store.RenameAccount.
+func AccountRename(ctx context.Context, account, newName string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("renaming account", rerr, mlog.Field("account", account), mlog.Field("newname", newName))
+		}
+	}()
+
+	if newName == "" || strings.ContainsAny(newName, "/\\") || newName == "." || newName == ".." {
+		return fmt.Errorf("invalid account name")
+	}
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	a, ok := c.Accounts[account]
+	if !ok {
+		return fmt.Errorf("account does not exist")
+	} else if _, ok := c.Accounts[newName]; ok {
+		return fmt.Errorf("account %q already exists", newName)
+	} else if Conf.Static.Postmaster.Account == account {
+		return fmt.Errorf("account is the postmaster account in the static config file mox.conf, cannot be renamed while mox is running")
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	nc := c
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range c.Accounts {
+		if name != account {
+			nc.Accounts[name] = a
+		}
+	}
+	nc.Accounts[newName] = a
+	nc.Domains = map[string]config.Domain{}
+	for name, d := range c.Domains {
+		if d.DMARC != nil && d.DMARC.Account == account {
+			dmarc := *d.DMARC
+			dmarc.Account = newName
+			d.DMARC = &dmarc
+		}
+		if d.TLSRPT != nil && d.TLSRPT.Account == account {
+			tlsrpt := *d.TLSRPT
+			tlsrpt.Account = newName
+			d.TLSRPT = &tlsrpt
+		}
+		nc.Domains[name] = d
+	}
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("account renamed", mlog.Field("account", account), mlog.Field("newname", newName))
+	return nil
+}
+
 // checkAddressAvailable checks that the address after canonicalization is not
 // already configured, and that its localpart does not contain the catchall
 // localpart separator.
@@ -654,6 +715,8 @@ func checkAddressAvailable(addr smtp.Address) error {
 		return fmt.Errorf("canonicalizing localpart: %v", err)
 	} else if _, ok := Conf.accountDestinations[smtp.NewAddress(lp, addr.Domain).String()]; ok {
 		return fmt.Errorf("canonicalized address %s already configured", smtp.NewAddress(lp, addr.Domain))
+	} else if _, ok := dc.Aliases[string(lp)]; ok {
+		return fmt.Errorf("canonicalized address %s already configured as alias", smtp.NewAddress(lp, addr.Domain))
 	} else if dc.LocalpartCatchallSeparator != "" && strings.Contains(string(addr.Localpart), dc.LocalpartCatchallSeparator) {
 		return fmt.Errorf("localpart cannot include domain catchall separator %s", dc.LocalpartCatchallSeparator)
 	}
@@ -776,6 +839,270 @@ func AddressRemove(ctx context.Context, address string) (rerr error) {
 	return nil
 }
 
+// AddressMove moves an email address, including its delivery rules, to another
+// account and reloads the configuration. Existing messages are not moved, see
+// store.MoveAddressMessages. Returns the name of the account the address was moved
+// from.
+func AddressMove(ctx context.Context, address, account string) (oldAccount string, rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("moving address", rerr, mlog.Field("address", address), mlog.Field("account", account))
+		}
+	}()
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	ad, ok := Conf.accountDestinations[address]
+	if !ok {
+		return "", fmt.Errorf("address does not exists")
+	}
+	if ad.Account == account {
+		return "", fmt.Errorf("address already belongs to account")
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	from, ok := Conf.Dynamic.Accounts[ad.Account]
+	if !ok {
+		return "", fmt.Errorf("internal error: cannot find account")
+	}
+	to, ok := Conf.Dynamic.Accounts[account]
+	if !ok {
+		return "", fmt.Errorf("account does not exist")
+	}
+	dest, ok := from.Destinations[address]
+	if !ok {
+		return "", fmt.Errorf("address not moved, likely a postmaster/reporting address")
+	} else if len(from.Destinations) == 1 {
+		return "", fmt.Errorf("cannot move the last address of an account")
+	}
+	nfrom := from
+	nfrom.Destinations = map[string]config.Destination{}
+	for destAddr, d := range from.Destinations {
+		if destAddr != address {
+			nfrom.Destinations[destAddr] = d
+		}
+	}
+	nto := to
+	nto.Destinations = map[string]config.Destination{}
+	for destAddr, d := range to.Destinations {
+		nto.Destinations[destAddr] = d
+	}
+	nto.Destinations[address] = dest
+	nc := Conf.Dynamic
+	nc.Accounts = map[string]config.Account{}
+	for name, a := range Conf.Dynamic.Accounts {
+		nc.Accounts[name] = a
+	}
+	nc.Accounts[ad.Account] = nfrom
+	nc.Accounts[account] = nto
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return "", fmt.Errorf("writing domains.conf: %v", err)
+	}
+	log.Info("address moved", mlog.Field("address", address), mlog.Field("from", ad.Account), mlog.Field("account", account))
+	return ad.Account, nil
+}
+
+// aliasModify calls fn with a copy of the aliases of the domain of address, and
+// the canonical localpart of address, for modification. If fn does not return an
+// error, the modified aliases are written and the configuration reloaded.
+func aliasModify(ctx context.Context, log *mlog.Log, address string, fn func(aliases map[string]config.Alias, lp string) error) error {
+	addr, err := smtp.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("parsing alias address: %v", err)
+	}
+
+	Conf.dynamicMutex.Lock()
+	defer Conf.dynamicMutex.Unlock()
+
+	c := Conf.Dynamic
+	dc, ok := c.Domains[addr.Domain.Name()]
+	if !ok {
+		return fmt.Errorf("domain does not exist")
+	}
+	lp, err := CanonicalLocalpart(addr.Localpart, dc)
+	if err != nil {
+		return fmt.Errorf("canonicalizing localpart: %v", err)
+	}
+
+	// Compose new config without modifying existing data structures. If we fail, we
+	// leave no trace.
+	na := map[string]config.Alias{}
+	for k, a := range dc.Aliases {
+		na[k] = a
+	}
+	if err := fn(na, string(lp)); err != nil {
+		return err
+	}
+	dc.Aliases = na
+	nc := c
+	nc.Domains = map[string]config.Domain{}
+	for name, d := range c.Domains {
+		nc.Domains[name] = d
+	}
+	nc.Domains[addr.Domain.Name()] = dc
+
+	if err := writeDynamic(ctx, log, nc); err != nil {
+		return fmt.Errorf("writing domains.conf: %v", err)
+	}
+	return nil
+}
+
+// AliasAdd adds an alias and reloads the configuration.
+func AliasAdd(ctx context.Context, address string, alias config.Alias) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("adding alias", rerr, mlog.Field("address", address))
+		}
+	}()
+
+	addr, err := smtp.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("parsing alias address: %v", err)
+	}
+
+	err = aliasModify(ctx, log, address, func(aliases map[string]config.Alias, lp string) error {
+		// Checked while holding the lock of aliasModify, so an account address cannot be
+		// added for the same address in the mean time.
+		if err := checkAddressAvailable(addr); err != nil {
+			return fmt.Errorf("address not available: %v", err)
+		}
+		aliases[lp] = config.Alias{
+			Addresses:       append([]string{}, alias.Addresses...),
+			PostPolicy:      alias.PostPolicy,
+			ListHeaders:     alias.ListHeaders,
+			ListUnsubscribe: alias.ListUnsubscribe,
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("alias added", mlog.Field("address", address))
+	return nil
+}
+
+// AliasUpdate updates the settings of an alias, but not its addresses, and
+// reloads the configuration.
+func AliasUpdate(ctx context.Context, address, postPolicy string, listHeaders bool, listUnsubscribe string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("updating alias", rerr, mlog.Field("address", address))
+		}
+	}()
+
+	err := aliasModify(ctx, log, address, func(aliases map[string]config.Alias, lp string) error {
+		a, ok := aliases[lp]
+		if !ok {
+			return fmt.Errorf("alias does not exist")
+		}
+		a.PostPolicy = postPolicy
+		a.ListHeaders = listHeaders
+		a.ListUnsubscribe = listUnsubscribe
+		aliases[lp] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("alias updated", mlog.Field("address", address))
+	return nil
+}
+
+// AliasRemove removes an alias and reloads the configuration.
+func AliasRemove(ctx context.Context, address string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("removing alias", rerr, mlog.Field("address", address))
+		}
+	}()
+
+	err := aliasModify(ctx, log, address, func(aliases map[string]config.Alias, lp string) error {
+		if _, ok := aliases[lp]; !ok {
+			return fmt.Errorf("alias does not exist")
+		}
+		delete(aliases, lp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("alias removed", mlog.Field("address", address))
+	return nil
+}
+
+// AliasAddressesAdd adds addresses to an alias and reloads the configuration.
+func AliasAddressesAdd(ctx context.Context, address string, addresses []string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("adding addresses to alias", rerr, mlog.Field("address", address), mlog.Field("addresses", addresses))
+		}
+	}()
+
+	err := aliasModify(ctx, log, address, func(aliases map[string]config.Alias, lp string) error {
+		a, ok := aliases[lp]
+		if !ok {
+			return fmt.Errorf("alias does not exist")
+		}
+		a.Addresses = append(append([]string{}, a.Addresses...), addresses...)
+		aliases[lp] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("addresses added to alias", mlog.Field("address", address), mlog.Field("addresses", addresses))
+	return nil
+}
+
+// AliasAddressesRemove removes addresses from an alias and reloads the
+// configuration. An alias must keep at least one address.
+func AliasAddressesRemove(ctx context.Context, address string, addresses []string) (rerr error) {
+	log := xlog.WithContext(ctx)
+	defer func() {
+		if rerr != nil {
+			log.Errorx("removing addresses from alias", rerr, mlog.Field("address", address), mlog.Field("addresses", addresses))
+		}
+	}()
+
+	err := aliasModify(ctx, log, address, func(aliases map[string]config.Alias, lp string) error {
+		a, ok := aliases[lp]
+		if !ok {
+			return fmt.Errorf("alias does not exist")
+		}
+		remove := map[string]bool{}
+		for _, s := range addresses {
+			remove[strings.ToLower(s)] = true
+		}
+		var l []string
+		for _, s := range a.Addresses {
+			if remove[strings.ToLower(s)] {
+				delete(remove, strings.ToLower(s))
+			} else {
+				l = append(l, s)
+			}
+		}
+		if len(remove) > 0 {
+			return fmt.Errorf("address(es) not in alias")
+		}
+		a.Addresses = l
+		aliases[lp] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("addresses removed from alias", mlog.Field("address", address), mlog.Field("addresses", addresses))
+	return nil
+}
+
 // DestinationSave updates a destination for an account and reloads the configuration.
 func DestinationSave(ctx context.Context, account, destName string, newDest config.Destination) (rerr error) {
 	log := xlog.WithContext(ctx)
@@ -616,6 +616,47 @@ func PrepareStaticConfig(ctx context.Context, configFile string, config *Config,
 			}
 			l.SMTP.DNSBLZones = append(l.SMTP.DNSBLZones, d)
 		}
+		checkLimits := func(kind string, limitErrs []error) {
+			for _, err := range limitErrs {
+				addErrorf("listener %q: %s limits: %v", name, kind, err)
+			}
+		}
+		checkLimits("SMTP", prepareLimits(l.SMTP.Limits))
+		checkLimits("Submission", prepareLimits(l.Submission.Limits))
+		checkLimits("IMAP", prepareLimits(l.IMAP.Limits))
+		if l.LMTP.Enabled && l.LMTP.UnixSocket == "" && len(l.LMTP.TrustedIPs) == 0 {
+			addErrorf("listener %q: LMTP on a TCP port requires at least one trusted IP", name)
+		}
+		l.LMTP.TrustedNets = nil
+		for _, s := range l.LMTP.TrustedIPs {
+			ipnet, err := parseIPNet(s)
+			if err != nil {
+				addErrorf("listener %q: LMTP trusted IPs: %v", name, err)
+				continue
+			}
+			l.LMTP.TrustedNets = append(l.LMTP.TrustedNets, ipnet)
+		}
+		if l.ProxyProtocol != nil {
+			if len(l.ProxyProtocol.TrustedIPs) == 0 {
+				addErrorf("listener %q: ProxyProtocol requires at least one trusted IP", name)
+			}
+			l.ProxyProtocol.TrustedNets = nil
+			for _, s := range l.ProxyProtocol.TrustedIPs {
+				ipnet, err := parseIPNet(s)
+				if err != nil {
+					addErrorf("listener %q: ProxyProtocol trusted IPs: %v", name, err)
+					continue
+				}
+				l.ProxyProtocol.TrustedNets = append(l.ProxyProtocol.TrustedNets, ipnet)
+			}
+			for _, s := range l.ProxyProtocol.Services {
+				switch s {
+				case "smtp", "submission", "submissions", "lmtp", "imap", "imaps", "http", "https":
+				default:
+					addErrorf("listener %q: ProxyProtocol has unknown service %q", name, s)
+				}
+			}
+		}
 		checkPath := func(kind string, enabled bool, path string) {
 			if enabled && path != "" && !strings.HasPrefix(path, "/") {
 				addErrorf("listener %q has %s with path %q that must start with a slash", name, kind, path)
@@ -635,6 +676,14 @@ func PrepareStaticConfig(ctx context.Context, configFile string, config *Config,
 		checkMailboxNormf(mb, "default mailbox")
 	}
 
+	prepareQueueConfig(&c.Queue, addErrorf)
+
+	for _, port := range c.IMAPImport.AllowPorts {
+		if port <= 0 || port > 65535 {
+			addErrorf("imap import: invalid port %d", port)
+		}
+	}
+
 	// Load CA certificate pool.
 	if c.TLS.CA != nil {
 		if c.TLS.CA.AdditionalToSystem {
@@ -661,6 +710,62 @@ func PrepareStaticConfig(ctx context.Context, configFile string, config *Config,
 	return
 }
 
+// prepareQueueConfig checks the queue retry settings and limits, and parses the
+// domains of per-domain policies and limits.
+func prepareQueueConfig(q *config.Queue, addErrorf func(format string, args ...any)) {
+	checkQueuePolicy := func(what string, schedule []time.Duration, maxLifetime, delayDSNAfter time.Duration) {
+		for _, d := range schedule {
+			if d <= 0 {
+				addErrorf("%s: RetrySchedule intervals must be positive, got %v", what, d)
+			}
+		}
+		if maxLifetime < 0 {
+			addErrorf("%s: MaxLifetime cannot be negative", what)
+		}
+		if delayDSNAfter < 0 {
+			addErrorf("%s: DelayDSNAfter cannot be negative", what)
+		}
+	}
+	checkQueuePolicy("queue", q.RetrySchedule, q.MaxLifetime, q.DelayDSNAfter)
+	q.DomainPoliciesParsed = map[dns.Domain]config.QueuePolicy{}
+	for name, p := range q.DomainPolicies {
+		d, err := dns.ParseDomain(name)
+		if err != nil {
+			addErrorf("queue: parsing domain %q in DomainPolicies: %v", name, err)
+			continue
+		}
+		if _, ok := q.DomainPoliciesParsed[d]; ok {
+			addErrorf("queue: duplicate domain %q in DomainPolicies", name)
+			continue
+		}
+		checkQueuePolicy(fmt.Sprintf("queue domain policy %q", name), p.RetrySchedule, p.MaxLifetime, p.DelayDSNAfter)
+		q.DomainPoliciesParsed[d] = p
+	}
+
+	if q.DefaultConcurrency < 0 {
+		addErrorf("queue: DefaultConcurrency cannot be negative")
+	}
+	if q.ThrottleBackoff < 0 {
+		addErrorf("queue: ThrottleBackoff cannot be negative")
+	}
+	q.DestinationLimitsParsed = map[string]config.QueueLimits{}
+	for name, l := range q.DestinationLimits {
+		d, err := dns.ParseDomain(name)
+		if err != nil {
+			addErrorf("queue: parsing domain %q in DestinationLimits: %v", name, err)
+			continue
+		}
+		if _, ok := q.DestinationLimitsParsed[d.Name()]; ok {
+			addErrorf("queue: duplicate domain %q in DestinationLimits", name)
+			continue
+		}
+		if l.Concurrency < 0 || l.MessagesPerMinute < 0 {
+			addErrorf("queue: destination limits for %q cannot be negative", name)
+		}
+		q.DestinationLimitsParsed[d.Name()] = l
+	}
+}
+
 // PrepareDynamicConfig parses the dynamic config file given a static file.
 func ParseDynamicConfig(ctx context.Context, dynamicPath string, static config.Static) (c config.Dynamic, mtime time.Time, accDests map[string]AccountDestination, errs []error) {
 	addErrorf := func(format string, args ...any) {
@@ -686,6 +791,34 @@ func ParseDynamicConfig(ctx context.Context, dynamicPath string, static config.S
 	return c, fi.ModTime(), accDests, errs
 }
 
+// prepareOutgoingIdentity parses the IPs and hostname of ident.
+func prepareOutgoingIdentity(ident *config.OutgoingIdentity) error {
+	if len(ident.IPs) == 0 {
+		return fmt.Errorf("must have at least one IP")
+	}
+	ident.ParsedIPs = nil
+	for _, s := range ident.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP %q", s)
+		} else if ip.IsUnspecified() {
+			return fmt.Errorf("IP %q must be a specific IP", s)
+		}
+		ident.ParsedIPs = append(ident.ParsedIPs, ip)
+	}
+	ident.HostnameDomain = dns.Domain{}
+	if ident.Hostname != "" {
+		d, err := dns.ParseDomain(ident.Hostname)
+		if err != nil {
+			return fmt.Errorf("parsing hostname: %v", err)
+		} else if d.Name() != ident.Hostname {
+			return fmt.Errorf("hostname %q must be specified in IDNA form, %q", ident.Hostname, d.Name())
+		}
+		ident.HostnameDomain = d
+	}
+	return nil
+}
+
 func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config.Static, c *config.Dynamic) (accDests map[string]AccountDestination, errs []error) {
 	log := xlog.WithContext(ctx)
 
@@ -729,6 +862,12 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 
 		domain.Domain = dnsdomain
 
+		if domain.OutgoingIdentity != nil {
+			if err := prepareOutgoingIdentity(domain.OutgoingIdentity); err != nil {
+				addErrorf("domain %s: OutgoingIdentity: %v", d, err)
+			}
+		}
+
 		for _, sign := range domain.DKIM.Sign {
 			if _, ok := domain.DKIM.Selectors[sign]; !ok {
 				addErrorf("selector %s for signing is missing in domain %s", sign, d)
@@ -853,6 +992,28 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 		}
 		checkMailboxNormf(acc.RejectsMailbox, "account %q", accName)
 
+		for mbName, r := range acc.MailboxRetention {
+			checkMailboxNormf(mbName, "account %q mailbox retention", accName)
+			if r.Age < 0 {
+				addErrorf("account %q: mailbox retention for %q: age must not be negative", accName, mbName)
+			}
+			switch r.Since {
+			case "", "received", "moved":
+			default:
+				addErrorf("account %q: mailbox retention for %q: unknown value %q for since, must be received or moved", accName, mbName, r.Since)
+			}
+		}
+		if r := acc.DefaultMailboxRetention; r != nil {
+			if r.Age <= 0 {
+				addErrorf("account %q: default mailbox retention: age must be positive", accName)
+			}
+			switch r.Since {
+			case "", "received", "moved":
+			default:
+				addErrorf("account %q: default mailbox retention: unknown value %q for since, must be received or moved", accName, r.Since)
+			}
+		}
+
 		if acc.AutomaticJunkFlags.JunkMailboxRegexp != "" {
 			r, err := regexp.Compile(acc.AutomaticJunkFlags.JunkMailboxRegexp)
 			if err != nil {
@@ -874,6 +1035,53 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 			}
 			acc.NotJunkMailbox = r
 		}
+
+		switch acc.SubmissionFromPolicy {
+		case "", "strict", "sender":
+		default:
+			addErrorf("account %q: unknown SubmissionFromPolicy %q, must be strict or sender", accName, acc.SubmissionFromPolicy)
+		}
+		acc.SubmissionAllowedFromCanonical = map[string]struct{}{}
+		for _, s := range acc.SubmissionAllowedFrom {
+			addr, err := smtp.ParseAddress(s)
+			if err != nil {
+				addErrorf("account %q: invalid SubmissionAllowedFrom address %q: %v", accName, s, err)
+				continue
+			}
+			dc, ok := c.Domains[addr.Domain.Name()]
+			if !ok {
+				addErrorf("account %q: SubmissionAllowedFrom address %q is not in a configured domain", accName, s)
+				continue
+			}
+			lp, err := CanonicalLocalpart(addr.Localpart, dc)
+			if err != nil {
+				addErrorf("account %q: SubmissionAllowedFrom address %q: %v", accName, s, err)
+				continue
+			}
+			acc.SubmissionAllowedFromCanonical[smtp.NewAddress(lp, addr.Domain).String()] = struct{}{}
+		}
+		if acc.OutgoingIdentity != nil {
+			if err := prepareOutgoingIdentity(acc.OutgoingIdentity); err != nil {
+				addErrorf("account %q: OutgoingIdentity: %v", accName, err)
+			}
+		}
+		if wh := acc.OutgoingWebhook; wh != nil {
+			if u, err := url.Parse(wh.URL); err != nil {
+				addErrorf("account %q: parsing OutgoingWebhook URL: %v", accName, err)
+			} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				addErrorf("account %q: OutgoingWebhook URL %q must be an absolute http or https URL", accName, wh.URL)
+			}
+			if wh.Secret == "" {
+				addErrorf("account %q: OutgoingWebhook must have a Secret", accName)
+			}
+			for _, ev := range wh.Events {
+				switch ev {
+				case "delivered", "delayed", "failed", "incomingdsn":
+				default:
+					addErrorf("account %q: unknown OutgoingWebhook event %q, must be delivered, delayed, failed or incomingdsn", accName, ev)
+				}
+			}
+		}
 		c.Accounts[accName] = acc
 
 		// todo deprecated: only localpart as keys for Destinations, we are replacing them with full addresses. if domains.conf is written, we won't have to do this again.
@@ -938,6 +1146,23 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 				}
 			}
 
+			dest.ForwardToAddresses = nil
+			for _, s := range dest.ForwardTo {
+				addr, err := smtp.ParseAddress(s)
+				if err != nil {
+					addErrorf("account %q, destination %q: invalid ForwardTo address %q: %v", accName, addrName, s, err)
+					continue
+				} else if strings.EqualFold(addr.String(), addrName) {
+					addErrorf("account %q, destination %q: cannot forward to itself", accName, addrName)
+					continue
+				}
+				dest.ForwardToAddresses = append(dest.ForwardToAddresses, addr)
+			}
+			if dest.ForwardKeepCopy && len(dest.ForwardTo) == 0 {
+				addErrorf("account %q, destination %q: ForwardKeepCopy requires ForwardTo", accName, addrName)
+			}
+			acc.Destinations[addrName] = dest
+
 			// Catchall destination for domain.
 			if strings.HasPrefix(addrName, "@") {
 				d, err := dns.ParseDomain(addrName[1:])
@@ -1065,6 +1290,59 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 		accDests[addrFull] = AccountDestination{false, lp, tlsrpt.Account, dest}
 	}
 
+	// Check aliases.
+	for d, domain := range c.Domains {
+		for lpstr, alias := range domain.Aliases {
+			lp, err := smtp.ParseLocalpart(lpstr)
+			if err != nil {
+				addErrorf("domain %s: invalid alias localpart %q: %v", d, lpstr, err)
+				continue
+			}
+			if clp, err := CanonicalLocalpart(lp, domain); err != nil || clp != lp {
+				addErrorf("domain %s: alias localpart %q must be in canonical form", d, lpstr)
+				continue
+			}
+			addr := smtp.NewAddress(lp, domain.Domain)
+			if _, ok := accDests[addr.String()]; ok {
+				addErrorf("alias %s: address is also an account destination", addr)
+			}
+			switch alias.PostPolicy {
+			case "", "members", "anyone", "authenticated":
+			default:
+				addErrorf("alias %s: unknown PostPolicy %q, must be members, anyone or authenticated", addr, alias.PostPolicy)
+			}
+			if len(alias.Addresses) == 0 {
+				addErrorf("alias %s: must have at least one address", addr)
+			}
+			alias.Address = addr
+			alias.ParsedAddresses = nil
+			seen := map[string]bool{}
+			for _, s := range alias.Addresses {
+				a, err := smtp.ParseAddress(s)
+				if err != nil {
+					addErrorf("alias %s: invalid address %q: %v", addr, s, err)
+					continue
+				}
+				k := strings.ToLower(a.String())
+				if seen[k] {
+					addErrorf("alias %s: duplicate address %s", addr, a)
+					continue
+				}
+				seen[k] = true
+				if dc, ok := c.Domains[a.Domain.Name()]; ok {
+					if clp, err := CanonicalLocalpart(a.Localpart, dc); err == nil {
+						if _, ok := dc.Aliases[string(clp)]; ok {
+							addErrorf("alias %s: address %s is an alias, nested aliases are not allowed", addr, a)
+							continue
+						}
+					}
+				}
+				alias.ParsedAddresses = append(alias.ParsedAddresses, a)
+			}
+			domain.Aliases[lpstr] = alias
+		}
+	}
+
 	// Check webserver configs.
 	if (len(c.WebDomainRedirects) > 0 || len(c.WebHandlers) > 0) && !haveWebserverListener {
 		addErrorf("WebDomainRedirects or WebHandlers configured but no listener with WebserverHTTP or WebserverHTTPS enabled")
@@ -1140,7 +1418,7 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 				case "", "/":
 					u.Path = "/"
 				default:
-					addErrorf("webredirect %s %s: BaseURL must have empty path", wh.Domain, wh.PathRegexp, wr.BaseURL)
+					addErrorf("webredirect %s %s: BaseURL %s must have empty path", wh.Domain, wh.PathRegexp, wr.BaseURL)
 				}
 				wr.URL = u
 			}
@@ -1184,6 +1462,63 @@ func prepareDynamicConfig(ctx context.Context, dynamicPath string, static config
 	return
 }
 
+// prepareLimits checks the limits and sets the parsed allowed networks.
+func prepareLimits(l *config.Limits) (errs []error) {
+	if l == nil {
+		return nil
+	}
+	addErrorf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	checkWindows := func(field string, wl []config.WindowLimit) {
+		for _, w := range wl {
+			if w.Window <= 0 {
+				addErrorf("invalid %s window %v", field, w.Window)
+			}
+			if len(w.Limits) != 3 {
+				addErrorf("%d instead of 3 values for %s", len(w.Limits), field)
+			}
+		}
+	}
+	checkWindows("ConnectionRate", l.ConnectionRate)
+	checkWindows("AuthFailures", l.AuthFailures)
+	if len(l.Connections) != 0 && len(l.Connections) != 3 {
+		addErrorf("%d instead of 3 values for Connections", len(l.Connections))
+	}
+
+	l.AllowNets = nil
+	for _, s := range l.AllowIPs {
+		ipnet, err := parseIPNet(s)
+		if err != nil {
+			addErrorf("allowed IPs: %v", err)
+			continue
+		}
+		l.AllowNets = append(l.AllowNets, ipnet)
+	}
+	return errs
+}
+
+// parseIPNet parses an IP address or network in CIDR notation. A bare IP
+// address is returned as a network with just that address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		} else if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q: %v", s, err)
+	}
+	return ipnet, nil
+}
+
 func loadTLSKeyCerts(configFile, kind string, ctls *config.TLS) error {
 	certs := []tls.Certificate{}
 	for _, kp := range ctls.KeyCerts {
@@ -16,7 +16,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/proxyproto"
 )
 
 // We start up as root, bind to sockets, open private key/cert files and fork and
@@ -176,6 +178,16 @@ func Listen(network, addr string) (net.Listener, error) {
 	return ln, err
 }
 
+// ProxyListener returns ln wrapped in a listener that requires a PROXY protocol
+// header on new connections if configured for service on listener l, and ln
+// itself otherwise.
+func ProxyListener(l config.Listener, service string, ln net.Listener) net.Listener {
+	if !l.ProxyProtocolService(service) {
+		return ln
+	}
+	return proxyproto.NewListener(ln, l.ProxyProtocol.TrustedNets)
+}
+
 // Open a privileged file, such as a TLS private key. When running as root
 // (during startup), the file is opened and the file descriptor is stored.
 // These file descriptors are passed to the unprivileged process. When in the
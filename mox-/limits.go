@@ -0,0 +1,80 @@
+package mox
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/ratelimit"
+)
+
+// Limiters holds the rate limiters for incoming connections for a service on a
+// listener.
+type Limiters struct {
+	ConnectionRate *ratelimit.Limiter
+	Connections    *ratelimit.Limiter
+	FailedAuth     *ratelimit.Limiter // Shared LimiterFailedAuth, unless configured for the service.
+	AllowNets      []*net.IPNet       // Remote IPs in these networks are not limited.
+}
+
+// NewLimiters returns limiters for a service, with limits from l if not nil, and
+// default values otherwise. Must be called after LimitersInit.
+func NewLimiters(l *config.Limits) *Limiters {
+	lim := &Limiters{
+		ConnectionRate: &ratelimit.Limiter{
+			WindowLimits: []ratelimit.WindowLimit{
+				{
+					Window: time.Minute,
+					Limits: [...]int64{300, 900, 2700},
+				},
+			},
+		},
+		Connections: &ratelimit.Limiter{
+			WindowLimits: []ratelimit.WindowLimit{
+				{
+					Window: time.Duration(math.MaxInt64), // All of time.
+					Limits: [...]int64{30, 90, 270},
+				},
+			},
+		},
+		FailedAuth: LimiterFailedAuth,
+	}
+	if l == nil {
+		return lim
+	}
+
+	if len(l.ConnectionRate) > 0 {
+		lim.ConnectionRate = &ratelimit.Limiter{WindowLimits: windowLimits(l.ConnectionRate)}
+	}
+	if len(l.Connections) == 3 {
+		lim.Connections.WindowLimits[0].Limits = [...]int64{l.Connections[0], l.Connections[1], l.Connections[2]}
+	}
+	if len(l.AuthFailures) > 0 {
+		lim.FailedAuth = &ratelimit.Limiter{WindowLimits: windowLimits(l.AuthFailures)}
+	}
+	lim.AllowNets = l.AllowNets
+	return lim
+}
+
+func windowLimits(l []config.WindowLimit) []ratelimit.WindowLimit {
+	var r []ratelimit.WindowLimit
+	for _, wl := range l {
+		r = append(r, ratelimit.WindowLimit{
+			Window: wl.Window,
+			Limits: [...]int64{wl.Limits[0], wl.Limits[1], wl.Limits[2]},
+		})
+	}
+	return r
+}
+
+// Exempt returns whether ip is in one of the allowed networks, and must not be
+// limited.
+func (l *Limiters) Exempt(ip net.IP) bool {
+	for _, n := range l.AllowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
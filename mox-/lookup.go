@@ -67,6 +67,24 @@ func FindAccount(localpart smtp.Localpart, domain dns.Domain, allowPostmaster bo
 	return accAddr.Account, canonical, accAddr.Destination, nil
 }
 
+// FindAlias returns the alias for the address, after canonicalizing the
+// localpart. Aliases take precedence over catchall destinations.
+func FindAlias(localpart smtp.Localpart, domain dns.Domain) (alias config.Alias, addr smtp.Address, ok bool) {
+	d, ok := Conf.Domain(domain)
+	if !ok || len(d.Aliases) == 0 {
+		return config.Alias{}, smtp.Address{}, false
+	}
+	localpart, err := CanonicalLocalpart(localpart, d)
+	if err != nil {
+		return config.Alias{}, smtp.Address{}, false
+	}
+	alias, ok = d.Aliases[string(localpart)]
+	if !ok {
+		return config.Alias{}, smtp.Address{}, false
+	}
+	return alias, smtp.NewAddress(localpart, domain), true
+}
+
 // CanonicalLocalpart returns the canonical localpart, removing optional catchall
 // separator, and optionally lower-casing the string.
 func CanonicalLocalpart(localpart smtp.Localpart, d config.Domain) (smtp.Localpart, error) {
@@ -83,3 +101,29 @@ func CanonicalLocalpart(localpart smtp.Localpart, d config.Domain) (smtp.Localpa
 	}
 	return localpart, nil
 }
+
+// AllowedFromAddress returns whether an account may use addr as SMTP MAIL FROM
+// and in the From and Sender headers of submitted messages. The address must be
+// a destination of the account (possibly after removing the catchall separator),
+// or be configured in the account's SubmissionAllowedFrom.
+func AllowedFromAddress(accountName string, addr smtp.Address, allowPostmaster bool) bool {
+	accName, _, _, err := FindAccount(addr.Localpart, addr.Domain, allowPostmaster)
+	if err == nil && accName == accountName {
+		return true
+	}
+
+	acc, ok := Conf.Account(accountName)
+	if !ok || len(acc.SubmissionAllowedFromCanonical) == 0 {
+		return false
+	}
+	d, ok := Conf.Domain(addr.Domain)
+	if !ok {
+		return false
+	}
+	localpart, err := CanonicalLocalpart(addr.Localpart, d)
+	if err != nil {
+		return false
+	}
+	_, ok = acc.SubmissionAllowedFromCanonical[smtp.NewAddress(localpart, addr.Domain).String()]
+	return ok
+}
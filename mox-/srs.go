@@ -0,0 +1,34 @@
+package mox
+
+import (
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/srs"
+)
+
+var srsKey []byte
+
+func init() {
+	// Init for tests. Overwritten in ../serve.go.
+	SRSInit([]byte("0123456789abcdef0123456789abcdef"))
+}
+
+// SRSInit sets the per-install key for rewriting MAIL FROM addresses of forwarded
+// messages.
+func SRSInit(key []byte) {
+	srsKey = key
+}
+
+// SRSForward returns the MAIL FROM address to use when forwarding a message
+// from addr, rewritten to an address in domain.
+func SRSForward(addr smtp.Address, domain dns.Domain) smtp.Address {
+	return srs.Forward(srsKey, addr, domain, time.Now())
+}
+
+// SRSReverse returns the original address for a localpart of an address
+// rewritten with SRSForward.
+func SRSReverse(localpart smtp.Localpart) (smtp.Address, error) {
+	return srs.Reverse(srsKey, localpart, time.Now())
+}
@@ -0,0 +1,291 @@
+// Package proxyproto implements reading the PROXY protocol header, versions 1
+// (text) and 2 (binary), as sent by load balancers such as HAProxy at the start
+// of a connection, conveying the original source and destination address.
+//
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+var xlog = mlog.New("proxyproto")
+
+var (
+	ErrUntrusted = errors.New("proxyproto: connection not from trusted network")
+	ErrHeader    = errors.New("proxyproto: bad header")
+)
+
+// Signature at the start of a version 2 header.
+var v2sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// HeaderTimeout is the maximum duration for reading the header after a
+// connection is accepted.
+var HeaderTimeout = 30 * time.Second
+
+// Header is a parsed PROXY header. For the LOCAL command (v2) and UNKNOWN
+// protocol (v1), e.g. used for health checks by the proxy, Source and
+// Destination are nil, and the addresses of the connection should be used.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader reads a version 1 or 2 header from r. It does not read beyond
+// the header.
+func ReadHeader(r io.Reader) (Header, error) {
+	buf := make([]byte, len(v2sig))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Header{}, fmt.Errorf("reading header: %w", err)
+	}
+	if bytes.Equal(buf, v2sig) {
+		return readV2(r)
+	}
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return Header{}, fmt.Errorf("%w: no v1 or v2 signature", ErrHeader)
+	}
+	// Line can be at most 107 bytes, including CRLF. Read a byte at a time so we
+	// don't read data following the header.
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= 107 {
+			return Header{}, fmt.Errorf("%w: v1 line too long", ErrHeader)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Header{}, fmt.Errorf("reading v1 header: %w", err)
+		}
+		buf = append(buf, b[0])
+	}
+	return parseV1(string(buf[:len(buf)-2]))
+}
+
+func parseV1(line string) (Header, error) {
+	h := Header{Version: 1}
+	t := strings.Split(line, " ")
+	if len(t) >= 2 && t[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(t) != 6 || t[1] != "TCP4" && t[1] != "TCP6" {
+		return Header{}, fmt.Errorf("%w: malformed v1 line %q", ErrHeader, line)
+	}
+	src, err := parseV1Addr(t[1], t[2], t[4])
+	if err != nil {
+		return Header{}, err
+	}
+	dst, err := parseV1Addr(t[1], t[3], t[5])
+	if err != nil {
+		return Header{}, err
+	}
+	h.Source = src
+	h.Destination = dst
+	return h, nil
+}
+
+func parseV1Addr(proto, ipstr, portstr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipstr)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: bad %s address %q", ErrHeader, proto, ipstr)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil || strconv.FormatUint(port, 10) != portstr {
+		return nil, fmt.Errorf("%w: bad port %q", ErrHeader, portstr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r io.Reader) (Header, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Header{}, fmt.Errorf("reading v2 header: %w", err)
+	}
+	verCmd, fam := buf[0], buf[1]
+	size := int(binary.BigEndian.Uint16(buf[2:]))
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Header{}, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	h := Header{Version: 2}
+	if verCmd>>4 != 2 {
+		return Header{}, fmt.Errorf("%w: unknown version %d", ErrHeader, verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL, connection from proxy itself.
+		return h, nil
+	case 1:
+		// PROXY
+	default:
+		return Header{}, fmt.Errorf("%w: unknown command %d", ErrHeader, verCmd&0xf)
+	}
+
+	var n int
+	switch fam {
+	case 0x11:
+		n = net.IPv4len
+	case 0x21:
+		n = net.IPv6len
+	default:
+		// Not TCP over IPv4/IPv6, e.g. UDP or unix sockets, we don't use the addresses.
+		return h, nil
+	}
+	if len(data) < 2*n+4 {
+		return Header{}, fmt.Errorf("%w: v2 address data too short", ErrHeader)
+	}
+	// We ignore any TLVs following the addresses.
+	h.Source = &net.TCPAddr{IP: net.IP(data[:n]), Port: int(binary.BigEndian.Uint16(data[2*n:]))}
+	h.Destination = &net.TCPAddr{IP: net.IP(data[n : 2*n]), Port: int(binary.BigEndian.Uint16(data[2*n+2:]))}
+	return h, nil
+}
+
+// Conn is a connection for which a PROXY header was read. RemoteAddr and
+// LocalAddr return the addresses from the header.
+type Conn struct {
+	net.Conn
+	Header Header
+}
+
+// RemoteAddr returns the source address from the header, or the address of the
+// underlying connection if the header did not convey addresses.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, or the address of
+// the underlying connection if the header did not convey addresses.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Listener wraps a listener, requiring a PROXY header on all accepted
+// connections. Connections from IPs outside the trusted networks, and
+// connections with an invalid header, are logged and closed, and not returned by
+// Accept. Headers are read in a goroutine per connection, so a slow connection
+// does not hold up others.
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+
+	conns   chan net.Conn
+	errs    chan error
+	closed  chan struct{}
+	closeMu sync.Mutex
+}
+
+// NewListener returns a new listener requiring PROXY headers on connections
+// from trusted networks. Connections are accepted from ln in a new goroutine.
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	l := &Listener{
+		Listener: ln,
+		Trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.accept()
+	return l
+}
+
+// Accept returns the next connection with a valid PROXY header.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener.
+func (l *Listener) Close() error {
+	l.closeMu.Lock()
+	defer l.closeMu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return l.Listener.Close()
+}
+
+func (l *Listener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	pc, err := l.readHeader(conn)
+	if err != nil {
+		xlog.Infox("proxy protocol header", err, mlog.Field("remote", conn.RemoteAddr()), mlog.Field("local", conn.LocalAddr()))
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *Listener) readHeader(conn net.Conn) (*Conn, error) {
+	if !l.trusted(conn.RemoteAddr()) {
+		return nil, ErrUntrusted
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(HeaderTimeout)); err != nil {
+		return nil, fmt.Errorf("set deadline: %v", err)
+	}
+	h, err := ReadHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("clear deadline: %v", err)
+	}
+	return &Conn{conn, h}, nil
+}
+
+func (l *Listener) trusted(a net.Addr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
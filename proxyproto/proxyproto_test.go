@@ -0,0 +1,137 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	test := func(input string, expSrc, expDst string, expErr error) {
+		t.Helper()
+
+		r := strings.NewReader(input + "rest")
+		h, err := ReadHeader(r)
+		if (err == nil) != (expErr == nil) || err != nil && !errors.Is(err, expErr) {
+			t.Fatalf("reading header %q: got err %v, expected %v", input, err, expErr)
+		}
+		if err != nil {
+			return
+		}
+		var src, dst string
+		if h.Source != nil {
+			src = h.Source.String()
+		}
+		if h.Destination != nil {
+			dst = h.Destination.String()
+		}
+		if src != expSrc || dst != expDst {
+			t.Fatalf("reading header %q: got src %q, dst %q, expected %q, %q", input, src, dst, expSrc, expDst)
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil || string(rest) != "rest" {
+			t.Fatalf("reading after header %q: got %q, err %v", input, rest, err)
+		}
+	}
+
+	test("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", "192.0.2.1:56324", "198.51.100.1:25", nil)
+	test("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", nil)
+	test("PROXY UNKNOWN\r\n", "", "", nil)
+	test("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", "", nil)
+	test("PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n", "", "", ErrHeader)
+	test("PROXY TCP4 192.0.2.1 198.51.100.1 056324 25\r\n", "", "", ErrHeader)
+	test("PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", "", "", ErrHeader)
+	test("PROXY TCP4 192.0.2.1 198.51.100.1 1 25 \r\n", "", "", ErrHeader)
+	test("PROXY UDP4 192.0.2.1 198.51.100.1 1 25\r\n", "", "", ErrHeader)
+	test("PROXY "+strings.Repeat("x", 110)+"\r\n", "", "", ErrHeader)
+	test("EHLO localhost\r\n", "", "", ErrHeader)
+
+	v2 := func(verCmd, fam byte, addrs ...byte) string {
+		b := append([]byte{}, v2sig...)
+		b = append(b, verCmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+		b = append(b, addrs...)
+		return string(b)
+	}
+	test(v2(0x21, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25), "192.0.2.1:56324", "198.51.100.1:25", nil)
+	// With trailing TLV that is ignored.
+	test(v2(0x21, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25, 0x01, 0, 2, 'h', '2'), "192.0.2.1:56324", "198.51.100.1:25", nil)
+	ip6 := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	test(v2(0x21, 0x21, append(ip6, 0xdc, 0x04, 1, 0xbb)...), "[2001:db8::1]:56324", "[2001:db8::2]:443", nil)
+	test(v2(0x20, 0x00), "", "", nil)                                    // LOCAL
+	test(v2(0x21, 0x31, bytes.Repeat([]byte{'x'}, 216)...), "", "", nil) // Unix socket, ignored.
+	test(v2(0x11, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25), "", "", ErrHeader)
+	test(v2(0x22, 0x11, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25), "", "", ErrHeader)
+	test(v2(0x21, 0x21, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25), "", "", ErrHeader)
+}
+
+func TestListener(t *testing.T) {
+	_, localhost, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+
+	listen := func(trusted *net.IPNet) *Listener {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		return NewListener(ln, []*net.IPNet{trusted})
+	}
+
+	dial := func(pl *Listener, header string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		if _, err := conn.Write([]byte(header + "hello")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return conn
+	}
+
+	// Connection from untrusted IP is closed.
+	pl := listen(other)
+	conn := dial(pl, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("read from connection from untrusted ip succeeded")
+	}
+	conn.Close()
+	pl.Close()
+
+	pl = listen(localhost)
+	defer pl.Close()
+
+	// Connection with bad header is closed, next connection is returned by Accept.
+	bad := dial(pl, "bogus\r\n")
+	defer bad.Close()
+	if _, err := bad.Read(buf); err == nil {
+		t.Fatalf("read from connection with bad header succeeded")
+	}
+	good := dial(pl, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	defer good.Close()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer c.Close()
+	if s := c.RemoteAddr().String(); s != "192.0.2.1:56324" {
+		t.Fatalf("got remote addr %s, expected 192.0.2.1:56324", s)
+	}
+	if s := c.LocalAddr().String(); s != "198.51.100.1:25" {
+		t.Fatalf("got local addr %s, expected 198.51.100.1:25", s)
+	}
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("reading data after header: got %q, err %v", buf, err)
+	}
+
+	pl.Close()
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close: got err %v, expected net.ErrClosed", err)
+	}
+}
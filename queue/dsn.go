@@ -39,17 +39,39 @@ Delivery has been delayed of your email to:
 
 	%s
 
-Next attempts to deliver: in 4 hours, 8 hours and 16 hours.
+Delivery will be attempted until %s.
 If these attempts all fail, you will receive a notice.
 
 Error during the last delivery attempt:
 
 	%s
-`, m.Recipient().XString(false), errmsg)
+`, m.Recipient().XString(false), retryUntil.UTC().Format(time.RFC1123), errmsg)
 
 	queueDSN(log, m, remoteMTA, secodeOpt, errmsg, false, &retryUntil, subject, message)
 }
 
+// dsnStatus returns the action, status and diagnostic code for the recipient in
+// a DSN about a failed delivery attempt.
+func dsnStatus(permanent bool, secodeOpt, errmsg string) (action dsn.Action, status, diagCode string) {
+	if permanent {
+		status = "5."
+		action = dsn.Failed
+	} else {
+		action = dsn.Delayed
+		status = "4."
+	}
+	if secodeOpt != "" {
+		status += secodeOpt
+	} else {
+		status += "0.0"
+	}
+	diagCode = errmsg
+	if !dsn.HasCode(diagCode) {
+		diagCode = status + " " + errmsg
+	}
+	return
+}
+
 // We only queue DSNs for delivery failures for emails submitted by authenticated
 // users. So we are delivering to local users. ../rfc/5321:1466
 // ../rfc/5321:1494
@@ -61,6 +83,13 @@ func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg stri
 		kind = "failure"
 	}
 
+	// No DSNs for messages with a null reverse path, such as forwarded or relayed
+	// bounces.
+	if m.Sender().IsZero() {
+		log.Info("not queueing dsn for message with null reverse path", mlog.Field("kind", kind), mlog.Field("recipient", m.Recipient().XString(m.SMTPUTF8)))
+		return
+	}
+
 	qlog := func(text string, err error) {
 		log.Errorx("queue dsn: "+text+": sender will not be informed about dsn", err, mlog.Field("sender", m.Sender().XString(m.SMTPUTF8)), mlog.Field("kind", kind))
 	}
@@ -81,24 +110,7 @@ func queueDSN(log *mlog.Log, m Msg, remoteMTA dsn.NameIP, secodeOpt, errmsg stri
 		return
 	}
 
-	var action dsn.Action
-	var status string
-	if permanent {
-		status = "5."
-		action = dsn.Failed
-	} else {
-		action = dsn.Delayed
-		status = "4."
-	}
-	if secodeOpt != "" {
-		status += secodeOpt
-	} else {
-		status += "0.0"
-	}
-	diagCode := errmsg
-	if !dsn.HasCode(diagCode) {
-		diagCode = status + " " + errmsg
-	}
+	action, status, diagCode := dsnStatus(permanent, secodeOpt, errmsg)
 
 	dsnMsg := &dsn.Message{
 		SMTPUTF8: m.SMTPUTF8,
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+const defaultHistoryRetention = 7 * 24 * time.Hour
+
+// MsgRetired is a record of a message that was removed from the queue after
+// successful delivery or a permanent failure. Retired messages are kept for the
+// configured history retention period, to look up the delivery status.
+type MsgRetired struct {
+	ID                 int64 // Same as ID of the message in the queue.
+	Queued             time.Time
+	SenderAccount      string `bstore:"index"`
+	SenderLocalpart    smtp.Localpart
+	SenderDomain       dns.IPDomain
+	RecipientLocalpart smtp.Localpart
+	RecipientDomain    dns.IPDomain
+	RecipientDomainStr string
+	Size               int64
+	MessageID          string
+	Attempts           int
+	Success            bool
+	Retired            time.Time `bstore:"index"` // Time of the final delivery attempt.
+	KeepUntil          time.Time `bstore:"index"`
+
+	// Details of the final delivery attempt. Can be empty, e.g. when no delivery
+	// could be attempted because of DNS errors.
+	RemoteMX   string
+	RemoteIP   string
+	TLSMode    string // strict, opportunistic or skip.
+	TLSVersion string // E.g. TLS1.3, empty if TLS was not used.
+	Response   string // Final SMTP response line or error message.
+}
+
+// Sender of message as used in MAIL FROM.
+func (m MsgRetired) Sender() smtp.Path {
+	return smtp.Path{Localpart: m.SenderLocalpart, IPDomain: m.SenderDomain}
+}
+
+// Recipient of message as used in RCPT TO.
+func (m MsgRetired) Recipient() smtp.Path {
+	return smtp.Path{Localpart: m.RecipientLocalpart, IPDomain: m.RecipientDomain}
+}
+
+// attemptResult holds details about a delivery attempt to a host, for history.
+type attemptResult struct {
+	remoteMX   string
+	remoteIP   string
+	tlsMode    string
+	tlsVersion string
+	response   string
+	transcript string // Kept with the message in the queue for temporary failures.
+}
+
+func historyRetention() time.Duration {
+	d := mox.Conf.Static.Queue.HistoryRetention
+	if d == 0 {
+		d = defaultHistoryRetention
+	}
+	return d
+}
+
+// queueRetire removes a message from the queue, keeping a history record if
+// enabled.
+func queueRetire(ctx context.Context, m Msg, success bool, r attemptResult) error {
+	err := DB.Write(ctx, func(tx *bstore.Tx) error {
+		if err := tx.Delete(&Msg{ID: m.ID}); err != nil {
+			return err
+		}
+		retention := historyRetention()
+		if retention < 0 {
+			return nil
+		}
+		now := time.Now()
+		retired := now
+		if m.LastAttempt != nil {
+			retired = *m.LastAttempt
+		}
+		mr := MsgRetired{
+			ID:                 m.ID,
+			Queued:             m.Queued,
+			SenderAccount:      m.SenderAccount,
+			SenderLocalpart:    m.SenderLocalpart,
+			SenderDomain:       m.SenderDomain,
+			RecipientLocalpart: m.RecipientLocalpart,
+			RecipientDomain:    m.RecipientDomain,
+			RecipientDomainStr: m.RecipientDomainStr,
+			Size:               m.Size,
+			MessageID:          m.MessageID,
+			Attempts:           m.Attempts,
+			Success:            success,
+			Retired:            retired,
+			KeepUntil:          now.Add(retention),
+			RemoteMX:           r.remoteMX,
+			RemoteIP:           r.remoteIP,
+			TLSMode:            r.tlsMode,
+			TLSVersion:         r.tlsVersion,
+			Response:           r.response,
+		}
+		return tx.Insert(&mr)
+	})
+	if err != nil {
+		return err
+	}
+	// If removing from database fails, we'll also leave the file in the file system.
+
+	p := m.MessagePath()
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("removing queue message from file system: %v", err)
+	}
+	return nil
+}
+
+// HistoryFilter selects retired messages. A message matches if it matches all
+// nonzero fields.
+type HistoryFilter struct {
+	Account string // Sender account.
+	From    string // Sender address, or "@domain".
+	To      string // Recipient address, or "@domain".
+	Success *bool
+	Limit   int // Maximum number of messages to return, most recent first. Zero for no limit.
+}
+
+// HistoryList returns retired messages matching the filter, most recently
+// retired first.
+func HistoryList(ctx context.Context, f HistoryFilter) ([]MsgRetired, error) {
+	q := bstore.QueryDB[MsgRetired](ctx, DB)
+	if f.Account != "" {
+		q.FilterEqual("SenderAccount", f.Account)
+	}
+	if f.Success != nil {
+		q.FilterEqual("Success", *f.Success)
+	}
+	if f.From != "" || f.To != "" {
+		q.FilterFn(func(m MsgRetired) bool {
+			return (f.From == "" || matchPath(f.From, m.SenderDomain, m.Sender().XString(true))) &&
+				(f.To == "" || matchPath(f.To, m.RecipientDomain, m.Recipient().XString(true)))
+		})
+	}
+	q.SortDesc("Retired")
+	if f.Limit > 0 {
+		q.Limit(f.Limit)
+	}
+	return q.List()
+}
+
+// historyCleanup removes retired messages past their retention period.
+func historyCleanup(ctx context.Context, log *mlog.Log) {
+	q := bstore.QueryDB[MsgRetired](ctx, DB)
+	q.FilterLess("KeepUntil", time.Now())
+	n, err := q.Delete()
+	if err != nil {
+		log.Errorx("removing expired history of queue", err)
+	} else if n > 0 {
+		log.Debug("removed expired history of queue", mlog.Field("count", n))
+	}
+}
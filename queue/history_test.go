@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestHistory(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt1 := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "one.example"}}}
+	rcpt2 := smtp.Path{Localpart: "b", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "two.example"}}}
+	for _, rcpt := range []smtp.Path{rcpt1, rcpt2} {
+		err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+		tcheck(t, err, "add message to queue")
+	}
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 2)
+
+	r := attemptResult{remoteMX: "mx.one.example", remoteIP: "10.0.0.1", tlsMode: "opportunistic", tlsVersion: "TLS1.3", response: "250 queued"}
+	err = queueRetire(ctxbg, msgs[0], true, r)
+	tcheck(t, err, "retire message")
+	err = queueRetire(ctxbg, msgs[1], false, attemptResult{response: "550 no such user"})
+	tcheck(t, err, "retire message")
+
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 0)
+
+	yes := true
+	no := false
+	checkCount := func(f HistoryFilter, exp int) {
+		t.Helper()
+		l, err := HistoryList(ctxbg, f)
+		tcheck(t, err, "list history")
+		tcompare(t, len(l), exp)
+	}
+	checkCount(HistoryFilter{}, 2)
+	checkCount(HistoryFilter{Account: "mjl"}, 2)
+	checkCount(HistoryFilter{Account: "other"}, 0)
+	checkCount(HistoryFilter{Success: &yes}, 1)
+	checkCount(HistoryFilter{Success: &no}, 1)
+	checkCount(HistoryFilter{From: "@MOX.example"}, 2)
+	checkCount(HistoryFilter{To: "a@one.example"}, 1)
+	checkCount(HistoryFilter{To: "@two.example", Success: &yes}, 0)
+	checkCount(HistoryFilter{Limit: 1}, 1)
+
+	l, err := HistoryList(ctxbg, HistoryFilter{Success: &yes})
+	tcheck(t, err, "list history")
+	mr := l[0]
+	tcompare(t, mr.Recipient(), rcpt1)
+	tcompare(t, [5]string{mr.RemoteMX, mr.RemoteIP, mr.TLSMode, mr.TLSVersion, mr.Response}, [5]string{r.remoteMX, r.remoteIP, r.tlsMode, r.tlsVersion, r.response})
+
+	// Expired history is removed.
+	q := bstore.QueryDB[MsgRetired](ctxbg, DB)
+	q.FilterID(mr.ID)
+	_, err = q.UpdateField("KeepUntil", time.Now().Add(-time.Minute))
+	tcheck(t, err, "update history")
+	historyCleanup(ctxbg, xlog)
+	checkCount(HistoryFilter{}, 1)
+
+	// No history is kept when disabled.
+	mox.Conf.Static.Queue.HistoryRetention = -1
+	defer func() {
+		mox.Conf.Static.Queue.HistoryRetention = 0
+	}()
+	err = Add(ctxbg, xlog, "mjl", from, rcpt1, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue")
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	err = queueRetire(ctxbg, msgs[0], true, r)
+	tcheck(t, err, "retire message")
+	checkCount(HistoryFilter{}, 1)
+}
@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+)
+
+// HoldRule is a set of conditions that cause a newly queued message to be marked
+// as on hold. Held messages are not delivered until released. A message matches
+// a rule if it matches all nonzero fields. A rule with only zero fields matches
+// all messages.
+type HoldRule struct {
+	ID              int64
+	Account         string     // Sender account.
+	SenderDomain    dns.Domain // Domain of MAIL FROM.
+	RecipientDomain dns.Domain
+	MinSize         int64 // Messages of at least this size.
+}
+
+// All returns whether the rule matches all messages.
+func (hr HoldRule) All() bool {
+	hr.ID = 0
+	return hr == HoldRule{}
+}
+
+func (hr HoldRule) matches(m Msg) bool {
+	return (hr.Account == "" || hr.Account == m.SenderAccount) &&
+		(hr.SenderDomain.IsZero() || hr.SenderDomain == m.SenderDomain.Domain) &&
+		(hr.RecipientDomain.IsZero() || hr.RecipientDomain == m.RecipientDomain.Domain) &&
+		(hr.MinSize == 0 || m.Size >= hr.MinSize)
+}
+
+// HoldRuleList returns all hold rules.
+func HoldRuleList(ctx context.Context) ([]HoldRule, error) {
+	return bstore.QueryDB[HoldRule](ctx, DB).List()
+}
+
+// HoldRuleAdd adds a new hold rule. Existing messages in the queue are not
+// affected, use HoldSet for those.
+func HoldRuleAdd(ctx context.Context, log *mlog.Log, hr HoldRule) (HoldRule, error) {
+	hr.ID = 0
+	if hr.MinSize < 0 {
+		return HoldRule{}, fmt.Errorf("minimum size cannot be negative")
+	}
+	if err := DB.Insert(ctx, &hr); err != nil {
+		return HoldRule{}, err
+	}
+	log.Info("adding hold rule", mlog.Field("holdrule", hr))
+	return hr, nil
+}
+
+// HoldRuleRemove removes a hold rule. Messages held due to the rule are not
+// released, use HoldSet for those.
+func HoldRuleRemove(ctx context.Context, log *mlog.Log, holdRuleID int64) error {
+	if err := DB.Delete(ctx, &HoldRule{ID: holdRuleID}); err != nil {
+		return err
+	}
+	log.Info("removed hold rule", mlog.Field("holdruleid", holdRuleID))
+	return nil
+}
+
+// Filter selects messages in the queue. A message matches if it matches all
+// nonzero fields. An empty filter matches all messages.
+type Filter struct {
+	IDs          []int64
+	Account      string // Sender account.
+	From         string // Sender address (MAIL FROM), or "@domain" for all addresses of a domain.
+	To           string // Recipient address, or "@domain".
+	Hold         *bool
+	QueuedBefore *time.Time // Only messages queued before this time, for selecting by age.
+	QueuedAfter  *time.Time
+	LastError    string // Substring of the last delivery error, case-insensitive.
+	MinAttempts  int    // Minimum number of delivery attempts made.
+}
+
+// matchPath returns whether an address or "@domain" pattern matches the path,
+// case-insensitively.
+func matchPath(pattern string, d dns.IPDomain, addr string) bool {
+	if strings.HasPrefix(pattern, "@") {
+		return strings.EqualFold(pattern[1:], formatIPDomain(d)) || strings.EqualFold(pattern[1:], d.XString(false))
+	}
+	return strings.EqualFold(pattern, addr)
+}
+
+func (f Filter) apply(q *bstore.Query[Msg]) {
+	if len(f.IDs) > 0 {
+		q.FilterIDs(f.IDs)
+	}
+	if f.Account != "" {
+		q.FilterEqual("SenderAccount", f.Account)
+	}
+	if f.Hold != nil {
+		q.FilterEqual("Hold", *f.Hold)
+	}
+	if f.QueuedBefore != nil {
+		q.FilterLess("Queued", *f.QueuedBefore)
+	}
+	if f.QueuedAfter != nil {
+		q.FilterGreater("Queued", *f.QueuedAfter)
+	}
+	if f.MinAttempts > 0 {
+		q.FilterGreaterEqual("Attempts", f.MinAttempts)
+	}
+	lastError := strings.ToLower(f.LastError)
+	if f.From != "" || f.To != "" || lastError != "" {
+		q.FilterFn(func(m Msg) bool {
+			return (f.From == "" || matchPath(f.From, m.SenderDomain, m.Sender().XString(true))) &&
+				(f.To == "" || matchPath(f.To, m.RecipientDomain, m.Recipient().XString(true))) &&
+				(lastError == "" || strings.Contains(strings.ToLower(m.LastError), lastError))
+		})
+	}
+}
+
+// HoldSet marks messages matching the filter as held or releases them. Released
+// messages are delivered when their next attempt is due, which may be
+// immediately.
+// Returns the number of messages changed.
+func HoldSet(ctx context.Context, f Filter, hold bool) (int, error) {
+	q := bstore.QueryDB[Msg](ctx, DB)
+	f.apply(q)
+	q.FilterEqual("Hold", !hold)
+	n, err := q.UpdateField("Hold", hold)
+	if err != nil {
+		return 0, fmt.Errorf("selecting and updating messages in queue: %v", err)
+	}
+	if !hold {
+		queuekick()
+	}
+	return n, nil
+}
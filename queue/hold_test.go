@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestHold(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	hr, err := HoldRuleAdd(ctxbg, xlog, HoldRule{RecipientDomain: dns.Domain{ASCII: "held.example"}})
+	tcheck(t, err, "add hold rule")
+	l, err := HoldRuleList(ctxbg)
+	tcheck(t, err, "list hold rules")
+	tcompare(t, l, []HoldRule{hr})
+	tcompare(t, hr.All(), false)
+	tcompare(t, HoldRule{ID: 1}.All(), true)
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	held := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "held.example"}}}
+	other := smtp.Path{Localpart: "b", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "other.example"}}}
+	for _, rcpt := range []smtp.Path{held, other} {
+		err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+		tcheck(t, err, "add message to queue")
+	}
+
+	yes := true
+	no := false
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 2)
+	for _, m := range msgs {
+		tcompare(t, m.Hold, m.RecipientDomain.Domain.ASCII == "held.example")
+	}
+
+	// Held message is not selected for delivery, and the domain of the other is
+	// busy.
+	busy := map[string]struct{}{"other.example": {}}
+	tcompare(t, launchWork(nil, busy), 0)
+
+	// Hold messages by sender domain.
+	n, err := HoldSet(ctxbg, Filter{From: "@mox.example", Hold: &no}, true)
+	tcheck(t, err, "hold messages")
+	tcompare(t, n, 1)
+
+	// Release by recipient address.
+	n, err = HoldSet(ctxbg, Filter{To: "A@held.example"}, false)
+	tcheck(t, err, "release messages")
+	tcompare(t, n, 1)
+
+	n, err = HoldSet(ctxbg, Filter{Account: "mjl", Hold: &yes}, false)
+	tcheck(t, err, "release messages")
+	tcompare(t, n, 1)
+
+	// New messages are no longer held after removing the rule.
+	err = HoldRuleRemove(ctxbg, xlog, hr.ID)
+	tcheck(t, err, "remove hold rule")
+	err = Add(ctxbg, xlog, "mjl", from, held, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue")
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	for _, m := range msgs {
+		tcompare(t, m.Hold, false)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	var ids []int64
+	for _, dom := range []string{"a.example", "b.example", "b.example", "c.example"} {
+		rcpt := smtp.Path{Localpart: "x", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: dom}}}
+		err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+		tcheck(t, err, "add message to queue")
+	}
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	tcompare(t, len(ids), 4)
+
+	// Make the messages look like they were queued a day ago and have failed.
+	old := time.Now().Add(-24 * time.Hour)
+	_, err = bstore.QueryDB[Msg](ctxbg, DB).FilterIDs(ids[:2]).UpdateFields(map[string]any{"Queued": old, "Attempts": 3, "LastError": "dialing smtp server: Connection Refused"})
+	tcheck(t, err, "update messages")
+
+	listIDs := func(f Filter, page Page) []int64 {
+		t.Helper()
+		l, err := List(ctxbg, f, page)
+		tcheck(t, err, "list queue")
+		r := []int64{}
+		for _, m := range l {
+			r = append(r, m.ID)
+		}
+		return r
+	}
+
+	hourAgo := time.Now().Add(-time.Hour)
+	tcompare(t, listIDs(Filter{To: "@b.example"}, Page{}), ids[1:3])
+	tcompare(t, listIDs(Filter{QueuedBefore: &hourAgo}, Page{}), ids[:2])
+	tcompare(t, listIDs(Filter{QueuedAfter: &hourAgo}, Page{}), ids[2:])
+	tcompare(t, listIDs(Filter{LastError: "connection refused"}, Page{}), ids[:2])
+	tcompare(t, listIDs(Filter{MinAttempts: 3, To: "@b.example"}, Page{}), ids[1:2])
+	tcompare(t, listIDs(Filter{Account: "other"}, Page{}), []int64{})
+
+	// Pagination.
+	tcompare(t, listIDs(Filter{}, Page{Limit: 3}), ids[:3])
+	tcompare(t, listIDs(Filter{}, Page{AfterID: ids[2], Limit: 3}), ids[3:])
+	tcompare(t, listIDs(Filter{To: "@b.example"}, Page{AfterID: ids[1]}), ids[2:3])
+
+	// Bulk operations.
+	n, err := Kick(ctxbg, Filter{MinAttempts: 1})
+	tcheck(t, err, "kick")
+	tcompare(t, n, 2)
+	n, err = Drop(ctxbg, Filter{LastError: "refused", To: "@a.example"})
+	tcheck(t, err, "drop")
+	tcompare(t, n, 1)
+	tcompare(t, listIDs(Filter{}, Page{}), ids[1:])
+}
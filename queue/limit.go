@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/mox-"
+)
+
+// Deliveries are limited per destination: per recipient domain when scheduling
+// messages for delivery, and per MX host when connecting. A destination can be
+// limited in concurrent deliveries and in deliveries started per minute. When a
+// remote server responds with a 421 or 451 (typically when we are sending too
+// much), the destination is throttled: no new deliveries are started for a while.
+
+const defaultThrottleBackoff = 5 * time.Minute
+
+var (
+	domainLimiter = newLimiter(true)
+	hostLimiter   = newLimiter(false)
+)
+
+// limiter keeps track of deliveries in progress for destinations, keyed by
+// domain name or IP address as formatted by formatIPDomain.
+type limiter struct {
+	domains bool // Whether destinations are recipient domains, or MX hosts.
+
+	sync.Mutex
+	busy      map[string]int         // Deliveries in progress.
+	starts    map[string][]time.Time // Start of deliveries in the past minute, only for rate-limited destinations.
+	throttled map[string]time.Time   // Until when no deliveries should be started.
+}
+
+func newLimiter(domains bool) *limiter {
+	return &limiter{
+		domains:   domains,
+		busy:      map[string]int{},
+		starts:    map[string][]time.Time{},
+		throttled: map[string]time.Time{},
+	}
+}
+
+// limits returns the maximum concurrent deliveries and deliveries per minute for
+// a destination. Zero means no limit.
+func (l *limiter) limits(key string) (concurrency, perMinute int) {
+	q := mox.Conf.Static.Queue
+	if l.domains {
+		concurrency = q.DefaultConcurrency
+		if concurrency == 0 {
+			concurrency = 1
+		}
+	}
+	if dl, ok := q.DestinationLimitsParsed[key]; ok {
+		if dl.Concurrency > 0 {
+			concurrency = dl.Concurrency
+		}
+		perMinute = dl.MessagesPerMinute
+	}
+	return
+}
+
+// wait returns whether a delivery to the destination can be started now. If
+// not, and the destination becomes available at a known time (i.e. not by a
+// delivery finishing), that time is returned in until.
+//
+// Must be called with lock held.
+func (l *limiter) wait(key string, now time.Time) (ok bool, until time.Time) {
+	if t, ok := l.throttled[key]; ok {
+		if now.Before(t) {
+			return false, t
+		}
+		delete(l.throttled, key)
+	}
+	concurrency, perMinute := l.limits(key)
+	if concurrency > 0 && l.busy[key] >= concurrency {
+		return false, time.Time{}
+	}
+	if perMinute > 0 {
+		starts := l.starts[key]
+		for len(starts) > 0 && now.Sub(starts[0]) >= time.Minute {
+			starts = starts[1:]
+		}
+		if len(starts) == 0 {
+			delete(l.starts, key)
+		} else {
+			l.starts[key] = starts
+		}
+		if len(starts) >= perMinute {
+			return false, starts[0].Add(time.Minute)
+		}
+	}
+	return true, time.Time{}
+}
+
+// start registers the start of a delivery to a destination, if allowed. If not
+// allowed, the time at which it may be allowed is returned, if known.
+func (l *limiter) start(key string, now time.Time) (ok bool, until time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	if ok, until := l.wait(key, now); !ok {
+		return false, until
+	}
+	l.busy[key]++
+	if _, perMinute := l.limits(key); perMinute > 0 {
+		l.starts[key] = append(l.starts[key], now)
+	}
+	return true, time.Time{}
+}
+
+// done registers the end of a delivery to a destination.
+func (l *limiter) done(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.busy[key] <= 1 {
+		delete(l.busy, key)
+	} else {
+		l.busy[key]--
+	}
+}
+
+// throttle prevents new deliveries to the destination for the configured
+// throttle backoff.
+func (l *limiter) throttle(key string, now time.Time) {
+	d := mox.Conf.Static.Queue.ThrottleBackoff
+	if d == 0 {
+		d = defaultThrottleBackoff
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.throttled[key] = now.Add(d)
+}
+
+// total returns the number of deliveries in progress over all destinations.
+func (l *limiter) total() int {
+	l.Lock()
+	defer l.Unlock()
+	n := 0
+	for _, v := range l.busy {
+		n += v
+	}
+	return n
+}
+
+// blocked returns the destinations to which no new deliveries can be started,
+// and the earliest time one of them becomes available again, if known.
+func (l *limiter) blocked(now time.Time) (blocked map[string]struct{}, wake time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	blocked = map[string]struct{}{}
+	check := func(key string) {
+		if _, ok := blocked[key]; ok {
+			return
+		}
+		if ok, until := l.wait(key, now); !ok {
+			blocked[key] = struct{}{}
+			if !until.IsZero() && (wake.IsZero() || until.Before(wake)) {
+				wake = until
+			}
+		}
+	}
+	for key := range l.busy {
+		check(key)
+	}
+	for key := range l.starts {
+		check(key)
+	}
+	for key := range l.throttled {
+		check(key)
+	}
+	return blocked, wake
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestLimiter(t *testing.T) {
+	defer func() {
+		mox.Conf.Static.Queue = config.Queue{}
+	}()
+	mox.Conf.Static.Queue = config.Queue{
+		DestinationLimitsParsed: map[string]config.QueueLimits{
+			"bulk.example": {Concurrency: 2, MessagesPerMinute: 3},
+		},
+	}
+
+	now := time.Now()
+	l := newLimiter(true)
+
+	// Default concurrency for domains is 1.
+	ok, _ := l.start("other.example", now)
+	tcompare(t, ok, true)
+	ok, until := l.start("other.example", now)
+	tcompare(t, ok, false)
+	tcompare(t, until.IsZero(), true)
+	l.done("other.example")
+	ok, _ = l.start("other.example", now)
+	tcompare(t, ok, true)
+	l.done("other.example")
+
+	// Configured concurrency and rate.
+	ok, _ = l.start("bulk.example", now)
+	tcompare(t, ok, true)
+	ok, _ = l.start("bulk.example", now)
+	tcompare(t, ok, true)
+	ok, _ = l.start("bulk.example", now)
+	tcompare(t, ok, false)
+	l.done("bulk.example")
+	l.done("bulk.example")
+	ok, _ = l.start("bulk.example", now.Add(time.Second))
+	tcompare(t, ok, true)
+	l.done("bulk.example")
+	ok, until = l.start("bulk.example", now.Add(2*time.Second))
+	tcompare(t, ok, false)
+	tcompare(t, until, now.Add(time.Minute))
+	blocked, wake := l.blocked(now.Add(2 * time.Second))
+	tcompare(t, blocked, map[string]struct{}{"bulk.example": {}})
+	tcompare(t, wake, now.Add(time.Minute))
+	ok, _ = l.start("bulk.example", now.Add(time.Minute))
+	tcompare(t, ok, true)
+	l.done("bulk.example")
+
+	// Hosts have no default limit.
+	hl := newLimiter(false)
+	for i := 0; i < 3; i++ {
+		ok, _ = hl.start("mx.other.example", now)
+		tcompare(t, ok, true)
+	}
+	tcompare(t, hl.total(), 3)
+
+	// Throttling.
+	l.throttle("other.example", now)
+	ok, until = l.start("other.example", now.Add(time.Minute))
+	tcompare(t, ok, false)
+	tcompare(t, until, now.Add(defaultThrottleBackoff))
+	ok, _ = l.start("other.example", now.Add(defaultThrottleBackoff))
+	tcompare(t, ok, true)
+}
+
+// Test that a delivery is postponed without counting as attempt when all hosts
+// are throttled.
+func TestDeliverLimited(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue for delivery")
+
+	resolver := dns.MockResolver{
+		A:  map[string][]string{"mox.example.": {"127.0.0.1"}},
+		MX: map[string][]*net.MX{"mox.example.": {{Host: "mox.example", Pref: 10}}},
+	}
+	dial = func(ctx context.Context, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		t.Fatalf("unexpected dial to throttled host")
+		return nil, fmt.Errorf("failure from test")
+	}
+
+	now := time.Now()
+	hostLimiter.throttle("mox.example", now)
+
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	go func() { <-deliveryResult }() // Deliver sends here.
+	deliver(resolver, msgs[0])
+
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, msgs[0].Attempts, 0)
+	tcompare(t, msgs[0].LastAttempt == nil, true)
+	if !msgs[0].NextAttempt.Equal(now.Add(defaultThrottleBackoff)) {
+		t.Fatalf("got next attempt %v, expected %v", msgs[0].NextAttempt, now.Add(defaultThrottleBackoff))
+	}
+}
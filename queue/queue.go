@@ -22,8 +22,10 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -70,8 +72,8 @@ var dial = func(ctx context.Context, timeout time.Duration, addr string, laddr n
 
 var jitter = mox.NewRand()
 
-var DBTypes = []any{Msg{}} // Types stored in DB.
-var DB *bstore.DB          // Exported for making backups.
+var DBTypes = []any{Msg{}, HoldRule{}, MsgRetired{}, Webhook{}} // Types stored in DB.
+var DB *bstore.DB                                               // Exported for making backups.
 
 // Set for mox localserve, to prevent queueing.
 var Localserve bool
@@ -86,14 +88,18 @@ type Msg struct {
 	RecipientLocalpart smtp.Localpart // Typically a remote user and domain.
 	RecipientDomain    dns.IPDomain
 	RecipientDomainStr string              // For filtering.
-	Attempts           int                 // Next attempt is based on last attempt and exponential back off based on attempts.
+	Attempts           int                 // Next attempt is based on last attempt and the retry schedule, indexed by attempts.
 	DialedIPs          map[string][]net.IP // For each host, the IPs that were dialed. Used for IP selection for later attempts.
 	NextAttempt        time.Time           // For scheduling.
+	Hold               bool                // If set, delivery won't be attempted.
+	FutureRelease      time.Time           // If set, message was submitted with SMTP FUTURERELEASE, and is not delivered before this time. Retries, delayed DSNs and the maximum lifetime are calculated from this time instead of Queued.
 	LastAttempt        *time.Time
 	LastError          string
-	Has8bit            bool  // Whether message contains bytes with high bit set, determines whether 8BITMIME SMTP extension is needed.
-	SMTPUTF8           bool  // Whether message requires use of SMTPUTF8.
-	Size               int64 // Full size of message, combined MsgPrefix with contents of message file.
+	LastTranscript     string `json:"-"` // SMTP protocol lines of the last delivery attempt, see smtpclient.Client.Transcript. Can be large, not included in JSON.
+	Has8bit            bool   // Whether message contains bytes with high bit set, determines whether 8BITMIME SMTP extension is needed.
+	SMTPUTF8           bool   // Whether message requires use of SMTPUTF8.
+	Size               int64  // Full size of message, combined MsgPrefix with contents of message file.
+	MessageID          string // Message-ID header, including <>, of a submitted message. Used for matching incoming DSNs to the message.
 	MsgPrefix          []byte
 	DSNUTF8            []byte // If set, this message is a DSN and this is a version using utf-8, for the case the remote MTA supports smtputf8. In this case, Size and MsgPrefix are not relevant.
 }
@@ -108,6 +114,16 @@ func (m Msg) Recipient() smtp.Path {
 	return smtp.Path{Localpart: m.RecipientLocalpart, IPDomain: m.RecipientDomain}
 }
 
+// baseTime returns the time from which retries, delayed DSNs and the maximum
+// lifetime are calculated: the time the message was queued, or the requested
+// future release time.
+func (m Msg) baseTime() time.Time {
+	if m.FutureRelease.After(m.Queued) {
+		return m.FutureRelease
+	}
+	return m.Queued
+}
+
 // MessagePath returns the path where the message is stored.
 func (m Msg) MessagePath() string {
 	return mox.DataDirPath(filepath.Join("queue", store.MessagePath(m.ID)))
@@ -140,29 +156,26 @@ func Shutdown() {
 	DB = nil
 }
 
-// List returns all messages in the delivery queue.
-// Ordered by earliest delivery attempt first.
-func List(ctx context.Context) ([]Msg, error) {
-	qmsgs, err := bstore.QueryDB[Msg](ctx, DB).List()
-	if err != nil {
-		return nil, err
+// Page selects a range of messages ordered by ID, for listing a large queue in
+// parts.
+type Page struct {
+	AfterID int64 // Only messages with a higher ID. Zero starts at the first message.
+	Limit   int   // Maximum number of messages to return. Zero for no limit.
+}
+
+// List returns messages in the delivery queue matching the filter, in the range
+// selected by page. Ordered by ID, i.e. the order in which messages were queued.
+func List(ctx context.Context, f Filter, page Page) ([]Msg, error) {
+	q := bstore.QueryDB[Msg](ctx, DB)
+	f.apply(q)
+	if page.AfterID > 0 {
+		q.FilterGreater("ID", page.AfterID)
 	}
-	sort.Slice(qmsgs, func(i, j int) bool {
-		a := qmsgs[i]
-		b := qmsgs[j]
-		la := a.LastAttempt != nil
-		lb := b.LastAttempt != nil
-		if !la && lb {
-			return true
-		} else if la && !lb {
-			return false
-		}
-		if !la && !lb || a.LastAttempt.Equal(*b.LastAttempt) {
-			return a.ID < b.ID
-		}
-		return a.LastAttempt.Before(*b.LastAttempt)
-	})
-	return qmsgs, nil
+	q.SortAsc("ID")
+	if page.Limit > 0 {
+		q.Limit(page.Limit)
+	}
+	return q.List()
 }
 
 // Count returns the number of messages in the delivery queue.
@@ -180,7 +193,10 @@ func Count(ctx context.Context) (int, error) {
 // this data is used as the message when delivering the DSN and the remote SMTP
 // server supports SMTPUTF8. If the remote SMTP server does not support SMTPUTF8,
 // the regular non-utf8 message is delivered.
-func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcptTo smtp.Path, has8bit, smtputf8 bool, size int64, msgPrefix []byte, msgFile *os.File, dsnutf8Opt []byte, consumeFile bool) error {
+//
+// If futureRelease is in the future, the first delivery attempt is not made
+// before that time.
+func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcptTo smtp.Path, has8bit, smtputf8 bool, size int64, messageID string, futureRelease time.Time, msgPrefix []byte, msgFile *os.File, dsnutf8Opt []byte, consumeFile bool) error {
 	// todo: Add should accept multiple rcptTo if they are for the same domain. so we can queue them for delivery in one (or just a few) session(s), transferring the data only once. ../rfc/5321:3759
 
 	if Localserve {
@@ -201,7 +217,38 @@ func Add(ctx context.Context, log *mlog.Log, senderAccount string, mailFrom, rcp
 	}()
 
 	now := time.Now()
-	qm := Msg{0, now, senderAccount, mailFrom.Localpart, mailFrom.IPDomain, rcptTo.Localpart, rcptTo.IPDomain, formatIPDomain(rcptTo.IPDomain), 0, nil, now, nil, "", has8bit, smtputf8, size, msgPrefix, dsnutf8Opt}
+	qm := Msg{
+		Queued:             now,
+		SenderAccount:      senderAccount,
+		SenderLocalpart:    mailFrom.Localpart,
+		SenderDomain:       mailFrom.IPDomain,
+		RecipientLocalpart: rcptTo.Localpart,
+		RecipientDomain:    rcptTo.IPDomain,
+		RecipientDomainStr: formatIPDomain(rcptTo.IPDomain),
+		NextAttempt:        now,
+		Has8bit:            has8bit,
+		SMTPUTF8:           smtputf8,
+		Size:               size,
+		MessageID:          messageID,
+		MsgPrefix:          msgPrefix,
+		DSNUTF8:            dsnutf8Opt,
+	}
+	if futureRelease.After(now) {
+		qm.NextAttempt = futureRelease
+		qm.FutureRelease = futureRelease
+	}
+
+	holdRules, err := bstore.QueryTx[HoldRule](tx).List()
+	if err != nil {
+		return fmt.Errorf("listing hold rules: %v", err)
+	}
+	for _, hr := range holdRules {
+		if hr.matches(qm) {
+			log.Info("holding queued message due to hold rule", mlog.Field("holdruleid", hr.ID), mlog.Field("recipient", rcptTo))
+			qm.Hold = true
+			break
+		}
+	}
 
 	if err := tx.Insert(&qm); err != nil {
 		return err
@@ -284,23 +331,13 @@ func queuekick() {
 	}
 }
 
-// Kick sets the NextAttempt for messages matching all parameters that are nonzero,
-// and kicks the queue, attempting delivery of those messages. If all parameters
-// are zero, all messages are kicked.
+// Kick sets the NextAttempt for messages matching the filter to now, and kicks
+// the queue, attempting delivery of those messages. An empty filter kicks all
+// messages. Held messages are not delivered until released.
 // Returns number of messages queued for immediate delivery.
-func Kick(ctx context.Context, ID int64, toDomain string, recipient string) (int, error) {
+func Kick(ctx context.Context, f Filter) (int, error) {
 	q := bstore.QueryDB[Msg](ctx, DB)
-	if ID > 0 {
-		q.FilterID(ID)
-	}
-	if toDomain != "" {
-		q.FilterEqual("RecipientDomainStr", toDomain)
-	}
-	if recipient != "" {
-		q.FilterFn(func(qm Msg) bool {
-			return qm.Recipient().XString(true) == recipient
-		})
-	}
+	f.apply(q)
 	n, err := q.UpdateNonzero(Msg{NextAttempt: time.Now()})
 	if err != nil {
 		return 0, fmt.Errorf("selecting and updating messages in queue: %v", err)
@@ -309,22 +346,38 @@ func Kick(ctx context.Context, ID int64, toDomain string, recipient string) (int
 	return n, nil
 }
 
-// Drop removes messages from the queue that match all nonzero parameters.
-// If all parameters are zero, all messages are removed.
-// Returns number of messages removed.
-func Drop(ctx context.Context, ID int64, toDomain string, recipient string) (int, error) {
+// Reschedule changes the requested future release time of messages matching
+// the filter that were submitted with a future release and have not had a
+// delivery attempt yet. Other messages are not changed. If release is zero or in
+// the past, a future release is cancelled and the messages are delivered
+// immediately.
+// Returns the number of messages changed.
+func Reschedule(ctx context.Context, f Filter, release time.Time) (int, error) {
 	q := bstore.QueryDB[Msg](ctx, DB)
-	if ID > 0 {
-		q.FilterID(ID)
-	}
-	if toDomain != "" {
-		q.FilterEqual("RecipientDomainStr", toDomain)
+	f.apply(q)
+	q.FilterEqual("Attempts", 0)
+	q.FilterFn(func(m Msg) bool { return !m.FutureRelease.IsZero() })
+	now := time.Now()
+	var fields map[string]any
+	if release.After(now) {
+		fields = map[string]any{"FutureRelease": release, "NextAttempt": release}
+	} else {
+		fields = map[string]any{"FutureRelease": time.Time{}, "NextAttempt": now}
 	}
-	if recipient != "" {
-		q.FilterFn(func(qm Msg) bool {
-			return qm.Recipient().XString(true) == recipient
-		})
+	n, err := q.UpdateFields(fields)
+	if err != nil {
+		return 0, fmt.Errorf("selecting and updating messages in queue: %v", err)
 	}
+	queuekick()
+	return n, nil
+}
+
+// Drop removes messages matching the filter from the queue. An empty filter
+// removes all messages.
+// Returns number of messages removed.
+func Drop(ctx context.Context, f Filter) (int, error) {
+	q := bstore.QueryDB[Msg](ctx, DB)
+	f.apply(q)
 	var msgs []Msg
 	q.Gather(&msgs)
 	n, err := q.Delete()
@@ -345,6 +398,27 @@ type ReadReaderAtCloser interface {
 	io.ReaderAt
 }
 
+// RenameAccount changes the sender account of queued and retired messages, hold
+// rules and pending webhook calls, after an account was renamed.
+func RenameAccount(ctx context.Context, log *mlog.Log, account, newName string) error {
+	return DB.Write(ctx, func(tx *bstore.Tx) error {
+		if _, err := bstore.QueryTx[Msg](tx).FilterNonzero(Msg{SenderAccount: account}).UpdateNonzero(Msg{SenderAccount: newName}); err != nil {
+			return fmt.Errorf("updating messages: %w", err)
+		}
+		if _, err := bstore.QueryTx[MsgRetired](tx).FilterNonzero(MsgRetired{SenderAccount: account}).UpdateNonzero(MsgRetired{SenderAccount: newName}); err != nil {
+			return fmt.Errorf("updating retired messages: %w", err)
+		}
+		if _, err := bstore.QueryTx[HoldRule](tx).FilterNonzero(HoldRule{Account: account}).UpdateNonzero(HoldRule{Account: newName}); err != nil {
+			return fmt.Errorf("updating hold rules: %w", err)
+		}
+		if _, err := bstore.QueryTx[Webhook](tx).FilterNonzero(Webhook{Account: account}).UpdateNonzero(Webhook{Account: newName}); err != nil {
+			return fmt.Errorf("updating webhooks: %w", err)
+		}
+		log.Info("renamed account in queue", mlog.Field("account", account), mlog.Field("newname", newName))
+		return nil
+	})
+}
+
 // OpenMessage opens a message present in the queue.
 func OpenMessage(ctx context.Context, id int64) (ReadReaderAtCloser, error) {
 	qm := Msg{ID: id}
@@ -370,9 +444,6 @@ func Start(resolver dns.Resolver, done chan struct{}) error {
 
 	// High-level delivery strategy advice: ../rfc/5321:3685
 	go func() {
-		// Map keys are either dns.Domain.Name()'s, or string-formatted IP addresses.
-		busyDomains := map[string]struct{}{}
-
 		timer := time.NewTimer(0)
 
 		for {
@@ -382,16 +453,38 @@ func Start(resolver dns.Resolver, done chan struct{}) error {
 				return
 			case <-kick:
 			case <-timer.C:
-			case domain := <-deliveryResult:
-				delete(busyDomains, domain)
+			case <-deliveryResult:
 			}
 
-			if len(busyDomains) >= maxConcurrentDeliveries {
+			if domainLimiter.total() >= maxConcurrentDeliveries {
 				continue
 			}
 
+			// Map keys are either dns.Domain.Name()'s, or string-formatted IP addresses.
+			busyDomains, _ := domainLimiter.blocked(time.Now())
 			launchWork(resolver, busyDomains)
-			timer.Reset(nextWork(mox.Shutdown, busyDomains))
+			busyDomains, wake := domainLimiter.blocked(time.Now())
+			next := nextWork(mox.Shutdown, busyDomains)
+			if !wake.IsZero() && time.Until(wake) < next {
+				next = time.Until(wake)
+			}
+			timer.Reset(next)
+		}
+	}()
+
+	startWebhooks()
+
+	// Periodically remove delivery history past its retention period.
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			historyCleanup(mox.Shutdown, xlog)
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 	return nil
@@ -399,6 +492,7 @@ func Start(resolver dns.Resolver, done chan struct{}) error {
 
 func nextWork(ctx context.Context, busyDomains map[string]struct{}) time.Duration {
 	q := bstore.QueryDB[Msg](ctx, DB)
+	q.FilterEqual("Hold", false)
 	if len(busyDomains) > 0 {
 		var doms []any
 		for d := range busyDomains {
@@ -418,9 +512,13 @@ func nextWork(ctx context.Context, busyDomains map[string]struct{}) time.Duratio
 	return time.Until(qm.NextAttempt)
 }
 
+// launchWork starts deliveries for messages that are due, for recipient domains
+// that are not in busyDomains and within the limits for the domain.
+// Domains that reach their limit are added to busyDomains.
 func launchWork(resolver dns.Resolver, busyDomains map[string]struct{}) int {
 	q := bstore.QueryDB[Msg](mox.Shutdown, DB)
 	q.FilterLessEqual("NextAttempt", time.Now())
+	q.FilterEqual("Hold", false)
 	q.SortAsc("NextAttempt")
 	q.Limit(maxConcurrentDeliveries)
 	if len(busyDomains) > 0 {
@@ -437,26 +535,98 @@ func launchWork(resolver dns.Resolver, busyDomains map[string]struct{}) int {
 		return -1
 	}
 
+	n := 0
 	for _, m := range msgs {
-		busyDomains[formatIPDomain(m.RecipientDomain)] = struct{}{}
+		if domainLimiter.total() >= maxConcurrentDeliveries {
+			break
+		}
+		domain := formatIPDomain(m.RecipientDomain)
+		if _, ok := busyDomains[domain]; ok {
+			continue
+		}
+		if ok, _ := domainLimiter.start(domain, time.Now()); !ok {
+			busyDomains[domain] = struct{}{}
+			continue
+		}
+		n++
 		go deliver(resolver, m)
 	}
-	return len(msgs)
+	return n
 }
 
-// Remove message from queue in database and file system.
-func queueDelete(ctx context.Context, msgID int64) error {
-	if err := DB.Delete(ctx, &Msg{ID: msgID}); err != nil {
-		return err
+// Default intervals between delivery attempts. Delivery attempts: immediately,
+// 7.5m, 15m, 30m, 1h, 2h (send delayed DSN), 4h, 8h (send permanent failure DSN).
+var defaultRetrySchedule = []time.Duration{
+	7*time.Minute + 30*time.Second,
+	15 * time.Minute,
+	30 * time.Minute,
+	1 * time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+}
+
+const defaultDelayDSNAfter = 90 * time.Minute
+
+// retryPolicy holds the effective retry settings for a recipient domain.
+type retryPolicy struct {
+	schedule      []time.Duration
+	maxLifetime   time.Duration // Zero means no limit.
+	delayDSNAfter time.Duration
+}
+
+// retryPolicyFor returns the retry settings for a recipient domain, with
+// per-domain overrides and defaults applied.
+func retryPolicyFor(d dns.IPDomain) retryPolicy {
+	q := mox.Conf.Static.Queue
+	p := retryPolicy{q.RetrySchedule, q.MaxLifetime, q.DelayDSNAfter}
+	if dp, ok := q.DomainPoliciesParsed[d.Domain]; ok && len(d.IP) == 0 {
+		if len(dp.RetrySchedule) > 0 {
+			p.schedule = dp.RetrySchedule
+		}
+		if dp.MaxLifetime > 0 {
+			p.maxLifetime = dp.MaxLifetime
+		}
+		if dp.DelayDSNAfter > 0 {
+			p.delayDSNAfter = dp.DelayDSNAfter
+		}
+	}
+	if len(p.schedule) == 0 {
+		p.schedule = defaultRetrySchedule
+	}
+	if p.delayDSNAfter == 0 {
+		p.delayDSNAfter = defaultDelayDSNAfter
 	}
-	// If removing from database fails, we'll also leave the file in the file system.
+	return p
+}
 
-	p := mox.DataDirPath(filepath.Join("queue", store.MessagePath(msgID)))
-	if err := os.Remove(p); err != nil {
-		return fmt.Errorf("removing queue message from file system: %v", err)
+// backoff returns the time until the next delivery attempt after the attempt
+// following the given number of earlier attempts, with some jitter. If final is
+// set, the schedule is exhausted and a failure must be treated as permanent.
+func (p retryPolicy) backoff(attempts int) (backoff time.Duration, final bool) {
+	i := attempts
+	if i >= len(p.schedule) {
+		i = len(p.schedule) - 1
+		final = true
+	}
+	backoff = p.schedule[i] + time.Duration(jitter.Intn(10)-5)*time.Second
+	if backoff <= 0 {
+		backoff = p.schedule[i]
 	}
+	return backoff, final
+}
 
-	return nil
+// retryUntil returns the time of the last delivery attempt, assuming all
+// remaining attempts in the schedule are made. Used in delayed DSNs.
+func (p retryPolicy) retryUntil(m Msg, now time.Time) time.Time {
+	t := now
+	for i := m.Attempts - 1; i >= 0 && i < len(p.schedule); i++ {
+		t = t.Add(p.schedule[i])
+	}
+	if p.maxLifetime > 0 && t.After(m.baseTime().Add(p.maxLifetime)) {
+		t = m.baseTime().Add(p.maxLifetime)
+	}
+	return t
 }
 
 // deliver attempts to deliver a message.
@@ -467,6 +637,7 @@ func deliver(resolver dns.Resolver, m Msg) {
 	qlog := xlog.WithCid(cid).Fields(mlog.Field("from", m.Sender()), mlog.Field("recipient", m.Recipient()), mlog.Field("attempts", m.Attempts), mlog.Field("msgid", m.ID))
 
 	defer func() {
+		domainLimiter.done(formatIPDomain(m.RecipientDomain))
 		deliveryResult <- formatIPDomain(m.RecipientDomain)
 
 		x := recover()
@@ -478,20 +649,20 @@ func deliver(resolver dns.Resolver, m Msg) {
 	}()
 
 	// We register this attempt by setting last_attempt, and already next_attempt time
-	// in the future with exponential backoff. If we run into trouble delivery below,
-	// at least we won't be bothering the receiving server with our problems.
-	// Delivery attempts: immediately, 7.5m, 15m, 30m, 1h, 2h (send delayed DSN), 4h,
-	// 8h, 16h (send permanent failure DSN).
+	// in the future with backoff from the retry schedule. If we run into trouble
+	// delivery below, at least we won't be bothering the receiving server with our
+	// problems.
 	// ../rfc/5321:3703
-	// todo future: make the back off times configurable. ../rfc/5321:3713
-	backoff := time.Duration(7*60+30+jitter.Intn(10)-5) * time.Second
-	for i := 0; i < m.Attempts; i++ {
-		backoff *= time.Duration(2)
-	}
+	retry := retryPolicyFor(m.RecipientDomain)
+	prevAttempt := m.LastAttempt
+	backoff, final := retry.backoff(m.Attempts)
 	m.Attempts++
 	now := time.Now()
 	m.LastAttempt = &now
 	m.NextAttempt = now.Add(backoff)
+	if retry.maxLifetime > 0 && m.NextAttempt.After(m.baseTime().Add(retry.maxLifetime)) {
+		final = true
+	}
 	qup := bstore.QueryDB[Msg](mox.Shutdown, DB)
 	qup.FilterID(m.ID)
 	update := Msg{Attempts: m.Attempts, NextAttempt: m.NextAttempt, LastAttempt: m.LastAttempt}
@@ -500,33 +671,49 @@ func deliver(resolver dns.Resolver, m Msg) {
 		return
 	}
 
+	// Details of the last delivery attempt to a host, kept in the delivery history.
+	var result attemptResult
+
 	fail := func(permanent bool, remoteMTA dsn.NameIP, secodeOpt, errmsg string) {
-		if permanent || m.Attempts >= 8 {
+		if permanent || final {
 			qlog.Errorx("permanent failure delivering from queue", errors.New(errmsg))
 			queueDSNFailure(qlog, m, remoteMTA, secodeOpt, errmsg)
 
-			if err := queueDelete(context.Background(), m.ID); err != nil {
-				qlog.Errorx("deleting message from queue after permanent failure", err)
+			result.response = errmsg
+			if err := queueRetire(context.Background(), m, false, result); err != nil {
+				qlog.Errorx("removing message from queue after permanent failure", err)
 			}
+			action, status, diagCode := dsnStatus(true, secodeOpt, errmsg)
+			d := &WebhookDSN{ReportingMTA: mox.Conf.Static.HostnameDomain.ASCII, Action: string(action), Status: status, RemoteMTA: remoteMTA.Name, DiagnosticCode: diagCode}
+			queueWebhook(context.Background(), qlog, m.SenderAccount, msgWebhookEvent(WebhookFailed, m, result, d))
 			return
 		}
 
 		qup := bstore.QueryDB[Msg](context.Background(), DB)
 		qup.FilterID(m.ID)
-		if _, err := qup.UpdateNonzero(Msg{LastError: errmsg, DialedIPs: m.DialedIPs}); err != nil {
+		fields := map[string]any{"LastError": errmsg, "DialedIPs": m.DialedIPs, "LastTranscript": result.transcript}
+		if _, err := qup.UpdateFields(fields); err != nil {
 			qlog.Errorx("storing delivery error", err, mlog.Field("deliveryerror", errmsg))
 		}
 
-		if m.Attempts == 5 {
-			// We've attempted deliveries at these intervals: 0, 7.5m, 15m, 30m, 1h, 2u.
-			// Let sender know delivery is delayed.
+		// Let sender know delivery is delayed, once, on the first failure after the
+		// configured delay.
+		delayed := func(tm time.Time) bool {
+			return tm.Sub(m.baseTime()) >= retry.delayDSNAfter
+		}
+		if delayed(now) && (prevAttempt == nil || !delayed(*prevAttempt)) {
 			qlog.Errorx("temporary failure delivering from queue, sending delayed dsn", errors.New(errmsg), mlog.Field("backoff", backoff))
 
-			retryUntil := m.LastAttempt.Add((4 + 8 + 16) * time.Hour)
-			queueDSNDelay(qlog, m, remoteMTA, secodeOpt, errmsg, retryUntil)
+			queueDSNDelay(qlog, m, remoteMTA, secodeOpt, errmsg, retry.retryUntil(m, now))
 		} else {
 			qlog.Errorx("temporary failure delivering from queue", errors.New(errmsg), mlog.Field("backoff", backoff), mlog.Field("nextattempt", m.NextAttempt))
 		}
+
+		result.response = errmsg
+		retryUntil := retry.retryUntil(m, now)
+		action, status, diagCode := dsnStatus(false, secodeOpt, errmsg)
+		d := &WebhookDSN{ReportingMTA: mox.Conf.Static.HostnameDomain.ASCII, Action: string(action), Status: status, RemoteMTA: remoteMTA.Name, DiagnosticCode: diagCode, WillRetryUntil: &retryUntil}
+		queueWebhook(context.Background(), qlog, m.SenderAccount, msgWebhookEvent(WebhookDelayed, m, result, d))
 	}
 
 	hosts, effectiveDomain, permanent, err := gatherHosts(resolver, m, cid, qlog)
@@ -555,18 +742,23 @@ func deliver(resolver dns.Resolver, m Msg) {
 	}
 
 	// We try delivery to each record until we have success or a permanent failure. So
-	// for transient errors, we'll try the next MX record. For MX records pointing to a
-	// dual stack host, we turn a permanent failure due to policy on the first delivery
-	// attempt into a temporary failure and make sure to try the other address family
-	// the next attempt. This should reduce issues due to one of our IPs being on a
-	// block list. We won't try multiple IPs of the same address family. Surprisingly,
-	// RFC 5321 does not specify a clear algorithm, but common practicie is probably
-	// ../rfc/3974:268.
+	// for transient errors, we'll try the next MX record. Permanent failures that are
+	// specific to a host, e.g. a size limit, are also followed by the next MX record,
+	// the message only fails permanently if all hosts refused it. For MX records
+	// pointing to a dual stack host, we turn a permanent failure due to policy on the
+	// first delivery attempt into a temporary failure and make sure to try the other
+	// address family the next attempt. This should reduce issues due to one of our IPs
+	// being on a block list. We won't try multiple IPs of the same address family.
+	// Surprisingly, RFC 5321 does not specify a clear algorithm, but common practicie
+	// is probably ../rfc/3974:268.
 	var remoteMTA dsn.NameIP
 	var secodeOpt, errmsg string
 	permanent = false
 	mtastsFailure := true
-	// todo: should make distinction between host permanently not accepting the message, and the message not being deliverable permanently. e.g. a mx host may have a size limit, or not accept 8bitmime, while another host in the list does accept the message. same for smtputf8, ../rfc/6531:555
+	var attempted, limited bool // Whether a delivery was attempted, and whether hosts were skipped due to limits.
+	var limitedUntil time.Time
+	var hostOnly bool        // Whether the last failure was permanent for the host only.
+	allHostPermanent := true // Whether all attempted hosts failed with a permanent failure specific to the host.
 	for _, h := range hosts {
 		var badTLS, ok bool
 
@@ -581,6 +773,23 @@ func deliver(resolver dns.Resolver, m Msg) {
 			continue
 		}
 
+		// We don't start a delivery to a host that is at its limits, but continue with the
+		// next host. If we cannot deliver to any host due to limits, we try again later,
+		// without counting this attempt.
+		hostKey := formatIPDomain(h)
+		if ok, until := hostLimiter.start(hostKey, time.Now()); !ok {
+			qlog.Info("mx host is at its delivery limits, skipping", mlog.Field("host", h), mlog.Field("until", until))
+			limited = true
+			if !until.IsZero() && (limitedUntil.IsZero() || until.Before(limitedUntil)) {
+				limitedUntil = until
+			}
+			if errmsg == "" {
+				errmsg = fmt.Sprintf("mx host %s is at delivery limits", h)
+			}
+			continue
+		}
+		attempted = true
+
 		qlog.Info("delivering to remote", mlog.Field("remote", h), mlog.Field("queuecid", cid))
 		cid := mox.Cid()
 		nqlog := qlog.WithCid(cid)
@@ -589,28 +798,59 @@ func deliver(resolver dns.Resolver, m Msg) {
 		if policy != nil && policy.Mode == mtasts.ModeEnforce {
 			tlsMode = smtpclient.TLSStrict
 		}
-		permanent, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, cid, h, &m, tlsMode)
-		if !ok && badTLS && tlsMode == smtpclient.TLSOpportunistic {
-			// In case of failure with opportunistic TLS, try again without TLS. ../rfc/7435:459
-			// todo future: revisit this decision. perhaps it should be a configuration option that defaults to not doing this?
-			nqlog.Info("connecting again for delivery attempt without tls")
-			permanent, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, cid, h, &m, smtpclient.TLSSkip)
-		}
+		func() {
+			// Deferred, so the host isn't kept at its limits after a panic.
+			defer hostLimiter.done(hostKey)
+
+			permanent, hostOnly, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, cid, h, &m, tlsMode, &result)
+			if !ok && badTLS && tlsMode == smtpclient.TLSOpportunistic {
+				// In case of failure with opportunistic TLS, try again without TLS. ../rfc/7435:459
+				// todo future: revisit this decision. perhaps it should be a configuration option that defaults to not doing this?
+				nqlog.Info("connecting again for delivery attempt without tls")
+				permanent, hostOnly, badTLS, secodeOpt, remoteIP, errmsg, ok = deliverHost(nqlog, resolver, cid, h, &m, smtpclient.TLSSkip, &result)
+			}
+		}()
 		if ok {
 			nqlog.Info("delivered from queue")
-			if err := queueDelete(context.Background(), m.ID); err != nil {
-				nqlog.Errorx("deleting message from queue after delivery", err)
+			if err := queueRetire(context.Background(), m, true, result); err != nil {
+				nqlog.Errorx("removing message from queue after delivery", err)
 			}
+			queueWebhook(context.Background(), nqlog, m.SenderAccount, msgWebhookEvent(WebhookDelivered, m, result, nil))
 			return
 		}
 		remoteMTA = dsn.NameIP{Name: h.XString(false), IP: remoteIP}
 		if !badTLS {
 			mtastsFailure = false
 		}
-		if permanent {
+		if permanent && !hostOnly {
 			break
+		} else if permanent {
+			nqlog.Info("permanent failure specific to mx host, trying next host", mlog.Field("host", h), mlog.Field("errmsg", errmsg))
+		} else {
+			allHostPermanent = false
 		}
 	}
+	if permanent && hostOnly {
+		// Only a permanent failure if no host could accept the message, and we didn't
+		// skip hosts due to limits.
+		permanent = allHostPermanent && !limited
+	}
+	if !attempted && limited {
+		// Not a real attempt, restore the previous state with a new time for the next
+		// attempt.
+		next := limitedUntil
+		if next.IsZero() {
+			next = time.Now().Add(time.Minute)
+		}
+		qlog.Info("all mx hosts at delivery limits, postponing delivery", mlog.Field("nextattempt", next))
+		qup := bstore.QueryDB[Msg](context.Background(), DB)
+		qup.FilterID(m.ID)
+		fields := map[string]any{"Attempts": m.Attempts - 1, "LastAttempt": prevAttempt, "NextAttempt": next}
+		if _, err := qup.UpdateFields(fields); err != nil {
+			qlog.Errorx("storing postponed delivery", err)
+		}
+		return
+	}
 	if mtastsFailure && policyFresh {
 		permanent = true
 	}
@@ -726,19 +966,30 @@ func gatherHosts(resolver dns.Resolver, m Msg, cid int64, qlog *mlog.Log) (hosts
 
 // deliverHost attempts to deliver m to host.
 // deliverHost updated m.DialedIPs, which must be saved in case of failure to deliver.
-func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDomain, m *Msg, tlsMode smtpclient.TLSMode) (permanent, badTLS bool, secodeOpt string, remoteIP net.IP, errmsg string, ok bool) {
+// Details about the attempt are stored in attempt.
+// A permanent failure that is specific to this host, e.g. due to a size limit, is
+// indicated with hostOnly, and delivery to other hosts can still succeed.
+func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDomain, m *Msg, tlsMode smtpclient.TLSMode, attempt *attemptResult) (permanent, hostOnly, badTLS bool, secodeOpt string, remoteIP net.IP, errmsg string, ok bool) {
 	// About attempting delivery to multiple addresses of a host: ../rfc/5321:3898
 
 	start := time.Now()
 	var deliveryResult string
+	var tlsVersion, response, transcript string
 	defer func() {
+		*attempt = attemptResult{remoteMX: host.XString(false), tlsMode: string(tlsMode), tlsVersion: tlsVersion, response: response, transcript: transcript}
+		if remoteIP != nil {
+			attempt.remoteIP = remoteIP.String()
+		}
+		if !ok {
+			attempt.response = errmsg
+		}
 		metricDeliveryHost.WithLabelValues(fmt.Sprintf("%d", m.Attempts), string(tlsMode), deliveryResult).Observe(float64(time.Since(start)) / float64(time.Second))
-		log.Debug("queue deliverhost result", mlog.Field("host", host), mlog.Field("attempt", m.Attempts), mlog.Field("tlsmode", tlsMode), mlog.Field("permanent", permanent), mlog.Field("badtls", badTLS), mlog.Field("secodeopt", secodeOpt), mlog.Field("errmsg", errmsg), mlog.Field("ok", ok), mlog.Field("duration", time.Since(start)))
+		log.Debug("queue deliverhost result", mlog.Field("host", host), mlog.Field("attempt", m.Attempts), mlog.Field("tlsmode", tlsMode), mlog.Field("permanent", permanent), mlog.Field("hostonly", hostOnly), mlog.Field("badtls", badTLS), mlog.Field("secodeopt", secodeOpt), mlog.Field("errmsg", errmsg), mlog.Field("ok", ok), mlog.Field("duration", time.Since(start)))
 	}()
 
 	f, err := os.Open(m.MessagePath())
 	if err != nil {
-		return false, false, "", nil, fmt.Sprintf("open message file: %s", err), false
+		return false, false, false, "", nil, fmt.Sprintf("open message file: %s", err), false
 	}
 	msgr := store.FileMsgReader(m.MsgPrefix, f)
 	defer func() {
@@ -750,7 +1001,15 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 	ctx, cancel := context.WithTimeout(cidctx, 30*time.Second)
 	defer cancel()
 
-	conn, ip, dualstack, err := dialHost(ctx, log, resolver, host, m)
+	var localIPs []net.IP
+	var ourHostname dns.Domain
+	if ident := outgoingIdentity(*m); ident != nil {
+		localIPs = ident.ParsedIPs
+		ourHostname = ident.HostnameDomain
+		log = log.Fields(mlog.Field("localips", localIPs), mlog.Field("ourhostname", ourHostname))
+	}
+
+	conn, ip, dualstack, err := dialHost(ctx, log, resolver, host, m, localIPs)
 	remoteIP = ip
 	cancel()
 	var result string
@@ -767,7 +1026,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 	metricConnection.WithLabelValues(result).Inc()
 	if err != nil {
 		log.Debugx("connecting to remote smtp", err, mlog.Field("host", host))
-		return false, false, "", ip, fmt.Sprintf("dialing smtp server: %v", err), false
+		return false, false, false, "", ip, fmt.Sprintf("dialing smtp server: %v", err), false
 	}
 
 	var mailFrom string
@@ -781,7 +1040,7 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 	ctx, cancel = context.WithTimeout(cidctx, 30*time.Minute)
 	defer cancel()
 	mox.Connections.Register(conn, "smtpclient", "queue")
-	sc, err := smtpclient.New(ctx, log, conn, tlsMode, host.String(), "")
+	sc, err := smtpclient.New(ctx, log, conn, tlsMode, ourHostname, host.String(), "")
 	defer func() {
 		if sc == nil {
 			conn.Close()
@@ -790,6 +1049,11 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 		}
 		mox.Connections.Unregister(conn)
 	}()
+	var nerr smtpclient.Error
+	if errors.As(err, &nerr) {
+		// Greeting, EHLO or STARTTLS failed, keep what was exchanged until then.
+		transcript = nerr.Transcript
+	}
 	if err == nil {
 		has8bit := m.Has8bit
 		smtputf8 := m.SMTPUTF8
@@ -800,8 +1064,40 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 			smtputf8 = true
 			size = int64(len(m.DSNUTF8))
 			msg = bytes.NewReader(m.DSNUTF8)
+		} else if has8bit && !sc.Supports8BITMIME() || smtputf8 && !sc.SupportsSMTPUTF8() {
+			// Remote does not implement an extension required for this message. We convert
+			// it to 7-bit ASCII, which may still fail, e.g. for non-ASCII localparts. Other
+			// hosts may implement the extensions. ../rfc/6152:100 ../rfc/6531:555
+			log.Info("remote does not support required extensions, downgrading message", mlog.Field("8bitmime", sc.Supports8BITMIME()), mlog.Field("smtputf8", sc.SupportsSMTPUTF8()))
+			df, dsize, derr := downgradeMessage(m, msgr)
+			if derr != nil {
+				tlsVersion = sc.TLSVersion()
+				transcript = sc.Transcript()
+				deliveryResult = "permerror"
+				errmsg := fmt.Sprintf("remote does not support 8bitmime and/or smtputf8, and message cannot be downgraded: %v", derr)
+				return true, true, false, smtp.SeMsg6NonASCIIAddrNotPermitted7, ip, errmsg, false
+			}
+			defer func() {
+				name := df.Name()
+				err := df.Close()
+				log.Check(err, "closing downgraded message")
+				err = os.Remove(name)
+				log.Check(err, "removing downgraded message")
+			}()
+			has8bit = false
+			smtputf8 = false
+			size = dsize
+			msg = df
+			mailFrom = ""
+			if m.SenderLocalpart != "" || !m.SenderDomain.IsZero() {
+				mailFrom = m.Sender().XString(false)
+			}
+			rcptTo = m.Recipient().XString(false)
 		}
 		err = sc.Deliver(ctx, mailFrom, rcptTo, size, msg, has8bit, smtputf8)
+		tlsVersion = sc.TLSVersion()
+		response = sc.LastResponse()
+		transcript = sc.Transcript()
 	}
 	if err != nil {
 		log.Infox("delivery failed", err)
@@ -823,8 +1119,17 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 		deliveryResult = "error"
 	}
 	if err == nil {
-		return false, false, "", ip, "", true
+		return false, false, false, "", ip, "", true
 	} else if cerr, ok := err.(smtpclient.Error); ok {
+		// Servers respond with 421 or 451 when we are sending too much. Back off from the
+		// whole destination, for all messages.
+		if !cerr.Permanent && (cerr.Code == smtp.C421ServiceUnavail || cerr.Code == smtp.C451LocalErr) {
+			log.Info("remote server is throttling, backing off from destination", mlog.Field("host", host), mlog.Field("code", cerr.Code))
+			now := time.Now()
+			hostLimiter.throttle(formatIPDomain(host), now)
+			domainLimiter.throttle(formatIPDomain(m.RecipientDomain), now)
+		}
+
 		// If we are being rejected due to policy reasons on the first
 		// attempt and remote has both IPv4 and IPv6, we'll give it
 		// another try. Our first IP may be in a block list, the address for
@@ -833,20 +1138,106 @@ func deliverHost(log *mlog.Log, resolver dns.Resolver, cid int64, host dns.IPDom
 		if permanent && m.Attempts == 1 && dualstack && strings.HasPrefix(cerr.Secode, "7.") {
 			permanent = false
 		}
-		return permanent, errors.Is(cerr, smtpclient.ErrTLS), cerr.Secode, ip, cerr.Error(), false
+		return permanent, permanent && hostPermanent(cerr), errors.Is(cerr, smtpclient.ErrTLS), cerr.Secode, ip, cerr.Error(), false
 	} else {
-		return false, errors.Is(cerr, smtpclient.ErrTLS), "", ip, err.Error(), false
+		return false, false, errors.Is(cerr, smtpclient.ErrTLS), "", ip, err.Error(), false
+	}
+}
+
+// hostPermanent returns whether a permanent failure is specific to the remote
+// host, instead of to the message or recipient. E.g. a message size limit, missing
+// support for a required feature, or a protocol error. Other MX hosts may accept
+// the message.
+func hostPermanent(cerr smtpclient.Error) bool {
+	if errors.Is(cerr, smtpclient.ErrSize) {
+		return true
+	}
+	if cerr.Secode != "" {
+		// Mail system status, e.g. 5.3.4 message too big for system. ../rfc/3463:540
+		// Protocol status, e.g. 5.5.4 invalid command arguments. ../rfc/3463:618
+		// Conversion and non-ASCII address issues. ../rfc/3463:690 ../rfc/6531:604
+		switch {
+		case strings.HasPrefix(cerr.Secode, "3."), strings.HasPrefix(cerr.Secode, "5."):
+			return true
+		case cerr.Secode == "6.3", cerr.Secode == "6.5", cerr.Secode == "6.7":
+			return true
+		}
+		return false
+	}
+	// Without enhanced status codes, we look at the response code. Syntax errors and
+	// unimplemented commands/parameters, and 552 which is commonly used for size
+	// limits. ../rfc/5321:2506 ../rfc/1870:174
+	switch cerr.Code {
+	case smtp.C500BadSyntax, smtp.C501BadParamSyntax, smtp.C502CmdNotImpl, smtp.C503BadCmdSeq, smtp.C504ParamNotImpl, smtp.C552MailboxFull, smtp.C555UnrecognizedAddrParams:
+		return true
+	}
+	return false
+}
+
+// downgradeMessage writes a 7-bit ASCII version of the message to a temporary
+// file, for delivery to a host that does not implement 8BITMIME or SMTPUTF8. The
+// caller must close and remove the file. The addresses in the SMTP transaction must
+// not have non-ASCII localparts.
+func downgradeMessage(m *Msg, msgr *store.MsgReader) (*os.File, int64, error) {
+	for _, lp := range []smtp.Localpart{m.SenderLocalpart, m.RecipientLocalpart} {
+		for _, c := range []byte(lp) {
+			if c >= 0x80 {
+				return nil, 0, fmt.Errorf("%w: %q", message.ErrDowngradeLocalpart, lp)
+			}
+		}
+	}
+
+	f, err := store.CreateMessageTemp("queue-downgrade")
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating temporary file: %v", err)
+	}
+	remove := func() {
+		name := f.Name()
+		f.Close()
+		os.Remove(name)
 	}
+	if err := message.Downgrade(f, msgr, m.Size); err != nil {
+		remove()
+		return nil, 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		remove()
+		return nil, 0, fmt.Errorf("seeking in downgraded message: %v", err)
+	}
+	return f, size, nil
+}
+
+// outgoingIdentity returns the configured local IPs and hostname for delivering
+// m: of the domain of the SMTP MAIL FROM address, or otherwise of the account
+// that submitted the message. Returns nil if neither is configured, for the
+// defaults.
+func outgoingIdentity(m Msg) *config.OutgoingIdentity {
+	if !m.SenderDomain.IsZero() {
+		if dc, ok := mox.Conf.Domain(m.SenderDomain.Domain); ok && dc.OutgoingIdentity != nil {
+			return dc.OutgoingIdentity
+		}
+	}
+	if m.SenderAccount != "" {
+		if ac, ok := mox.Conf.Account(m.SenderAccount); ok && ac.OutgoingIdentity != nil {
+			return ac.OutgoingIdentity
+		}
+	}
+	return nil
 }
 
 // dialHost dials host for delivering Msg, taking previous attempts into accounts.
 // If the previous attempt used IPv4, this attempt will use IPv6 (in case one of the IPs is in a DNSBL).
 // The second attempt for an address family we prefer the same IP as earlier, to increase our chances if remote is doing greylisting.
 // dialHost updates m with the dialed IP and m should be saved in case of failure.
-// If we have fully specified local smtp listen IPs, we set those for the outgoing
-// connection. The admin probably configured these same IPs in SPF, but others
-// possibly not.
-func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, host dns.IPDomain, m *Msg) (conn net.Conn, ip net.IP, dualstack bool, rerr error) {
+// The local address is the first IP of the same address family from localIPs,
+// typically from an outgoing identity. Otherwise, if we have fully specified local
+// smtp listen IPs, we set those for the outgoing connection. The admin probably
+// configured these same IPs in SPF, but others possibly not.
+func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, host dns.IPDomain, m *Msg, localIPs []net.IP) (conn net.Conn, ip net.IP, dualstack bool, rerr error) {
 	var ips []net.IP
 	if len(host.IP) > 0 {
 		ips = []net.IP{host.IP}
@@ -909,11 +1300,16 @@ func dialHost(ctx context.Context, log *mlog.Log, resolver dns.Resolver, host dn
 		addr := net.JoinHostPort(ip.String(), "25")
 		log.Debug("dialing remote smtp", mlog.Field("addr", addr))
 		var laddr net.Addr
-		for _, lip := range mox.Conf.Static.SpecifiedSMTPListenIPs {
-			ipIs4 := ip.To4() != nil
-			lipIs4 := lip.To4() != nil
-			if ipIs4 == lipIs4 {
-				laddr = &net.TCPAddr{IP: lip}
+		for _, l := range [][]net.IP{localIPs, mox.Conf.Static.SpecifiedSMTPListenIPs} {
+			for _, lip := range l {
+				ipIs4 := ip.To4() != nil
+				lipIs4 := lip.To4() != nil
+				if ipIs4 == lipIs4 {
+					laddr = &net.TCPAddr{IP: lip}
+					break
+				}
+			}
+			if laddr != nil {
 				break
 			}
 		}
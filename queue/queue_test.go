@@ -15,9 +15,11 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/config"
 	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
 	"github.com/mjl-/mox/store"
 )
 
@@ -30,12 +32,21 @@ func tcheck(t *testing.T, err error, msg string) {
 	}
 }
 
+func tcompare(t *testing.T, got, exp any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+}
+
 func setup(t *testing.T) (*store.Account, func()) {
 	// Prepare config so email can be delivered to mjl@mox.example.
 	os.RemoveAll("../testdata/queue/data")
 	mox.Context = ctxbg
 	mox.ConfigStaticPath = "../testdata/queue/mox.conf"
 	mox.MustLoadConfig(false)
+	domainLimiter = newLimiter(true)
+	hostLimiter = newLimiter(false)
 	acc, err := store.OpenAccount("mjl")
 	tcheck(t, err, "open account")
 	err = acc.SetPassword("testtest")
@@ -73,22 +84,22 @@ func TestQueue(t *testing.T) {
 	err := Init()
 	tcheck(t, err, "queue init")
 
-	msgs, err := List(ctxbg)
+	msgs, err := List(ctxbg, Filter{}, Page{})
 	tcheck(t, err, "listing messages in queue")
 	if len(msgs) != 0 {
 		t.Fatalf("got %d messages in queue, expected 0", len(msgs))
 	}
 
 	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
-	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
 	tcheck(t, err, "add message to queue for delivery")
 
 	mf2 := prepareFile(t)
-	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, mf2, nil, false)
+	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), "", time.Time{}, nil, mf2, nil, false)
 	tcheck(t, err, "add message to queue for delivery")
 	os.Remove(mf2.Name())
 
-	msgs, err = List(ctxbg)
+	msgs, err = List(ctxbg, Filter{}, Page{})
 	tcheck(t, err, "listing queue")
 	if len(msgs) != 2 {
 		t.Fatalf("got msgs %v, expected 1", msgs)
@@ -97,7 +108,7 @@ func TestQueue(t *testing.T) {
 	if msg.Attempts != 0 {
 		t.Fatalf("msg attempts %d, expected 0", msg.Attempts)
 	}
-	n, err := Drop(ctxbg, msgs[1].ID, "", "")
+	n, err := Drop(ctxbg, Filter{IDs: []int64{msgs[1].ID}})
 	tcheck(t, err, "drop")
 	if n != 1 {
 		t.Fatalf("dropped %d, expected 1", n)
@@ -167,12 +178,12 @@ func TestQueue(t *testing.T) {
 		t.Fatalf("message mismatch, got %q, expected %q", string(msgbuf), testmsg)
 	}
 
-	n, err = Kick(ctxbg, msg.ID+1, "", "")
+	n, err = Kick(ctxbg, Filter{IDs: []int64{msg.ID + 1}})
 	tcheck(t, err, "kick")
 	if n != 0 {
 		t.Fatalf("kick %d, expected 0", n)
 	}
-	n, err = Kick(ctxbg, msg.ID, "", "")
+	n, err = Kick(ctxbg, Filter{IDs: []int64{msg.ID}})
 	tcheck(t, err, "kick")
 	if n != 1 {
 		t.Fatalf("kicked %d, expected 1", n)
@@ -220,7 +231,7 @@ func TestQueue(t *testing.T) {
 		case <-smtpdone:
 			i := 0
 			for {
-				xmsgs, err := List(ctxbg)
+				xmsgs, err := List(ctxbg, Filter{}, Page{})
 				tcheck(t, err, "list queue")
 				if len(xmsgs) == 0 {
 					break
@@ -239,11 +250,21 @@ func TestQueue(t *testing.T) {
 	}
 	<-deliveryResult // Deliver sends here.
 
+	// Delivered message is kept in the history.
+	hist, err := HistoryList(ctxbg, HistoryFilter{})
+	tcheck(t, err, "list history")
+	if len(hist) != 1 {
+		t.Fatalf("history has %d messages, expected 1", len(hist))
+	}
+	if h := hist[0]; h.ID != msg.ID || !h.Success || h.Attempts != 2 || h.RemoteMX != "mox.example" || h.RemoteIP != "127.0.0.1" || h.TLSMode != string(smtpclient.TLSOpportunistic) || h.Response != "250 ok" {
+		t.Fatalf("unexpected history record %#v", h)
+	}
+
 	// Add another message that we'll fail to deliver entirely.
-	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
 	tcheck(t, err, "add message to queue for delivery")
 
-	msgs, err = List(ctxbg)
+	msgs, err = List(ctxbg, Filter{}, Page{})
 	tcheck(t, err, "list queue")
 	if len(msgs) != 1 {
 		t.Fatalf("queue has %d messages, expected 1", len(msgs))
@@ -285,11 +306,25 @@ func TestQueue(t *testing.T) {
 	comm := store.RegisterComm(acc)
 	defer comm.Unregister()
 
+	// Simulate the passing of time until the next attempt, so the delayed DSN is
+	// sent at the right attempt, and throttling by the remote server has expired.
+	elapse := func() {
+		domainLimiter = newLimiter(true)
+		hostLimiter = newLimiter(false)
+		d := time.Until(msg.NextAttempt)
+		msg.Queued = msg.Queued.Add(-d)
+		if msg.LastAttempt != nil {
+			t := msg.LastAttempt.Add(-d)
+			msg.LastAttempt = &t
+		}
+	}
+
 	for i := 1; i < 8; i++ {
 		go func() { <-deliveryResult }() // Deliver sends here.
 		deliver(resolver, msg)
 		err = DB.Get(ctxbg, &msg)
 		tcheck(t, err, "get msg")
+		elapse()
 		if msg.Attempts != i {
 			t.Fatalf("got attempt %d, expected %d", msg.Attempts, i)
 		}
@@ -315,6 +350,12 @@ func TestQueue(t *testing.T) {
 	if err != bstore.ErrAbsent {
 		t.Fatalf("attempt to fetch delivered and removed message from queue, got err %v, expected ErrAbsent", err)
 	}
+	failure := false
+	hist, err = HistoryList(ctxbg, HistoryFilter{Success: &failure})
+	tcheck(t, err, "list history")
+	if len(hist) != 1 || hist[0].ID != msg.ID || hist[0].Attempts != 8 || hist[0].Response == "" {
+		t.Fatalf("unexpected history after permanent failure %#v", hist)
+	}
 
 	timer.Reset(time.Second)
 	changes := make(chan struct{}, 1)
@@ -329,6 +370,52 @@ func TestQueue(t *testing.T) {
 	}
 }
 
+func TestRetryPolicy(t *testing.T) {
+	defer func() {
+		mox.Conf.Static.Queue = config.Queue{}
+	}()
+	partner := dns.Domain{ASCII: "partner.example"}
+	mox.Conf.Static.Queue = config.Queue{
+		MaxLifetime: 24 * time.Hour,
+		DomainPoliciesParsed: map[dns.Domain]config.QueuePolicy{
+			partner: {RetrySchedule: []time.Duration{time.Minute, 2 * time.Minute}},
+		},
+	}
+
+	within := func(d, exp time.Duration) {
+		t.Helper()
+		if d < exp-5*time.Second || d > exp+5*time.Second {
+			t.Fatalf("got backoff %v, expected around %v", d, exp)
+		}
+	}
+
+	// Defaults, with global max lifetime.
+	p := retryPolicyFor(dns.IPDomain{Domain: dns.Domain{ASCII: "other.example"}})
+	if p.maxLifetime != 24*time.Hour || p.delayDSNAfter != defaultDelayDSNAfter || len(p.schedule) != len(defaultRetrySchedule) {
+		t.Fatalf("unexpected default policy %v", p)
+	}
+	d, final := p.backoff(0)
+	within(d, 7*time.Minute+30*time.Second)
+	tcompare(t, final, false)
+	_, final = p.backoff(len(defaultRetrySchedule))
+	tcompare(t, final, true)
+
+	// Domain override, with max lifetime from global config.
+	p = retryPolicyFor(dns.IPDomain{Domain: partner})
+	d, final = p.backoff(1)
+	within(d, 2*time.Minute)
+	tcompare(t, final, false)
+	_, final = p.backoff(2)
+	tcompare(t, final, true)
+	tcompare(t, p.maxLifetime, 24*time.Hour)
+
+	now := time.Now()
+	m := Msg{Queued: now, Attempts: 1}
+	tcompare(t, p.retryUntil(m, now), now.Add(3*time.Minute))
+	m.Queued = now.Add(-24*time.Hour + time.Minute)
+	tcompare(t, p.retryUntil(m, now), now.Add(time.Minute))
+}
+
 // test Start and that it attempts to deliver.
 func TestQueueStart(t *testing.T) {
 	// Override dial function. We'll make connecting fail and check the attempt.
@@ -374,7 +461,7 @@ func TestQueueStart(t *testing.T) {
 	}
 
 	path := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
-	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), nil, prepareFile(t), nil, true)
+	err = Add(ctxbg, xlog, "mjl", path, path, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
 	tcheck(t, err, "add message to queue for delivery")
 	checkDialed(true)
 
@@ -383,7 +470,7 @@ func TestQueueStart(t *testing.T) {
 	checkDialed(false)
 
 	// Kick for real, should see another attempt.
-	n, err := Kick(ctxbg, 0, "mox.example", "")
+	n, err := Kick(ctxbg, Filter{To: "@mox.example"})
 	tcheck(t, err, "kick queue")
 	if n != 1 {
 		t.Fatalf("kick changed %d messages, expected 1", n)
@@ -520,7 +607,9 @@ func TestDialHost(t *testing.T) {
 		},
 	}
 
+	var dialLocal net.Addr
 	dial = func(ctx context.Context, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		dialLocal = laddr
 		return nil, nil // No error, nil connection isn't used.
 	}
 
@@ -529,12 +618,380 @@ func TestDialHost(t *testing.T) {
 	}
 
 	m := Msg{DialedIPs: map[string][]net.IP{}}
-	_, ip, dualstack, err := dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m)
+	_, ip, dualstack, err := dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m, nil)
 	if err != nil || ip.String() != "10.0.0.1" || !dualstack {
 		t.Fatalf("expected err nil, address 10.0.0.1, dualstack true, got %v %v %v", err, ip, dualstack)
 	}
-	_, ip, dualstack, err = dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m)
+	_, ip, dualstack, err = dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m, nil)
 	if err != nil || ip.String() != "2001:db8::1" || !dualstack {
 		t.Fatalf("expected err nil, address 2001:db8::1, dualstack true, got %v %v %v", err, ip, dualstack)
 	}
+
+	// Local IP of the same address family is used.
+	localIPs := []net.IP{net.ParseIP("2001:db8::2"), net.ParseIP("10.0.0.2")}
+	m = Msg{DialedIPs: map[string][]net.IP{}}
+	_, ip, _, err = dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m, localIPs)
+	tcheck(t, err, "dial host")
+	if ip.String() != "10.0.0.1" || dialLocal == nil || dialLocal.String() != "10.0.0.2:0" {
+		t.Fatalf("got ip %v, local address %v, expected 10.0.0.1 from 10.0.0.2", ip, dialLocal)
+	}
+	_, ip, _, err = dialHost(ctxbg, xlog, resolver, ipdomain("dualstack.example"), &m, localIPs)
+	tcheck(t, err, "dial host")
+	if ip.String() != "2001:db8::1" || dialLocal == nil || dialLocal.String() != "[2001:db8::2]:0" {
+		t.Fatalf("got ip %v, local address %v, expected 2001:db8::1 from 2001:db8::2", ip, dialLocal)
+	}
+}
+
+func TestOutgoingIdentity(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	domIdent := &config.OutgoingIdentity{IPs: []string{"10.0.0.2"}, Hostname: "dom.mox.example"}
+	accIdent := &config.OutgoingIdentity{IPs: []string{"10.0.0.3"}, Hostname: "acc.mox.example"}
+
+	dom := mox.Conf.Dynamic.Domains["mox.example"]
+	dom.OutgoingIdentity = domIdent
+	mox.Conf.Dynamic.Domains["mox.example"] = dom
+	acc := mox.Conf.Dynamic.Accounts["mjl"]
+	acc.OutgoingIdentity = accIdent
+	mox.Conf.Dynamic.Accounts["mjl"] = acc
+	defer func() {
+		dom.OutgoingIdentity = nil
+		mox.Conf.Dynamic.Domains["mox.example"] = dom
+		acc.OutgoingIdentity = nil
+		mox.Conf.Dynamic.Accounts["mjl"] = acc
+	}()
+
+	msg := func(account, senderDomain string) Msg {
+		return Msg{SenderAccount: account, SenderDomain: dns.IPDomain{Domain: dns.Domain{ASCII: senderDomain}}}
+	}
+	tcompare(t, outgoingIdentity(msg("mjl", "mox.example")), domIdent) // Domain takes precedence.
+	tcompare(t, outgoingIdentity(msg("mjl", "other.example")), accIdent)
+	tcompare(t, outgoingIdentity(msg("", "mox.example")), domIdent)
+	tcompare(t, outgoingIdentity(msg("", "")), (*config.OutgoingIdentity)(nil)) // E.g. DSNs.
+}
+
+func TestFutureRelease(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+	release := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "", release, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue")
+
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	m := msgs[0]
+	if !m.FutureRelease.Equal(release) || !m.NextAttempt.Equal(release) {
+		t.Fatalf("got future release %v, next attempt %v, expected %v", m.FutureRelease, m.NextAttempt, release)
+	}
+	// Lifetime of the message starts at the release time.
+	tcompare(t, m.baseTime().Equal(release), true)
+
+	// Move release time.
+	release = release.Add(time.Hour)
+	n, err := Reschedule(ctxbg, Filter{IDs: []int64{m.ID}}, release)
+	tcheck(t, err, "reschedule")
+	tcompare(t, n, 1)
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	m = msgs[0]
+	if !m.FutureRelease.Equal(release) || !m.NextAttempt.Equal(release) {
+		t.Fatalf("got future release %v, next attempt %v, expected %v", m.FutureRelease, m.NextAttempt, release)
+	}
+
+	// Cancel future release, message is delivered immediately.
+	n, err = Reschedule(ctxbg, Filter{Account: "mjl"}, time.Time{})
+	tcheck(t, err, "reschedule")
+	tcompare(t, n, 1)
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	m = msgs[0]
+	if !m.FutureRelease.IsZero() || m.NextAttempt.After(time.Now()) {
+		t.Fatalf("got future release %v, next attempt %v, expected immediate delivery", m.FutureRelease, m.NextAttempt)
+	}
+	tcompare(t, m.baseTime().Equal(m.Queued), true)
+
+	// Messages without future release are not rescheduled.
+	n, err = Reschedule(ctxbg, Filter{}, release)
+	tcheck(t, err, "reschedule")
+	tcompare(t, n, 0)
+
+	// Messages with delivery attempts are not rescheduled.
+	_, err = bstore.QueryDB[Msg](ctxbg, DB).UpdateNonzero(Msg{FutureRelease: release})
+	tcheck(t, err, "set future release")
+	_, err = bstore.QueryDB[Msg](ctxbg, DB).UpdateField("Attempts", 1)
+	tcheck(t, err, "update attempts")
+	n, err = Reschedule(ctxbg, Filter{}, release)
+	tcheck(t, err, "reschedule")
+	tcompare(t, n, 0)
+}
+
+// Test permanent failures specific to a host causing delivery to the next MX
+// host, and downgrading of messages for hosts without 8BITMIME/SMTPUTF8.
+func TestDeliverHostPermanent(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"mx1.remote.example.": {"10.0.0.1"},
+			"mx2.remote.example.": {"10.0.0.2"},
+		},
+		MX: map[string][]*net.MX{
+			"remote.example.": {{Host: "mx1.remote.example.", Pref: 10}, {Host: "mx2.remote.example.", Pref: 20}},
+		},
+	}
+
+	// Fake SMTP servers, by address, with the extensions they announce and their
+	// response to the message data.
+	type server struct {
+		ext  []string
+		resp string
+	}
+	var servers map[string]server
+	type delivery struct {
+		addr, mailFrom, data string
+	}
+	received := make(chan delivery, 2)
+	dial = func(ctx context.Context, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		srv := servers[addr]
+		sconn, cconn := net.Pipe()
+		go func() {
+			defer sconn.Close()
+			br := bufio.NewReader(sconn)
+			fmt.Fprintf(sconn, "220 mox.example\r\n")
+			br.ReadString('\n') // Should be EHLO.
+			lines := append([]string{"mox.example"}, srv.ext...)
+			for i, s := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				fmt.Fprintf(sconn, "250%s%s\r\n", sep, s)
+			}
+			mailFrom, _ := br.ReadString('\n')
+			if !strings.HasPrefix(mailFrom, "MAIL FROM:") {
+				// Client gave up on this host, e.g. when it cannot downgrade the message.
+				return
+			}
+			fmt.Fprintf(sconn, "250 ok\r\n")
+			br.ReadString('\n') // Should be RCPT TO.
+			fmt.Fprintf(sconn, "250 ok\r\n")
+			br.ReadString('\n') // Should be DATA.
+			fmt.Fprintf(sconn, "354 continue\r\n")
+			buf, err := io.ReadAll(smtp.NewDataReader(br))
+			if err != nil {
+				return
+			}
+			received <- delivery{addr, strings.TrimSpace(mailFrom), string(buf)}
+			fmt.Fprintf(sconn, "%s\r\n", srv.resp)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
+					fmt.Fprintf(sconn, "221 ok\r\n")
+					return
+				}
+				fmt.Fprintf(sconn, "250 ok\r\n")
+			}
+		}()
+		return cconn, nil
+	}
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+
+	// Deliver a message, returning the deliveries seen by the servers and the
+	// message from the history.
+	test := func(msg string, has8bit, smtputf8 bool) ([]delivery, MsgRetired) {
+		t.Helper()
+		mf, err := store.CreateMessageTemp("queue")
+		tcheck(t, err, "create temp message")
+		_, err = mf.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		err = Add(ctxbg, xlog, "mjl", from, rcpt, has8bit, smtputf8, int64(len(msg)), "", time.Time{}, nil, mf, nil, true)
+		tcheck(t, err, "add message to queue")
+		msgs, err := List(ctxbg, Filter{}, Page{})
+		tcheck(t, err, "list queue")
+		tcompare(t, len(msgs), 1)
+
+		deliver(resolver, msgs[0])
+		<-deliveryResult
+
+		var l []delivery
+		for len(received) > 0 {
+			l = append(l, <-received)
+		}
+		hist, err := HistoryList(ctxbg, HistoryFilter{Limit: 1})
+		tcheck(t, err, "list history")
+		if len(hist) != 1 || hist[0].ID != msgs[0].ID {
+			t.Fatalf("message not retired after delivery attempt, history %v", hist)
+		}
+		return l, hist[0]
+	}
+
+	// Size limit at first host, delivered to second.
+	servers = map[string]server{
+		"10.0.0.1:25": {nil, "552 5.3.4 message too big for system"},
+		"10.0.0.2:25": {nil, "250 ok"},
+	}
+	l, mr := test(testmsg, false, false)
+	tcompare(t, len(l), 2)
+	tcompare(t, mr.Success, true)
+	tcompare(t, mr.RemoteMX, "mx2.remote.example")
+
+	// Message-level failure at first host is not retried at the second.
+	servers = map[string]server{
+		"10.0.0.1:25": {nil, "550 5.1.1 no such user"},
+		"10.0.0.2:25": {nil, "250 ok"},
+	}
+	l, mr = test(testmsg, false, false)
+	tcompare(t, len(l), 1)
+	tcompare(t, mr.Success, false)
+
+	// Host-level failure at all hosts is a permanent failure.
+	servers = map[string]server{
+		"10.0.0.1:25": {nil, "552 5.3.4 message too big for system"},
+		"10.0.0.2:25": {nil, "554 5.5.0 protocol error"},
+	}
+	l, mr = test(testmsg, false, false)
+	tcompare(t, len(l), 2)
+	tcompare(t, mr.Success, false)
+
+	// Message requiring 8BITMIME and SMTPUTF8 is downgraded for host without them.
+	const utf8msg = "From: <mjl@mox.example>\r\nTo: <a@remote.example>\r\nSubject: héllo\r\n\r\nwörld\r\n"
+	servers = map[string]server{
+		"10.0.0.1:25": {nil, "250 ok"},
+	}
+	l, mr = test(utf8msg, true, true)
+	tcompare(t, mr.Success, true)
+	tcompare(t, len(l), 1)
+	d := l[0]
+	tcompare(t, d.mailFrom, "MAIL FROM:<mjl@mox.example>")
+	exp := "Subject: =?utf-8?q?h=C3=A9llo?=\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nw=C3=B6rld\r\n"
+	if !strings.HasSuffix(d.data, exp) {
+		t.Fatalf("got downgraded message %q, expected suffix %q", d.data, exp)
+	}
+
+	// Not downgraded for host implementing the extensions.
+	servers = map[string]server{
+		"10.0.0.1:25": {[]string{"8BITMIME", "SMTPUTF8"}, "250 ok"},
+	}
+	l, _ = test(utf8msg, true, true)
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].mailFrom, "MAIL FROM:<mjl@mox.example> BODY=8BITMIME SMTPUTF8")
+	tcompare(t, l[0].data, utf8msg)
+
+	// Non-ASCII localpart cannot be downgraded, next host is tried.
+	rcpt.Localpart = "møx"
+	servers = map[string]server{
+		"10.0.0.1:25": {nil, "250 ok"},
+		"10.0.0.2:25": {[]string{"8BITMIME", "SMTPUTF8"}, "250 ok"},
+	}
+	l, mr = test(utf8msg, true, true)
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].addr, "10.0.0.2:25")
+	tcompare(t, mr.Success, true)
+}
+
+func TestLastTranscript(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	resolver := dns.MockResolver{
+		A:  map[string][]string{"mx.remote.example.": {"10.0.0.1"}},
+		MX: map[string][]*net.MX{"remote.example.": {{Host: "mx.remote.example.", Pref: 10}}},
+	}
+	dial = func(ctx context.Context, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		sconn, cconn := net.Pipe()
+		go func() {
+			defer sconn.Close()
+			br := bufio.NewReader(sconn)
+			fmt.Fprintf(sconn, "220 mox.example\r\n")
+			br.ReadString('\n') // Should be EHLO.
+			fmt.Fprintf(sconn, "250 mox.example\r\n")
+			br.ReadString('\n') // Should be MAIL FROM.
+			fmt.Fprintf(sconn, "250 ok\r\n")
+			br.ReadString('\n') // Should be RCPT TO.
+			fmt.Fprintf(sconn, "250 ok\r\n")
+			br.ReadString('\n') // Should be DATA.
+			fmt.Fprintf(sconn, "354 continue\r\n")
+			io.Copy(io.Discard, smtp.NewDataReader(br))
+			fmt.Fprintf(sconn, "451 4.3.0 try again later\r\n")
+			br.ReadString('\n') // Should be QUIT.
+			fmt.Fprintf(sconn, "221 ok\r\n")
+		}()
+		return cconn, nil
+	}
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+	err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "", time.Time{}, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue")
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 1)
+
+	deliver(resolver, msgs[0])
+	<-deliveryResult
+
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 1)
+	exp := strings.Join([]string{
+		"S: 220 mox.example",
+		"C: EHLO " + mox.Conf.Static.HostnameDomain.ASCII,
+		"S: 250 mox.example",
+		"C: MAIL FROM:<mjl@mox.example>",
+		"S: 250 ok",
+		"C: RCPT TO:<a@remote.example>",
+		"S: 250 ok",
+		"C: DATA",
+		"S: 354 continue",
+		"C: (message data)",
+		"S: 451 4.3.0 try again later",
+	}, "\n")
+	tcompare(t, msgs[0].LastTranscript, exp)
+	tcompare(t, msgs[0].LastError != "", true)
+
+	// A failure during EHLO also keeps the transcript. The remote throttled us, reset.
+	domainLimiter = newLimiter(true)
+	hostLimiter = newLimiter(false)
+	dial = func(ctx context.Context, timeout time.Duration, addr string, laddr net.Addr) (net.Conn, error) {
+		sconn, cconn := net.Pipe()
+		go func() {
+			defer sconn.Close()
+			br := bufio.NewReader(sconn)
+			fmt.Fprintf(sconn, "220 mox.example\r\n")
+			br.ReadString('\n') // Should be EHLO.
+			fmt.Fprintf(sconn, "421 4.3.2 shutting down\r\n")
+			br.ReadString('\n') // Possibly QUIT.
+		}()
+		return cconn, nil
+	}
+	deliver(resolver, msgs[0])
+	<-deliveryResult
+
+	msgs, err = List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	tcompare(t, len(msgs), 1)
+	exp = strings.Join([]string{
+		"S: 220 mox.example",
+		"C: EHLO " + mox.Conf.Static.HostnameDomain.ASCII,
+		"S: 421 4.3.2 shutting down",
+	}, "\n")
+	tcompare(t, msgs[0].LastTranscript, exp)
 }
@@ -0,0 +1,436 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/metrics"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/moxvar"
+)
+
+// Accounts can configure an HTTP webhook that is called for events about their
+// outgoing messages. Calls are stored in the queue database before they are made,
+// and retried with backoff on failure, so events survive restarts.
+
+// Webhook event types.
+const (
+	WebhookDelivered   = "delivered"   // Message was delivered to the remote mail server.
+	WebhookDelayed     = "delayed"     // Temporary failure, delivery will be retried.
+	WebhookFailed      = "failed"      // Permanent failure, no further deliveries are attempted.
+	WebhookIncomingDSN = "incomingdsn" // DSN received for a message sent earlier.
+)
+
+// Intervals between attempts to call a webhook. After the last, the call is
+// dropped.
+var webhookRetrySchedule = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	1 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+	12 * time.Hour,
+}
+
+// WebhookHTTPClient is used for calling webhooks.
+var WebhookHTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("redirect not allowed for webhooks")
+	},
+}
+
+var webhookKick = make(chan struct{}, 1)
+
+// Maximum number of accounts for which webhooks are called concurrently. Calls
+// for a single account are made one at a time, in order.
+const webhookConcurrency = 10
+
+var webhookSlots = make(chan struct{}, webhookConcurrency)
+
+// Accounts for which webhooks are currently being called.
+var webhookBusy = struct {
+	sync.Mutex
+	accounts map[string]bool
+}{accounts: map[string]bool{}}
+
+// For waiting until calls in progress are done, in tests.
+var webhookWorkers sync.WaitGroup
+
+func webhookAccountBusy(account string) bool {
+	webhookBusy.Lock()
+	defer webhookBusy.Unlock()
+	return webhookBusy.accounts[account]
+}
+
+// WebhookEvent is the JSON body of a webhook call.
+type WebhookEvent struct {
+	ID         int64     // Unique ID for this event. Retried calls have the same ID.
+	Event      string    // One of delivered, delayed, failed, incomingdsn.
+	Time       time.Time // Time of event.
+	QueueMsgID int64     // ID of the message in the queue. Zero for an incoming DSN that could not be matched to an outgoing message.
+	MessageID  string    // Message-ID header of the message, including <>.
+	From       string    // SMTP MAIL FROM address.
+	To         string    // SMTP RCPT TO address.
+	Attempts   int       // Number of delivery attempts so far.
+
+	// Details of the last delivery attempt, not set for incoming DSNs.
+	RemoteMX   string
+	RemoteIP   string
+	TLSVersion string // E.g. TLS1.3, empty if TLS was not used.
+	Response   string // SMTP response line or error message.
+
+	// For delayed and failed events, the DSN sent to the sender. For incoming DSNs,
+	// the DSN that was received.
+	DSN *WebhookDSN `json:",omitempty"`
+}
+
+// WebhookDSN holds the per-recipient fields of a DSN.
+type WebhookDSN struct {
+	ReportingMTA   string
+	Action         string // E.g. failed, delayed, delivered, relayed, expanded.
+	Status         string // Enhanced status code, e.g. 5.1.1.
+	RemoteMTA      string
+	DiagnosticCode string
+	WillRetryUntil *time.Time `json:",omitempty"`
+}
+
+// Webhook is a pending call of the webhook of an account.
+type Webhook struct {
+	ID          int64
+	Account     string
+	Queued      time.Time `bstore:"default now"`
+	Attempts    int
+	NextAttempt time.Time `bstore:"index"`
+	LastError   string
+	Event       WebhookEvent
+}
+
+func webhookkick() {
+	select {
+	case webhookKick <- struct{}{}:
+	default:
+	}
+}
+
+// webhookWanted returns the webhook config of the account if it wants calls for
+// event.
+func webhookWanted(accountName, event string) *config.OutgoingWebhook {
+	if accountName == "" {
+		return nil
+	}
+	acc, ok := mox.Conf.Account(accountName)
+	if !ok || acc.OutgoingWebhook == nil {
+		return nil
+	}
+	wh := acc.OutgoingWebhook
+	if len(wh.Events) == 0 {
+		return wh
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return wh
+		}
+	}
+	return nil
+}
+
+// queueWebhook stores a call of the webhook of the account for the event, if
+// the account wants it.
+func queueWebhook(ctx context.Context, log *mlog.Log, accountName string, ev WebhookEvent) {
+	if webhookWanted(accountName, ev.Event) == nil {
+		return
+	}
+	h := Webhook{Account: accountName, NextAttempt: time.Now(), Event: ev}
+	if err := DB.Insert(ctx, &h); err != nil {
+		log.Errorx("storing webhook call", err, mlog.Field("account", accountName), mlog.Field("event", ev.Event))
+		return
+	}
+	webhookkick()
+}
+
+// msgWebhookEvent returns a webhook event for a message in the queue.
+func msgWebhookEvent(event string, m Msg, r attemptResult, d *WebhookDSN) WebhookEvent {
+	return WebhookEvent{
+		Event:      event,
+		Time:       time.Now(),
+		QueueMsgID: m.ID,
+		MessageID:  m.MessageID,
+		From:       m.Sender().XString(true),
+		To:         m.Recipient().XString(true),
+		Attempts:   m.Attempts,
+		RemoteMX:   r.remoteMX,
+		RemoteIP:   r.remoteIP,
+		TLSVersion: r.tlsVersion,
+		Response:   r.response,
+		DSN:        d,
+	}
+}
+
+// IncomingDSN calls the webhook of the account, if configured, for a DSN that
+// was delivered to the account. The DSN is matched by message-id and recipient
+// to the original message in the queue or the delivery history. Messages that
+// are not DSNs are ignored.
+func IncomingDSN(ctx context.Context, log *mlog.Log, accountName string, r io.ReaderAt) {
+	if webhookWanted(accountName, WebhookIncomingDSN) == nil {
+		return
+	}
+	dsnMsg, _, err := dsn.Parse(r)
+	if err != nil {
+		// Most messages are not DSNs.
+		return
+	}
+	if dsnMsg.OriginalMessageID == "" {
+		log.Debug("incoming dsn without message-id of original message, not calling webhook")
+		return
+	}
+
+	for _, rcpt := range dsnMsg.Recipients {
+		to := rcpt.FinalRecipient.XString(true)
+		ev := WebhookEvent{
+			Event:     WebhookIncomingDSN,
+			Time:      time.Now(),
+			MessageID: dsnMsg.OriginalMessageID,
+			To:        to,
+			DSN: &WebhookDSN{
+				ReportingMTA:   dsnMsg.ReportingMTA,
+				Action:         string(rcpt.Action),
+				Status:         rcpt.Status,
+				RemoteMTA:      rcpt.RemoteMTA.Name,
+				DiagnosticCode: rcpt.DiagnosticCode,
+				WillRetryUntil: rcpt.WillRetryUntil,
+			},
+		}
+
+		q := bstore.QueryDB[Msg](ctx, DB)
+		q.FilterNonzero(Msg{SenderAccount: accountName, MessageID: dsnMsg.OriginalMessageID})
+		q.FilterFn(func(m Msg) bool { return strings.EqualFold(m.Recipient().XString(true), to) })
+		q.Limit(1)
+		if m, err := q.Get(); err == nil {
+			ev.QueueMsgID = m.ID
+			ev.From = m.Sender().XString(true)
+			ev.Attempts = m.Attempts
+		} else if err != bstore.ErrAbsent {
+			log.Errorx("looking up original message in queue for dsn", err)
+		} else {
+			q := bstore.QueryDB[MsgRetired](ctx, DB)
+			q.FilterNonzero(MsgRetired{SenderAccount: accountName, MessageID: dsnMsg.OriginalMessageID})
+			q.FilterFn(func(m MsgRetired) bool { return strings.EqualFold(m.Recipient().XString(true), to) })
+			q.SortDesc("Retired")
+			q.Limit(1)
+			if m, err := q.Get(); err == nil {
+				ev.QueueMsgID = m.ID
+				ev.From = m.Sender().XString(true)
+				ev.Attempts = m.Attempts
+			} else if err != bstore.ErrAbsent {
+				log.Errorx("looking up original message in queue history for dsn", err)
+			}
+		}
+		queueWebhook(ctx, log, accountName, ev)
+	}
+}
+
+// startWebhooks starts calling webhooks, until mox.Shutdown.
+func startWebhooks() {
+	go func() {
+		log := xlog.Fields(mlog.Field("subsystem", "webhook"))
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-mox.Shutdown.Done():
+				return
+			case <-webhookKick:
+			case <-timer.C:
+			}
+			webhooksCall(mox.Shutdown, log)
+			timer.Reset(webhookNext(mox.Shutdown, log))
+		}
+	}()
+}
+
+// webhookNext returns the duration until the next webhook call is due. Calls for
+// accounts with calls in progress are ignored, a kick follows when they are done.
+func webhookNext(ctx context.Context, log *mlog.Log) time.Duration {
+	q := bstore.QueryDB[Webhook](ctx, DB)
+	q.FilterFn(func(h Webhook) bool { return !webhookAccountBusy(h.Account) })
+	q.SortAsc("NextAttempt")
+	q.Limit(1)
+	h, err := q.Get()
+	if err == bstore.ErrAbsent {
+		return 24 * time.Hour
+	} else if err != nil {
+		log.Errorx("finding time for next webhook call", err)
+		return time.Minute
+	}
+	return time.Until(h.NextAttempt)
+}
+
+// webhooksCall starts making the webhook calls that are due, concurrently for
+// up to webhookConcurrency accounts, so a slow webhook of one account does not
+// delay calls for other accounts. Per account, calls are made one at a time, in
+// order of queueing. When the calls for an account are done, a kick is sent to
+// check for more calls.
+func webhooksCall(ctx context.Context, log *mlog.Log) {
+	q := bstore.QueryDB[Webhook](ctx, DB)
+	q.FilterLessEqual("NextAttempt", time.Now())
+	q.FilterFn(func(h Webhook) bool { return !webhookAccountBusy(h.Account) })
+	q.SortAsc("NextAttempt")
+	q.Limit(100)
+	l, err := q.List()
+	if err != nil {
+		log.Errorx("listing webhook calls", err)
+		return
+	}
+
+	var accounts []string
+	calls := map[string][]Webhook{}
+	for _, h := range l {
+		if _, ok := calls[h.Account]; !ok {
+			accounts = append(accounts, h.Account)
+		}
+		calls[h.Account] = append(calls[h.Account], h)
+	}
+
+	for _, account := range accounts {
+		select {
+		case webhookSlots <- struct{}{}:
+		default:
+			// All slots in use. We'll get a kick when a slot frees up.
+			return
+		}
+
+		webhookBusy.Lock()
+		webhookBusy.accounts[account] = true
+		webhookBusy.Unlock()
+
+		webhookWorkers.Add(1)
+		go func(account string, l []Webhook) {
+			defer func() {
+				x := recover()
+				if x != nil {
+					log.Error("unhandled panic while calling webhooks", mlog.Field("panic", x), mlog.Field("account", account))
+					metrics.PanicInc("webhook")
+				}
+
+				webhookBusy.Lock()
+				delete(webhookBusy.accounts, account)
+				webhookBusy.Unlock()
+				<-webhookSlots
+				webhookWorkers.Done()
+				webhookkick()
+			}()
+
+			for _, h := range l {
+				// After a failure, the endpoint is likely down. Remaining calls are retried in a
+				// next round instead of each waiting for a timeout now.
+				if ctx.Err() != nil || !webhookCall(ctx, log, h) {
+					return
+				}
+			}
+		}(account, calls[account])
+	}
+}
+
+// webhookCall makes a single webhook call, and removes it or schedules the next
+// attempt. It returns whether the call succeeded.
+func webhookCall(ctx context.Context, log *mlog.Log, h Webhook) bool {
+	log = log.Fields(mlog.Field("account", h.Account), mlog.Field("event", h.Event.Event), mlog.Field("webhookid", h.ID))
+
+	acc, ok := mox.Conf.Account(h.Account)
+	if !ok || acc.OutgoingWebhook == nil {
+		log.Info("webhook no longer configured for account, dropping call")
+		err := DB.Delete(ctx, &Webhook{ID: h.ID})
+		log.Check(err, "removing webhook call")
+		return true
+	}
+
+	h.Attempts++
+	ev := h.Event
+	ev.ID = h.ID
+	err := webhookPost(ctx, *acc.OutgoingWebhook, ev, h.Attempts)
+	if err == nil {
+		log.Debug("webhook called")
+		err := DB.Delete(ctx, &Webhook{ID: h.ID})
+		log.Check(err, "removing webhook call after success")
+		return true
+	}
+	if h.Attempts > len(webhookRetrySchedule) {
+		log.Errorx("calling webhook failed, giving up", err, mlog.Field("attempts", h.Attempts))
+		err := DB.Delete(ctx, &Webhook{ID: h.ID})
+		log.Check(err, "removing webhook call")
+		return false
+	}
+	log.Infox("calling webhook failed, will retry", err, mlog.Field("attempts", h.Attempts))
+	h.LastError = err.Error()
+	h.NextAttempt = time.Now().Add(webhookRetrySchedule[h.Attempts-1])
+	err = DB.Update(ctx, &h)
+	log.Check(err, "storing webhook call after failure")
+	return false
+}
+
+// webhookSignature returns the value for the Mox-Webhook-Signature header, over
+// the timestamp as sent in the Mox-Webhook-Timestamp header, a dot, and the
+// body. Receivers can reject requests with old timestamps, to prevent replays.
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookPost(ctx context.Context, wh config.OutgoingWebhook, ev WebhookEvent, attempt int) error {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal event: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, WebhookHTTPClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("new http request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mox/"+moxvar.Version)
+	req.Header.Set("Mox-Webhook-ID", fmt.Sprintf("%d", ev.ID))
+	req.Header.Set("Mox-Webhook-Event", ev.Event)
+	req.Header.Set("Mox-Webhook-Attempt", fmt.Sprintf("%d", attempt))
+	timestamp := time.Now().Unix()
+	req.Header.Set("Mox-Webhook-Timestamp", fmt.Sprintf("%d", timestamp))
+	req.Header.Set("Mox-Webhook-Signature", webhookSignature(wh.Secret, timestamp, buf))
+
+	start := time.Now()
+	resp, err := WebhookHTTPClient.Do(req)
+	var code int
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	metrics.HTTPClientObserve(ctx, "webhook", req.Method, code, err, start)
+	if err != nil {
+		return fmt.Errorf("http post: %v", err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	xlog.Check(err, "reading webhook response body")
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("http status %s, expected 2xx", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/dsn"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestWebhook(t *testing.T) {
+	_, cleanup := setup(t)
+	defer cleanup()
+	err := Init()
+	tcheck(t, err, "queue init")
+
+	type call struct {
+		event     WebhookEvent
+		signature string
+	}
+	calls := make(chan call, 10)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := io.ReadAll(r.Body)
+		tcheck(t, err, "read body")
+		var ev WebhookEvent
+		err = json.Unmarshal(buf, &ev)
+		tcheck(t, err, "parse event")
+		timestamp, err := strconv.ParseInt(r.Header.Get("Mox-Webhook-Timestamp"), 10, 64)
+		if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			t.Errorf("bad timestamp %q", r.Header.Get("Mox-Webhook-Timestamp"))
+		}
+		if sig := r.Header.Get("Mox-Webhook-Signature"); sig != webhookSignature("secret", timestamp, buf) {
+			t.Errorf("bad signature %q", sig)
+		}
+		calls <- call{ev, r.Header.Get("Mox-Webhook-Event")}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	acc := mox.Conf.Dynamic.Accounts["mjl"]
+	acc.OutgoingWebhook = &config.OutgoingWebhook{URL: srv.URL, Secret: "secret", Events: []string{WebhookDelivered, WebhookIncomingDSN}}
+	mox.Conf.Dynamic.Accounts["mjl"] = acc
+	defer func() {
+		acc.OutgoingWebhook = nil
+		mox.Conf.Dynamic.Accounts["mjl"] = acc
+	}()
+
+	pending := func() []Webhook {
+		t.Helper()
+		l, err := bstore.QueryDB[Webhook](ctxbg, DB).List()
+		tcheck(t, err, "list webhooks")
+		return l
+	}
+
+	from := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	rcpt := smtp.Path{Localpart: "a", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+	err = Add(ctxbg, xlog, "mjl", from, rcpt, false, false, int64(len(testmsg)), "<test@mox.example>", time.Time{}, nil, prepareFile(t), nil, true)
+	tcheck(t, err, "add message to queue")
+	msgs, err := List(ctxbg, Filter{}, Page{})
+	tcheck(t, err, "list queue")
+	m := msgs[0]
+	m.Attempts = 1
+
+	// Events the account is not interested in are not stored.
+	queueWebhook(ctxbg, xlog, "mjl", msgWebhookEvent(WebhookFailed, m, attemptResult{}, nil))
+	queueWebhook(ctxbg, xlog, "other", msgWebhookEvent(WebhookDelivered, m, attemptResult{}, nil))
+	tcompare(t, len(pending()), 0)
+
+	r := attemptResult{remoteMX: "mx.remote.example", remoteIP: "10.0.0.1", response: "250 queued"}
+	queueWebhook(ctxbg, xlog, "mjl", msgWebhookEvent(WebhookDelivered, m, r, nil))
+	tcompare(t, len(pending()), 1)
+
+	// Failed call is retried later.
+	status = http.StatusInternalServerError
+	webhooksCall(ctxbg, xlog)
+	webhookWorkers.Wait()
+	<-calls
+	l := pending()
+	tcompare(t, len(l), 1)
+	tcompare(t, l[0].Attempts, 1)
+	if l[0].LastError == "" || !l[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("webhook not rescheduled after failure: %#v", l[0])
+	}
+	webhooksCall(ctxbg, xlog)
+	webhookWorkers.Wait()
+	tcompare(t, len(calls), 0)
+
+	// Successful call removes it.
+	status = http.StatusOK
+	webhookCall(ctxbg, xlog, l[0])
+	c := <-calls
+	tcompare(t, c.signature, WebhookDelivered)
+	tcompare(t, c.event.ID, l[0].ID)
+	tcompare(t, c.event.QueueMsgID, m.ID)
+	tcompare(t, c.event.MessageID, "<test@mox.example>")
+	tcompare(t, c.event.To, "a@remote.example")
+	tcompare(t, c.event.RemoteMX, "mx.remote.example")
+	tcompare(t, c.event.Response, "250 queued")
+	tcompare(t, len(pending()), 0)
+
+	// Incoming DSN is matched to the original message in the history.
+	err = queueRetire(ctxbg, m, true, r)
+	tcheck(t, err, "retire message")
+	dsnMsg := dsn.Message{
+		From:         smtp.Path{Localpart: "postmaster", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}},
+		To:           from,
+		Subject:      "mail delivery failed",
+		TextBody:     "delivery failed\n",
+		ReportingMTA: "mx.remote.example",
+		Recipients: []dsn.Recipient{
+			{
+				FinalRecipient: rcpt,
+				Action:         dsn.Failed,
+				Status:         "5.1.1",
+				DiagnosticCode: "550 5.1.1 no such user",
+			},
+		},
+		Original: []byte("Message-Id: <test@mox.example>\r\nSubject: test\r\n"),
+	}
+	buf, err := dsnMsg.Compose(xlog, false)
+	tcheck(t, err, "compose dsn")
+	IncomingDSN(ctxbg, xlog, "mjl", bytes.NewReader(buf))
+	webhooksCall(ctxbg, xlog)
+	webhookWorkers.Wait()
+	c = <-calls
+	tcompare(t, c.event.Event, WebhookIncomingDSN)
+	tcompare(t, c.event.QueueMsgID, m.ID)
+	tcompare(t, c.event.From, "mjl@mox.example")
+	d := *c.event.DSN
+	if d.ReportingMTA != "mx.remote.example" || d.Action != "failed" || d.Status != "5.1.1" || !strings.Contains(d.DiagnosticCode, "no such user") {
+		t.Fatalf("unexpected dsn in event %#v", d)
+	}
+
+	// Regular messages are ignored.
+	IncomingDSN(ctxbg, xlog, "mjl", strings.NewReader(testmsg))
+	tcompare(t, len(pending()), 0)
+}
@@ -14,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/imapclient"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -122,7 +123,7 @@ This is the message.
 		msg = strings.ReplaceAll(msg, "\n", "\r\n")
 		auth := bytes.Join([][]byte{nil, []byte(mailfrom), []byte(password)}, []byte{0})
 		authLine := fmt.Sprintf("AUTH PLAIN %s", base64.StdEncoding.EncodeToString(auth))
-		c, err := smtpclient.New(mox.Context, xlog, conn, smtpclient.TLSSkip, desthost, authLine)
+		c, err := smtpclient.New(mox.Context, xlog, conn, smtpclient.TLSSkip, dns.Domain{}, desthost, authLine)
 		tcheck(t, err, "smtp hello")
 		err = c.Deliver(mox.Context, mailfrom, rcptto, int64(len(msg)), strings.NewReader(msg), false, false)
 		tcheck(t, err, "deliver with smtp")
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/mox-"
+)
+
+func cmdRestore(c *cmd) {
+	c.params = "[-account name] backup-dir"
+	c.help = `Restore a backup made with "mox backup" into the data directory.
+
+Mox must not be running during a restore. The backup directory is first copied
+to a staging directory next to the data directory, the staging copy is then
+verified like "mox verifydata -fix" does, and only if no errors were found is
+it moved into place. The backup directory itself is not modified. Message files
+are hardlinked from the backup when possible, all other files, including
+database files, are copied.
+
+Without -account, the entire data directory is replaced. The old data directory
+is kept, renamed with a ".replaced-<timestamp>" suffix.
+
+With -account, only the files of that account are restored, other accounts,
+the queue and other databases are left as is. The account must be present in
+the configuration file. The old account directory is moved to
+"moved/accounts/<account>.replaced-<timestamp>" in the data directory.
+
+After restoring, you may want to run "mox bumpuidvalidity" for each restored
+account to force IMAP clients to synchronize mailbox state.
+`
+	var account string
+	c.flag.StringVar(&account, "account", "", "only restore the files for this account")
+	args := c.Parse()
+	if len(args) != 1 {
+		c.Usage()
+	}
+	mustLoadConfig()
+
+	backupDir, err := filepath.Abs(args[0])
+	xcheckf(err, "making backup path absolute")
+	dataDir, err := filepath.Abs(mox.DataDirPath(""))
+	xcheckf(err, "making data dir path absolute")
+	restore(backupDir, dataDir, account)
+}
+
+// restore restores backupDir into dataDir, or only the files of account if
+// non-empty. Errors are fatal.
+func restore(backupDir, dataDir, account string) {
+	if backupDir == dataDir {
+		log.Fatalf("backup directory is the data directory")
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, "moxversion")); err != nil {
+		log.Fatalf("backup directory does not look like a backup made with mox backup: %v", err)
+	}
+
+	// Refuse to restore while mox is running, it has the databases open.
+	if conn, err := net.Dial("unix", mox.DataDirPath("ctl")); err == nil {
+		conn.Close()
+		log.Fatalf("mox is running, stop it before restoring")
+	}
+
+	stamp := time.Now().Format("20060102-150405")
+
+	if account != "" {
+		if _, ok := mox.Conf.Account(account); !ok {
+			log.Fatalf("account %q not present in configuration", account)
+		}
+		srcAccDir := filepath.Join(backupDir, "accounts", account)
+		if _, err := os.Stat(srcAccDir); err != nil {
+			log.Fatalf("account not present in backup: %v", err)
+		}
+
+		// Staging directory within the data directory, so the final rename will work.
+		stagingDir := filepath.Join(dataDir, "tmp", "restore-"+stamp)
+		stagingAccDir := filepath.Join(stagingDir, "accounts", account)
+		log.Printf("copying account from backup to staging directory %s", stagingDir)
+		restoreCopyDir(srcAccDir, stagingAccDir, func(p string) bool {
+			return strings.HasPrefix(p, "msg"+string(filepath.Separator))
+		})
+
+		if !verifyDataDir(stagingDir, true, account) {
+			log.Fatalf("errors were found in restored account, leaving staging directory %s in place", stagingDir)
+		}
+
+		accDir := filepath.Join(dataDir, "accounts", account)
+		if _, err := os.Stat(accDir); err == nil {
+			oldAccDir := filepath.Join(dataDir, "moved", "accounts", account+".replaced-"+stamp)
+			err := os.MkdirAll(filepath.Dir(oldAccDir), 0770)
+			xcheckf(err, "creating directory for current account")
+			err = os.Rename(accDir, oldAccDir)
+			xcheckf(err, "moving current account directory away")
+			log.Printf("moved current account directory to %s", oldAccDir)
+		} else if !os.IsNotExist(err) {
+			xcheckf(err, "checking current account directory")
+		}
+		err := os.MkdirAll(filepath.Dir(accDir), 0770)
+		xcheckf(err, "creating accounts directory")
+		err = os.Rename(stagingAccDir, accDir)
+		xcheckf(err, "moving restored account into place")
+		err = os.RemoveAll(stagingDir)
+		xcheckf(err, "removing staging directory")
+		fmt.Printf("account %s restored from %s\n", account, backupDir)
+		return
+	}
+
+	// Staging directory next to the data directory, so the final rename will work.
+	stagingDir := dataDir + ".restore-" + stamp
+	log.Printf("copying backup to staging directory %s", stagingDir)
+	restoreCopyDir(backupDir, stagingDir, func(p string) bool {
+		l := strings.Split(p, string(filepath.Separator))
+		switch {
+		case len(l) >= 3 && l[0] == "queue":
+			return true
+		case len(l) >= 5 && l[0] == "accounts" && l[2] == "msg":
+			return true
+		}
+		return false
+	})
+
+	if !verifyDataDir(stagingDir, true, "") {
+		log.Fatalf("errors were found in restored data directory, leaving staging directory %s in place", stagingDir)
+	}
+
+	if _, err := os.Stat(dataDir); err == nil {
+		oldDataDir := dataDir + ".replaced-" + stamp
+		err := os.Rename(dataDir, oldDataDir)
+		xcheckf(err, "moving current data directory away")
+		log.Printf("moved current data directory to %s", oldDataDir)
+	} else if !os.IsNotExist(err) {
+		xcheckf(err, "checking current data directory")
+	}
+	err := os.Rename(stagingDir, dataDir)
+	xcheckf(err, "moving restored data directory into place")
+	fmt.Printf("data directory restored from %s\n", backupDir)
+}
+
+// restoreCopyDir copies the files in srcDir to dstDir, which must not yet exist.
+// Files for which isMessage returns true, called with the path relative to
+// srcDir, are hardlinked when possible, other files are always copied so
+// changes to them after the restore don't modify the backup. A top-level "tmp"
+// directory is skipped.
+func restoreCopyDir(srcDir, dstDir string, isMessage func(p string) bool) {
+	if _, err := os.Stat(dstDir); err == nil {
+		log.Fatalf("destination %s already exists", dstDir)
+	}
+
+	var nlinked, ncopied int
+	shared := map[fileID]string{}
+	err := filepath.WalkDir(srcDir, func(srcpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		p, err := filepath.Rel(srcDir, srcpath)
+		if err != nil {
+			return err
+		}
+		dstpath := filepath.Join(dstDir, p)
+		if d.IsDir() {
+			if p == "tmp" {
+				return fs.SkipDir
+			}
+			return os.MkdirAll(dstpath, 0770)
+		}
+		if !d.Type().IsRegular() {
+			log.Printf("warning: %s: not a regular file, skipping", srcpath)
+			return nil
+		}
+		if isMessage(p) {
+			if err := os.Link(srcpath, dstpath); err == nil {
+				nlinked++
+				return nil
+			} else if linkShared(shared, srcpath, dstpath) {
+				// Message file stored once for multiple messages, keep it that way.
+				nlinked++
+				return nil
+			}
+		}
+		if err := restoreCopyFile(srcpath, dstpath); err != nil {
+			return fmt.Errorf("copying %s: %v", srcpath, err)
+		}
+		ncopied++
+		return nil
+	})
+	xcheckf(err, "copying backup")
+	log.Printf("files hardlinked %d, copied %d", nlinked, ncopied)
+}
+
+func restoreCopyFile(srcpath, dstpath string) error {
+	sf, err := os.Open(srcpath)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dstpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return err
+	}
+	return df.Close()
+}
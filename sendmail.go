@@ -17,6 +17,7 @@ import (
 
 	"github.com/mjl-/sconf"
 
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/smtp"
@@ -232,7 +233,7 @@ binary should be setgid that group:
 	// todo: should have more auth options, scram-sha-256 at least, perhaps cram-md5 for compatibility as well.
 	authLine := fmt.Sprintf("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("\u0000%s\u0000%s", submitconf.Username, submitconf.Password))))
 	mox.Conf.Static.HostnameDomain.ASCII = submitconf.LocalHostname
-	client, err := smtpclient.New(ctx, mlog.New("sendmail"), conn, tlsMode, submitconf.Host, authLine)
+	client, err := smtpclient.New(ctx, mlog.New("sendmail"), conn, tlsMode, dns.Domain{}, submitconf.Host, authLine)
 	xcheckf(err, "open smtp session")
 
 	err = client.Deliver(ctx, submitconf.From, recipient, int64(len(msg)), strings.NewReader(msg), true, false)
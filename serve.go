@@ -209,6 +209,24 @@ requested, other TLS certificates are requested on demand.
 		log.Fatalx("init receivedid", err)
 	}
 
+	// Initialize key for rewriting the MAIL FROM address of forwarded messages (SRS).
+	srspath := mox.DataDirPath("srs.key")
+	srsbuf, err := os.ReadFile(srspath)
+	if err != nil || len(srsbuf) != 32 {
+		srsbuf = make([]byte, 32)
+		if _, err := cryptorand.Read(srsbuf); err != nil {
+			log.Fatalx("reading random srs key", err)
+		}
+		if err := os.WriteFile(srspath, srsbuf, 0660); err != nil {
+			log.Fatalx("writing srs key", err, mlog.Field("path", srspath))
+		}
+		err := os.Chown(srspath, int(mox.Conf.Static.UID), 0)
+		log.Check(err, "chown srs.key", mlog.Field("path", srspath), mlog.Field("uid", mox.Conf.Static.UID), mlog.Field("gid", 0))
+		err = os.Chmod(srspath, 0640)
+		log.Check(err, "chmod srs.key to 0640", mlog.Field("path", srspath))
+	}
+	mox.SRSInit(srsbuf)
+
 	// Start mox. If running as root, this will bind/listen on network sockets, and
 	// fork and exec itself as unprivileged user, then waits for the child to stop and
 	// exit. When running as root, this function never returns. But the new
@@ -611,6 +629,7 @@ func start(mtastsdbRefresher, skipForkExec bool) error {
 	}
 
 	store.StartAuthCache()
+	store.StartRetention()
 	smtpserver.Serve()
 	imapserver.Serve()
 	http.Serve()
@@ -16,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/metrics"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
@@ -96,8 +97,19 @@ type Client struct {
 	maxSize       int64 // Max size of email message.
 	extPipelining bool  // Remote server supports command pipelining.
 	extSMTPUTF8   bool  // Remote server supports SMTPUTF8 extension.
+
+	tlsVersion   string // Set after successful STARTTLS, e.g. "TLS1.3".
+	lastResponse string // Last line of response to message data of last successful delivery.
+
+	transcript       []string // Protocol lines, see Transcript.
+	transcriptSize   int
+	transcriptRedact bool // Set while authenticating, lines written are not recorded.
 }
 
+// Maximum size of lines kept in the transcript. Lines after reaching the limit are
+// dropped.
+const maxTranscriptSize = 64 * 1024
+
 // Error represents a failure to deliver a message.
 //
 // Code, Secode, Command and Line are only set for SMTP-level errors, and are zero
@@ -119,6 +131,9 @@ type Error struct {
 	Line string
 	// Underlying error, e.g. one of the Err variables in this package, or io errors.
 	Err error
+	// For errors returned by New, the protocol lines exchanged until the failure,
+	// see Client.Transcript.
+	Transcript string
 }
 
 // Unwrap returns the underlying Err.
@@ -164,10 +179,16 @@ func (e Error) Error() string {
 // TLS error is encountered, the caller may want to try again (on a new connection)
 // without TLS.
 //
+// ourHostname is the hostname used in the EHLO or HELO command. If zero, the
+// hostname of the mox instance is used.
+//
 // If auth is non-empty, it is executed as a command after SMTP greeting/EHLO
 // initialization, before starting delivery. For authenticating to a submission
 // service with AUTH PLAIN, only meant for testing.
-func New(ctx context.Context, log *mlog.Log, conn net.Conn, tlsMode TLSMode, remoteHostname, auth string) (*Client, error) {
+//
+// Errors are of type Error, with Transcript set to the protocol lines exchanged
+// until the failure.
+func New(ctx context.Context, log *mlog.Log, conn net.Conn, tlsMode TLSMode, ourHostname dns.Domain, remoteHostname, auth string) (*Client, error) {
 	c := &Client{
 		origConn: conn,
 		conn:     conn,
@@ -192,7 +213,14 @@ func New(ctx context.Context, log *mlog.Log, conn net.Conn, tlsMode TLSMode, rem
 	c.tw = moxio.NewTraceWriter(c.log, "LC: ", timeoutWriter{c.conn, 30 * time.Second, c.log})
 	c.w = bufio.NewWriter(c.tw)
 
-	if err := c.hello(ctx, tlsMode, remoteHostname, auth); err != nil {
+	if ourHostname.IsZero() {
+		ourHostname = mox.Conf.Static.HostnameDomain
+	}
+	if err := c.hello(ctx, tlsMode, ourHostname, remoteHostname, auth); err != nil {
+		if cerr, ok := err.(Error); ok {
+			cerr.Transcript = c.Transcript()
+			err = cerr
+		}
 		return nil, err
 	}
 	return c, nil
@@ -216,7 +244,7 @@ func (c *Client) errorf(permanent bool, code int, secode, lastLine, format strin
 	if len(c.cmds) > 0 {
 		cmd = c.cmds[0]
 	}
-	return Error{permanent, code, secode, cmd, lastLine, fmt.Errorf(format, args...)}
+	return Error{Permanent: permanent, Code: code, Secode: secode, Command: cmd, Line: lastLine, Err: fmt.Errorf(format, args...)}
 }
 
 func (c *Client) xerrorf(permanent bool, code int, secode, lastLine, format string, args ...any) {
@@ -251,6 +279,7 @@ func (c *Client) readline() (string, error) {
 	if err != nil {
 		return line, c.botchf(0, "", "", "%s: %w", strings.Join(c.cmds, ","), err)
 	}
+	c.transcriptAdd("S: " + line)
 	return line, nil
 }
 
@@ -258,11 +287,32 @@ func (c *Client) xtrace(level mlog.Level) func() {
 	c.xflush()
 	c.tr.SetTrace(level)
 	c.tw.SetTrace(level)
+	c.transcriptRedact = level == mlog.LevelTraceauth
 	return func() {
 		c.xflush()
 		c.tr.SetTrace(mlog.LevelTrace)
 		c.tw.SetTrace(mlog.LevelTrace)
+		c.transcriptRedact = false
+	}
+}
+
+func (c *Client) transcriptAdd(line string) {
+	if c.transcriptSize > maxTranscriptSize {
+		return
+	}
+	c.transcriptSize += len(line) + 1
+	if c.transcriptSize > maxTranscriptSize {
+		line = "(transcript truncated)"
 	}
+	c.transcript = append(c.transcript, line)
+}
+
+// Transcript returns the SMTP protocol lines exchanged with the remote server so
+// far, each line prefixed with "C: " for lines sent by the client or "S: " for
+// lines sent by the server, separated by newlines. Authentication and message data
+// are not included.
+func (c *Client) Transcript() string {
+	return strings.Join(c.transcript, "\n")
 }
 
 func (c *Client) xwritelinef(format string, args ...any) {
@@ -280,6 +330,11 @@ func (c *Client) xbwritelinef(format string, args ...any) {
 }
 
 func (c *Client) xbwriteline(line string) {
+	if c.transcriptRedact {
+		c.transcriptAdd("C: (authentication)")
+	} else {
+		c.transcriptAdd("C: " + line)
+	}
 	_, err := fmt.Fprintf(c.w, "%s\r\n", line)
 	if err != nil {
 		c.xbotchf(0, "", "", "write: %w", err)
@@ -437,7 +492,7 @@ func (c *Client) recover(rerr *error) {
 	*rerr = cerr
 }
 
-func (c *Client) hello(ctx context.Context, tlsMode TLSMode, remoteHostname, auth string) (rerr error) {
+func (c *Client) hello(ctx context.Context, tlsMode TLSMode, ourHostname dns.Domain, remoteHostname, auth string) (rerr error) {
 	defer c.recover(&rerr)
 
 	// perform EHLO handshake, falling back to HELO if server does not appear to
@@ -448,7 +503,7 @@ func (c *Client) hello(ctx context.Context, tlsMode TLSMode, remoteHostname, aut
 		c.cmds[0] = "ehlo"
 		c.cmdStart = time.Now()
 		// Syntax: ../rfc/5321:1827
-		c.xwritelinef("EHLO %s", mox.Conf.Static.HostnameDomain.ASCII)
+		c.xwritelinef("EHLO %s", ourHostname.ASCII)
 		code, _, lastLine, remains := c.xreadecode(false)
 		switch code {
 		// ../rfc/5321:997
@@ -460,7 +515,7 @@ func (c *Client) hello(ctx context.Context, tlsMode TLSMode, remoteHostname, aut
 			// ../rfc/5321:996
 			c.cmds[0] = "helo"
 			c.cmdStart = time.Now()
-			c.xwritelinef("HELO %s", mox.Conf.Static.HostnameDomain.ASCII)
+			c.xwritelinef("HELO %s", ourHostname.ASCII)
 			code, _, lastLine, _ = c.xreadecode(false)
 			if code != smtp.C250Completed {
 				c.xerrorf(code/100 == 5, code, "", lastLine, "%w: expected 250 to HELO, got %d", ErrStatus, code)
@@ -556,6 +611,8 @@ func (c *Client) hello(ctx context.Context, tlsMode TLSMode, remoteHostname, aut
 		c.w = bufio.NewWriter(c.tw)
 
 		tlsversion, ciphersuite := mox.TLSInfo(nconn)
+		c.tlsVersion = tlsversion
+		c.transcriptAdd(fmt.Sprintf("(tls handshake done, %s)", tlsversion))
 		c.log.Debug("tls client handshake done", mlog.Field("tls", tlsversion), mlog.Field("ciphersuite", ciphersuite), mlog.Field("servername", remoteHostname), mlog.Field("insecureskipverify", tlsConfig.InsecureSkipVerify))
 
 		hello(false)
@@ -726,6 +783,7 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	// For a DATA write, the suggested timeout is 3 minutes, we use 30 seconds for all
 	// writes through timeoutWriter. ../rfc/5321:3651
 	defer c.xtrace(mlog.LevelTracedata)()
+	c.transcriptAdd("C: (message data)")
 	err := smtp.DataWrite(c.w, msg)
 	if err != nil {
 		c.xbotchf(0, "", "", "writing message as smtp data: %w", err)
@@ -738,9 +796,23 @@ func (c *Client) Deliver(ctx context.Context, mailFrom string, rcptTo string, ms
 	}
 
 	c.needRset = false
+	c.lastResponse = lastline
 	return
 }
 
+// TLSVersion returns the TLS version of the connection, e.g. "TLS1.3", or an
+// empty string if TLS is not used.
+func (c *Client) TLSVersion() string {
+	return c.tlsVersion
+}
+
+// LastResponse returns the last line of the response of the remote server to the
+// message data of the last successful delivery, e.g. with a queue ID of the
+// remote server.
+func (c *Client) LastResponse() string {
+	return c.lastResponse
+}
+
 // Reset sends an SMTP RSET command to reset the message transaction state. Deliver
 // automatically sends it if needed.
 func (c *Client) Reset() (rerr error) {
@@ -17,6 +17,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mjl-/mox/dns"
 	"github.com/mjl-/mox/mlog"
 	"github.com/mjl-/mox/mox-"
 	"github.com/mjl-/mox/smtp"
@@ -200,7 +201,7 @@ func TestClient(t *testing.T) {
 				result <- fmt.Errorf("client: %w", fmt.Errorf(format, args...))
 				panic("stop")
 			}
-			c, err := New(ctx, log, clientConn, opts.tlsMode, opts.tlsHostname, "")
+			c, err := New(ctx, log, clientConn, opts.tlsMode, dns.Domain{}, opts.tlsHostname, "")
 			if (err == nil) != (expClientErr == nil) || err != nil && !errors.As(err, reflect.New(reflect.ValueOf(expClientErr).Type()).Interface()) && !errors.Is(err, expClientErr) {
 				fail("new client: got err %v, expected %#v", err, expClientErr)
 			}
@@ -297,7 +298,7 @@ func TestErrors(t *testing.T) {
 	run(t, func(s xserver) {
 		s.writeline("bogus") // Invalid, should be "220 <hostname>".
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		_, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, ErrProtocol) || !errors.As(err, &xerr) || xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrProtocol without Permanent", err))
@@ -308,7 +309,7 @@ func TestErrors(t *testing.T) {
 	run(t, func(s xserver) {
 		s.conn.Close()
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		_, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, io.ErrUnexpectedEOF) || !errors.As(err, &xerr) || xerr.Permanent {
 			panic(fmt.Errorf("got %#v (%v), expected ErrUnexpectedEOF without Permanent", err, err))
@@ -319,7 +320,7 @@ func TestErrors(t *testing.T) {
 	run(t, func(s xserver) {
 		s.writeline("521 not accepting connections")
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		_, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, ErrStatus) || !errors.As(err, &xerr) || !xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrStatus with Permanent", err))
@@ -330,7 +331,7 @@ func TestErrors(t *testing.T) {
 	run(t, func(s xserver) {
 		s.writeline("2200 mox.example") // Invalid, too many digits.
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		_, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, ErrProtocol) || !errors.As(err, &xerr) || xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrProtocol without Permanent", err))
@@ -344,7 +345,7 @@ func TestErrors(t *testing.T) {
 		s.writeline("250-mox.example")
 		s.writeline("500 different code") // Invalid.
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		_, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, ErrProtocol) || !errors.As(err, &xerr) || xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrProtocol without Permanent", err))
@@ -360,7 +361,7 @@ func TestErrors(t *testing.T) {
 		s.readline("MAIL FROM:")
 		s.writeline("550 5.7.0 not allowed")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
@@ -370,6 +371,19 @@ func TestErrors(t *testing.T) {
 		if err == nil || !errors.Is(err, ErrStatus) || !errors.As(err, &xerr) || !xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrStatus with Permanent", err))
 		}
+
+		hostname := mox.Conf.Static.HostnameDomain.ASCII
+		expTranscript := strings.Join([]string{
+			"S: 220 mox.example",
+			"C: EHLO " + hostname,
+			"S: 250-mox.example",
+			"S: 250 ENHANCEDSTATUSCODES",
+			"C: MAIL FROM:<postmaster@other.example>",
+			"S: 550 5.7.0 not allowed",
+		}, "\n")
+		if transcript := c.Transcript(); transcript != expTranscript {
+			panic(fmt.Errorf("got transcript %q, expected %q", transcript, expTranscript))
+		}
 	})
 
 	// Server temporarily refuses MAIL FROM.
@@ -380,7 +394,7 @@ func TestErrors(t *testing.T) {
 		s.readline("MAIL FROM:")
 		s.writeline("451 bad sender")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
@@ -402,7 +416,7 @@ func TestErrors(t *testing.T) {
 		s.readline("RCPT TO:")
 		s.writeline("451")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
@@ -426,7 +440,7 @@ func TestErrors(t *testing.T) {
 		s.readline("DATA")
 		s.writeline("550 no!")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
@@ -446,7 +460,7 @@ func TestErrors(t *testing.T) {
 		s.readline("STARTTLS")
 		s.writeline("502 command not implemented")
 	}, func(conn net.Conn) {
-		_, err := New(ctx, log, conn, TLSStrict, "mox.example", "")
+		_, err := New(ctx, log, conn, TLSStrict, dns.Domain{}, "mox.example", "")
 		var xerr Error
 		if err == nil || !errors.Is(err, ErrTLS) || !errors.As(err, &xerr) || !xerr.Permanent {
 			panic(fmt.Errorf("got %#v, expected ErrTLS with Permanent", err))
@@ -462,7 +476,7 @@ func TestErrors(t *testing.T) {
 		s.readline("MAIL FROM:")
 		s.writeline("451 enough")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSSkip, "mox.example", "")
+		c, err := New(ctx, log, conn, TLSSkip, dns.Domain{}, "mox.example", "")
 		if err != nil {
 			panic(err)
 		}
@@ -492,7 +506,7 @@ func TestErrors(t *testing.T) {
 		s.readline("DATA")
 		s.writeline("550 not now")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
@@ -522,7 +536,7 @@ func TestErrors(t *testing.T) {
 		s.readline("MAIL FROM:")
 		s.writeline("550 ok")
 	}, func(conn net.Conn) {
-		c, err := New(ctx, log, conn, TLSOpportunistic, "", "")
+		c, err := New(ctx, log, conn, TLSOpportunistic, dns.Domain{}, "", "")
 		if err != nil {
 			panic(err)
 		}
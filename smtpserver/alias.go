@@ -0,0 +1,156 @@
+package smtpserver
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+)
+
+// aliasPostAllowed returns whether a message may be delivered to the alias,
+// based on its posting policy and the verified MAIL FROM and message From
+// addresses.
+func aliasPostAllowed(alias config.Alias, mailFrom smtp.Path, mailFromVerified bool, msgFrom smtp.Address, msgFromVerified bool) bool {
+	allowed := func(addr smtp.Address) bool {
+		switch alias.PostPolicy {
+		case "authenticated":
+			_, ok := mox.Conf.Domain(addr.Domain)
+			return ok
+		default:
+			for _, a := range alias.ParsedAddresses {
+				if strings.EqualFold(a.String(), addr.String()) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if alias.PostPolicy == "anyone" {
+		return true
+	}
+	if mailFromVerified && !mailFrom.IsZero() && allowed(smtp.NewAddress(mailFrom.Localpart, mailFrom.IPDomain.Domain)) {
+		return true
+	}
+	return msgFromVerified && !msgFrom.IsZero() && allowed(msgFrom)
+}
+
+// aliasListID returns the List-Id for an alias. ../rfc/2919
+func aliasListID(alias config.Alias) string {
+	return "<" + string(alias.Address.Localpart) + "." + alias.Address.Domain.ASCII + ">"
+}
+
+// aliasListIDPresent returns whether the message already has the List-Id of
+// the alias, i.e. a mail loop.
+func aliasListIDPresent(header textproto.MIMEHeader, alias config.Alias) bool {
+	if !alias.ListHeaders {
+		return false
+	}
+	id := strings.ToLower(aliasListID(alias))
+	for _, v := range header.Values("List-Id") {
+		if strings.Contains(strings.ToLower(v), id) {
+			return true
+		}
+	}
+	return false
+}
+
+// aliasListHeaders returns the list headers to prepend to messages for the
+// alias, if enabled. ../rfc/2369
+func aliasListHeaders(alias config.Alias) string {
+	if !alias.ListHeaders {
+		return ""
+	}
+	addr := alias.Address.Pack(false)
+	unsubscribe := alias.ListUnsubscribe
+	if unsubscribe == "" {
+		postmaster := smtp.NewAddress("postmaster", alias.Address.Domain).Pack(false)
+		subject := strings.ReplaceAll(url.QueryEscape("unsubscribe "+addr), "+", "%20")
+		unsubscribe = "<mailto:" + postmaster + "?subject=" + subject + ">"
+	}
+	return "List-Id: " + aliasListID(alias) + "\r\n" +
+		"List-Post: <mailto:" + addr + ">\r\n" +
+		"List-Unsubscribe: " + unsubscribe + "\r\n"
+}
+
+// expandAlias returns recipients for the members of an alias. Local members
+// are delivered to their account, others are forwarded.
+func expandAlias(log *mlog.Log, rcptAcc rcptAccount) []rcptAccount {
+	var l []rcptAccount
+	for _, addr := range rcptAcc.alias.ParsedAddresses {
+		r := rcptAccount{
+			rcptTo:      smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}},
+			alias:       rcptAcc.alias,
+			aliasRcptTo: rcptAcc.rcptTo,
+		}
+		accountName, canonical, dest, err := mox.FindAccount(addr.Localpart, addr.Domain, false)
+		if err == nil {
+			r.local = true
+			r.accountName = accountName
+			r.destination = dest
+			r.canonicalAddress = canonical
+		} else if !errors.Is(err, mox.ErrDomainNotFound) {
+			// Local member that does not exist (anymore). Without alias, delivery fails
+			// as unknown user.
+			log.Errorx("looking up account for alias member", err, mlog.Field("alias", rcptAcc.alias.Address), mlog.Field("member", addr))
+			r.alias = nil
+		}
+		l = append(l, r)
+	}
+	return l
+}
+
+// dedupAliasMembers removes alias members from recipients that are also a
+// direct recipient or an earlier member, adjusting the member counts per alias
+// in aliasMembers.
+func dedupAliasMembers(recipients []rcptAccount, aliasMembers map[string]int) []rcptAccount {
+	key := func(r rcptAccount) string {
+		if r.local {
+			return "local:" + r.canonicalAddress
+		}
+		return strings.ToLower(r.rcptTo.String())
+	}
+
+	seen := map[string]bool{}
+	for _, r := range recipients {
+		if r.aliasRcptTo.IsZero() {
+			seen[key(r)] = true
+		}
+	}
+	var l []rcptAccount
+	for _, r := range recipients {
+		if !r.aliasRcptTo.IsZero() {
+			k := key(r)
+			if seen[k] {
+				aliasMembers[r.aliasRcptTo.String()]--
+				continue
+			}
+			seen[k] = true
+		}
+		l = append(l, r)
+	}
+	return l
+}
+
+// forwardAliasMember queues a message to an alias for delivery to an external
+// member, with the MAIL FROM address rewritten with SRS.
+func (c *conn) forwardAliasMember(ctx context.Context, log *mlog.Log, rcptAcc rcptAccount, msgPrefix []byte, msgWriter *message.Writer, dataFile *os.File) error {
+	mailFrom := c.srsMailFrom(rcptAcc.alias.Address.Domain)
+	size := int64(len(msgPrefix)) + msgWriter.Size
+	if err := queue.Add(ctx, log, "", mailFrom, rcptAcc.rcptTo, msgWriter.Has8bit, c.smtputf8, size, "", time.Time{}, msgPrefix, dataFile, nil, false); err != nil {
+		return err
+	}
+	log.Info("message for alias forwarded to member", mlog.Field("alias", rcptAcc.alias.Address), mlog.Field("srsmailfrom", mailFrom))
+	return nil
+}
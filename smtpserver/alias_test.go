@@ -0,0 +1,127 @@
+package smtpserver
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
+	"github.com/mjl-/mox/srs"
+	"github.com/mjl-/mox/store"
+)
+
+// Test delivery to aliases, with local and external members.
+func TestAlias(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"example.org.":   {"127.0.0.10"}, // For mx check.
+			"other.example.": {"127.0.0.10"},
+			"spam.example.":  {"127.0.0.10"},
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"other.example."},
+		},
+		TXT: map[string][]string{
+			"example.org.":  {"v=spf1 ip4:127.0.0.10 -all"},
+			"spam.example.": {"v=spf1 -all"},
+		},
+	}
+	ts := newTestServer(t, "../testdata/smtp/alias/mox.conf", resolver)
+	defer ts.close()
+
+	testDeliver := func(mailFrom, rcptTo, msg string, expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(msg)), strings.NewReader(msg), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	checkCounts := func(expQueued, expLocal int) {
+		t.Helper()
+		n, err := queue.Count(ctxbg)
+		tcheck(t, err, "counting queue")
+		tcompare(t, n, expQueued)
+		n, err = bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).Count()
+		tcheck(t, err, "counting delivered messages")
+		tcompare(t, n, expLocal)
+	}
+
+	// Member with SPF pass posts. Delivered locally and queued for the two external
+	// members.
+	testDeliver("remote@example.org", "team@mox.example", deliverMessage, nil)
+	checkCounts(2, 1)
+
+	msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Page{})
+	tcheck(t, err, "listing queue")
+	for _, qm := range msgs {
+		tcompare(t, qm.SenderAccount, "")
+		tcompare(t, srs.IsSRS(qm.SenderLocalpart), true)
+	}
+
+	m, err := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).Get()
+	tcheck(t, err, "get delivered message")
+	mr := ts.acc.MessageReader(m)
+	buf, err := io.ReadAll(mr)
+	tcheck(t, err, "reading message")
+	err = mr.Close()
+	tcheck(t, err, "closing message")
+	if !strings.Contains(string(buf), "List-Id: <team.mox.example>\r\n") {
+		t.Fatalf("missing list-id header in delivered message")
+	}
+
+	// Non-member is not allowed to post.
+	strangerMessage := strings.Replace(deliverMessage, "remote@example.org", "stranger@example.org", 1)
+	testDeliver("stranger@example.org", "team@mox.example", strangerMessage, &smtpclient.Error{Secode: smtp.SePol7DeliveryUnauth1})
+	checkCounts(2, 1)
+
+	// Message that already went through the alias is rejected as loop.
+	loopMessage := "List-Id: <team.mox.example>\r\n" + deliverMessage
+	testDeliver("remote@example.org", "team@mox.example", loopMessage, &smtpclient.Error{Secode: smtp.SeNet4Loop6})
+	checkCounts(2, 1)
+
+	// Anyone can post to alias with policy "anyone".
+	testDeliver("stranger@example.org", "public@mox.example", strangerMessage, nil)
+	checkCounts(2, 2)
+
+	// Message that would be rejected for local delivery, here due to an SPF fail
+	// without reputation, is not forwarded to external members.
+	spamMessage := strings.Replace(deliverMessage, "remote@example.org", "spammer@spam.example", 1)
+	testDeliver("spammer@spam.example", "outside@mox.example", spamMessage, &smtpclient.Error{Secode: smtp.SeSys3Other0})
+	checkCounts(2, 2)
+
+	// Accepted message is forwarded to the external member.
+	testDeliver("stranger@example.org", "outside@mox.example", strangerMessage, nil)
+	checkCounts(3, 2)
+}
+
+func TestAliasDedup(t *testing.T) {
+	alias := smtp.Path{Localpart: "team", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	alias2 := smtp.Path{Localpart: "team2", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	ext := smtp.Path{Localpart: "other", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "remote.example"}}}
+	local := smtp.Path{Localpart: "mjl", IPDomain: dns.IPDomain{Domain: dns.Domain{ASCII: "mox.example"}}}
+	recipients := []rcptAccount{
+		{rcptTo: local, local: true, canonicalAddress: "mjl@mox.example"},
+		{rcptTo: local, local: true, canonicalAddress: "mjl@mox.example", aliasRcptTo: alias},
+		{rcptTo: ext, aliasRcptTo: alias},
+		{rcptTo: ext, aliasRcptTo: alias2},
+	}
+	members := map[string]int{alias.String(): 2, alias2.String(): 1}
+	l := dedupAliasMembers(recipients, members)
+	tcompare(t, len(l), 2)
+	tcompare(t, l[0].aliasRcptTo.IsZero(), true)
+	tcompare(t, l[1].aliasRcptTo.String(), alias.String())
+	tcompare(t, members, map[string]int{alias.String(): 1, alias2.String(): 0})
+}
@@ -2,6 +2,7 @@ package smtpserver
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mjl-/mox/message"
 )
@@ -114,3 +115,104 @@ func value(s string) string {
 	r += `"`
 	return r
 }
+
+// parseAuthResults parses the value of an Authentication-Results header. Comments
+// are ignored. Only the syntax as commonly generated is supported, e.g. no
+// whitespace around "=".
+func parseAuthResults(s string) (AuthResults, error) {
+	// Split into statements separated by ";", each with tokens separated by
+	// whitespace. Quoted strings are unquoted. ../rfc/8601:577
+	var statements [][]string
+	var tokens []string
+	var token strings.Builder
+	var haveToken, quoted, escaped bool
+	depth := 0 // For nested comments.
+	endToken := func() {
+		if haveToken {
+			tokens = append(tokens, token.String())
+		}
+		token.Reset()
+		haveToken = false
+	}
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+			if depth == 0 {
+				token.WriteRune(c)
+				haveToken = true
+			}
+		case c == '\\' && (quoted || depth > 0):
+			escaped = true
+		case quoted:
+			if c == '"' {
+				quoted = false
+			} else {
+				token.WriteRune(c)
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return AuthResults{}, fmt.Errorf("unbalanced parentheses")
+			}
+			depth--
+		case depth > 0:
+		case c == '"':
+			quoted = true
+			haveToken = true
+		case c == ';':
+			endToken()
+			statements = append(statements, tokens)
+			tokens = nil
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			endToken()
+		default:
+			token.WriteRune(c)
+			haveToken = true
+		}
+	}
+	if quoted || depth > 0 {
+		return AuthResults{}, fmt.Errorf("unterminated quoted string or comment")
+	}
+	endToken()
+	statements = append(statements, tokens)
+
+	// ../rfc/8601:586
+	if len(statements[0]) == 0 || len(statements[0]) > 2 {
+		return AuthResults{}, fmt.Errorf("missing or malformed authserv-id")
+	}
+	ar := AuthResults{Hostname: statements[0][0]}
+	for i, st := range statements[1:] {
+		if len(st) == 0 {
+			continue
+		}
+		// ../rfc/8601:592
+		if len(st) == 1 && strings.EqualFold(st[0], "none") {
+			continue
+		}
+		method, result, ok := strings.Cut(st[0], "=")
+		if !ok || method == "" || result == "" {
+			return AuthResults{}, fmt.Errorf("malformed result %q in statement %d", st[0], i+1)
+		}
+		method, _, _ = strings.Cut(method, "/") // Ignore version.
+		m := AuthMethod{Method: strings.ToLower(method), Result: strings.ToLower(result)}
+		for _, t := range st[1:] {
+			k, v, ok := strings.Cut(t, "=")
+			if !ok {
+				return AuthResults{}, fmt.Errorf("malformed property %q for method %s", t, m.Method)
+			}
+			if strings.EqualFold(k, "reason") {
+				m.Reason = v
+				continue
+			}
+			typ, prop, ok := strings.Cut(k, ".")
+			if !ok {
+				return AuthResults{}, fmt.Errorf("malformed property name %q for method %s", k, m.Method)
+			}
+			m.Props = append(m.Props, AuthProp{Type: strings.ToLower(typ), Property: strings.ToLower(prop), Value: v})
+		}
+		ar.Methods = append(ar.Methods, m)
+	}
+	return ar, nil
+}
@@ -24,3 +24,28 @@ func TestAuthResults(t *testing.T) {
 		t.Fatalf("got %q, expected %q", s, exp)
 	}
 }
+
+func TestParseAuthResults(t *testing.T) {
+	ar, err := parseAuthResults(` relay.example 1 (comment (nested));
+	spf=pass smtp.mailfrom=remote@example.org;
+	dkim/1=pass reason="good \"sig\"" header.d=example.org header.s=sel (b);
+	none`)
+	tcheck(t, err, "parse")
+	exp := AuthResults{
+		Hostname: "relay.example",
+		Methods: []AuthMethod{
+			{"spf", "pass", "", "", []AuthProp{{"smtp", "mailfrom", "remote@example.org", false, ""}}},
+			{"dkim", "pass", "", `good "sig"`, []AuthProp{{"header", "d", "example.org", false, ""}, {"header", "s", "sel", false, ""}}},
+		},
+	}
+	tcompare(t, ar, exp)
+
+	_, err = parseAuthResults("relay.example; spf=pass (unterminated")
+	if err == nil {
+		t.Fatalf("parsing unterminated comment succeeded")
+	}
+	_, err = parseAuthResults("relay.example; spf")
+	if err == nil {
+		t.Fatalf("parsing result without value succeeded")
+	}
+}
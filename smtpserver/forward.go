@@ -0,0 +1,84 @@
+package smtpserver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/store"
+)
+
+// forward queues the message for delivery to the ForwardTo addresses of the
+// destination, with the MAIL FROM address rewritten with SRS. Messages that would
+// be delivered to a junk mailbox are not forwarded. If forwarded is false, the
+// message must be delivered locally, so it isn't lost.
+func (c *conn) forward(ctx context.Context, log *mlog.Log, acc *store.Account, rcptAcc rcptAccount, m *store.Message, msgPrefix []byte, msgWriter *message.Writer, dataFile *os.File) (forwarded bool) {
+	// We don't want to forward spam, it would hurt the reputation of our IPs and
+	// domain. The user can still find it in their junk mailbox.
+	conf, _ := acc.Conf()
+	mailbox := store.DestinationMailbox(log, rcptAcc.destination, m, dataFile)
+	var jm store.Message
+	jm.JunkFlagsForMailbox(mailbox, conf)
+	var junkMailbox bool
+	acc.WithRLock(func() {
+		err := acc.DB.Read(ctx, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			junkMailbox = mb != nil && mb.Junk
+			return err
+		})
+		log.Check(err, "looking up destination mailbox for forwarding")
+	})
+	if jm.Junk || junkMailbox {
+		log.Info("not forwarding message classified as junk", mlog.Field("mailbox", mailbox))
+		metricDelivery.WithLabelValues("forwardjunk", "").Inc()
+		return false
+	}
+
+	mailFrom := c.srsMailFrom(rcptAcc.rcptTo.IPDomain.Domain)
+	forwarded = true
+	size := int64(len(msgPrefix)) + msgWriter.Size
+	for _, addr := range rcptAcc.destination.ForwardToAddresses {
+		rcptTo := smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+		if err := queue.Add(ctx, log, rcptAcc.accountName, mailFrom, rcptTo, msgWriter.Has8bit, c.smtputf8, size, "", time.Time{}, msgPrefix, dataFile, nil, false); err != nil {
+			log.Errorx("queueing forwarded message", err, mlog.Field("forwardto", rcptTo))
+			metricDelivery.WithLabelValues("forwarderror", "").Inc()
+			forwarded = false
+			continue
+		}
+		log.Info("incoming message forwarded", mlog.Field("forwardto", rcptTo), mlog.Field("srsmailfrom", mailFrom))
+		metricDelivery.WithLabelValues("forwarded", "").Inc()
+	}
+	return forwarded
+}
+
+// relaySRSBounce queues a bounce to an SRS-rewritten address for delivery to the
+// original sender of the forwarded message. Like the original bounce, the relayed
+// message has a null reverse path.
+func (c *conn) relaySRSBounce(ctx context.Context, log *mlog.Log, rcptAcc rcptAccount, msgPrefix []byte, msgWriter *message.Writer, dataFile *os.File) error {
+	rcptTo := smtp.Path{Localpart: rcptAcc.srsOrig.Localpart, IPDomain: dns.IPDomain{Domain: rcptAcc.srsOrig.Domain}}
+	size := int64(len(msgPrefix)) + msgWriter.Size
+	if err := queue.Add(ctx, log, "", smtp.Path{}, rcptTo, msgWriter.Has8bit, c.smtputf8, size, "", time.Time{}, msgPrefix, dataFile, nil, false); err != nil {
+		return err
+	}
+	log.Info("bounce to srs address relayed to original sender", mlog.Field("origsender", rcptTo))
+	return nil
+}
+
+// srsMailFrom returns the MAIL FROM address for forwarding the message in the
+// current transaction, rewritten with SRS to an address in domain. A null
+// reverse path stays null.
+func (c *conn) srsMailFrom(domain dns.Domain) smtp.Path {
+	if c.mailFrom.IsZero() {
+		return smtp.Path{}
+	}
+	addr := mox.SRSForward(smtp.NewAddress(c.mailFrom.Localpart, c.mailFrom.IPDomain.Domain), domain)
+	return smtp.Path{Localpart: addr.Localpart, IPDomain: dns.IPDomain{Domain: addr.Domain}}
+}
@@ -0,0 +1,103 @@
+package smtpserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/smtpclient"
+	"github.com/mjl-/mox/srs"
+	"github.com/mjl-/mox/store"
+)
+
+// Test forwarding with SRS, and relaying bounces to SRS addresses.
+func TestForward(t *testing.T) {
+	resolver := dns.MockResolver{
+		A: map[string][]string{
+			"other.example.": {"127.0.0.10"}, // For mx check.
+		},
+		PTR: map[string][]string{
+			"127.0.0.10": {"other.example."},
+		},
+	}
+	ts := newTestServer(t, "../testdata/smtp/forward/mox.conf", resolver)
+	defer ts.close()
+
+	testDeliver := func(mailFrom, rcptTo string, expErr *smtpclient.Error) {
+		t.Helper()
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, rcptTo, int64(len(deliverMessage)), strings.NewReader(deliverMessage), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	checkCounts := func(expQueued, expLocal int) {
+		t.Helper()
+		n, err := queue.Count(ctxbg)
+		tcheck(t, err, "counting queue")
+		tcompare(t, n, expQueued)
+		n, err = bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).Count()
+		tcheck(t, err, "counting delivered messages")
+		tcompare(t, n, expLocal)
+	}
+
+	// Forwarded, without local copy.
+	testDeliver("mjl@other.example", "fwd@mox.example", nil)
+	checkCounts(1, 0)
+
+	msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Page{})
+	tcheck(t, err, "listing queue")
+	qm := msgs[0]
+	tcompare(t, qm.Recipient().String(), "other@remote.example")
+	tcompare(t, qm.SenderAccount, "mjl")
+	tcompare(t, srs.IsSRS(qm.SenderLocalpart), true)
+	tcompare(t, qm.SenderDomain.Domain.Name(), "mox.example")
+	orig, err := mox.SRSReverse(qm.SenderLocalpart)
+	tcheck(t, err, "reversing srs address")
+	tcompare(t, orig.String(), "mjl@other.example")
+
+	// Forwarded, and local copy.
+	testDeliver("mjl@other.example", "fwdcopy@mox.example", nil)
+	checkCounts(2, 1)
+
+	// Junk is not forwarded, only delivered locally.
+	testDeliver("mjl@other.example", "fwdjunk@mox.example", nil)
+	checkCounts(2, 2)
+
+	// Bounce to SRS address is relayed to the original sender.
+	srsAddr := qm.Sender().String()
+	testDeliver("", srsAddr, nil)
+	checkCounts(3, 2)
+	msgs, err = queue.List(ctxbg, queue.Filter{}, queue.Page{})
+	tcheck(t, err, "listing queue")
+	var relayed *queue.Msg
+	for i, m := range msgs {
+		if m.Recipient().String() == "mjl@other.example" {
+			relayed = &msgs[i]
+		}
+	}
+	if relayed == nil {
+		t.Fatalf("relayed bounce not in queue")
+	}
+	tcompare(t, relayed.Sender().IsZero(), true)
+
+	// Only bounces are accepted for SRS addresses.
+	testDeliver("mjl@other.example", srsAddr, &smtpclient.Error{Secode: smtp.SePol7DeliveryUnauth1})
+
+	// Tampered SRS address.
+	bad := strings.Replace(srsAddr, "other.example", "example.org", 1)
+	testDeliver("", bad, &smtpclient.Error{Secode: smtp.SeAddr1UnknownDestMailbox1})
+	checkCounts(3, 2)
+}
@@ -0,0 +1,258 @@
+package smtpserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/publicsuffix"
+	"github.com/mjl-/mox/smtp"
+	"github.com/mjl-/mox/spf"
+	"github.com/mjl-/mox/store"
+)
+
+// deliverLMTP delivers a message received over LMTP from a trusted relay to the
+// local recipients, and writes a response for each recipient. The relay has
+// already done its checks, we don't analyze the message for spam.
+func (c *conn) deliverLMTP(ctx context.Context, recvHdrFor func(string) string, msgWriter *message.Writer, pdataFile **os.File) {
+	dataFile := *pdataFile
+
+	type result struct {
+		code   int
+		secode string
+		errmsg string
+	}
+	results := make([]result, len(c.recipients))
+
+	msgFrom, header, err := message.From(dataFile)
+	if err != nil {
+		c.log.Infox("parsing message for From address", err)
+	}
+
+	// Basic loop detection. ../rfc/5321:4065 ../rfc/5321:1526
+	loop := len(header.Values("Received")) > 100
+
+	var ehloValidation, mailFromValidation = store.ValidationUnknown, store.ValidationUnknown
+	var msgFromValidation = store.ValidationNone
+	var dkimDomains []string
+	if c.trustedAuthServID != "" && !loop {
+		ehloValidation, mailFromValidation, msgFromValidation, dkimDomains = trustedAuthResults(c.log, header, c.trustedAuthServID, msgFrom)
+	}
+
+	ipmasked1, ipmasked2, ipmasked3 := ipmasked(c.remoteIP)
+
+	for i, rcptAcc := range c.recipients {
+		log := c.log.Fields(mlog.Field("mailfrom", c.mailFrom), mlog.Field("rcptto", rcptAcc.rcptTo))
+
+		if loop {
+			results[i] = result{smtp.C550MailboxUnavail, smtp.SeNet4Loop6, "loop detected, more than 100 Received headers"}
+			continue
+		} else if !rcptAcc.local {
+			metricDelivery.WithLabelValues("unknownuser", "").Inc()
+			results[i] = result{smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "no such user"}
+			continue
+		}
+
+		// ../rfc/5321:3204
+		msgPrefix := []byte("Return-Path: <" + c.mailFrom.String() + ">\r\n" + recvHdrFor(rcptAcc.rcptTo.String()))
+		if !msgWriter.HaveHeaders {
+			msgPrefix = append(msgPrefix, "\r\n"...)
+		}
+
+		m := &store.Message{
+			Received:           time.Now(),
+			RemoteIP:           c.remoteIP.String(),
+			RemoteIPMasked1:    ipmasked1,
+			RemoteIPMasked2:    ipmasked2,
+			RemoteIPMasked3:    ipmasked3,
+			EHLODomain:         c.hello.Domain.Name(),
+			MailFrom:           c.mailFrom.String(),
+			MailFromLocalpart:  c.mailFrom.Localpart,
+			MailFromDomain:     c.mailFrom.IPDomain.Domain.Name(),
+			RcptToLocalpart:    rcptAcc.rcptTo.Localpart,
+			RcptToDomain:       rcptAcc.rcptTo.IPDomain.Domain.Name(),
+			MsgFromLocalpart:   msgFrom.Localpart,
+			MsgFromDomain:      msgFrom.Domain.Name(),
+			MsgFromOrgDomain:   publicsuffix.Lookup(ctx, msgFrom.Domain).Name(),
+			EHLOValidated:      ehloValidation == store.ValidationPass,
+			MailFromValidated:  mailFromValidation == store.ValidationPass,
+			MsgFromValidated:   msgFromValidation == store.ValidationDMARC,
+			EHLOValidation:     ehloValidation,
+			MailFromValidation: mailFromValidation,
+			MsgFromValidation:  msgFromValidation,
+			DKIMDomains:        dkimDomains,
+			Size:               int64(len(msgPrefix)) + msgWriter.Size,
+			MsgPrefix:          msgPrefix,
+		}
+
+		acc, err := store.OpenAccount(rcptAcc.accountName)
+		if err != nil {
+			log.Errorx("open account", err, mlog.Field("account", rcptAcc.accountName))
+			metricDelivery.WithLabelValues("accounterror", "").Inc()
+			results[i] = result{smtp.C451LocalErr, smtp.SeSys3Other0, "error processing"}
+			continue
+		}
+		deliverLocal := true
+		if len(rcptAcc.destination.ForwardToAddresses) > 0 {
+			fwdPrefix := []byte(recvHdrFor(rcptAcc.rcptTo.String()))
+			if !msgWriter.HaveHeaders {
+				fwdPrefix = append(fwdPrefix, "\r\n"...)
+			}
+			forwarded := c.forward(ctx, log, acc, rcptAcc, m, fwdPrefix, msgWriter, dataFile)
+			deliverLocal = !forwarded || rcptAcc.destination.ForwardKeepCopy
+		}
+		if deliverLocal {
+			acc.WithWLock(func() {
+				err = acc.Deliver(log, rcptAcc.destination, m, dataFile, false)
+			})
+		}
+		if err != nil {
+			log.Errorx("delivering", err)
+			metricDelivery.WithLabelValues("delivererror", "lmtp").Inc()
+			codes := errCodes(smtp.C451LocalErr, smtp.SeSys3Other0, err)
+			results[i] = result{codes.code, codes.secode, "error processing"}
+		} else if deliverLocal {
+			metricDelivery.WithLabelValues("delivered", "lmtp").Inc()
+			log.Info("incoming message delivered over lmtp", mlog.Field("msgfrom", msgFrom))
+			results[i] = result{smtp.C250Completed, smtp.SeMailbox2Other0, "delivered"}
+		} else {
+			results[i] = result{smtp.C250Completed, smtp.SeMailbox2Other0, "forwarded"}
+		}
+		err = acc.Close()
+		log.Check(err, "closing account after delivering")
+	}
+
+	err = os.Remove(dataFile.Name())
+	c.log.Check(err, "removing file after delivery")
+	err = dataFile.Close()
+	c.log.Check(err, "closing data file after delivery")
+	*pdataFile = nil
+
+	c.transactionGood++
+	c.transactionBad-- // Compensate for early earlier pessimistic increase.
+	c.rset()
+
+	// One response for each recipient, in order of the RCPT TO commands. ../rfc/2033:219
+	for _, r := range results {
+		msg := r.errmsg
+		if r.code != smtp.C250Completed {
+			msg = fmt.Sprintf("%s (%s)", msg, mox.ReceivedID(c.cid))
+		}
+		c.bwritecodeline(r.code, r.secode, msg, nil)
+	}
+}
+
+// lmtpTrusted returns whether a connection from addr is from one of the trusted
+// networks of the LMTP listener.
+func lmtpTrusted(trustedNets []*net.IPNet, addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trustedNets {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedAuthResults returns the validations from the first
+// Authentication-Results header with authServID, as added by a trusted relay.
+func trustedAuthResults(log *mlog.Log, header textproto.MIMEHeader, authServID string, msgFrom smtp.Address) (ehloValidation, mailFromValidation, msgFromValidation store.Validation, dkimDomains []string) {
+	ehloValidation = store.ValidationUnknown
+	mailFromValidation = store.ValidationUnknown
+	msgFromValidation = store.ValidationNone
+
+	for _, v := range header.Values("Authentication-Results") {
+		ar, err := parseAuthResults(v)
+		if err != nil {
+			log.Infox("parsing authentication-results header", err, mlog.Field("header", v))
+			continue
+		}
+		if !strings.EqualFold(ar.Hostname, authServID) {
+			continue
+		}
+
+		propDomain := func(m AuthMethod, typ, prop string) (dns.Domain, bool) {
+			for _, p := range m.Props {
+				if p.Type != typ || p.Property != prop {
+					continue
+				}
+				// Value can be a domain, or an address (e.g. for smtp.mailfrom).
+				s := p.Value
+				if t := strings.Split(s, "@"); len(t) > 1 {
+					s = t[len(t)-1]
+				}
+				d, err := dns.ParseDomain(s)
+				if err != nil {
+					log.Debugx("parsing domain in authentication-results", err, mlog.Field("value", p.Value))
+					return dns.Domain{}, false
+				}
+				return d, true
+			}
+			return dns.Domain{}, false
+		}
+
+		for _, m := range ar.Methods {
+			switch m.Method {
+			case "spf":
+				status := spf.Status(m.Result)
+				switch status {
+				case spf.StatusNone, spf.StatusNeutral, spf.StatusPass, spf.StatusFail, spf.StatusSoftfail, spf.StatusTemperror, spf.StatusPermerror:
+				default:
+					continue
+				}
+				if _, ok := propDomain(m, "smtp", "mailfrom"); ok {
+					mailFromValidation = store.SPFValidation(status)
+				} else if _, ok := propDomain(m, "smtp", "helo"); ok {
+					ehloValidation = store.SPFValidation(status)
+				}
+			case "dkim":
+				if m.Result != "pass" {
+					continue
+				}
+				if d, ok := propDomain(m, "header", "d"); ok {
+					name := d.Name()
+					if !sliceContains(dkimDomains, name) {
+						dkimDomains = append(dkimDomains, name)
+					}
+				}
+			case "dmarc":
+				if d, ok := propDomain(m, "header", "from"); !ok || d != msgFrom.Domain {
+					continue
+				}
+				switch m.Result {
+				case "pass":
+					msgFromValidation = store.ValidationDMARC
+				case "fail":
+					msgFromValidation = store.ValidationFail
+				case "temperror":
+					msgFromValidation = store.ValidationTemperror
+				case "permerror":
+					msgFromValidation = store.ValidationPermerror
+				}
+			}
+		}
+		log.Debug("using trusted authentication-results", mlog.Field("authservid", ar.Hostname), mlog.Field("ehlovalidation", ehloValidation), mlog.Field("mailfromvalidation", mailFromValidation), mlog.Field("msgfromvalidation", msgFromValidation), mlog.Field("dkimdomains", dkimDomains))
+		return
+	}
+	return
+}
+
+func sliceContains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
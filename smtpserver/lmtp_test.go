@@ -0,0 +1,152 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/queue"
+	"github.com/mjl-/mox/store"
+)
+
+func TestLMTP(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	serverConn, clientConn := net.Pipe()
+	serverdone := make(chan struct{})
+	defer func() { <-serverdone }()
+	defer clientConn.Close()
+	go func() {
+		defer close(serverdone)
+		defer serverConn.Close()
+		serve("test", ts.cid, dns.Domain{ASCII: "mox.example"}, nil, serverConn, ts.resolver, false, false, 100<<20, false, false, nil, defaultLimiters, true, "relay.example")
+	}()
+
+	br := bufio.NewReader(clientConn)
+	// readResponse reads a (multiline) response, and returns the code of the last line.
+	readResponse := func() string {
+		t.Helper()
+		for {
+			line, err := br.ReadString('\n')
+			tcheck(t, err, "read response")
+			if len(line) < 4 {
+				t.Fatalf("short response line %q", line)
+			}
+			if line[3] == ' ' {
+				return line[:3]
+			}
+		}
+	}
+	write := func(format string, args ...any) {
+		t.Helper()
+		_, err := fmt.Fprintf(clientConn, format+"\r\n", args...)
+		tcheck(t, err, "write")
+	}
+	cmd := func(expCode string, format string, args ...any) {
+		t.Helper()
+		write(format, args...)
+		if code := readResponse(); code != expCode {
+			t.Fatalf("command %q: got code %s, expected %s", fmt.Sprintf(format, args...), code, expCode)
+		}
+	}
+
+	tcompare(t, readResponse(), "220")
+	cmd("500", "EHLO relay.example") // Must use LHLO.
+	cmd("250", "LHLO relay.example")
+	cmd("250", "MAIL FROM:<remote@example.org>")
+	cmd("250", "RCPT TO:<mjl@mox.example>")
+	cmd("550", "RCPT TO:<unknown@mox.example>") // Unknown users are rejected immediately.
+	cmd("550", "RCPT TO:<remote@example.org>")  // Not a local domain.
+	cmd("250", "RCPT TO:<mjl@mox2.example>")
+	cmd("354", "DATA")
+	msg := strings.ReplaceAll(`Authentication-Results: other.example; spf=fail smtp.mailfrom=example.org
+Authentication-Results: relay.example (comment);
+	spf=pass smtp.mailfrom=remote@example.org;
+	dkim=pass (2048 bit rsa) header.d=example.org header.s=sel;
+	dmarc=pass header.from=example.org
+`, "\n", "\r\n") + deliverMessage + ".\r\n"
+	_, err := clientConn.Write([]byte(msg))
+	tcheck(t, err, "write message")
+	// One response per accepted recipient.
+	tcompare(t, readResponse(), "250")
+	tcompare(t, readResponse(), "250")
+
+	msgs, err := bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).List()
+	tcheck(t, err, "list messages")
+	tcompare(t, len(msgs), 2)
+	for _, m := range msgs {
+		tcompare(t, m.MailFromValidation, store.ValidationPass)
+		tcompare(t, m.MsgFromValidation, store.ValidationDMARC)
+		tcompare(t, m.DKIMDomains, []string{"example.org"})
+	}
+
+	cmd("221", "QUIT")
+}
+
+func TestLMTPTrusted(t *testing.T) {
+	_, ipnet, err := net.ParseCIDR("10.0.0.0/8")
+	tcheck(t, err, "parse cidr")
+	nets := []*net.IPNet{ipnet}
+	tcompare(t, lmtpTrusted(nets, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}), true)
+	tcompare(t, lmtpTrusted(nets, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}), false)
+	tcompare(t, lmtpTrusted(nil, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}), false)
+}
+
+// Messages for destinations with ForwardTo are forwarded, also over LMTP.
+func TestLMTPForward(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/forward/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	serverConn, clientConn := net.Pipe()
+	serverdone := make(chan struct{})
+	defer func() { <-serverdone }()
+	defer clientConn.Close()
+	go func() {
+		defer close(serverdone)
+		defer serverConn.Close()
+		serve("test", ts.cid, dns.Domain{ASCII: "mox.example"}, nil, serverConn, ts.resolver, false, false, 100<<20, false, false, nil, defaultLimiters, true, "")
+	}()
+
+	br := bufio.NewReader(clientConn)
+	readCode := func() string {
+		t.Helper()
+		for {
+			line, err := br.ReadString('\n')
+			tcheck(t, err, "read response")
+			if len(line) >= 4 && line[3] == ' ' {
+				return line[:3]
+			}
+		}
+	}
+	cmd := func(expCode string, s string) {
+		t.Helper()
+		_, err := fmt.Fprintf(clientConn, "%s\r\n", s)
+		tcheck(t, err, "write")
+		tcompare(t, readCode(), expCode)
+	}
+
+	tcompare(t, readCode(), "220")
+	cmd("250", "LHLO relay.example")
+	cmd("250", "MAIL FROM:<remote@example.org>")
+	cmd("250", "RCPT TO:<fwd@mox.example>")
+	cmd("250", "RCPT TO:<fwdcopy@mox.example>")
+	cmd("354", "DATA")
+	_, err := clientConn.Write([]byte(deliverMessage + ".\r\n"))
+	tcheck(t, err, "write message")
+	tcompare(t, readCode(), "250")
+	tcompare(t, readCode(), "250")
+	cmd("221", "QUIT")
+
+	n, err := queue.Count(ctxbg)
+	tcheck(t, err, "counting queue")
+	tcompare(t, n, 2)
+	n, err = bstore.QueryDB[store.Message](ctxbg, ts.acc.DB).Count()
+	tcheck(t, err, "counting delivered messages")
+	tcompare(t, n, 1)
+}
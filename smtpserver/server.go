@@ -15,8 +15,10 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"math"
+	"io/fs"
 	"net"
+	"net/mail"
+	"net/textproto"
 	"os"
 	"runtime/debug"
 	"strconv"
@@ -44,10 +46,10 @@ import (
 	"github.com/mjl-/mox/moxvar"
 	"github.com/mjl-/mox/publicsuffix"
 	"github.com/mjl-/mox/queue"
-	"github.com/mjl-/mox/ratelimit"
 	"github.com/mjl-/mox/scram"
 	"github.com/mjl-/mox/smtp"
 	"github.com/mjl-/mox/spf"
+	"github.com/mjl-/mox/srs"
 	"github.com/mjl-/mox/store"
 	"github.com/mjl-/mox/tlsrptdb"
 )
@@ -66,7 +68,9 @@ var errIO = errors.New("fatal io error")
 // delivered to the account named mox.
 var Localserve bool
 
-var limiterConnectionRate, limiterConnections *ratelimit.Limiter
+// Limiters for services on listeners without configured limits. Shared between
+// those services.
+var defaultLimiters *mox.Limiters
 
 // For delivery rate limiting. Variable because changed during tests.
 var limitIPMasked1MessagesPerMinute int = 500
@@ -79,23 +83,7 @@ func init() {
 
 func limitersInit() {
 	mox.LimitersInit()
-	// todo future: make these configurable
-	limiterConnectionRate = &ratelimit.Limiter{
-		WindowLimits: []ratelimit.WindowLimit{
-			{
-				Window: time.Minute,
-				Limits: [...]int64{300, 900, 2700},
-			},
-		},
-	}
-	limiterConnections = &ratelimit.Limiter{
-		WindowLimits: []ratelimit.WindowLimit{
-			{
-				Window: time.Duration(math.MaxInt64), // All of time.
-				Limits: [...]int64{30, 90, 270},
-			},
-		},
-	}
+	defaultLimiters = mox.NewLimiters(nil)
 }
 
 var (
@@ -186,10 +174,16 @@ func Listen() {
 				hostname = listener.HostnameDomain
 			}
 			port := config.Port(listener.SMTP.Port, 25)
+			limiters := listenerLimiters(listener.SMTP.Limits)
 			for _, ip := range listener.IPs {
-				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, listener.SMTP.DNSBLZones)
+				listen1("smtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, listener.SMTP.RequireSTARTTLS, listener.SMTP.DNSBLZones, limiters)
 			}
 		}
+		// Submission and submissions share limiters.
+		var submissionLimiters *mox.Limiters
+		if listener.Submission.Enabled || listener.Submissions.Enabled {
+			submissionLimiters = listenerLimiters(listener.Submission.Limits)
+		}
 		if listener.Submission.Enabled {
 			hostname := mox.Conf.Static.HostnameDomain
 			if listener.Hostname != "" {
@@ -197,7 +191,7 @@ func Listen() {
 			}
 			port := config.Port(listener.Submission.Port, 587)
 			for _, ip := range listener.IPs {
-				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, nil)
+				listen1("submission", name, ip, port, hostname, tlsConfig, true, false, maxMsgSize, !listener.Submission.NoRequireSTARTTLS, !listener.Submission.NoRequireSTARTTLS, nil, submissionLimiters)
 			}
 		}
 
@@ -208,15 +202,39 @@ func Listen() {
 			}
 			port := config.Port(listener.Submissions.Port, 465)
 			for _, ip := range listener.IPs {
-				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, nil)
+				listen1("submissions", name, ip, port, hostname, tlsConfig, true, true, maxMsgSize, true, true, nil, submissionLimiters)
+			}
+		}
+
+		if listener.LMTP.Enabled {
+			hostname := mox.Conf.Static.HostnameDomain
+			if listener.Hostname != "" {
+				hostname = listener.HostnameDomain
+			}
+			if listener.LMTP.UnixSocket != "" {
+				listenLMTPUnix(name, listener.LMTP.UnixSocket, hostname, maxMsgSize, listener.LMTP.TrustedAuthServID)
+			} else {
+				port := config.Port(listener.LMTP.Port, 24)
+				for _, ip := range listener.IPs {
+					listen1("lmtp", name, ip, port, hostname, tlsConfig, false, false, maxMsgSize, false, false, nil, defaultLimiters)
+				}
 			}
 		}
 	}
 }
 
+// listenerLimiters returns limiters for a service with configured limits, or
+// the default limiters otherwise.
+func listenerLimiters(l *config.Limits) *mox.Limiters {
+	if l == nil {
+		return defaultLimiters
+	}
+	return mox.NewLimiters(l)
+}
+
 var servers []func()
 
-func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain) {
+func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig *tls.Config, submission, xtls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain, limiters *mox.Limiters) {
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 	if os.Getuid() == 0 {
 		xlog.Print("listening for smtp", mlog.Field("listener", name), mlog.Field("address", addr), mlog.Field("protocol", protocol))
@@ -226,10 +244,19 @@ func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig
 	if err != nil {
 		xlog.Fatalx("smtp: listen for smtp", err, mlog.Field("protocol", protocol), mlog.Field("listener", name))
 	}
+	ln = mox.ProxyListener(mox.Conf.Static.Listeners[name], protocol, ln)
 	if xtls {
 		ln = tls.NewListener(ln, tlsConfig)
 	}
 
+	lmtp := protocol == "lmtp"
+	var trustedAuthServID string
+	var trustedNets []*net.IPNet
+	if lmtp {
+		trustedAuthServID = mox.Conf.Static.Listeners[name].LMTP.TrustedAuthServID
+		trustedNets = mox.Conf.Static.Listeners[name].LMTP.TrustedNets
+	}
+
 	serve := func() {
 		for {
 			conn, err := ln.Accept()
@@ -237,8 +264,50 @@ func listen1(protocol, name, ip string, port int, hostname dns.Domain, tlsConfig
 				xlog.Infox("smtp: accept", err, mlog.Field("protocol", protocol), mlog.Field("listener", name))
 				continue
 			}
+			// LMTP skips all checks, only relays we trust may deliver.
+			if lmtp && !lmtpTrusted(trustedNets, conn.RemoteAddr()) {
+				xlog.Info("smtp: closing lmtp connection from untrusted ip", mlog.Field("remoteaddr", conn.RemoteAddr()), mlog.Field("listener", name))
+				err := conn.Close()
+				xlog.Check(err, "closing lmtp connection")
+				continue
+			}
 			resolver := dns.StrictResolver{} // By leaving Pkg empty, it'll be set by each package that uses the resolver, e.g. spf/dkim/dmarc.
-			go serve(name, mox.Cid(), hostname, tlsConfig, conn, resolver, submission, xtls, maxMessageSize, requireTLSForAuth, requireTLSForDelivery, dnsBLs)
+			go serve(name, mox.Cid(), hostname, tlsConfig, conn, resolver, submission, xtls, maxMessageSize, requireTLSForAuth, requireTLSForDelivery, dnsBLs, limiters, lmtp, trustedAuthServID)
+		}
+	}
+
+	servers = append(servers, serve)
+}
+
+// listenLMTPUnix prepares to serve LMTP on a unix domain socket. Unlike TCP
+// sockets, the unix domain socket is created by the unprivileged mox process.
+func listenLMTPUnix(name, path string, hostname dns.Domain, maxMessageSize int64, trustedAuthServID string) {
+	if os.Getuid() == 0 && !mox.FilesImmediate {
+		return
+	}
+	path = mox.DataDirPath(path)
+	xlog.Print("listening for lmtp", mlog.Field("listener", name), mlog.Field("path", path))
+	// A socket may be left behind after an unclean shutdown.
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		xlog.Fatalx("smtp: removing existing lmtp unix domain socket", err, mlog.Field("path", path), mlog.Field("listener", name))
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		xlog.Fatalx("smtp: listen for lmtp", err, mlog.Field("path", path), mlog.Field("listener", name))
+	}
+	// Access is restricted through the permissions of the directory.
+	err = os.Chmod(path, 0666)
+	xlog.Check(err, "making lmtp unix domain socket accessible", mlog.Field("path", path))
+
+	serve := func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				xlog.Infox("smtp: accept", err, mlog.Field("protocol", "lmtp"), mlog.Field("listener", name))
+				continue
+			}
+			resolver := dns.StrictResolver{}
+			go serve(name, mox.Cid(), hostname, nil, conn, resolver, false, false, maxMessageSize, false, false, nil, defaultLimiters, true, trustedAuthServID)
 		}
 	}
 
@@ -283,6 +352,10 @@ type conn struct {
 	cmdStart              time.Time // Start of current command.
 	ncmds                 int       // Number of commands processed. Used to abort connection when first incoming command is unknown/invalid.
 	dnsBLs                []dns.Domain
+	limiters              *mox.Limiters
+	ratelimitExempt       bool   // Whether remoteIP is allowlisted in the limiters.
+	lmtp                  bool   // ../rfc/2033 applies, for delivery from a trusted relay.
+	trustedAuthServID     string // For LMTP, if set, results from Authentication-Results header with this authserv-id are used.
 
 	// If non-zero, taken into account during Read and Write. Set while processing DATA
 	// command, we don't want the entire delivery to take too long.
@@ -300,10 +373,11 @@ type conn struct {
 	transactionBad  int
 
 	// Message transaction.
-	mailFrom    *smtp.Path
-	has8bitmime bool // If MAIL FROM parameter BODY=8BITMIME was sent. Required for SMTPUTF8.
-	smtputf8    bool // todo future: we should keep track of this per recipient. perhaps only a specific recipient requires smtputf8, e.g. due to a utf8 localpart. we should decide ourselves if the message needs smtputf8, e.g. due to utf8 header values.
-	recipients  []rcptAccount
+	mailFrom      *smtp.Path
+	has8bitmime   bool      // If MAIL FROM parameter BODY=8BITMIME was sent. Required for SMTPUTF8.
+	futureRelease time.Time // If MAIL FROM parameter HOLDFOR or HOLDUNTIL was sent, for submission. ../rfc/4865
+	smtputf8      bool      // todo future: we should keep track of this per recipient. perhaps only a specific recipient requires smtputf8, e.g. due to a utf8 localpart. we should decide ourselves if the message needs smtputf8, e.g. due to utf8 header values.
+	recipients    []rcptAccount
 }
 
 type rcptAccount struct {
@@ -314,6 +388,15 @@ type rcptAccount struct {
 	accountName      string
 	destination      config.Destination
 	canonicalAddress string // Optional catchall part stripped and/or lowercased.
+
+	// For bounces to an SRS-rewritten address of a forwarded message, the original
+	// sender the bounce is relayed to.
+	srsOrig smtp.Address
+
+	// For an alias, the alias configuration. Aliases are expanded into members when
+	// delivering. For members, aliasRcptTo is the address of the alias.
+	alias       *config.Alias
+	aliasRcptTo smtp.Path
 }
 
 func isClosed(err error) bool {
@@ -339,10 +422,25 @@ func (c *conn) reset() {
 func (c *conn) rset() {
 	c.mailFrom = nil
 	c.has8bitmime = false
+	c.futureRelease = time.Time{}
 	c.smtputf8 = false
 	c.recipients = nil
 }
 
+const defaultMaxFutureRelease = 30 * 24 * time.Hour
+
+// maxFutureRelease returns the maximum hold for messages submitted with
+// FUTURERELEASE, or zero if FUTURERELEASE is disabled.
+func maxFutureRelease() time.Duration {
+	d := mox.Conf.Static.Queue.MaxFutureRelease
+	if d == 0 {
+		return defaultMaxFutureRelease
+	} else if d < 0 {
+		return 0
+	}
+	return d
+}
+
 func (c *conn) earliestDeadline(d time.Duration) time.Time {
 	e := time.Now().Add(d)
 	if !c.deadline.IsZero() && c.deadline.Before(e) {
@@ -509,16 +607,21 @@ func (c *conn) writelinef(format string, args ...any) {
 
 var cleanClose struct{} // Sentinel value for panic/recover indicating clean close of connection.
 
-func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.Config, nc net.Conn, resolver dns.Resolver, submission, tls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain) {
+func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.Config, nc net.Conn, resolver dns.Resolver, submission, tls bool, maxMessageSize int64, requireTLSForAuth, requireTLSForDelivery bool, dnsBLs []dns.Domain, limiters *mox.Limiters, lmtp bool, trustedAuthServID string) {
 	var localIP, remoteIP net.IP
 	if a, ok := nc.LocalAddr().(*net.TCPAddr); ok {
 		localIP = a.IP
+	} else if _, ok := nc.LocalAddr().(*net.UnixAddr); ok {
+		// For LMTP over unix domain socket.
+		localIP = net.IPv4(127, 0, 0, 1)
 	} else {
 		// For net.Pipe, during tests.
 		localIP = net.ParseIP("127.0.0.10")
 	}
 	if a, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
 		remoteIP = a.IP
+	} else if _, ok := nc.RemoteAddr().(*net.UnixAddr); ok {
+		remoteIP = net.IPv4(127, 0, 0, 1)
 	} else {
 		// For net.Pipe, during tests.
 		remoteIP = net.ParseIP("127.0.0.10")
@@ -540,6 +643,10 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 		requireTLSForAuth:     requireTLSForAuth,
 		requireTLSForDelivery: requireTLSForDelivery,
 		dnsBLs:                dnsBLs,
+		limiters:              limiters,
+		ratelimitExempt:       lmtp || limiters.Exempt(remoteIP), // LMTP is only for trusted relays.
+		lmtp:                  lmtp,
+		trustedAuthServID:     trustedAuthServID,
 	}
 	c.log = xlog.MoreFields(func() []mlog.Pair {
 		now := time.Now()
@@ -591,25 +698,31 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	default:
 	}
 
-	if !limiterConnectionRate.Add(c.remoteIP, time.Now(), 1) {
-		c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "connection rate from your ip or network too high, slow down please", nil)
-		return
-	}
+	if c.ratelimitExempt {
+		c.log.Debug("remote ip is exempt from rate limiting", mlog.Field("remoteip", c.remoteIP))
+	} else {
+		if !c.limiters.ConnectionRate.Add(c.remoteIP, time.Now(), 1) {
+			metrics.ConnectionRatelimitedInc(c.kind(), "connectionrate")
+			c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "connection rate from your ip or network too high, slow down please", nil)
+			return
+		}
 
-	// If remote IP/network resulted in too many authentication failures, refuse to serve.
-	if submission && !mox.LimiterFailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
-		metrics.AuthenticationRatelimitedInc("submission")
-		c.log.Debug("refusing connection due to many auth failures", mlog.Field("remoteip", c.remoteIP))
-		c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many auth failures", nil)
-		return
-	}
+		// If remote IP/network resulted in too many authentication failures, refuse to serve.
+		if submission && !c.limiters.FailedAuth.CanAdd(c.remoteIP, time.Now(), 1) {
+			metrics.AuthenticationRatelimitedInc("submission")
+			c.log.Debug("refusing connection due to many auth failures", mlog.Field("remoteip", c.remoteIP))
+			c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many auth failures", nil)
+			return
+		}
 
-	if !limiterConnections.Add(c.remoteIP, time.Now(), 1) {
-		c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
-		c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many open connections from your ip or network", nil)
-		return
+		if !c.limiters.Connections.Add(c.remoteIP, time.Now(), 1) {
+			metrics.ConnectionRatelimitedInc(c.kind(), "connections")
+			c.log.Debug("refusing connection due to many open connections", mlog.Field("remoteip", c.remoteIP))
+			c.writecodeline(smtp.C421ServiceUnavail, smtp.SePol7Other0, "too many open connections from your ip or network", nil)
+			return
+		}
+		defer c.limiters.Connections.Add(c.remoteIP, time.Now(), -1)
 	}
-	defer limiterConnections.Add(c.remoteIP, time.Now(), -1)
 
 	// We register and unregister the original connection, in case c.conn is replaced
 	// with a TLS connection later on.
@@ -621,7 +734,12 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 	// We include the string ESMTP. https://cr.yp.to/smtp/greeting.html recommends it.
 	// Should not be too relevant nowadays, but does not hurt and default blackbox
 	// exporter SMTP health check expects it.
-	c.writelinef("%d %s ESMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	if c.lmtp {
+		// ../rfc/2033:156
+		c.writelinef("%d %s LMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	} else {
+		c.writelinef("%d %s ESMTP mox %s", smtp.C220ServiceReady, c.hostname.ASCII, moxvar.Version)
+	}
 
 	for {
 		command(c)
@@ -642,6 +760,7 @@ func serve(listenerName string, cid int64, hostname dns.Domain, tlsConfig *tls.C
 var commands = map[string]func(c *conn, p *parser){
 	"helo":     (*conn).cmdHelo,
 	"ehlo":     (*conn).cmdEhlo,
+	"lhlo":     (*conn).cmdLhlo,
 	"starttls": (*conn).cmdStarttls,
 	"auth":     (*conn).cmdAuth,
 	"mail":     (*conn).cmdMail,
@@ -729,6 +848,8 @@ func command(c *conn) {
 func (c *conn) kind() string {
 	if c.submission {
 		return "submission"
+	} else if c.lmtp {
+		return "lmtp"
 	}
 	return "smtp"
 }
@@ -748,13 +869,31 @@ func (c *conn) xneedTLSForDelivery() {
 }
 
 func (c *conn) cmdHelo(p *parser) {
+	c.xnotLMTP()
 	c.cmdHello(p, false)
 }
 
 func (c *conn) cmdEhlo(p *parser) {
+	c.xnotLMTP()
+	c.cmdHello(p, true)
+}
+
+// ../rfc/2033:134
+func (c *conn) cmdLhlo(p *parser) {
+	if !c.lmtp {
+		xsmtpUserErrorf(smtp.C500BadSyntax, smtp.SeProto5BadCmdOrSeq1, "unknown command")
+	}
 	c.cmdHello(p, true)
 }
 
+// xnotLMTP aborts the command for LMTP connections, which must use LHLO.
+func (c *conn) xnotLMTP() {
+	if c.lmtp {
+		// ../rfc/2033:140
+		xsmtpUserErrorf(smtp.C500BadSyntax, smtp.SeProto5BadCmdOrSeq1, "this is an lmtp server, use lhlo")
+	}
+}
+
 // ../rfc/5321:1783
 func (c *conn) cmdHello(p *parser, ehlo bool) {
 	// ../rfc/5321:1827, though a few paragraphs earlier at ../rfc/5321:1802 is a claim
@@ -805,6 +944,10 @@ func (c *conn) cmdHello(p *parser, ehlo bool) {
 		}
 	}
 	c.bwritelinef("250-ENHANCEDSTATUSCODES") // ../rfc/2034:71
+	if maxHold := maxFutureRelease(); c.submission && maxHold > 0 {
+		// Maximum interval in seconds, and maximum date-time. ../rfc/4865
+		c.bwritelinef("250-FUTURERELEASE %d %s", int64(maxHold/time.Second), time.Now().Add(maxHold).UTC().Format(time.RFC3339))
+	}
 	// todo future? c.writelinef("250-DSN")
 	c.bwritelinef("250-8BITMIME")              // ../rfc/6152:86
 	c.bwritecodeline(250, "", "SMTPUTF8", nil) // ../rfc/6531:201
@@ -896,11 +1039,12 @@ func (c *conn) cmdAuth(p *parser) {
 	authResult := "error"
 	defer func() {
 		metrics.AuthenticationInc("submission", authVariant, authResult)
-		switch authResult {
-		case "ok":
-			mox.LimiterFailedAuth.Reset(c.remoteIP, time.Now())
+		switch {
+		case c.ratelimitExempt:
+		case authResult == "ok":
+			c.limiters.FailedAuth.Reset(c.remoteIP, time.Now())
 		default:
-			mox.LimiterFailedAuth.Add(c.remoteIP, time.Now(), 1)
+			c.limiters.FailedAuth.Add(c.remoteIP, time.Now(), 1)
 		}
 	}()
 
@@ -1248,6 +1392,32 @@ func (c *conn) cmdMail(p *parser) {
 		case "SMTPUTF8":
 			// ../rfc/6531:213
 			c.smtputf8 = true
+		case "HOLDFOR", "HOLDUNTIL":
+			// ../rfc/4865
+			maxHold := maxFutureRelease()
+			if !c.submission || maxHold == 0 {
+				xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
+			}
+			if K == "HOLDFOR" && paramSeen["HOLDUNTIL"] || K == "HOLDUNTIL" && paramSeen["HOLDFOR"] {
+				xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "cannot use both HOLDFOR and HOLDUNTIL")
+			}
+			p.xtake("=")
+			now := time.Now()
+			if K == "HOLDFOR" {
+				secs := p.xnumber(9)
+				c.futureRelease = now.Add(time.Duration(secs) * time.Second)
+			} else {
+				v := p.xparamValue()
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "parsing HOLDUNTIL date-time: %v", err)
+				}
+				// A release time in the past means the message can be delivered immediately.
+				c.futureRelease = t
+			}
+			if c.futureRelease.Sub(now) > maxHold {
+				xsmtpUserErrorf(smtp.C501BadParamSyntax, smtp.SeProto5BadParams4, "requested release time too far in the future, maximum hold is %d seconds", int64(maxHold/time.Second))
+			}
 		default:
 			// ../rfc/5321:2230
 			xsmtpUserErrorf(smtp.C555UnrecognizedAddrParams, smtp.SeSys3NotSupported3, "unrecognized parameter %q", key)
@@ -1268,11 +1438,10 @@ func (c *conn) cmdMail(p *parser) {
 		if rpath.IsZero() {
 			return true
 		}
-		accName, _, _, err := mox.FindAccount(rpath.Localpart, rpath.IPDomain.Domain, false)
-		return err == nil && accName == c.account.Name
+		return mox.AllowedFromAddress(c.account.Name, smtp.Address{Localpart: rpath.Localpart, Domain: rpath.IPDomain.Domain}, false)
 	}
 
-	if !c.submission && !rpath.IPDomain.Domain.IsZero() {
+	if !c.submission && !c.lmtp && !rpath.IPDomain.Domain.IsZero() {
 		// If rpath domain has null MX record or is otherwise not accepting email, reject.
 		// ../rfc/7505:181
 		// ../rfc/5321:4045
@@ -1350,7 +1519,7 @@ func (c *conn) cmdRcpt(p *parser) {
 	// We don't want to allow delivery to multiple recipients with a null reverse path.
 	// Why would anyone send like that? Null reverse path is intended for delivery
 	// notifications, they should go to a single recipient.
-	if !c.submission && len(c.recipients) > 0 && c.mailFrom.IsZero() {
+	if !c.submission && !c.lmtp && len(c.recipients) > 0 && c.mailFrom.IsZero() {
 		xsmtpUserErrorf(smtp.C452StorageFull, smtp.SeProto5TooManyRcpts3, "only one recipient allowed with null reverse address")
 	}
 
@@ -1363,7 +1532,8 @@ func (c *conn) cmdRcpt(p *parser) {
 	// ../rfc/5321:3598
 	// ../rfc/5321:4045
 	// Also see ../rfc/7489:2214
-	if !c.submission && len(c.recipients) == 1 && !Localserve {
+	// A relay delivering over LMTP has already done its checks.
+	if !c.submission && !c.lmtp && len(c.recipients) == 1 && !Localserve {
 		// note: because of check above, mailFrom cannot be the null address.
 		var pass bool
 		d := c.mailFrom.IPDomain.Domain
@@ -1402,31 +1572,56 @@ func (c *conn) cmdRcpt(p *parser) {
 		// which is typically the mox user.
 		acc, _ := mox.Conf.Account("mox")
 		dest := acc.Destinations["mox@localhost"]
-		c.recipients = append(c.recipients, rcptAccount{fpath, true, "mox", dest, "mox@localhost"})
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath, local: true, accountName: "mox", destination: dest, canonicalAddress: "mox@localhost"})
 	} else if len(fpath.IPDomain.IP) > 0 {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for ip")
 		}
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath})
+	} else if _, ok := mox.Conf.Domain(fpath.IPDomain.Domain); ok && !c.submission && !c.lmtp && srs.IsSRS(fpath.Localpart) {
+		// Bounce to the rewritten MAIL FROM address of a message we forwarded. We only
+		// accept bounces, otherwise anyone who learned a rewritten address could use us
+		// as relay.
+		orig, err := mox.SRSReverse(fpath.Localpart)
+		if err != nil {
+			c.log.Infox("bad srs address", err, mlog.Field("rcptto", fpath))
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "invalid or expired srs address")
+		}
+		if !c.mailFrom.IsZero() {
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "srs address only accepts bounces with null reverse path")
+		}
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath, srsOrig: orig})
+	} else if alias, _, ok := mox.FindAlias(fpath.Localpart, fpath.IPDomain.Domain); ok {
+		if c.submission {
+			// Delivered through the queue to ourselves, and expanded at that time.
+			c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath})
+		} else if c.lmtp {
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "aliases not supported over lmtp")
+		} else {
+			// The posting policy is checked during delivery, when we have verified the
+			// sender addresses.
+			c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath, alias: &alias})
+		}
 	} else if accountName, canonical, addr, err := mox.FindAccount(fpath.Localpart, fpath.IPDomain.Domain, true); err == nil {
 		// note: a bare postmaster, without domain, is handled by FindAccount. ../rfc/5321:735
-		c.recipients = append(c.recipients, rcptAccount{fpath, true, accountName, addr, canonical})
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath, local: true, accountName: accountName, destination: addr, canonicalAddress: canonical})
 	} else if errors.Is(err, mox.ErrDomainNotFound) {
 		if !c.submission {
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "not accepting email for domain")
 		}
 		// We'll be delivering this email.
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath})
 	} else if errors.Is(err, mox.ErrAccountNotFound) {
-		if c.submission {
-			// For submission, we're transparent about which user exists. Should be fine for the typical small-scale deploy.
-			// ../rfc/5321:1071
+		if c.submission || c.lmtp {
+			// For submission, we're transparent about which user exists. Should be fine for
+			// the typical small-scale deploy. For LMTP, the relay is trusted.
+			// ../rfc/5321:1071 ../rfc/2033:202
 			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, "no such user")
 		}
 		// We pretend to accept. We don't want to let remote know the user does not exist
 		// until after DATA. Because then remote has committed to sending a message.
 		// note: not local for !c.submission is the signal this address is in error.
-		c.recipients = append(c.recipients, rcptAccount{fpath, false, "", config.Destination{}, ""})
+		c.recipients = append(c.recipients, rcptAccount{rcptTo: fpath})
 	} else {
 		c.log.Errorx("looking up account for delivery", err, mlog.Field("rcptto", fpath))
 		xsmtpServerErrorf(codes{smtp.C451LocalErr, smtp.SeSys3Other0}, "error processing")
@@ -1552,15 +1747,18 @@ func (c *conn) cmdData(p *parser) {
 			// comment belongs to "BY" which comes immediately after "FROM".
 			recvFrom = c.hello.Domain.XName(c.smtputf8)
 		}
-		iprevctx, iprevcancel := context.WithTimeout(cmdctx, time.Minute)
 		var revName string
 		var revNames []string
-		iprevStatus, revName, revNames, err = iprev.Lookup(iprevctx, c.resolver, c.remoteIP)
-		iprevcancel()
-		if err != nil {
-			c.log.Infox("reverse-forward lookup", err, mlog.Field("remoteip", c.remoteIP))
+		// For LMTP, the relay is trusted, we don't evaluate its IP.
+		if !c.lmtp {
+			iprevctx, iprevcancel := context.WithTimeout(cmdctx, time.Minute)
+			iprevStatus, revName, revNames, err = iprev.Lookup(iprevctx, c.resolver, c.remoteIP)
+			iprevcancel()
+			if err != nil {
+				c.log.Infox("reverse-forward lookup", err, mlog.Field("remoteip", c.remoteIP))
+			}
+			c.log.Debug("dns iprev check", mlog.Field("addr", c.remoteIP), mlog.Field("status", iprevStatus))
 		}
-		c.log.Debug("dns iprev check", mlog.Field("addr", c.remoteIP), mlog.Field("status", iprevStatus))
 		var name string
 		if revName != "" {
 			name = revName
@@ -1586,7 +1784,11 @@ func (c *conn) cmdData(p *parser) {
 
 	// ../rfc/3848:34 ../rfc/6531:791
 	with := "SMTP"
-	if c.smtputf8 {
+	if c.lmtp && c.smtputf8 {
+		with = "UTF8LMTP"
+	} else if c.lmtp {
+		with = "LMTP"
+	} else if c.smtputf8 {
 		with = "UTF8SMTP"
 	} else if c.ehlo {
 		with = "ESMTP"
@@ -1617,6 +1819,8 @@ func (c *conn) cmdData(p *parser) {
 	// internet traffic.
 	if c.submission {
 		c.submit(cmdctx, recvHdrFor, msgWriter, &dataFile)
+	} else if c.lmtp {
+		c.deliverLMTP(cmdctx, recvHdrFor, msgWriter, &dataFile)
 	} else {
 		c.deliver(cmdctx, recvHdrFor, msgWriter, iprevStatus, &dataFile)
 	}
@@ -1633,6 +1837,55 @@ func messageHeaderCommentDomain(domain dns.Domain, smtputf8 bool) string {
 	return s
 }
 
+// checkFromSender checks that the From and Sender message headers, as used in
+// a submitted message, belong to the authenticated account, according to the
+// account's SubmissionFromPolicy. It responds with an error if not.
+func (c *conn) checkFromSender(msgFrom smtp.Address, header textproto.MIMEHeader) {
+	// ../rfc/6409:522
+	var sender *smtp.Address
+	if senders := header.Values("Sender"); len(senders) > 1 {
+		metricSubmission.WithLabelValues("badsender").Inc()
+		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "message must have at most one Sender header")
+	} else if len(senders) == 1 {
+		// ../rfc/5322:1102
+		l, err := mail.Header(header).AddressList("Sender")
+		if err != nil || len(l) != 1 {
+			metricSubmission.WithLabelValues("badsender").Inc()
+			c.log.Infox("parsing message Sender address", err, mlog.Field("user", c.username), mlog.Field("sender", senders[0]))
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "Sender header must have a single valid address")
+		}
+		addr, err := smtp.ParseAddress(l[0].Address)
+		if err != nil {
+			metricSubmission.WithLabelValues("badsender").Inc()
+			c.log.Infox("parsing message Sender address", err, mlog.Field("user", c.username), mlog.Field("sender", l[0].Address))
+			xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "cannot parse Sender address: %v", err)
+		}
+		sender = &addr
+	}
+
+	if sender != nil && !mox.AllowedFromAddress(c.account.Name, *sender, true) {
+		metricSubmission.WithLabelValues("badsender").Inc()
+		c.log.Info("verifying message Sender address failed", mlog.Field("user", c.username), mlog.Field("sender", *sender))
+		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "Sender header address must match authenticated user")
+	}
+
+	if mox.AllowedFromAddress(c.account.Name, msgFrom, true) {
+		return
+	}
+	// With policy "sender", a message may be sent on behalf of another address in one
+	// of our domains, as long as the Sender header identifies the account.
+	accConf, _ := c.account.Conf()
+	if accConf.SubmissionFromPolicy == "sender" && sender != nil {
+		if _, ok := mox.Conf.Domain(msgFrom.Domain); ok {
+			c.log.Info("allowing message From address through Sender header", mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom), mlog.Field("sender", *sender))
+			return
+		}
+	}
+	metricSubmission.WithLabelValues("badfrom").Inc()
+	c.log.Info("verifying message From address failed", mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom))
+	xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "From header address must match authenticated user")
+}
+
 // submit is used for mail from authenticated users that we will try to deliver.
 func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWriter *message.Writer, pdataFile **os.File) {
 	dataFile := *pdataFile
@@ -1647,16 +1900,7 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 		c.log.Infox("parsing message From address", err, mlog.Field("user", c.username))
 		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SeMsg6Other0, "cannot parse header or From address: %v", err)
 	}
-	accName, _, _, err := mox.FindAccount(msgFrom.Localpart, msgFrom.Domain, true)
-	if err != nil || accName != c.account.Name {
-		// ../rfc/6409:522
-		if err == nil {
-			err = mox.ErrAccountNotFound
-		}
-		metricSubmission.WithLabelValues("badfrom").Inc()
-		c.log.Infox("verifying message From address", err, mlog.Field("user", c.username), mlog.Field("msgfrom", msgFrom))
-		xsmtpUserErrorf(smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, "must match authenticated user")
-	}
+	c.checkFromSender(msgFrom, header)
 
 	// Outgoing messages should not have a Return-Path header. The final receiving mail
 	// server will add it.
@@ -1668,8 +1912,10 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 
 	// Add Message-Id header if missing.
 	// ../rfc/5321:4131 ../rfc/6409:751
-	if header.Get("Message-Id") == "" {
-		msgPrefix = append(msgPrefix, fmt.Sprintf("Message-Id: <%s>\r\n", mox.MessageIDGen(c.smtputf8))...)
+	messageID := header.Get("Message-Id")
+	if messageID == "" {
+		messageID = fmt.Sprintf("<%s>", mox.MessageIDGen(c.smtputf8))
+		msgPrefix = append(msgPrefix, fmt.Sprintf("Message-Id: %s\r\n", messageID)...)
 	}
 
 	// ../rfc/6409:745
@@ -1860,7 +2106,7 @@ func (c *conn) submit(ctx context.Context, recvHdrFor func(string) string, msgWr
 			}
 
 			msgSize := int64(len(xmsgPrefix)) + msgWriter.Size
-			if err := queue.Add(ctx, c.log, c.account.Name, *c.mailFrom, rcptAcc.rcptTo, msgWriter.Has8bit, c.smtputf8, msgSize, xmsgPrefix, dataFile, nil, i == len(c.recipients)-1); err != nil {
+			if err := queue.Add(ctx, c.log, c.account.Name, *c.mailFrom, rcptAcc.rcptTo, msgWriter.Has8bit, c.smtputf8, msgSize, messageID, c.futureRelease, xmsgPrefix, dataFile, nil, i == len(c.recipients)-1); err != nil {
 				// Aborting the transaction is not great. But continuing and generating DSNs will
 				// probably result in errors as well...
 				metricSubmission.WithLabelValues("queueerror").Inc()
@@ -2033,7 +2279,7 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 	// Give immediate response if all recipients are unknown.
 	nunknown := 0
 	for _, r := range c.recipients {
-		if !r.local {
+		if !r.local && r.srsOrig.IsZero() && r.alias == nil {
 			nunknown++
 		}
 	}
@@ -2233,14 +2479,124 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		errmsg    string
 	}
 	var deliverErrors []deliverError
+	// Failures for alias members are only reported to the sender if delivery to all
+	// members of an alias failed. Keyed by alias address.
+	aliasErrors := map[string][]deliverError{}
 	addError := func(rcptAcc rcptAccount, code int, secode string, userError bool, errmsg string) {
 		e := deliverError{rcptAcc.rcptTo, code, secode, userError, errmsg}
 		c.log.Info("deliver error", mlog.Field("rcptto", e.rcptTo), mlog.Field("code", code), mlog.Field("secode", "secode"), mlog.Field("usererror", userError), mlog.Field("errmsg", errmsg))
+		if !rcptAcc.aliasRcptTo.IsZero() {
+			k := rcptAcc.aliasRcptTo.String()
+			aliasErrors[k] = append(aliasErrors[k], e)
+			return
+		}
 		deliverErrors = append(deliverErrors, e)
 	}
 
-	// For each recipient, do final spam analysis and delivery.
+	// Expand aliases into their members, if the sender is allowed to post.
+	var recipients []rcptAccount
+	aliasMembers := map[string]int{}
 	for _, rcptAcc := range c.recipients {
+		if rcptAcc.alias == nil {
+			recipients = append(recipients, rcptAcc)
+			continue
+		}
+		mailFromVerified := mailFromValidation == store.ValidationPass
+		msgFromVerified := msgFromValidation == store.ValidationStrict || msgFromValidation == store.ValidationDMARC || msgFromValidation == store.ValidationRelaxed
+		if aliasListIDPresent(headers, *rcptAcc.alias) {
+			metricDelivery.WithLabelValues("aliasloop", "").Inc()
+			addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SeNet4Loop6, true, "loop detected, message already has list-id of alias")
+			continue
+		} else if !aliasPostAllowed(*rcptAcc.alias, *c.mailFrom, mailFromVerified, msgFrom, msgFromVerified) {
+			metricDelivery.WithLabelValues("aliaspolicy", "").Inc()
+			addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SePol7DeliveryUnauth1, true, "not allowed to send to alias")
+			continue
+		} else if dmarcUse && dmarcResult.Reject {
+			// Regular analysis would reject for local members, but we also don't want to
+			// forward to external members.
+			metricDelivery.WithLabelValues("reject", reasonDMARCPolicy).Inc()
+			addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SePol7MultiAuthFails26, true, "rejecting per dmarc policy")
+			continue
+		}
+		members := expandAlias(c.log, rcptAcc)
+		aliasMembers[rcptAcc.rcptTo.String()] = len(members)
+		recipients = append(recipients, members...)
+	}
+
+	// A member of an alias can also be a direct recipient, or a member of multiple
+	// aliases. Deliver only once.
+	recipients = dedupAliasMembers(recipients, aliasMembers)
+
+	newMessage := func(rcptAcc rcptAccount, msgPrefix []byte) *store.Message {
+		return &store.Message{
+			Received:           time.Now(),
+			RemoteIP:           c.remoteIP.String(),
+			RemoteIPMasked1:    ipmasked1,
+			RemoteIPMasked2:    ipmasked2,
+			RemoteIPMasked3:    ipmasked3,
+			EHLODomain:         c.hello.Domain.Name(),
+			MailFrom:           c.mailFrom.String(),
+			MailFromLocalpart:  c.mailFrom.Localpart,
+			MailFromDomain:     c.mailFrom.IPDomain.Domain.Name(),
+			RcptToLocalpart:    rcptAcc.rcptTo.Localpart,
+			RcptToDomain:       rcptAcc.rcptTo.IPDomain.Domain.Name(),
+			MsgFromLocalpart:   msgFrom.Localpart,
+			MsgFromDomain:      msgFrom.Domain.Name(),
+			MsgFromOrgDomain:   publicsuffix.Lookup(ctx, msgFrom.Domain).Name(),
+			EHLOValidated:      ehloValidation == store.ValidationPass,
+			MailFromValidated:  mailFromValidation == store.ValidationPass,
+			MsgFromValidated:   msgFromValidation == store.ValidationStrict || msgFromValidation == store.ValidationDMARC || msgFromValidation == store.ValidationRelaxed,
+			EHLOValidation:     ehloValidation,
+			MailFromValidation: mailFromValidation,
+			MsgFromValidation:  msgFromValidation,
+			DKIMDomains:        verifiedDKIMDomains,
+			Size:               int64(len(msgPrefix)) + msgWriter.Size,
+			MsgPrefix:          msgPrefix,
+		}
+	}
+
+	// External members of an alias only get the message if it would be accepted for
+	// local delivery. We analyze the message once per alias, with the account of a
+	// local member, or the postmaster account if the alias has no local members.
+	aliasAnalyses := map[string]analysis{}
+	analyzeAlias := func(log *mlog.Log, member rcptAccount) analysis {
+		k := member.aliasRcptTo.String()
+		if a, ok := aliasAnalyses[k]; ok {
+			return a
+		}
+		ref := rcptAccount{
+			rcptTo:      member.aliasRcptTo,
+			local:       true,
+			accountName: mox.Conf.Static.Postmaster.Account,
+			destination: config.Destination{Mailbox: mox.Conf.Static.Postmaster.Mailbox},
+		}
+		for _, r := range recipients {
+			if r.local && r.aliasRcptTo.String() == k {
+				ref = r
+				break
+			}
+		}
+		var a analysis
+		acc, err := store.OpenAccount(ref.accountName)
+		if err != nil {
+			log.Errorx("open account for analyzing message to alias", err, mlog.Field("account", ref.accountName))
+			a = analysis{false, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing", err, nil, nil, "accounterror"}
+		} else {
+			msgPrefix := []byte(authResults.Header() + receivedSPF.Header() + recvHdrFor(ref.rcptTo.String()))
+			if !msgWriter.HaveHeaders {
+				msgPrefix = append(msgPrefix, "\r\n"...)
+			}
+			d := delivery{newMessage(ref, msgPrefix), dataFile, ref, acc, msgFrom, c.dnsBLs, dmarcUse, dmarcResult, dkimResults, iprevStatus}
+			a = analyze(ctx, log, c.resolver, d)
+			err := acc.Close()
+			log.Check(err, "closing account after analyzing message to alias")
+		}
+		aliasAnalyses[k] = a
+		return a
+	}
+
+	// For each recipient, do final spam analysis and delivery.
+	for _, rcptAcc := range recipients {
 		log := c.log.Fields(mlog.Field("mailfrom", c.mailFrom), mlog.Field("rcptto", rcptAcc.rcptTo))
 
 		// If this is not a valid local user, we send back a DSN. This can only happen when
@@ -2251,7 +2607,44 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// deliveries, and return an error at the end? Though the failure conditions will
 		// probably prevent any other successful deliveries too...
 		// We'll continue delivering to other recipients. ../rfc/5321:3275
-		if !rcptAcc.local {
+		if !rcptAcc.srsOrig.IsZero() {
+			msgPrefix := []byte(authResults.Header() + receivedSPF.Header() + recvHdrFor(rcptAcc.rcptTo.String()))
+			if !msgWriter.HaveHeaders {
+				msgPrefix = append(msgPrefix, "\r\n"...)
+			}
+			if Localserve {
+				addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, true, "no relaying with localserve")
+			} else if err := c.relaySRSBounce(ctx, log, rcptAcc, msgPrefix, msgWriter, dataFile); err != nil {
+				log.Errorx("relaying bounce to srs address", err)
+				metricDelivery.WithLabelValues("srserror", "").Inc()
+				addError(rcptAcc, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+			} else {
+				metricDelivery.WithLabelValues("srsrelayed", "").Inc()
+			}
+			continue
+		} else if rcptAcc.alias != nil && !rcptAcc.local {
+			// External member of alias.
+			msgPrefix := []byte(aliasListHeaders(*rcptAcc.alias) + authResults.Header() + receivedSPF.Header() + recvHdrFor(rcptAcc.rcptTo.String()))
+			if !msgWriter.HaveHeaders {
+				msgPrefix = append(msgPrefix, "\r\n"...)
+			}
+			if Localserve {
+				addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, true, "no relaying with localserve")
+			} else if a := analyzeAlias(log, rcptAcc); !a.accept {
+				// We don't forward messages we would reject, it would hurt the reputation of our
+				// IPs and domain.
+				log.Info("not forwarding message for alias to external member", mlog.Field("reason", a.reason), mlog.Field("msgfrom", msgFrom))
+				metricDelivery.WithLabelValues("forwardjunk", a.reason).Inc()
+				addError(rcptAcc, a.code, a.secode, a.userError, a.errmsg)
+			} else if err := c.forwardAliasMember(ctx, log, rcptAcc, msgPrefix, msgWriter, dataFile); err != nil {
+				log.Errorx("queueing message for alias member", err)
+				metricDelivery.WithLabelValues("forwarderror", "").Inc()
+				addError(rcptAcc, smtp.C451LocalErr, smtp.SeSys3Other0, false, "error processing")
+			} else {
+				metricDelivery.WithLabelValues("forwarded", "").Inc()
+			}
+			continue
+		} else if !rcptAcc.local {
 			metricDelivery.WithLabelValues("unknownuser", "").Inc()
 			addError(rcptAcc, smtp.C550MailboxUnavail, smtp.SeAddr1UnknownDestMailbox1, true, "no such user")
 			continue
@@ -2276,6 +2669,9 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// purged, or by filling the disk. We check both cases for IP's and networks.
 		var rateError bool // Whether returned error represents a rate error.
 		err = acc.DB.Read(ctx, func(tx *bstore.Tx) (retErr error) {
+			if c.ratelimitExempt {
+				return nil
+			}
 			now := time.Now()
 			defer func() {
 				log.Debugx("checking message and size delivery rates", retErr, mlog.Field("duration", time.Since(now)))
@@ -2357,36 +2753,16 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		// ../rfc/5321:3204
 		// ../rfc/5321:3300
 		// Received-SPF header goes before Received. ../rfc/7208:2038
-		msgPrefix := []byte("Return-Path: <" + c.mailFrom.String() + ">\r\n" + authResults.Header() + receivedSPF.Header() + recvHdrFor(rcptAcc.rcptTo.String()))
+		var listHeaders string
+		if rcptAcc.alias != nil {
+			listHeaders = aliasListHeaders(*rcptAcc.alias)
+		}
+		msgPrefix := []byte("Return-Path: <" + c.mailFrom.String() + ">\r\n" + listHeaders + authResults.Header() + receivedSPF.Header() + recvHdrFor(rcptAcc.rcptTo.String()))
 		if !msgWriter.HaveHeaders {
 			msgPrefix = append(msgPrefix, "\r\n"...)
 		}
 
-		m := &store.Message{
-			Received:           time.Now(),
-			RemoteIP:           c.remoteIP.String(),
-			RemoteIPMasked1:    ipmasked1,
-			RemoteIPMasked2:    ipmasked2,
-			RemoteIPMasked3:    ipmasked3,
-			EHLODomain:         c.hello.Domain.Name(),
-			MailFrom:           c.mailFrom.String(),
-			MailFromLocalpart:  c.mailFrom.Localpart,
-			MailFromDomain:     c.mailFrom.IPDomain.Domain.Name(),
-			RcptToLocalpart:    rcptAcc.rcptTo.Localpart,
-			RcptToDomain:       rcptAcc.rcptTo.IPDomain.Domain.Name(),
-			MsgFromLocalpart:   msgFrom.Localpart,
-			MsgFromDomain:      msgFrom.Domain.Name(),
-			MsgFromOrgDomain:   publicsuffix.Lookup(ctx, msgFrom.Domain).Name(),
-			EHLOValidated:      ehloValidation == store.ValidationPass,
-			MailFromValidated:  mailFromValidation == store.ValidationPass,
-			MsgFromValidated:   msgFromValidation == store.ValidationStrict || msgFromValidation == store.ValidationDMARC || msgFromValidation == store.ValidationRelaxed,
-			EHLOValidation:     ehloValidation,
-			MailFromValidation: mailFromValidation,
-			MsgFromValidation:  msgFromValidation,
-			DKIMDomains:        verifiedDKIMDomains,
-			Size:               int64(len(msgPrefix)) + msgWriter.Size,
-			MsgPrefix:          msgPrefix,
-		}
+		m := newMessage(rcptAcc, msgPrefix)
 		d := delivery{m, dataFile, rcptAcc, acc, msgFrom, c.dnsBLs, dmarcUse, dmarcResult, dkimResults, iprevStatus}
 		a := analyze(ctx, log, c.resolver, d)
 		if a.reason != "" {
@@ -2482,7 +2858,21 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 				addError(rcptAcc, code, smtp.SeOther00, false, fmt.Sprintf("failure with code %d due to special localpart", code))
 			}
 		} else {
+			deliverLocal := true
+			if len(rcptAcc.destination.ForwardToAddresses) > 0 {
+				fwdPrefix := []byte(authResults.Header() + receivedSPF.Header() + recvHdrFor(rcptAcc.rcptTo.String()))
+				if !msgWriter.HaveHeaders {
+					fwdPrefix = append(fwdPrefix, "\r\n"...)
+				}
+				forwarded := c.forward(ctx, log, acc, rcptAcc, m, fwdPrefix, msgWriter, dataFile)
+				deliverLocal = !forwarded || rcptAcc.destination.ForwardKeepCopy
+			}
+			var delivered bool
+			msgPrefix := m.MsgPrefix // Cleared during delivery for accounts with encrypted messages.
 			acc.WithWLock(func() {
+				if !deliverLocal {
+					return
+				}
 				if err := acc.Deliver(log, rcptAcc.destination, m, dataFile, false); err != nil {
 					log.Errorx("delivering", err)
 					metricDelivery.WithLabelValues("delivererror", a.reason).Inc()
@@ -2492,6 +2882,8 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 				metricDelivery.WithLabelValues("delivered", a.reason).Inc()
 				log.Info("incoming message delivered", mlog.Field("reason", a.reason), mlog.Field("msgfrom", msgFrom))
 
+				delivered = true
+
 				conf, _ := acc.Conf()
 				if conf.RejectsMailbox != "" && messageID != "" {
 					if err := acc.RejectsRemove(log, conf.RejectsMailbox, messageID); err != nil {
@@ -2499,6 +2891,12 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 					}
 				}
 			})
+
+			// A DSN for a message sent by this account may have to be passed on to the
+			// webhook of the account.
+			if delivered {
+				queue.IncomingDSN(ctx, log, acc.Name, store.FileMsgReader(msgPrefix, dataFile))
+			}
 		}
 
 		err = acc.Close()
@@ -2506,6 +2904,16 @@ func (c *conn) deliver(ctx context.Context, recvHdrFor func(string) string, msgW
 		acc = nil
 	}
 
+	// Delivery to an alias failed if delivery to all its members failed.
+	for _, rcptAcc := range c.recipients {
+		k := rcptAcc.rcptTo.String()
+		if rcptAcc.alias != nil && len(aliasErrors[k]) > 0 && len(aliasErrors[k]) == aliasMembers[k] {
+			e := aliasErrors[k][0]
+			e.rcptTo = rcptAcc.rcptTo
+			deliverErrors = append(deliverErrors, e)
+		}
+	}
+
 	// If all recipients failed to deliver, return an error.
 	if len(c.recipients) == len(deliverErrors) {
 		same := true
@@ -4,6 +4,7 @@ package smtpserver
 // todo: test delivering a message to multiple recipients, and with some of them failing.
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ed25519"
@@ -83,6 +84,7 @@ type testserver struct {
 	submission bool
 	dnsbls     []dns.Domain
 	tlsmode    smtpclient.TLSMode
+	limiters   *mox.Limiters // If nil, defaultLimiters is used.
 }
 
 func newTestServer(t *testing.T, configPath string, resolver dns.Resolver) *testserver {
@@ -131,7 +133,11 @@ func (ts *testserver) run(fn func(helloErr error, client *smtpclient.Client)) {
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{fakeCert(ts.t)},
 		}
-		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.dnsbls)
+		limiters := ts.limiters
+		if limiters == nil {
+			limiters = defaultLimiters
+		}
+		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.dnsbls, limiters, false, "")
 		close(serverdone)
 	}()
 
@@ -140,7 +146,7 @@ func (ts *testserver) run(fn func(helloErr error, client *smtpclient.Client)) {
 		authLine = fmt.Sprintf("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("\u0000%s\u0000%s", ts.user, ts.pass))))
 	}
 
-	client, err := smtpclient.New(ctxbg, xlog.WithCid(ts.cid-1), clientConn, ts.tlsmode, "mox.example", authLine)
+	client, err := smtpclient.New(ctxbg, xlog.WithCid(ts.cid-1), clientConn, ts.tlsmode, dns.Domain{}, "mox.example", authLine)
 	if err != nil {
 		clientConn.Close()
 	} else {
@@ -217,6 +223,188 @@ func TestSubmission(t *testing.T) {
 	testAuth("mjl@mox.example", "testtest", nil)
 }
 
+// Test From and Sender headers of submitted messages must belong to the account.
+func TestSubmissionFrom(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/catchall/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	ts.submission = true
+	ts.user = "mjl@mox.example"
+	ts.pass = "testtest"
+
+	test := func(mailFrom, headers string, expErr *smtpclient.Error) {
+		t.Helper()
+		msg := strings.ReplaceAll(headers+`To: <remote@example.org>
+Subject: test
+
+test email
+`, "\n", "\r\n")
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			if err == nil {
+				err = client.Deliver(ctxbg, mailFrom, "remote@example.org", int64(len(msg)), strings.NewReader(msg), false, false)
+			}
+			var cerr smtpclient.Error
+			if expErr == nil && err != nil || expErr != nil && (err == nil || !errors.As(err, &cerr) || cerr.Secode != expErr.Secode) {
+				t.Fatalf("got err %#v, expected %#v", err, expErr)
+			}
+		})
+	}
+
+	unauth := &smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SePol7DeliveryUnauth1}
+	badmsg := &smtpclient.Error{Permanent: true, Code: smtp.C550MailboxUnavail, Secode: smtp.SeMsg6Other0}
+
+	test("mjl@mox.example", "From: <mjl@mox.example>\n", nil)
+	test("mjl@mox.example", "From: <mjl+test@mox.example>\n", nil)                                     // Catchall separator.
+	test("mjl@mox.example", "From: <other@mox.example>\n", unauth)                                     // Address of catchall account.
+	test("other@mox.example", "From: <mjl@mox.example>\n", unauth)                                     // Bad MAIL FROM.
+	test("mjl@mox.example", "From: <mjl@mox.example>\nSender: <other@mox.example>\n", unauth)          // Bad Sender.
+	test("mjl@mox.example", "From: <mjl@mox.example>\nSender: <mjl@mox.example>\n", nil)               // Good Sender.
+	test("mjl@mox.example", "From: <mjl@mox.example>\nSender: a@mox.example, b@mox.example\n", badmsg) // Multiple Sender addresses.
+	test("mjl@mox.example", "From: <other@mox.example>\nSender: <mjl@mox.example>\n", unauth)          // Sender policy not enabled.
+
+	// Allow sending from other address, e.g. shared identity.
+	acc, _ := mox.Conf.Account("mjl")
+	acc.SubmissionAllowedFromCanonical = map[string]struct{}{"info@mox.example": {}}
+	mox.Conf.Dynamic.Accounts["mjl"] = acc
+	test("info@mox.example", "From: <info@mox.example>\n", nil)
+	test("mjl@mox.example", "From: <INFO+x@mox.example>\nSender: <mjl@mox.example>\n", nil)
+	test("mjl@mox.example", "From: <mjl@mox.example>\nSender: <info@mox.example>\n", nil)
+	test("mjl@mox.example", "From: <other@mox.example>\n", unauth)
+
+	// With sender policy, From may be another local address, if Sender is ours.
+	acc.SubmissionFromPolicy = "sender"
+	mox.Conf.Dynamic.Accounts["mjl"] = acc
+	test("mjl@mox.example", "From: <other@mox.example>\nSender: <mjl@mox.example>\n", nil)
+	test("mjl@mox.example", "From: <other@mox.example>\n", unauth)
+	test("mjl@mox.example", "From: <remote@example.org>\nSender: <mjl@mox.example>\n", unauth) // Not our domain.
+}
+
+// Test FUTURERELEASE during submission, with HOLDFOR and HOLDUNTIL.
+func TestFutureRelease(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	// Run a raw SMTP transaction, smtpclient has no support for MAIL FROM parameters.
+	// Returns the EHLO response and the response to MAIL FROM.
+	test := func(submission bool, mailParams string) (ehlo, mail string) {
+		t.Helper()
+
+		ts.cid += 2
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+		serverdone := make(chan struct{})
+		defer func() { <-serverdone }()
+
+		go func() {
+			tlsConfig := &tls.Config{
+				Certificates: []tls.Certificate{fakeCert(ts.t)},
+			}
+			serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, submission, false, 100<<20, false, false, nil, defaultLimiters, false, "")
+			close(serverdone)
+		}()
+
+		br := bufio.NewReader(clientConn)
+		response := func() string {
+			t.Helper()
+			var r string
+			for {
+				line, err := br.ReadString('\n')
+				tcheck(t, err, "read response")
+				r += line
+				if len(line) < 4 || line[3] == ' ' {
+					return r
+				}
+			}
+		}
+		command := func(cmd string) string {
+			t.Helper()
+			_, err := fmt.Fprintf(clientConn, "%s\r\n", cmd)
+			tcheck(t, err, "write command")
+			return response()
+		}
+
+		response() // Greeting.
+		ehlo = command("EHLO mox.example")
+		if submission {
+			r := command("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\u0000mjl@mox.example\u0000testtest")))
+			if !strings.HasPrefix(r, "235 ") {
+				t.Fatalf("auth: %q", r)
+			}
+		}
+		mail = command("MAIL FROM:<mjl@mox.example>" + mailParams)
+		if strings.HasPrefix(mail, "250 ") {
+			for _, cmd := range []string{"RCPT TO:<remote@example.org>", "DATA"} {
+				if r := command(cmd); !strings.HasPrefix(r, "250 ") && !strings.HasPrefix(r, "354 ") {
+					t.Fatalf("%s: %q", cmd, r)
+				}
+			}
+			if r := command(submitMessage + "."); !strings.HasPrefix(r, "250 ") {
+				t.Fatalf("data: %q", r)
+			}
+		}
+		command("QUIT")
+		return
+	}
+
+	checkQueue := func(expRelease time.Time) {
+		t.Helper()
+		msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Page{})
+		tcheck(t, err, "listing queue")
+		if len(msgs) != 1 {
+			t.Fatalf("got %d messages in queue, expected 1", len(msgs))
+		}
+		m := msgs[0]
+		if expRelease.IsZero() {
+			if !m.FutureRelease.IsZero() || m.NextAttempt.After(time.Now().Add(time.Minute)) {
+				t.Fatalf("got future release %v, next attempt %v, expected immediate delivery", m.FutureRelease, m.NextAttempt)
+			}
+		} else if d := m.NextAttempt.Sub(expRelease); d < -time.Minute || d > time.Minute || !m.FutureRelease.Equal(m.NextAttempt) {
+			t.Fatalf("got future release %v, next attempt %v, expected %v", m.FutureRelease, m.NextAttempt, expRelease)
+		}
+		_, err = queue.Drop(ctxbg, queue.Filter{IDs: []int64{m.ID}})
+		tcheck(t, err, "drop message from queue")
+	}
+
+	// Only advertised and allowed for submission.
+	ehlo, mail := test(false, " HOLDFOR=60")
+	if strings.Contains(ehlo, "FUTURERELEASE") || !strings.HasPrefix(mail, "555 ") {
+		t.Fatalf("futurerelease for delivery: ehlo %q, mail %q", ehlo, mail)
+	}
+
+	ehlo, mail = test(true, " HOLDFOR=3600")
+	if !strings.Contains(ehlo, "250-FUTURERELEASE 2592000 ") {
+		t.Fatalf("missing futurerelease in ehlo %q", ehlo)
+	}
+	checkQueue(time.Now().Add(time.Hour))
+
+	until := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	test(true, " HOLDUNTIL="+until.Format(time.RFC3339))
+	checkQueue(until)
+
+	// Release time in the past means immediate delivery.
+	test(true, " HOLDUNTIL=2000-01-01T00:00:00Z")
+	checkQueue(time.Time{})
+
+	// Too far in the future, bad syntax, or both parameters.
+	for _, params := range []string{" HOLDFOR=999999999", " HOLDUNTIL=tomorrow", " HOLDFOR=60 HOLDUNTIL=2000-01-01T00:00:00Z"} {
+		if _, mail := test(true, params); !strings.HasPrefix(mail, "501 ") {
+			t.Fatalf("mail from with %q: got %q, expected 501", params, mail)
+		}
+	}
+
+	// Disabled through configuration.
+	mox.Conf.Static.Queue.MaxFutureRelease = -1
+	defer func() {
+		mox.Conf.Static.Queue.MaxFutureRelease = 0
+	}()
+	ehlo, mail = test(true, " HOLDFOR=60")
+	if strings.Contains(ehlo, "FUTURERELEASE") || !strings.HasPrefix(mail, "555 ") {
+		t.Fatalf("futurerelease while disabled: ehlo %q, mail %q", ehlo, mail)
+	}
+}
+
 // Test delivery from external MTA.
 func TestDelivery(t *testing.T) {
 	resolver := dns.MockResolver{
@@ -787,6 +975,46 @@ func TestRatelimitConnectionrate(t *testing.T) {
 	}
 }
 
+// Test configured limits, and IPs exempt from limits.
+func TestRatelimitConfigured(t *testing.T) {
+	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
+	defer ts.close()
+
+	ts.tlsmode = smtpclient.TLSSkip
+
+	limits := &config.Limits{
+		ConnectionRate: []config.WindowLimit{{Window: time.Hour, Limits: []int64{2, 2, 2}}},
+	}
+	ts.limiters = mox.NewLimiters(limits)
+	for i := 0; i < 3; i++ {
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			if err != nil && i < 2 {
+				t.Fatalf("expected smtp connection, got %v", err)
+			}
+			if err == nil && i == 2 {
+				t.Fatalf("expected no smtp connection due to connection rate limit, got connection")
+			}
+			if client != nil {
+				client.Close()
+			}
+		})
+	}
+
+	// Connections from net.Pipe come from 127.0.0.10.
+	_, ipnet, err := net.ParseCIDR("127.0.0.0/8")
+	tcheck(t, err, "parse cidr")
+	limits.AllowNets = []*net.IPNet{ipnet}
+	ts.limiters = mox.NewLimiters(limits)
+	for i := 0; i < 3; i++ {
+		ts.run(func(err error, client *smtpclient.Client) {
+			t.Helper()
+			tcheck(t, err, "smtp connection from exempt ip")
+			client.Close()
+		})
+	}
+}
+
 func TestRatelimitAuth(t *testing.T) {
 	ts := newTestServer(t, "../testdata/smtp/mox.conf", dns.MockResolver{})
 	defer ts.close()
@@ -897,7 +1125,7 @@ func TestNonSMTP(t *testing.T) {
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{fakeCert(ts.t)},
 		}
-		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.dnsbls)
+		serve("test", ts.cid-2, dns.Domain{ASCII: "mox.example"}, tlsConfig, serverConn, ts.resolver, ts.submission, false, 100<<20, false, false, ts.dnsbls, defaultLimiters, false, "")
 		close(serverdone)
 	}()
 
@@ -1078,7 +1306,7 @@ test email
 			}
 			tcheck(t, err, "deliver")
 
-			msgs, err := queue.List(ctxbg)
+			msgs, err := queue.List(ctxbg, queue.Filter{}, queue.Page{})
 			tcheck(t, err, "listing queue")
 			n++
 			tcompare(t, len(msgs), n)
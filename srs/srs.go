@@ -0,0 +1,224 @@
+// Package srs implements the Sender Rewriting Scheme, for rewriting the SMTP
+// MAIL FROM address of forwarded messages.
+//
+// A forwarding mail server cannot use the original MAIL FROM address: SPF
+// checks at the next hop would fail because the forwarding server is not
+// allowed to send for the original domain. With SRS, the MAIL FROM address is
+// rewritten to an address in a domain of the forwarding server, with the
+// original address encoded in the localpart. Bounces to a rewritten address can
+// be verified and relayed to the original address.
+//
+// Rewritten addresses have the form:
+//
+//	SRS0=<hash>=<timestamp>=<original domain>=<original localpart>@<forwarding domain>
+//
+// The hash is a truncated HMAC over the timestamp and original address, so
+// rewritten addresses cannot be forged to turn the forwarding server into an
+// open relay. The timestamp is in days, limiting how long an address can be
+// used for bounces.
+//
+// A message from an address that was already rewritten by another forwarder is
+// not rewritten again as SRS0, the localpart would keep growing with each hop.
+// Instead, the address is rewritten to an SRS1 address that points back to the
+// first forwarder, which has the original address:
+//
+//	SRS1=<hash>=<first forwarding domain>==<hash>=<timestamp>=<original domain>=<original localpart>@<forwarding domain>
+//
+// The part after the first forwarding domain is copied from the SRS0 address,
+// or from the SRS1 address when rewriting an SRS1 address. Bounces to an SRS1
+// address are relayed to the SRS0 address at the first forwarder.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/smtp"
+)
+
+var xlog = mlog.New("srs")
+
+var (
+	metricReverse = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mox_srs_reverse_total",
+			Help: "Number of reversed SRS addresses, for bounces to forwarded messages.",
+		},
+		[]string{
+			"result", // ok, syntax, hash, expired
+		},
+	)
+)
+
+var (
+	ErrSyntax  = errors.New("srs: malformed address")
+	ErrHash    = errors.New("srs: hash mismatch")
+	ErrExpired = errors.New("srs: address expired")
+)
+
+// MaxAge is how long a rewritten address is accepted for bounces.
+var MaxAge = 21 * 24 * time.Hour
+
+// Prefix is the case-insensitive prefix of rewritten localparts.
+const Prefix = "SRS0="
+
+// Prefix1 is the case-insensitive prefix of localparts of rewritten addresses
+// that were already rewritten by another forwarder.
+const Prefix1 = "SRS1="
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const (
+	timeUnit    = 24 * time.Hour
+	timeModulus = 32 * 32 // Two base32 characters.
+)
+
+// IsSRS returns whether localpart looks like a rewritten address, SRS0 or SRS1.
+func IsSRS(localpart smtp.Localpart) bool {
+	return hasPrefix(localpart, Prefix) || hasPrefix(localpart, Prefix1)
+}
+
+func hasPrefix(localpart smtp.Localpart, prefix string) bool {
+	return len(localpart) >= len(prefix) && strings.EqualFold(string(localpart[:len(prefix)]), prefix)
+}
+
+// Forward returns the rewritten address for use as MAIL FROM when forwarding a
+// message from addr, with the forwarding domain. The null address is not
+// rewritten, so bounces are still not bounced. An SRS0 or SRS1 address is
+// rewritten to an SRS1 address.
+func Forward(key []byte, addr smtp.Address, domain dns.Domain, now time.Time) smtp.Address {
+	if addr.IsZero() {
+		return addr
+	}
+	if host, rest, ok := srs1Parts(addr); ok {
+		lp := Prefix1 + hash(key, "srs1", host, rest) + "=" + host + "=" + rest
+		return smtp.NewAddress(smtp.Localpart(lp), domain)
+	}
+	ts := timestamp(now)
+	d := addr.Domain.ASCII
+	lp := string(addr.Localpart)
+	lp = Prefix + hash(key, ts, d, lp) + "=" + ts + "=" + d + "=" + lp
+	return smtp.NewAddress(smtp.Localpart(lp), domain)
+}
+
+// Reverse verifies the rewritten localpart and returns the original address.
+func Reverse(key []byte, localpart smtp.Localpart, now time.Time) (addr smtp.Address, rerr error) {
+	defer func() {
+		result := "ok"
+		switch {
+		case errors.Is(rerr, ErrSyntax):
+			result = "syntax"
+		case errors.Is(rerr, ErrHash):
+			result = "hash"
+		case errors.Is(rerr, ErrExpired):
+			result = "expired"
+		}
+		metricReverse.WithLabelValues(result).Inc()
+		xlog.Debugx("srs reverse", rerr, mlog.Field("localpart", localpart), mlog.Field("address", addr))
+	}()
+
+	if hasPrefix(localpart, Prefix1) {
+		return reverse1(key, localpart)
+	} else if !hasPrefix(localpart, Prefix) {
+		return smtp.Address{}, fmt.Errorf("%w: missing prefix", ErrSyntax)
+	}
+	t := strings.SplitN(string(localpart[len(Prefix):]), "=", 4)
+	if len(t) != 4 || t[2] == "" || t[3] == "" {
+		return smtp.Address{}, fmt.Errorf("%w: expected hash, timestamp, domain and localpart", ErrSyntax)
+	}
+	h, ts, d, lp := t[0], t[1], t[2], t[3]
+
+	tsv, err := decodeTimestamp(ts)
+	if err != nil {
+		return smtp.Address{}, err
+	}
+	if !hmac.Equal([]byte(strings.ToLower(h)), []byte(hash(key, ts, d, lp))) {
+		return smtp.Address{}, ErrHash
+	}
+	// Timestamps wrap around, we interpret it as a time in the past.
+	today := now.Unix() / int64(timeUnit/time.Second)
+	age := (today - int64(tsv)) % timeModulus
+	if age < 0 {
+		age += timeModulus
+	}
+	if time.Duration(age)*timeUnit > MaxAge {
+		return smtp.Address{}, ErrExpired
+	}
+
+	dom, err := dns.ParseDomain(d)
+	if err != nil {
+		return smtp.Address{}, fmt.Errorf("%w: parsing domain: %v", ErrSyntax, err)
+	}
+	return smtp.NewAddress(smtp.Localpart(lp), dom), nil
+}
+
+// srs1Parts returns the domain of the first forwarder and the opaque part of the
+// SRS0 address at that forwarder, starting with "=", for rewriting addr to an
+// SRS1 address. For an SRS0 address, the first forwarder is its domain.
+func srs1Parts(addr smtp.Address) (host, rest string, ok bool) {
+	lp := string(addr.Localpart)
+	if hasPrefix(addr.Localpart, Prefix) {
+		return addr.Domain.ASCII, lp[len(Prefix)-1:], true
+	} else if !hasPrefix(addr.Localpart, Prefix1) {
+		return "", "", false
+	}
+	t := strings.SplitN(lp[len(Prefix1):], "=", 3)
+	if len(t) != 3 || t[1] == "" || !strings.HasPrefix(t[2], "=") {
+		return "", "", false
+	}
+	return t[1], t[2], true
+}
+
+// reverse1 verifies an SRS1 localpart and returns the SRS0 address at the first
+// forwarder.
+func reverse1(key []byte, localpart smtp.Localpart) (smtp.Address, error) {
+	t := strings.SplitN(string(localpart[len(Prefix1):]), "=", 3)
+	if len(t) != 3 || t[1] == "" || len(t[2]) < 2 || t[2][0] != '=' {
+		return smtp.Address{}, fmt.Errorf("%w: expected hash, forwarding domain and srs0 address", ErrSyntax)
+	}
+	h, host, rest := t[0], t[1], t[2]
+	if !hmac.Equal([]byte(strings.ToLower(h)), []byte(hash(key, "srs1", host, rest))) {
+		return smtp.Address{}, ErrHash
+	}
+	dom, err := dns.ParseDomain(host)
+	if err != nil {
+		return smtp.Address{}, fmt.Errorf("%w: parsing domain: %v", ErrSyntax, err)
+	}
+	return smtp.NewAddress(smtp.Localpart(Prefix[:len(Prefix)-1]+rest), dom), nil
+}
+
+func timestamp(now time.Time) string {
+	v := now.Unix() / int64(timeUnit/time.Second) % timeModulus
+	return encoding.EncodeToString([]byte{byte(v >> 2), byte(v << 6)})[:2]
+}
+
+func decodeTimestamp(s string) (int, error) {
+	if len(s) != 2 {
+		return 0, fmt.Errorf("%w: bad timestamp length", ErrSyntax)
+	}
+	buf, err := encoding.DecodeString(strings.ToUpper(s) + "AA")
+	if err != nil {
+		return 0, fmt.Errorf("%w: decoding timestamp: %v", ErrSyntax, err)
+	}
+	return int(buf[0])<<2 | int(buf[1])>>6, nil
+}
+
+// hash returns the lower case hash for the parts of a rewritten address: the
+// timestamp and original address for SRS0, or "srs1", the first forwarding
+// domain and the opaque part for SRS1. The data is lower cased because
+// intermediate mail servers may change the case of the address.
+func hash(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(strings.Join(parts, "="))))
+	return strings.ToLower(encoding.EncodeToString(mac.Sum(nil)[:5]))
+}
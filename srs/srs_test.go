@@ -0,0 +1,81 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestSRS(t *testing.T) {
+	key := []byte("secret")
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	fwd := dns.Domain{ASCII: "forward.example"}
+
+	test := func(addr string, exp smtp.Address, expErr error, tm time.Time) {
+		t.Helper()
+		a, err := smtp.ParseAddress(addr)
+		if err != nil {
+			t.Fatalf("parse address: %v", err)
+		}
+		r, err := Reverse(key, a.Localpart, tm)
+		if (err == nil) != (expErr == nil) || err != nil && !errors.Is(err, expErr) {
+			t.Fatalf("reverse %s: got err %v, expected %v", addr, err, expErr)
+		}
+		if err == nil && r != exp {
+			t.Fatalf("reverse %s: got %v, expected %v", addr, r, exp)
+		}
+	}
+
+	orig := smtp.NewAddress("Mjl+Test=x", dns.Domain{ASCII: "example.org"})
+	srs := Forward(key, orig, fwd, now)
+	if srs.Domain != fwd || !IsSRS(srs.Localpart) {
+		t.Fatalf("bad rewritten address %v", srs)
+	}
+	test(srs.String(), orig, nil, now)
+	test(srs.String(), orig, nil, now.Add(MaxAge))
+	test(strings.ToLower(srs.String()), smtp.NewAddress("mjl+test=x", orig.Domain), nil, now)
+	test(srs.String(), smtp.Address{}, ErrExpired, now.Add(MaxAge+timeUnit))
+	test(srs.String(), smtp.Address{}, ErrExpired, now.Add(-2*timeUnit))
+
+	// Wraparound of timestamp.
+	later := now.Add(timeModulus * timeUnit)
+	test(Forward(key, orig, fwd, later.Add(-timeUnit)).String(), orig, nil, later)
+
+	// Tampering.
+	bad := smtp.NewAddress(smtp.Localpart(strings.Replace(string(srs.Localpart), "example.org", "example.com", 1)), fwd)
+	test(bad.String(), smtp.Address{}, ErrHash, now)
+	test(Forward([]byte("other"), orig, fwd, now).String(), smtp.Address{}, ErrHash, now)
+
+	test("SRS0=abc@forward.example", smtp.Address{}, ErrSyntax, now)
+	test("SRS0=abc=x=example.org=mjl@forward.example", smtp.Address{}, ErrSyntax, now)
+	test("mjl@forward.example", smtp.Address{}, ErrSyntax, now)
+
+	// Already rewritten addresses are rewritten to SRS1, pointing to the first
+	// forwarder, so the localpart doesn't grow with each hop.
+	fwd2 := dns.Domain{ASCII: "forward2.example"}
+	srs1 := Forward([]byte("other"), srs, fwd2, now)
+	if srs1.Domain != fwd2 || !strings.HasPrefix(string(srs1.Localpart), "SRS1=") || !IsSRS(srs1.Localpart) {
+		t.Fatalf("bad srs1 address %v", srs1)
+	}
+	test(srs1.String(), smtp.Address{}, ErrHash, now)
+	r, err := Reverse([]byte("other"), srs1.Localpart, now)
+	if err != nil || r != srs {
+		t.Fatalf("reverse srs1 %v: got %v, err %v, expected %v", srs1, r, err, srs)
+	}
+	fwd3 := dns.Domain{ASCII: "forward3.example"}
+	srs1b := Forward(key, srs1, fwd3, now)
+	if len(srs1b.Localpart) != len(srs1.Localpart) {
+		t.Fatalf("srs1 address %v rewritten to %v with different length", srs1, srs1b)
+	}
+	test(srs1b.String(), srs, nil, now)
+	test(strings.ToLower(srs1b.String()), smtp.NewAddress(smtp.Localpart("SRS0"+strings.ToLower(string(srs.Localpart[4:]))), fwd), nil, now)
+	test("SRS1=abc=forward.example@forward3.example", smtp.Address{}, ErrSyntax, now)
+
+	if zero := Forward(key, smtp.Address{}, fwd, now); !zero.IsZero() {
+		t.Fatalf("null address rewritten to %v", zero)
+	}
+}
@@ -22,8 +22,10 @@ package store
 // todo: make up a function naming scheme that indicates whether caller should broadcast changes.
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding"
@@ -213,6 +215,16 @@ const (
 	ValidationNone      Validation = 10 // E.g. No records.
 )
 
+var validationNames = []string{"unknown", "strict", "dmarc", "relaxed", "pass", "neutral", "temperror", "permerror", "fail", "softfail", "none"}
+
+// String returns the lower-case name of the validation, e.g. "dmarc".
+func (v Validation) String() string {
+	if int(v) < len(validationNames) {
+		return validationNames[v]
+	}
+	return fmt.Sprintf("validation%d", v)
+}
+
 // Message stored in database and per-message file on disk.
 //
 // Contents are always the combined data from MsgPrefix and the on-disk file named
@@ -248,6 +260,11 @@ type Message struct {
 
 	Received time.Time `bstore:"default now,index"`
 
+	// Time the message was moved or copied into its current mailbox. Zero if the
+	// message was delivered, imported or appended to the mailbox. Used for retention
+	// policies of mailboxes.
+	Moved time.Time
+
 	// Full IP address of remote SMTP server. Empty if not delivered over
 	// SMTP.
 	RemoteIP        string
@@ -288,21 +305,40 @@ type Message struct {
 	Flags
 	Size        int64
 	TrainedJunk *bool  // If nil, no training done yet. Otherwise, true is trained as junk, false trained as nonjunk.
-	MsgPrefix   []byte // Typically holds received headers and/or header separator.
+	MsgPrefix   []byte // Typically holds received headers and/or header separator. Stored in the message file instead for encrypted messages.
+
+	// Whether the message file is stored compressed, see compress.go, and
+	// encrypted, see encrypt.go. The format is not determined from the file contents:
+	// plain message files hold data from remote senders.
+	Compressed bool
+	Encrypted  bool
 
 	// ParsedBuf message structure. Currently saved as JSON of message.Part because bstore
 	// cannot yet store recursive types. Created when first needed, and saved in the
 	// database.
+	// Encrypted for accounts with encrypted messages.
 	ParsedBuf []byte
+
+	parsedPlain []byte // Plaintext of encrypted ParsedBuf, set during delivery.
 }
 
-// LoadPart returns a message.Part by reading from m.ParsedBuf.
+// LoadPart returns a message.Part by reading from m.ParsedBuf. If ParsedBuf is
+// encrypted, r must be a MsgReader of an unlocked account, as returned by
+// Account.MessageReader.
 func (m Message) LoadPart(r io.ReaderAt) (message.Part, error) {
 	if m.ParsedBuf == nil {
 		return message.Part{}, fmt.Errorf("message not parsed")
 	}
+	var key *rsa.PrivateKey
+	if mr, ok := r.(*MsgReader); ok {
+		key = mr.key
+	}
+	buf, err := m.parsedPlaintext(key)
+	if err != nil {
+		return message.Part{}, err
+	}
 	var p message.Part
-	err := json.Unmarshal(m.ParsedBuf, &p)
+	err = json.Unmarshal(buf, &p)
 	if err != nil {
 		return p, fmt.Errorf("unmarshal message part")
 	}
@@ -377,7 +413,7 @@ type Outgoing struct {
 }
 
 // Types stored in DB.
-var DBTypes = []any{NextUIDValidity{}, Message{}, Recipient{}, Mailbox{}, Subscription{}, Outgoing{}, Password{}, Subjectpass{}}
+var DBTypes = []any{NextUIDValidity{}, Message{}, Recipient{}, Mailbox{}, Subscription{}, Outgoing{}, Password{}, Subjectpass{}, EncryptionKey{}, IMAPImportMailbox{}, IMAPImportMessage{}}
 
 // Account holds the information about a user, includings mailboxes, messages, imap subscriptions.
 type Account struct {
@@ -393,6 +429,10 @@ type Account struct {
 	sync.RWMutex
 
 	nused int // Reference count, while >0, this account is alive and shared.
+
+	encLock  sync.Mutex      // For encKey and encNoKey.
+	encKey   *rsa.PrivateKey // Unsealed private key for encrypted message files, when account is unlocked.
+	encNoKey bool            // Whether the account is known to have no encryption key.
 }
 
 // InitialUIDValidity returns a UIDValidity used for initializing an account.
@@ -577,7 +617,10 @@ func (a *Account) WithRLock(fn func()) {
 //
 // The message, with msg.MsgPrefix and msgFile combined, must have a header
 // section. The caller is responsible for adding a header separator to
-// msg.MsgPrefix if missing from an incoming message.
+// msg.MsgPrefix if missing from an incoming message. The message file is stored
+// compressed and/or encrypted as configured for the account, m.Compressed and
+// m.Encrypted must be false. For encrypted messages, m.MsgPrefix is stored in the
+// message file, and cleared in m.
 //
 // If isSent is true, the message is parsed for its recipients (to/cc/bcc). Their
 // domains are added to Recipients for use in dmarc reputation.
@@ -618,6 +661,21 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 		m.ParsedBuf = buf
 	}
 
+	// For encrypted messages, the message prefix, typically with received headers,
+	// is stored in the encrypted message file instead of the database.
+	prefix := m.MsgPrefix
+	pub, err := a.messagePublicKey(tx)
+	if err != nil {
+		return fmt.Errorf("get encryption key: %w", err)
+	}
+	if pub != nil {
+		if err := m.sealParsed(pub); err != nil {
+			return err
+		}
+		m.Encrypted = true
+		m.MsgPrefix = nil
+	}
+
 	// If we are delivering to the originally intended mailbox, no need to store the mailbox ID again.
 	if m.MailboxDestinedID != 0 && m.MailboxDestinedID == m.MailboxOrigID {
 		m.MailboxDestinedID = 0
@@ -631,7 +689,9 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 		// Attempt to parse the message for its To/Cc/Bcc headers, which we insert into Recipient.
 		if part == nil {
 			var p message.Part
-			if err := json.Unmarshal(m.ParsedBuf, &p); err != nil {
+			if buf, err := m.parsedPlaintext(nil); err != nil {
+				log.Errorx("parsed message for its to,cc,bcc headers, continuing", err)
+			} else if err := json.Unmarshal(buf, &p); err != nil {
 				log.Errorx("unmarshal parsed message for its to,cc,bcc headers, continuing", err, mlog.Field("parse", ""))
 			} else {
 				part = &p
@@ -683,7 +743,43 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 		}
 	}
 
-	if consumeFile {
+	if conf.CompressMessages || pub != nil {
+		// A compressed message file written for a delivery of the same message to another
+		// account is shared.
+		var compressed, linked bool
+		if pub == nil {
+			compressed, linked = linkSharedFile(log, msgFile, msgPath)
+		}
+		if !linked {
+			fi, err := msgFile.Stat()
+			if err != nil {
+				return fmt.Errorf("stat message file: %w", err)
+			}
+			var r io.ReaderAt = msgFile
+			size := fi.Size()
+			if pub != nil {
+				r = FileMsgReader(prefix, msgFile) // We don't close, it would close the msgFile.
+				size += int64(len(prefix))
+			}
+			compressed, err = writeMessageFile(msgPath, r, size, conf.CompressMessages, pub, sync)
+			if err != nil {
+				return fmt.Errorf("writing message file: %w", err)
+			}
+			if pub == nil && !consumeFile {
+				addSharedFile(msgFile, msgPath, compressed)
+			}
+		}
+		if compressed {
+			m.Compressed = true
+			if err := tx.Update(m); err != nil {
+				return fmt.Errorf("marking message as compressed: %w", err)
+			}
+		}
+		if consumeFile {
+			err := os.Remove(msgFile.Name())
+			log.Check(err, "removing consumed message file after compressing", mlog.Field("path", msgFile.Name()))
+		}
+	} else if consumeFile {
 		if err := os.Rename(msgFile.Name(), msgPath); err != nil {
 			return fmt.Errorf("moving msg file to destination directory: %w", err)
 		}
@@ -701,11 +797,12 @@ func (a *Account) DeliverMessage(log *mlog.Log, tx *bstore.Tx, m *Message, msgFi
 	}
 
 	if !notrain && m.NeedsTraining() {
-		l := []Message{*m}
-		if err := a.RetrainMessages(context.TODO(), log, tx, l, false); err != nil {
+		// Train with the message file we were given, the stored message file may be
+		// encrypted while the account is locked.
+		mr := FileMsgReader(prefix, msgFile) // We don't close, it would close the msgFile.
+		if err := a.retrainMessages(context.TODO(), log, tx, []*Message{m}, false, mr); err != nil {
 			return fmt.Errorf("training junkfilter: %w", err)
 		}
-		*m = l[0]
 	}
 
 	return nil
@@ -733,6 +830,83 @@ func writeFile(dst string, r io.Reader) error {
 	return nil
 }
 
+// writeMessageFile writes the size bytes of r to a new message file at dst, see
+// writeMessageData. If sync is set, the new file is synced to disk. Returns
+// whether the data was written compressed.
+func writeMessageFile(dst string, r io.ReaderAt, size int64, compress bool, pub *rsa.PublicKey, sync bool) (compressed bool, rerr error) {
+	f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return false, fmt.Errorf("create: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := f.Close()
+			xlog.Check(err, "closing message file after error")
+		}
+		if rerr != nil {
+			err := os.Remove(dst)
+			xlog.Check(err, "removing message file after error", mlog.Field("path", dst))
+		}
+	}()
+
+	compressed, err = writeMessageData(f, r, size, compress, pub)
+	if err != nil {
+		return false, err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return false, fmt.Errorf("sync: %w", err)
+		}
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return false, fmt.Errorf("close: %w", err)
+	}
+	return compressed, nil
+}
+
+// writeMessageData writes the size bytes of r to the new empty file f, compressed
+// if compress is set and compression makes it smaller, and encrypted if pub is
+// set. At least one of compress and pub must be set. Returns whether the data was
+// written compressed.
+func writeMessageData(f *os.File, r io.ReaderAt, size int64, compress bool, pub *rsa.PublicKey) (compressed bool, rerr error) {
+	if pub == nil {
+		compressed, _, err := writeCompressed(f, r, size)
+		if err != nil {
+			return false, fmt.Errorf("compress: %w", err)
+		}
+		return compressed, nil
+	}
+
+	src := r
+	if compress {
+		// Compress to temporary file, which we then encrypt.
+		tf, err := CreateMessageTemp("compress")
+		if err != nil {
+			return false, fmt.Errorf("creating temporary file: %w", err)
+		}
+		defer func() {
+			err := tf.Close()
+			xlog.Check(err, "closing temporary file")
+			err = os.Remove(tf.Name())
+			xlog.Check(err, "removing temporary file", mlog.Field("path", tf.Name()))
+		}()
+		if compressed, size, err = writeCompressed(tf, r, size); err != nil {
+			return false, fmt.Errorf("compress: %w", err)
+		}
+		src = tf
+	}
+	bw := bufio.NewWriter(f)
+	if err := writeEncrypted(bw, src, size, pub); err != nil {
+		return false, fmt.Errorf("encrypt: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return false, fmt.Errorf("write: %w", err)
+	}
+	return compressed, nil
+}
+
 // SetPassword saves a new password for this account. This password is used for
 // IMAP, SMTP (submission) sessions and the HTTP account web page.
 func (a *Account) SetPassword(password string) error {
@@ -784,6 +958,10 @@ func (a *Account) SetPassword(password string) error {
 		if err := tx.Insert(&pw); err != nil {
 			return fmt.Errorf("inserting new password: %v", err)
 		}
+
+		if err := a.resealEncryptionKey(tx, password); err != nil {
+			return fmt.Errorf("sealing encryption key with new password: %w", err)
+		}
 		return nil
 	})
 	if err == nil {
@@ -1010,9 +1188,10 @@ func (a *Account) MessagePath(messageID int64) string {
 }
 
 // MessageReader opens a message for reading, transparently combining the
-// message prefix with the original incoming message.
+// message prefix with the original incoming message. Reading an encrypted
+// message fails with ErrAccountLocked if the account is locked.
 func (a *Account) MessageReader(m Message) *MsgReader {
-	return &MsgReader{prefix: m.MsgPrefix, path: a.MessagePath(m.ID), size: m.Size}
+	return &MsgReader{prefix: m.MsgPrefix, path: a.MessagePath(m.ID), size: m.Size, compressed: m.Compressed, encrypted: m.Encrypted, key: a.MessageKey()}
 }
 
 // Deliver delivers an email to dest, based on the configured rulesets.
@@ -1020,16 +1199,20 @@ func (a *Account) MessageReader(m Message) *MsgReader {
 // Caller must hold account wlock (mailbox may be created).
 // Message delivery and possible mailbox creation are broadcasted.
 func (a *Account) Deliver(log *mlog.Log, dest config.Destination, m *Message, msgFile *os.File, consumeFile bool) error {
-	var mailbox string
+	mailbox := DestinationMailbox(log, dest, m, msgFile)
+	return a.DeliverMailbox(log, mailbox, m, msgFile, consumeFile)
+}
+
+// DestinationMailbox returns the mailbox a message would be delivered to for
+// dest, based on the rulesets.
+func DestinationMailbox(log *mlog.Log, dest config.Destination, m *Message, msgFile *os.File) string {
 	rs := MessageRuleset(log, dest, m, m.MsgPrefix, msgFile)
 	if rs != nil {
-		mailbox = rs.Mailbox
+		return rs.Mailbox
 	} else if dest.Mailbox == "" {
-		mailbox = "Inbox"
-	} else {
-		mailbox = dest.Mailbox
+		return "Inbox"
 	}
-	return a.DeliverMailbox(log, mailbox, m, msgFile, consumeFile)
+	return dest.Mailbox
 }
 
 // DeliverMailbox delivers an email to the specified mailbox.
@@ -1098,7 +1281,7 @@ func (a *Account) TidyRejectsMailbox(log *mlog.Log, rejectsMailbox string) (hasS
 			return fmt.Errorf("listing old messages: %w", err)
 		}
 
-		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove)
+		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove, true)
 		if err != nil {
 			return fmt.Errorf("removing messages: %w", err)
 		}
@@ -1127,7 +1310,10 @@ func (a *Account) TidyRejectsMailbox(log *mlog.Log, rejectsMailbox string) (hasS
 	return hasSpace, nil
 }
 
-func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mb *Mailbox, l []Message) ([]Change, error) {
+// removeMessages removes messages from the database, returning changes to
+// broadcast. If untrain is set, the messages are untrained from the junk filter.
+// Message files must be removed by the caller after committing the transaction.
+func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, mb *Mailbox, l []Message, untrain bool) ([]Change, error) {
 	if len(l) == 0 {
 		return nil, nil
 	}
@@ -1156,12 +1342,14 @@ func (a *Account) removeMessages(ctx context.Context, log *mlog.Log, tx *bstore.
 	}
 
 	// Mark as neutral and train so junk filter gets untrained with these (junk) messages.
-	for i := range deleted {
-		deleted[i].Junk = false
-		deleted[i].Notjunk = false
-	}
-	if err := a.RetrainMessages(ctx, log, tx, deleted, true); err != nil {
-		return nil, fmt.Errorf("training deleted messages: %w", err)
+	if untrain {
+		for i := range deleted {
+			deleted[i].Junk = false
+			deleted[i].Notjunk = false
+		}
+		if err := a.RetrainMessages(ctx, log, tx, deleted, true); err != nil {
+			return nil, fmt.Errorf("training deleted messages: %w", err)
+		}
 	}
 
 	changes := make([]Change, len(l))
@@ -1202,7 +1390,7 @@ func (a *Account) RejectsRemove(log *mlog.Log, rejectsMailbox, messageID string)
 			return fmt.Errorf("listing messages to remove: %w", err)
 		}
 
-		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove)
+		changes, err = a.removeMessages(context.TODO(), log, tx, mb, remove, true)
 		if err != nil {
 			return fmt.Errorf("removing messages: %w", err)
 		}
@@ -1274,16 +1462,17 @@ func OpenEmailAuth(email string, password string) (acc *Account, rerr error) {
 	authCache.Lock()
 	ok := len(password) >= 8 && authCache.success[authKey{email, pw.Hash}] == password
 	authCache.Unlock()
-	if ok {
-		return
-	}
-	if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
-		rerr = ErrUnknownCredentials
-	} else {
+	if !ok {
+		if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
+			return acc, ErrUnknownCredentials
+		}
 		authCache.Lock()
 		authCache.success[authKey{email, pw.Hash}] = password
 		authCache.Unlock()
 	}
+	if err := acc.unlock(password); err != nil {
+		return acc, fmt.Errorf("unlocking account: %v", err)
+	}
 	return
 }
 
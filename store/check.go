@@ -0,0 +1,429 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/junk"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/moxio"
+)
+
+// LostFoundMailbox is the mailbox that CheckConsistency delivers message files
+// to that are not referenced by a message in the database.
+const LostFoundMailbox = "lost+found"
+
+// CheckStats holds the results of CheckConsistency.
+type CheckStats struct {
+	Messages int      // Messages checked.
+	Problems []string // Description of each problem found.
+	Repaired int      // Number of problems repaired.
+}
+
+// CheckConsistency checks the invariants of the account: message files are
+// present with the size of the message, UIDs are unique within a mailbox and
+// below the UIDNext of the mailbox, ParsedBuf can be decoded, junk filter training
+// matches the Junk/Notjunk flags, and all files in the message directory belong
+// to a message.
+//
+// If repair is set, problems are fixed where possible: messages are parsed again,
+// (re)trained, UIDs in a mailbox are reassigned with a new UIDValidity, and
+// unreferenced message files are delivered to the lost+found mailbox. Missing
+// message files cannot be repaired.
+//
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) CheckConsistency(log *mlog.Log, repair bool) (CheckStats, error) {
+	var stats CheckStats
+	var changes []Change
+
+	problem := func(repaired bool, format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		if repaired {
+			s += " (repaired)"
+			stats.Repaired++
+		}
+		stats.Problems = append(stats.Problems, s)
+	}
+
+	var jf *junk.Filter
+	defer func() {
+		if jf != nil {
+			err := jf.Close()
+			log.Check(err, "closing junk filter after consistency check")
+		}
+	}()
+
+	seen := map[string]bool{} // Relative message paths.
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mailboxes, err := bstore.QueryTx[Mailbox](tx).List()
+		if err != nil {
+			return fmt.Errorf("listing mailboxes: %w", err)
+		}
+
+		for _, mb := range mailboxes {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterNonzero(Message{MailboxID: mb.ID})
+			q.SortAsc("UID", "ID")
+			msgs, err := q.List()
+			if err != nil {
+				return fmt.Errorf("listing messages in mailbox %q: %w", mb.Name, err)
+			}
+			stats.Messages += len(msgs)
+
+			var badUIDs bool
+			for i := range msgs {
+				m := &msgs[i]
+				seen[MessagePath(m.ID)] = true
+				if i > 0 && m.UID == msgs[i-1].UID {
+					problem(repair, "mailbox %q: message %d: duplicate uid %d", mb.Name, m.ID, m.UID)
+					badUIDs = true
+				}
+				if m.UID >= mb.UIDNext {
+					problem(repair, "mailbox %q: message %d: uid %d not below uidnext %d", mb.Name, m.ID, m.UID, mb.UIDNext)
+					badUIDs = true
+				}
+
+				update, err := a.checkMessage(log, tx, &jf, mb, m, repair, problem)
+				if err != nil {
+					return fmt.Errorf("checking message %d: %w", m.ID, err)
+				}
+				if update {
+					if err := tx.Update(m); err != nil {
+						return fmt.Errorf("updating message %d: %w", m.ID, err)
+					}
+				}
+			}
+
+			if badUIDs && repair {
+				// Assign new UIDs after the highest current UID, so they don't conflict with the
+				// current UIDs. Clients must resynchronize due to the new UIDValidity.
+				mb.UIDValidity, err = a.NextUIDValidity(tx)
+				if err != nil {
+					return fmt.Errorf("next uid validity: %w", err)
+				}
+				if n := len(msgs); n > 0 && msgs[n-1].UID >= mb.UIDNext {
+					mb.UIDNext = msgs[n-1].UID + 1
+				}
+				var removed []UID
+				for i := range msgs {
+					m := &msgs[i]
+					removed = append(removed, m.UID)
+					m.UID = mb.UIDNext
+					mb.UIDNext++
+					if err := tx.Update(m); err != nil {
+						return fmt.Errorf("updating uid for message %d: %w", m.ID, err)
+					}
+				}
+				if err := tx.Update(&mb); err != nil {
+					return fmt.Errorf("updating mailbox %q: %w", mb.Name, err)
+				}
+				changes = append(changes, ChangeRemoveUIDs{mb.ID, removed})
+				for _, m := range msgs {
+					changes = append(changes, ChangeAddUID{mb.ID, m.UID, m.Flags})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if jf != nil {
+		err := jf.Close()
+		jf = nil
+		if err != nil {
+			return stats, fmt.Errorf("saving junk filter: %w", err)
+		}
+	}
+
+	// Look for files in the message directory that don't belong to a message.
+	msgDir := filepath.Join(a.Dir, "msg")
+	var orphans []string
+	err = filepath.WalkDir(msgDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == msgDir && errors.Is(err, fs.ErrNotExist) {
+				// New accounts without messages don't have a msg directory.
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		p := path[len(msgDir)+1:]
+		if seen[p] {
+			return nil
+		}
+		if id, err := strconv.ParseInt(filepath.Base(p), 10, 64); err == nil && p == MessagePath(id) {
+			orphans = append(orphans, path)
+		} else if strings.HasPrefix(filepath.Base(p), lostFoundPrefix) {
+			// Left behind by an interrupted repair, still to be delivered.
+			orphans = append(orphans, path)
+		} else if strings.HasPrefix(filepath.Base(p), ".dedup-") {
+			// Left behind by an interrupted DedupMessageFiles.
+			var removed bool
+			if repair {
+				err := os.Remove(path)
+				log.Check(err, "removing temporary file from deduplicating", mlog.Field("path", path))
+				removed = err == nil
+			}
+			problem(removed, "%s: temporary file from deduplicating message files", path)
+		} else {
+			problem(false, "%s: unrecognized file in message directory", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("walking message directory: %w", err)
+	}
+
+	// Messages delivered to lost+found get new message IDs, and their paths can be
+	// those of orphans. So we first move all orphans out of the way.
+	moved := make([]string, len(orphans))
+	for i, path := range orphans {
+		moved[i] = path
+		if !repair || strings.HasPrefix(filepath.Base(path), lostFoundPrefix) {
+			continue
+		}
+		np := filepath.Join(filepath.Dir(path), lostFoundPrefix+filepath.Base(path))
+		if _, err := os.Stat(np); err == nil {
+			return stats, fmt.Errorf("moving unreferenced message file %s: %s already exists", path, np)
+		}
+		if err := os.Rename(path, np); err != nil {
+			return stats, fmt.Errorf("moving unreferenced message file: %w", err)
+		}
+		moved[i] = np
+	}
+
+	for i, path := range orphans {
+		if !repair {
+			problem(false, "%s: message file not referenced by a message", path)
+			continue
+		}
+		chl, err := a.deliverLostFound(log, moved[i])
+		if err != nil {
+			problem(false, "%s: message file not referenced by a message, delivering to %s: %v", path, LostFoundMailbox, err)
+			continue
+		}
+		problem(true, "%s: message file not referenced by a message, delivered to %s", path, LostFoundMailbox)
+		changes = append(changes, chl...)
+	}
+
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+
+	return stats, nil
+}
+
+// checkMessage checks the message file, parsed form and junk training of a
+// message. Returns whether m was modified and must be updated in the database.
+func (a *Account) checkMessage(log *mlog.Log, tx *bstore.Tx, jf **junk.Filter, mb Mailbox, m *Message, repair bool, problem func(repaired bool, format string, args ...any)) (update bool, rerr error) {
+	path := a.MessagePath(m.ID)
+
+	// The file must be present and have the size of the message without prefix.
+	// Encrypted files of a locked account cannot be checked for size.
+	var reparse bool
+	mf, err := openMessageFile(path, a.MessageKey(), m.Compressed, m.Encrypted)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		problem(false, "mailbox %q: message %d: message file missing", mb.Name, m.ID)
+		return false, nil
+	} else if err != nil && errors.Is(err, ErrAccountLocked) {
+		// Cannot check, and the message cannot be read for repairs.
+		repair = false
+	} else if err != nil {
+		problem(false, "mailbox %q: message %d: opening message file: %v", mb.Name, m.ID, err)
+		return false, nil
+	} else {
+		size, err := messageFileSize(mf)
+		mf.Close()
+		if err != nil {
+			problem(false, "mailbox %q: message %d: size of message file: %v", mb.Name, m.ID, err)
+			return false, nil
+		}
+		if exp := m.Size - int64(len(m.MsgPrefix)); size != exp {
+			problem(repair, "mailbox %q: message %d: message file has size %d, expected %d", mb.Name, m.ID, size, exp)
+			if repair {
+				m.Size = int64(len(m.MsgPrefix)) + size
+				update = true
+				reparse = true
+			}
+		}
+	}
+
+	var p message.Part
+	if m.ParsedBuf == nil {
+		problem(repair, "mailbox %q: message %d: missing parsed message", mb.Name, m.ID)
+		reparse = true
+	} else if buf, err := m.parsedPlaintext(a.MessageKey()); errors.Is(err, ErrAccountLocked) {
+		// Cannot check encrypted parsed message while locked.
+	} else if err != nil {
+		problem(repair, "mailbox %q: message %d: decrypting parsed message: %v", mb.Name, m.ID, err)
+		reparse = true
+	} else if err := json.Unmarshal(buf, &p); err != nil {
+		problem(repair, "mailbox %q: message %d: decoding parsed message: %v", mb.Name, m.ID, err)
+		reparse = true
+	}
+	if reparse && repair {
+		mr := a.MessageReader(*m)
+		p, err := message.EnsurePart(mr, m.Size)
+		mr.Close()
+		if err != nil {
+			log.Debugx("parsing message for consistency check, continuing", err, mlog.Field("parse", ""), mlog.Field("message", m.ID))
+		}
+		if err := a.SetParsed(tx, m, p); err != nil {
+			return false, err
+		}
+		update = true
+	}
+
+	// Training must match the junk flags, if a junk filter is configured.
+	if conf, _ := a.Conf(); conf.JunkFilter != nil && m.NeedsTraining() {
+		problem(repair, "mailbox %q: message %d: junk filter training does not match junk/nonjunk flags", mb.Name, m.ID)
+		if repair {
+			if *jf == nil {
+				f, _, err := a.OpenJunkFilter(context.TODO(), log)
+				if err != nil {
+					return false, fmt.Errorf("open junk filter: %w", err)
+				}
+				*jf = f
+			}
+			if err := a.RetrainMessage(context.TODO(), log, tx, *jf, m, false); err != nil {
+				return false, fmt.Errorf("retraining message: %w", err)
+			}
+			update = true
+		}
+	}
+	return update, nil
+}
+
+// Prefix for unreferenced message files that are being delivered to lost+found.
+const lostFoundPrefix = ".lostfound-"
+
+// deliverLostFound delivers the contents of an unreferenced message file to the
+// lost+found mailbox, and removes the file. The file must not be at a message
+// path, the delivered message can get that path.
+func (a *Account) deliverLostFound(log *mlog.Log, path string) ([]Change, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the plain contents to a temporary file, for delivery.
+	f, err := CreateMessageTemp("lostfound")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			err := os.Remove(f.Name())
+			log.Check(err, "removing temporary file", mlog.Field("path", f.Name()))
+			err = f.Close()
+			log.Check(err, "closing temporary file")
+		}
+	}()
+	size, err := a.copyLostFound(log, f, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	m := Message{Received: fi.ModTime(), Size: size}
+	err = a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		mb, chl, err := a.MailboxEnsure(tx, LostFoundMailbox, true)
+		if err != nil {
+			return fmt.Errorf("ensuring mailbox: %w", err)
+		}
+		changes = chl
+		m.MailboxID = mb.ID
+		m.MailboxOrigID = mb.ID
+		return a.DeliverMessage(log, tx, &m, f, true, false, true, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = f.Close()
+	log.Check(err, "closing delivered message file")
+	f = nil
+
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("removing message file after delivery: %w", err)
+	}
+	if err := moxio.SyncDir(filepath.Dir(path)); err != nil {
+		log.Errorx("sync directory after removing message file", err)
+	}
+	return append(changes, ChangeAddUID{m.MailboxID, m.UID, m.Flags}), nil
+}
+
+// copyLostFound writes the plain contents of the unreferenced message file at
+// path to the empty file f, and returns its size.
+//
+// The format of an unreferenced file is not recorded in the database. We try
+// decoding it as an encrypted and/or compressed message file, with the same
+// checks against the file size as for referenced files, and otherwise take the
+// file as is: a plain message file can start with what looks like a header. If
+// the account is locked, a file that looks encrypted is left for a later check.
+func (a *Account) copyLostFound(log *mlog.Log, f *os.File, path string) (int64, error) {
+	locked, err := a.Locked()
+	if err != nil {
+		return 0, err
+	}
+	key := a.MessageKey()
+	formats := []struct{ compressed, encrypted bool }{
+		{true, true},
+		{false, true},
+		{true, false},
+	}
+	for _, format := range formats {
+		if format.encrypted && key == nil && !locked {
+			continue
+		}
+		mf, err := openMessageFile(path, key, format.compressed, format.encrypted)
+		if err != nil && errors.Is(err, ErrAccountLocked) {
+			return 0, err
+		} else if err != nil {
+			continue
+		}
+		size, err := messageFileSize(mf)
+		if err == nil {
+			_, err = io.Copy(f, io.NewSectionReader(mf, 0, size))
+		}
+		mf.Close()
+		if err == nil {
+			return size, nil
+		}
+		log.Debugx("decoding unreferenced message file, trying next format", err, mlog.Field("path", path), mlog.Field("compressed", format.compressed), mlog.Field("encrypted", format.encrypted))
+		if err := f.Truncate(0); err != nil {
+			return 0, fmt.Errorf("truncating temporary file: %w", err)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return 0, fmt.Errorf("seek in temporary file: %w", err)
+		}
+	}
+
+	pf, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer pf.Close()
+	size, err := io.Copy(f, pf)
+	if err != nil {
+		return 0, fmt.Errorf("copying message: %w", err)
+	}
+	return size, nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	msg := "Subject: test\r\n\r\ntest message\r\n"
+	deliver := func() Message {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("check-test")
+		tcheck(t, err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now(), Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver message")
+		return m
+	}
+
+	check := func(repair bool, expProblems, expRepaired int) {
+		t.Helper()
+		var stats CheckStats
+		acc.WithWLock(func() {
+			stats, err = acc.CheckConsistency(log, repair)
+		})
+		tcheck(t, err, "check consistency")
+		if len(stats.Problems) != expProblems || stats.Repaired != expRepaired {
+			t.Fatalf("got %d problems, %d repaired, expected %d and %d: %v", len(stats.Problems), stats.Repaired, expProblems, expRepaired, stats.Problems)
+		}
+	}
+
+	m0 := deliver()
+	m1 := deliver()
+	check(false, 0, 0)
+
+	// Break the account: bad parsed message, junk flag without training, uid not
+	// below uidnext, and an unreferenced message file.
+	err = acc.DB.Write(ctxbg, func(tx *bstore.Tx) error {
+		m := Message{ID: m0.ID}
+		if err := tx.Get(&m); err != nil {
+			return err
+		}
+		m.ParsedBuf = []byte("bogus")
+		m.Junk = true
+		if err := tx.Update(&m); err != nil {
+			return err
+		}
+		mb := Mailbox{ID: m1.MailboxID}
+		if err := tx.Get(&mb); err != nil {
+			return err
+		}
+		mb.UIDNext = m1.UID
+		return tx.Update(&mb)
+	})
+	tcheck(t, err, "breaking account")
+	orphan := acc.MessagePath(m1.ID + 100)
+	os.MkdirAll(filepath.Dir(orphan), 0770)
+	err = os.WriteFile(orphan, []byte(msg), 0660)
+	tcheck(t, err, "write orphan message file")
+	// Orphan at the path of the next message ID, which the first message delivered
+	// to lost+found gets.
+	msg2 := "Subject: orphan\r\n\r\norphan message\r\n"
+	orphan2 := acc.MessagePath(m1.ID + 1)
+	err = os.WriteFile(orphan2, []byte(msg2), 0660)
+	tcheck(t, err, "write orphan message file")
+	// Plain orphan that looks like a compressed message file is delivered as is.
+	msg3 := compressMagic + "\xff\xff\xff\xff\xff\xff\xff\xff\r\nSubject: magic\r\n\r\ntest\r\n"
+	orphan3 := acc.MessagePath(m1.ID + 101)
+	err = os.WriteFile(orphan3, []byte(msg3), 0660)
+	tcheck(t, err, "write orphan message file")
+
+	check(false, 6, 0)
+	check(true, 6, 6)
+	check(false, 0, 0)
+
+	if _, err := os.Stat(orphan); err == nil {
+		t.Fatalf("orphan message file still present")
+	}
+	err = acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+		mb, err := acc.MailboxFind(tx, LostFoundMailbox)
+		tcheck(t, err, "find lost+found mailbox")
+		l, err := bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).List()
+		tcheck(t, err, "list messages")
+		if len(l) != 3 {
+			t.Fatalf("got %d messages in lost+found, expected 3", len(l))
+		}
+		var msgs []string
+		for _, m := range l {
+			buf, err := os.ReadFile(acc.MessagePath(m.ID))
+			tcheck(t, err, "read message file in lost+found")
+			msgs = append(msgs, string(buf))
+		}
+		sort.Strings(msgs)
+		if exp := []string{msg3, msg2, msg}; !reflect.DeepEqual(msgs, exp) {
+			t.Fatalf("got messages %q in lost+found, expected %q", msgs, exp)
+		}
+
+		m := Message{ID: m1.ID}
+		tcheck(t, tx.Get(&m), "get message")
+		if m.UID == m1.UID {
+			t.Fatalf("uid not reassigned")
+		}
+		return nil
+	})
+	tcheck(t, err, "read account")
+
+	// Missing message file cannot be repaired.
+	err = os.Remove(acc.MessagePath(m1.ID))
+	tcheck(t, err, "remove message file")
+	check(true, 1, 0)
+}
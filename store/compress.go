@@ -0,0 +1,420 @@
+package store
+
+import (
+	"compress/flate"
+	"context"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mjl-/bstore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// Message files can be stored compressed. A compressed message file consists of a
+// header followed by the message data in independently DEFLATE-compressed
+// chunks, so random access only requires decompressing the chunks that are read.
+// The header is:
+//
+//	magic, 8 bytes: "\x00moxz\x00\x01\n"
+//	uncompressed size, uint64
+//	uncompressed chunk size, uint32
+//	number of chunks, uint32
+//	for each chunk, offset of the end of its compressed data relative to the
+//	start of the first chunk, uint64
+//
+// All integers are big endian. Whether a message file is compressed is recorded
+// in Message.Compressed. It is not determined by looking for the magic: plain
+// message files hold data from remote senders, which can start with anything.
+
+const compressMagic = "\x00moxz\x00\x01\n"
+
+const compressChunkSize = 64 * 1024
+
+var (
+	metricCompressOriginal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_store_compress_original_bytes_total",
+			Help: "Size of message files before compression, for files stored compressed.",
+		},
+	)
+	metricCompressStored = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mox_store_compress_stored_bytes_total",
+			Help: "Size of compressed message files as stored. The difference with the original size is the space saved.",
+		},
+	)
+)
+
+// messageFile is an opened on-disk message file, plain or compressed.
+type messageFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openMessageFile opens a message file. If encrypted is set, the file is
+// decrypted with key, failing with ErrAccountLocked if key is nil. If compressed
+// is set, the (decrypted) file is decompressed.
+func openMessageFile(path string, key *rsa.PrivateKey, compressed, encrypted bool) (messageFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed && !encrypted {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var mf messageFile = f
+	size := fi.Size()
+	if encrypted {
+		ef, err := newEncryptedFile(f, size, key)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		mf = ef
+		size = ef.size
+	}
+	if compressed {
+		cf, err := newCompressedFile(mf, size)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		mf = cf
+	}
+	return mf, nil
+}
+
+// messageFileSize returns the uncompressed size of an opened message file.
+func messageFileSize(mf messageFile) (int64, error) {
+	switch f := mf.(type) {
+	case *compressedFile:
+		return f.size, nil
+	case *encryptedFile:
+		return f.size, nil
+	case *os.File:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	return 0, fmt.Errorf("unknown message file type %T", mf)
+}
+
+// compressedFile gives random access to the uncompressed contents of a
+// compressed message file.
+type compressedFile struct {
+	f         messageFile
+	size      int64    // Uncompressed size.
+	chunkSize int64    // Uncompressed size of each chunk, except possibly the last.
+	dataStart int64    // File offset of first chunk.
+	ends      []uint64 // End offsets of compressed chunks, relative to dataStart.
+
+	sync.Mutex
+	chunk int    // Index of chunk in buf, -1 if none.
+	buf   []byte // Uncompressed data of chunk.
+	fr    io.ReadCloser
+}
+
+// newCompressedFile returns a compressedFile for f, of fileSize bytes.
+func newCompressedFile(f messageFile, fileSize int64) (*compressedFile, error) {
+	var hdr [24]byte
+	if _, err := f.ReadAt(hdr[:], 0); err == io.EOF || err == nil && string(hdr[:8]) != compressMagic {
+		return nil, fmt.Errorf("missing header for compressed message file")
+	} else if err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint64(hdr[8:16]))
+	chunkSize := int64(binary.BigEndian.Uint32(hdr[16:20]))
+	nchunks := int64(binary.BigEndian.Uint32(hdr[20:24]))
+	// The header is only trusted as far as the file is large enough to hold it, and
+	// we don't allocate large buffers for chunks.
+	dataStart := 24 + 8*nchunks
+	if size < 0 || chunkSize == 0 || chunkSize > 16*compressChunkSize || nchunks != (size+chunkSize-1)/chunkSize || dataStart > fileSize {
+		return nil, fmt.Errorf("bad header in compressed message file")
+	}
+	buf := make([]byte, 8*nchunks)
+	if _, err := f.ReadAt(buf, 24); err != nil {
+		return nil, fmt.Errorf("reading chunk offsets in compressed message file: %w", err)
+	}
+	ends := make([]uint64, nchunks)
+	for i := range ends {
+		ends[i] = binary.BigEndian.Uint64(buf[8*i:])
+		if i > 0 && ends[i] < ends[i-1] || ends[i] > uint64(fileSize-dataStart) {
+			return nil, fmt.Errorf("bad chunk offsets in compressed message file")
+		}
+	}
+	return &compressedFile{f: f, size: size, chunkSize: chunkSize, dataStart: dataStart, ends: ends, chunk: -1}, nil
+}
+
+// ReadAt reads uncompressed data, decompressing chunks as needed.
+func (cf *compressedFile) ReadAt(buf []byte, off int64) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	var n int
+	for n < len(buf) && off < cf.size {
+		if err := cf.load(int(off / cf.chunkSize)); err != nil {
+			return n, err
+		}
+		nn := copy(buf[n:], cf.buf[off%cf.chunkSize:])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load decompresses a chunk into cf.buf, if not already present.
+func (cf *compressedFile) load(chunk int) error {
+	if cf.chunk == chunk {
+		return nil
+	}
+	cf.chunk = -1
+
+	var start int64
+	if chunk > 0 {
+		start = int64(cf.ends[chunk-1])
+	}
+	sr := io.NewSectionReader(cf.f, cf.dataStart+start, int64(cf.ends[chunk])-start)
+	if cf.fr == nil {
+		cf.fr = flate.NewReader(sr)
+	} else if err := cf.fr.(flate.Resetter).Reset(sr, nil); err != nil {
+		return err
+	}
+	n := cf.size - int64(chunk)*cf.chunkSize
+	if n > cf.chunkSize {
+		n = cf.chunkSize
+	}
+	if int64(cap(cf.buf)) < n {
+		cf.buf = make([]byte, n)
+	}
+	cf.buf = cf.buf[:n]
+	if _, err := io.ReadFull(cf.fr, cf.buf); err != nil {
+		return fmt.Errorf("decompressing chunk %d: %w", chunk, err)
+	}
+	cf.chunk = chunk
+	return nil
+}
+
+// Close closes the underlying file.
+func (cf *compressedFile) Close() error {
+	return cf.f.Close()
+}
+
+// writeCompressed writes the size bytes of r to the new empty file f, in
+// compressed form. If compressing does not make the file smaller, the data is
+// written plain. Returns whether the data was compressed, and the resulting
+// file size.
+func writeCompressed(f *os.File, r io.ReaderAt, size int64) (compressed bool, stored int64, rerr error) {
+	nchunks := (size + compressChunkSize - 1) / compressChunkSize
+	dataStart := 24 + 8*nchunks
+	hdr := make([]byte, dataStart)
+	copy(hdr, compressMagic)
+	binary.BigEndian.PutUint64(hdr[8:], uint64(size))
+	binary.BigEndian.PutUint32(hdr[16:], compressChunkSize)
+	binary.BigEndian.PutUint32(hdr[20:], uint32(nchunks))
+
+	// Write chunks after the space for the header, we only know the offsets after
+	// compressing.
+	if _, err := f.Seek(dataStart, io.SeekStart); err != nil {
+		return false, 0, fmt.Errorf("seek: %w", err)
+	}
+	fw, err := flate.NewWriter(f, flate.DefaultCompression)
+	if err != nil {
+		return false, 0, err
+	}
+	stored = dataStart
+	for i := int64(0); i < nchunks && stored < size; i++ {
+		n := size - i*compressChunkSize
+		if n > compressChunkSize {
+			n = compressChunkSize
+		}
+		fw.Reset(f)
+		if _, err := io.Copy(fw, io.NewSectionReader(r, i*compressChunkSize, n)); err != nil {
+			return false, 0, fmt.Errorf("compressing: %w", err)
+		}
+		if err := fw.Close(); err != nil {
+			return false, 0, fmt.Errorf("compressing: %w", err)
+		}
+		if stored, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return false, 0, fmt.Errorf("seek: %w", err)
+		}
+		binary.BigEndian.PutUint64(hdr[24+8*i:], uint64(stored-dataStart))
+	}
+
+	if stored >= size {
+		// Not worth it, store plain.
+		if err := f.Truncate(0); err != nil {
+			return false, 0, fmt.Errorf("truncate: %w", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, 0, fmt.Errorf("seek: %w", err)
+		}
+		if _, err := io.Copy(f, io.NewSectionReader(r, 0, size)); err != nil {
+			return false, 0, fmt.Errorf("copy: %w", err)
+		}
+		return false, size, nil
+	}
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return false, 0, fmt.Errorf("writing header: %w", err)
+	}
+	metricCompressOriginal.Add(float64(size))
+	metricCompressStored.Add(float64(stored))
+	return true, stored, nil
+}
+
+// CompressStats holds the results of compressing the message files of an
+// account.
+type CompressStats struct {
+	Messages   int   // Messages looked at.
+	Compressed int   // Message files that were compressed.
+	Original   int64 // Size of the compressed files before compression.
+	Stored     int64 // Size of the compressed files after compression.
+}
+
+// CompressMessages compresses the existing plain message files of the
+// account. Files that are already compressed or encrypted, or that don't become
+// smaller when compressed, are left as is.
+func (a *Account) CompressMessages(log *mlog.Log) (CompressStats, error) {
+	var stats CompressStats
+	err := a.convertMessageFiles(log, func(m *Message, f, tf *os.File, size int64) (bool, error) {
+		stats.Messages++
+		if m.Compressed || m.Encrypted {
+			return false, nil
+		}
+		compressed, stored, err := writeCompressed(tf, f, size)
+		if err != nil || !compressed {
+			return false, err
+		}
+		m.Compressed = true
+		stats.Compressed++
+		stats.Original += size
+		stats.Stored += stored
+		return true, nil
+	})
+	return stats, err
+}
+
+// convertMessageFiles calls convert for each message of the account, with the
+// message, its opened message file, a new temporary file and the size of the
+// message file. If convert returns true, the message file is replaced with the
+// temporary file, and the fields describing the stored message, which convert may
+// change (Compressed, Encrypted, MsgPrefix and ParsedBuf), are updated in the
+// database in the same transaction. So the file and database change together for
+// readers that read messages in a write transaction, like IMAP. Messages are processed one
+// at a time while holding the account rlock, so the account remains usable.
+// Readers that have the original file open keep reading the original.
+func (a *Account) convertMessageFiles(log *mlog.Log, convert func(m *Message, f, tf *os.File, size int64) (bool, error)) error {
+	// Gather the message IDs first, so we don't hold a read transaction for the
+	// duration of the conversion.
+	var ids []int64
+	err := a.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		return bstore.QueryTx[Message](tx).ForEach(func(m Message) error {
+			ids = append(ids, m.ID)
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("listing messages: %w", err)
+	}
+
+	for _, id := range ids {
+		var err error
+		a.WithRLock(func() {
+			err = a.convertMessageFile(log, id, convert)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Account) convertMessageFile(log *mlog.Log, id int64, convert func(m *Message, f, tf *os.File, size int64) (bool, error)) error {
+	// Message may have been removed in the mean time. We hold the rlock so it
+	// cannot be removed while we are converting.
+	m := Message{ID: id}
+	if err := a.DB.Get(context.TODO(), &m); err == bstore.ErrAbsent {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get message: %w", err)
+	}
+
+	p := a.MessagePath(m.ID)
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("open message file: %w", err)
+	}
+	defer func() {
+		err := f.Close()
+		log.Check(err, "closing message file")
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat message file: %w", err)
+	}
+
+	tf, err := CreateMessageTemp("convert")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if tf != nil {
+			err := tf.Close()
+			log.Check(err, "closing temporary file")
+			err = os.Remove(tf.Name())
+			log.Check(err, "removing temporary file", mlog.Field("path", tf.Name()))
+		}
+	}()
+	if ok, err := convert(&m, f, tf, fi.Size()); err != nil {
+		return fmt.Errorf("converting message file %s: %w", p, err)
+	} else if !ok {
+		return nil
+	}
+	if err := tf.Sync(); err != nil {
+		return fmt.Errorf("sync converted file: %w", err)
+	}
+	err = a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		// Other fields, e.g. flags, may have changed in the mean time.
+		xm := Message{ID: m.ID}
+		if err := tx.Get(&xm); err != nil {
+			return fmt.Errorf("get message: %w", err)
+		}
+		xm.Compressed = m.Compressed
+		xm.Encrypted = m.Encrypted
+		xm.MsgPrefix = m.MsgPrefix
+		xm.ParsedBuf = m.ParsedBuf
+		if err := tx.Update(&xm); err != nil {
+			return fmt.Errorf("updating message: %w", err)
+		}
+		if err := os.Rename(tf.Name(), p); err != nil {
+			return fmt.Errorf("replacing message file with converted file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tf.Close()
+	log.Check(err, "closing converted file")
+	tf = nil
+	return nil
+}
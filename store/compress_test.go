@@ -0,0 +1,186 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestCompress(t *testing.T) {
+	// Compressible data spanning multiple chunks, and data that doesn't compress.
+	text := []byte(strings.Repeat("Subject: test\r\n\r\nthis is a test message\r\n", 10000))
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	check := func(data []byte, expCompressed bool) {
+		t.Helper()
+
+		f, err := os.CreateTemp("", "mox-test-compress")
+		tcheck(t, err, "create temp")
+		defer os.Remove(f.Name())
+		defer f.Close()
+		compressed, stored, err := writeCompressed(f, bytes.NewReader(data), int64(len(data)))
+		tcheck(t, err, "write compressed")
+		if compressed != expCompressed {
+			t.Fatalf("compressed %v, expected %v", compressed, expCompressed)
+		}
+		fi, err := f.Stat()
+		tcheck(t, err, "stat")
+		if fi.Size() != stored {
+			t.Fatalf("file size %d, expected %d", fi.Size(), stored)
+		}
+		if compressed && stored >= int64(len(data)) {
+			t.Fatalf("compressed file size %d not smaller than original %d", stored, len(data))
+		}
+
+		mr := &MsgReader{prefix: []byte("prefix\r\n"), path: f.Name(), compressed: compressed, size: int64(len("prefix\r\n") + len(data))}
+		defer mr.Close()
+		buf, err := io.ReadAll(mr)
+		tcheck(t, err, "read all")
+		if !bytes.Equal(buf, append([]byte("prefix\r\n"), data...)) {
+			t.Fatalf("read data differs")
+		}
+
+		// Random access, including across chunk boundaries and at the end.
+		for _, off := range []int64{0, compressChunkSize - 3, 1, int64(len(data)) - 5, compressChunkSize * 3} {
+			if off < 0 || off > int64(len(data)) {
+				continue
+			}
+			xbuf := make([]byte, 10)
+			n, err := mr.ReadAt(xbuf, int64(len("prefix\r\n"))+off)
+			if err != nil && err != io.EOF {
+				t.Fatalf("readat %d: %v", off, err)
+			}
+			end := off + 10
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			if !bytes.Equal(xbuf[:n], data[off:end]) {
+				t.Fatalf("readat %d: got %q, expected %q", off, xbuf[:n], data[off:end])
+			}
+		}
+	}
+	check(text, true)
+	check(random, false)
+	check(nil, false)
+
+	// A header claiming a huge number of chunks for a small file must be rejected,
+	// not cause a large allocation.
+	f, err := os.CreateTemp("", "mox-test-compress")
+	tcheck(t, err, "create temp")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write([]byte(compressMagic + "\x00\x00\xff\xff\xff\xff\x00\x00\x00\x01\x00\x00\xff\xff\xff\xff" + strings.Repeat("x", 24)))
+	tcheck(t, err, "write")
+	if _, err := openMessageFile(f.Name(), nil, true, false); err == nil {
+		t.Fatalf("open compressed file with bad header succeeded")
+	}
+}
+
+func TestCompressAccount(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("test message text\r\n", 1000)
+	deliver := func() Message {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("compress-test")
+		tcheck(t, err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now(), Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver message")
+		return m
+	}
+
+	checkMessage := func(m Message, expCompressed bool) {
+		t.Helper()
+		err := acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get message")
+		if m.Compressed != expCompressed {
+			t.Fatalf("message compressed %v, expected %v", m.Compressed, expCompressed)
+		}
+		fi, err := os.Stat(acc.MessagePath(m.ID))
+		tcheck(t, err, "stat message file")
+		if compressed := fi.Size() < m.Size; compressed != expCompressed {
+			t.Fatalf("message file compressed %v, expected %v", compressed, expCompressed)
+		}
+		mr := acc.MessageReader(m)
+		defer mr.Close()
+		buf, err := io.ReadAll(mr)
+		tcheck(t, err, "read message")
+		if string(buf) != msg {
+			t.Fatalf("read message differs")
+		}
+	}
+
+	// Plain message, compressed after delivery.
+	m0 := deliver()
+	checkMessage(m0, false)
+	stats, err := acc.CompressMessages(log)
+	tcheck(t, err, "compress messages")
+	if stats.Messages != 1 || stats.Compressed != 1 || stats.Original != int64(len(msg)) || stats.Stored >= stats.Original {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+	checkMessage(m0, true)
+
+	// Compressing again does nothing.
+	stats, err = acc.CompressMessages(log)
+	tcheck(t, err, "compress messages")
+	if stats.Messages != 1 || stats.Compressed != 0 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+
+	// Message compressed during delivery.
+	conf := mox.Conf.Dynamic.Accounts["mjl"]
+	conf.CompressMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	defer func() {
+		conf.CompressMessages = false
+		mox.Conf.Dynamic.Accounts["mjl"] = conf
+	}()
+	m1 := deliver()
+	checkMessage(m1, true)
+
+	// Parsed form of message can be loaded from the compressed file.
+	err = acc.DB.Get(ctxbg, &m1)
+	tcheck(t, err, "get message")
+	_, err = m1.LoadPart(acc.MessageReader(m1))
+	tcheck(t, err, "load part")
+
+	// A plain message that looks like a compressed file is read as is, its contents
+	// come from the sender.
+	conf.CompressMessages = false
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	msg = compressMagic + "\x00\x00\x00\x00\x00\x00\x10\x00\x00\x01\x00\x00\xff\xff\xff\xff\r\n\r\ntest\r\n"
+	m2 := deliver()
+	checkMessage(m2, false)
+
+	n, err := bstore.QueryDB[Message](ctxbg, acc.DB).Count()
+	tcheck(t, err, "count messages")
+	if n != 3 {
+		t.Fatalf("got %d messages, expected 3", n)
+	}
+}
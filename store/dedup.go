@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+// Message files are stored once for messages with identical contents (without
+// MsgPrefix), e.g. for an incoming message delivered to multiple accounts. This
+// is done with hardlinks: the file system keeps a reference count, and removing
+// a message file on expunge only removes the file contents when no other message
+// references it.
+//
+// Plain message files are hardlinked by DeliverMessage from the same temporary
+// file. Compressed message files are written by DeliverMessage, so we keep track
+// of the files recently written for a temporary file, and hardlink to them for
+// the next delivery of the same temporary file. Encrypted message files are
+// never shared, they are encrypted with a key of the account.
+
+// sharedFile is a message file written for a temporary message file.
+type sharedFile struct {
+	src        os.FileInfo // Of the temporary message file, with its name, size and mtime.
+	path       string      // Message file written for src.
+	compressed bool        // Whether the message file is compressed.
+}
+
+var sharedFiles = struct {
+	sync.Mutex
+	l []sharedFile // Most recent last.
+}{}
+
+const sharedFilesMax = 16
+
+// linkSharedFile tries to hardlink a message file that was previously written for
+// msgFile to dst. Returns whether the message file is compressed, and whether
+// linking succeeded.
+func linkSharedFile(log *mlog.Log, msgFile *os.File, dst string) (compressed, ok bool) {
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return false, false
+	}
+	sharedFiles.Lock()
+	defer sharedFiles.Unlock()
+	for i := len(sharedFiles.l) - 1; i >= 0; i-- {
+		sf := sharedFiles.l[i]
+		// Temporary files have random names. Comparing name, size and mtime protects
+		// against a reused inode.
+		if !os.SameFile(sf.src, fi) || sf.src.Name() != fi.Name() || sf.src.Size() != fi.Size() || !sf.src.ModTime().Equal(fi.ModTime()) {
+			continue
+		}
+		if err := os.Link(sf.path, dst); err != nil {
+			// Message file may have been removed in the mean time.
+			log.Debugx("hardlinking shared message file", err, mlog.Field("path", sf.path))
+			sharedFiles.l = append(sharedFiles.l[:i], sharedFiles.l[i+1:]...)
+			return false, false
+		}
+		return sf.compressed, true
+	}
+	return false, false
+}
+
+// addSharedFile registers path as message file written for msgFile, for
+// hardlinking on later deliveries.
+func addSharedFile(msgFile *os.File, path string, compressed bool) {
+	fi, err := msgFile.Stat()
+	if err != nil {
+		return
+	}
+	sharedFiles.Lock()
+	defer sharedFiles.Unlock()
+	if len(sharedFiles.l) >= sharedFilesMax {
+		sharedFiles.l = sharedFiles.l[1:]
+	}
+	sharedFiles.l = append(sharedFiles.l, sharedFile{fi, path, compressed})
+}
+
+// DedupStats holds the results of DedupMessageFiles.
+type DedupStats struct {
+	Files      int   // Message files looked at.
+	Shared     int   // Message files already shared with other messages.
+	Duplicates int   // Message files replaced by a hardlink to an identical file.
+	Saved      int64 // Bytes saved by replacing duplicates.
+}
+
+// DedupMessageFiles finds identical message files across the accounts, and
+// replaces duplicates with hardlinks to a single file. Messages are processed
+// while holding the account rlock, so the accounts remain usable.
+func DedupMessageFiles(log *mlog.Log, accountNames []string) (DedupStats, error) {
+	var stats DedupStats
+
+	type msgFile struct {
+		acc  *Account
+		id   int64
+		path string
+		fi   os.FileInfo
+	}
+
+	var accounts []*Account
+	defer func() {
+		for _, acc := range accounts {
+			err := acc.Close()
+			log.Check(err, "closing account after deduplicating message files")
+		}
+	}()
+
+	// Gather all message files, grouped by size.
+	bySize := map[int64][]msgFile{}
+	for _, name := range accountNames {
+		acc, err := OpenAccount(name)
+		if err != nil {
+			return stats, fmt.Errorf("open account %s: %w", name, err)
+		}
+		accounts = append(accounts, acc)
+
+		err = acc.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			return bstore.QueryTx[Message](tx).ForEach(func(m Message) error {
+				if m.Encrypted {
+					// Encrypted with a key of the account, never identical to other files.
+					return nil
+				}
+				p := acc.MessagePath(m.ID)
+				fi, err := os.Stat(p)
+				if err != nil {
+					// Message may have been removed, or has no file because it only has a prefix.
+					return nil
+				}
+				if fi.Size() > 0 {
+					bySize[fi.Size()] = append(bySize[fi.Size()], msgFile{acc, m.ID, p, fi})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return stats, fmt.Errorf("listing messages for account %s: %w", name, err)
+		}
+	}
+
+	for _, l := range bySize {
+		stats.Files += len(l)
+		if len(l) == 1 {
+			continue
+		}
+
+		// Files with the same size, hash those that aren't already the same file.
+		var distinct []msgFile
+		for _, mf := range l {
+			shared := false
+			for _, d := range distinct {
+				if os.SameFile(d.fi, mf.fi) {
+					shared = true
+					break
+				}
+			}
+			if shared {
+				stats.Shared++
+			} else {
+				distinct = append(distinct, mf)
+			}
+		}
+		if len(distinct) == 1 {
+			continue
+		}
+
+		byHash := map[[sha256.Size]byte]msgFile{}
+		for _, mf := range distinct {
+			h, err := hashFile(mf.path)
+			if err != nil {
+				log.Debugx("hashing message file", err, mlog.Field("path", mf.path))
+				continue
+			}
+			orig, ok := byHash[h]
+			if !ok {
+				byHash[h] = mf
+				continue
+			}
+
+			var replaced bool
+			mf.acc.WithRLock(func() {
+				replaced, err = replaceWithLink(mf.acc, mf.id, orig.path, mf.path)
+			})
+			if err != nil {
+				return stats, fmt.Errorf("replacing %s with hardlink to %s: %w", mf.path, orig.path, err)
+			}
+			if replaced {
+				stats.Duplicates++
+				stats.Saved += mf.fi.Size()
+			}
+		}
+	}
+	return stats, nil
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// replaceWithLink replaces message file path of message id with a hardlink to
+// orig. Caller must hold account rlock, so the message cannot be removed. If the
+// message or orig no longer exists, nothing is done.
+func replaceWithLink(acc *Account, id int64, orig, path string) (bool, error) {
+	if err := acc.DB.Get(context.TODO(), &Message{ID: id}); err == bstore.ErrAbsent {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("get message: %w", err)
+	}
+
+	// Create hardlink under a temporary name, then atomically replace the file.
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".dedup-%d-%d", id, time.Now().UnixNano()))
+	if err := os.Link(orig, tmp); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("hardlink: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("rename: %w", err)
+	}
+	return true, nil
+}
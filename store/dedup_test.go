@@ -0,0 +1,106 @@
+package store
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestDedup(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("test message text\r\n", 1000)
+	writeTemp := func() *os.File {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("dedup-test")
+		tcheck(t, err, "create temp message")
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		return msgFile
+	}
+	deliver := func(msgFile *os.File, consume bool) Message {
+		t.Helper()
+		m := Message{Received: time.Now(), Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, consume)
+		})
+		tcheck(t, err, "deliver message")
+		return m
+	}
+	stat := func(m Message) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(acc.MessagePath(m.ID))
+		tcheck(t, err, "stat message file")
+		return fi
+	}
+	readMessage := func(m Message) {
+		t.Helper()
+		mr := acc.MessageReader(m)
+		defer mr.Close()
+		buf, err := io.ReadAll(mr)
+		tcheck(t, err, "read message")
+		if string(buf) != msg {
+			t.Fatalf("read message differs")
+		}
+	}
+
+	// Different files for separately delivered messages.
+	m0 := deliver(writeTemp(), true)
+	m1 := deliver(writeTemp(), true)
+	if os.SameFile(stat(m0), stat(m1)) {
+		t.Fatalf("separately delivered messages share file")
+	}
+
+	// Compressed message delivered twice from the same file is stored once.
+	conf := mox.Conf.Dynamic.Accounts["mjl"]
+	conf.CompressMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	msgFile := writeTemp()
+	m2 := deliver(msgFile, false)
+	m3 := deliver(msgFile, true)
+	conf.CompressMessages = false
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	if !os.SameFile(stat(m2), stat(m3)) {
+		t.Fatalf("compressed message delivered twice not stored once")
+	}
+	if m2.Compressed != m3.Compressed {
+		t.Fatalf("shared message file has different compressed flags, %v and %v", m2.Compressed, m3.Compressed)
+	}
+	readMessage(m3)
+
+	// Deduplicate the plain messages.
+	stats, err := DedupMessageFiles(log, []string{"mjl"})
+	tcheck(t, err, "dedup message files")
+	if stats.Files != 4 || stats.Shared != 1 || stats.Duplicates != 1 || stats.Saved != int64(len(msg)) {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+	if !os.SameFile(stat(m0), stat(m1)) {
+		t.Fatalf("message files not shared after dedup")
+	}
+
+	// Removing one message file, as expunge does, leaves the other intact.
+	err = os.Remove(acc.MessagePath(m0.ID))
+	tcheck(t, err, "remove message file")
+	readMessage(m1)
+
+	// Nothing more to do.
+	stats, err = DedupMessageFiles(log, []string{"mjl"})
+	tcheck(t, err, "dedup message files")
+	if stats.Duplicates != 0 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
@@ -0,0 +1,617 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+)
+
+// Message files of an account can be encrypted at rest. Each account with
+// encryption has an RSA key pair. The public key is used to encrypt new message
+// files, also when nobody is logged in. The private key is sealed with a key
+// derived from the account password, and is unsealed when the user logs in with
+// the password, "unlocking" the account until the account is no longer in use.
+//
+// An encrypted message file starts with a header:
+//
+//	magic, 8 bytes: "\x00moxe\x00\x01\n"
+//	length of wrapped file key, uint16
+//	wrapped file key, the random AES-256 key for this file encrypted with RSA-OAEP and SHA-256
+//	plaintext size, uint64
+//	plaintext chunk size, uint32
+//
+// All integers are big endian. The header is followed by the plaintext in
+// chunks, each sealed with AES-256-GCM, with the chunk index as nonce, and a
+// byte indicating whether it is the last chunk as additional data. The
+// plaintext can be a compressed message file. Whether a message file is
+// encrypted is recorded in Message.Encrypted, not determined by looking for the
+// magic.
+//
+// Of the account database, the message contents are encrypted: the received
+// headers that are normally stored in Message.MsgPrefix are stored in the
+// encrypted message file instead, and the parsed message structure in
+// Message.ParsedBuf, with the subject, addresses and MIME structure, is encrypted
+// in the same format as message files. Other data in the database is needed for
+// deliveries while the account is locked, and is not encrypted: the fields of
+// messages used for reputation (envelope and message From addresses, recipient,
+// remote IPs, EHLO and DKIM domains, and the Message-ID of rejected messages),
+// flags, sizes and times, and the mailbox names. The junk filter database, with
+// words from messages, is not encrypted either.
+
+const encryptMagic = "\x00moxe\x00\x01\n"
+
+const encryptChunkSize = 64 * 1024
+
+// Label for RSA-OAEP when wrapping file keys.
+var encryptLabel = []byte("mox message file key")
+
+// Parameters for deriving the key for sealing the private key.
+const encryptKeyIterations = 100000
+
+// ErrAccountLocked is returned when reading an encrypted message file for an
+// account that is locked, i.e. when the private key has not been unsealed with
+// the account password.
+var ErrAccountLocked = errors.New("account is locked, encrypted messages can only be read after login with password")
+
+// ErrNoEncryptionKey is returned when delivering a message to an account with
+// encryption enabled for which no key pair has been created yet. Messages are
+// not stored unencrypted.
+var ErrNoEncryptionKey = errors.New("encryption is enabled for account but its key pair has not been created yet, by setting the password, login with the password, or mox encrypt")
+
+// EncryptionKey holds the key pair for encrypting the message files of an
+// account. There is at most one, it is created when encryption is enabled for
+// the account and the password is available: when setting a password, at login,
+// or with "mox encrypt".
+type EncryptionKey struct {
+	ID         int64
+	Created    time.Time `bstore:"default now"`
+	PublicKey  []byte    // PKIX DER-encoded RSA public key.
+	SealedKey  []byte    // PKCS#8 DER-encoded private key, sealed with AES-256-GCM, nonce prepended.
+	Salt       []byte    // For PBKDF2 with SHA-256 of the password.
+	Iterations int
+}
+
+// sealPrivateKey sets the sealed private key in k, using a key derived from password.
+func (k *EncryptionKey) sealPrivateKey(priv *rsa.PrivateKey, password string) error {
+	buf, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %v", err)
+	}
+	k.Salt = make([]byte, 16)
+	if _, err := cryptorand.Read(k.Salt); err != nil {
+		return fmt.Errorf("generating salt: %v", err)
+	}
+	k.Iterations = encryptKeyIterations
+	aead, err := k.passwordAEAD(password)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %v", err)
+	}
+	k.SealedKey = aead.Seal(nonce, nonce, buf, nil)
+	return nil
+}
+
+// unsealPrivateKey returns the private key, unsealed with password.
+func (k EncryptionKey) unsealPrivateKey(password string) (*rsa.PrivateKey, error) {
+	aead, err := k.passwordAEAD(password)
+	if err != nil {
+		return nil, err
+	}
+	n := aead.NonceSize()
+	if len(k.SealedKey) < n {
+		return nil, fmt.Errorf("sealed key too short")
+	}
+	buf, err := aead.Open(nil, k.SealedKey[:n], k.SealedKey[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unsealing private key: %v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %v", err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, expected rsa", key)
+	}
+	return priv, nil
+}
+
+func (k EncryptionKey) passwordAEAD(password string) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(password), k.Salt, k.Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k EncryptionKey) publicKey() (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(k.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %v", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is %T, expected rsa", key)
+	}
+	return pub, nil
+}
+
+// newEncryptionKey generates a new key pair, with the private key sealed with
+// password.
+func newEncryptionKey(password string) (EncryptionKey, *rsa.PrivateKey, error) {
+	priv, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		return EncryptionKey{}, nil, fmt.Errorf("generating rsa key: %v", err)
+	}
+	pubbuf, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return EncryptionKey{}, nil, fmt.Errorf("marshal public key: %v", err)
+	}
+	k := EncryptionKey{PublicKey: pubbuf}
+	if err := k.sealPrivateKey(priv, password); err != nil {
+		return EncryptionKey{}, nil, err
+	}
+	return k, priv, nil
+}
+
+// unlock unseals the private key of the account with password, after the
+// password was verified. If encryption is enabled in the configuration but no
+// key exists yet, it is created.
+func (a *Account) unlock(password string) error {
+	a.encLock.Lock()
+	defer a.encLock.Unlock()
+	conf, _ := a.Conf()
+	if a.encKey != nil || a.encNoKey && !conf.EncryptMessages {
+		return nil
+	}
+
+	k, err := bstore.QueryDB[EncryptionKey](context.TODO(), a.DB).Get()
+	if err == bstore.ErrAbsent {
+		if !conf.EncryptMessages {
+			// Don't look again at next login.
+			a.encNoKey = true
+			return nil
+		}
+		// A key may have been created by a password change in the mean time, so check
+		// again in the write transaction.
+		var priv *rsa.PrivateKey
+		err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+			k, err := bstore.QueryTx[EncryptionKey](tx).Get()
+			if err == nil {
+				priv, err = k.unsealPrivateKey(password)
+				return err
+			} else if err != bstore.ErrAbsent {
+				return err
+			}
+			k, priv, err = newEncryptionKey(password)
+			if err != nil {
+				return err
+			}
+			xlog.Info("created encryption key for account", mlog.Field("account", a.Name))
+			return tx.Insert(&k)
+		})
+		if err != nil {
+			return err
+		}
+		a.encKey = priv
+		a.encNoKey = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	priv, err := k.unsealPrivateKey(password)
+	if err != nil {
+		return err
+	}
+	a.encKey = priv
+	return nil
+}
+
+// UnlockWithPassword verifies password and unseals the private key of the account, creating
+// the key pair if encryption is enabled but no key exists yet. The account stays
+// unlocked until it is no longer in use.
+func (a *Account) UnlockWithPassword(password string) error {
+	pw, err := bstore.QueryDB[Password](context.TODO(), a.DB).Get()
+	if err == bstore.ErrAbsent {
+		return ErrUnknownCredentials
+	} else if err != nil {
+		return fmt.Errorf("looking up password: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(pw.Hash), []byte(password)); err != nil {
+		return ErrUnknownCredentials
+	}
+	return a.unlock(password)
+}
+
+// Locked returns whether the account has encrypted messages that cannot be read
+// because the account has not been unlocked with the password.
+func (a *Account) Locked() (bool, error) {
+	a.encLock.Lock()
+	defer a.encLock.Unlock()
+	if a.encKey != nil {
+		return false, nil
+	}
+	n, err := bstore.QueryDB[EncryptionKey](context.TODO(), a.DB).Count()
+	return n > 0, err
+}
+
+// MessageKey returns the private key for decrypting message files if the account
+// is unlocked, and nil otherwise.
+func (a *Account) MessageKey() *rsa.PrivateKey {
+	a.encLock.Lock()
+	defer a.encLock.Unlock()
+	return a.encKey
+}
+
+// resealEncryptionKey seals the private key with a new password. The account
+// must be unlocked if it has an encryption key. If encryption is enabled for the
+// account but no key exists yet, it is created.
+func (a *Account) resealEncryptionKey(tx *bstore.Tx, password string) error {
+	a.encLock.Lock()
+	defer a.encLock.Unlock()
+
+	k, err := bstore.QueryTx[EncryptionKey](tx).Get()
+	if err == bstore.ErrAbsent {
+		if conf, _ := a.Conf(); !conf.EncryptMessages {
+			return nil
+		}
+		k, priv, err := newEncryptionKey(password)
+		if err != nil {
+			return err
+		}
+		if err := tx.Insert(&k); err != nil {
+			return err
+		}
+		a.encKey = priv
+		a.encNoKey = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if a.encKey == nil {
+		return fmt.Errorf("%w: password of account with encrypted messages can only be changed while the account is unlocked", ErrAccountLocked)
+	}
+	if err := k.sealPrivateKey(a.encKey, password); err != nil {
+		return err
+	}
+	return tx.Update(&k)
+}
+
+// messagePublicKey returns the public key for encrypting new message files, or
+// nil if messages should not be encrypted. If encryption is enabled but no key
+// exists yet, ErrNoEncryptionKey is returned, the message must not be stored.
+func (a *Account) messagePublicKey(tx *bstore.Tx) (*rsa.PublicKey, error) {
+	if conf, _ := a.Conf(); !conf.EncryptMessages {
+		return nil, nil
+	}
+	return accountPublicKey(tx)
+}
+
+// accountPublicKey returns the public key of the account, or ErrNoEncryptionKey.
+func accountPublicKey(tx *bstore.Tx) (*rsa.PublicKey, error) {
+	k, err := bstore.QueryTx[EncryptionKey](tx).Get()
+	if err == bstore.ErrAbsent {
+		return nil, ErrNoEncryptionKey
+	} else if err != nil {
+		return nil, err
+	}
+	return k.publicKey()
+}
+
+// encryptedFile gives random access to the plaintext of an encrypted message
+// file.
+type encryptedFile struct {
+	f         messageFile
+	size      int64 // Plaintext size.
+	chunkSize int64 // Plaintext size of each chunk, except possibly the last.
+	dataStart int64 // File offset of first chunk.
+	aead      cipher.AEAD
+
+	sync.Mutex
+	chunk int    // Index of chunk in buf, -1 if none.
+	buf   []byte // Plaintext of chunk.
+	sbuf  []byte // Buffer for sealed chunk.
+}
+
+// newEncryptedFile returns an encryptedFile for f, of fileSize bytes, decrypted
+// with key.
+func newEncryptedFile(f messageFile, fileSize int64, key *rsa.PrivateKey) (*encryptedFile, error) {
+	var hdr [10]byte
+	if _, err := f.ReadAt(hdr[:], 0); err == io.EOF || err == nil && string(hdr[:8]) != encryptMagic {
+		return nil, fmt.Errorf("missing header for encrypted message file")
+	} else if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrAccountLocked
+	}
+	n := int64(binary.BigEndian.Uint16(hdr[8:10]))
+	if 10+n+12 > fileSize {
+		return nil, fmt.Errorf("bad header in encrypted message file")
+	}
+	buf := make([]byte, n+12)
+	if _, err := f.ReadAt(buf, 10); err != nil {
+		return nil, fmt.Errorf("reading header of encrypted message file: %w", err)
+	}
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, buf[:n], encryptLabel)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping file key: %v", err)
+	}
+	size := int64(binary.BigEndian.Uint64(buf[n : n+8]))
+	chunkSize := int64(binary.BigEndian.Uint32(buf[n+8 : n+12]))
+	dataStart := 10 + n + 12
+	if size < 0 || size > fileSize || chunkSize == 0 || chunkSize > 16*encryptChunkSize {
+		return nil, fmt.Errorf("bad header in encrypted message file")
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nchunks := (size + chunkSize - 1) / chunkSize
+	if nchunks == 0 {
+		nchunks = 1
+	}
+	if dataStart+size+nchunks*int64(aead.Overhead()) != fileSize {
+		return nil, fmt.Errorf("size of encrypted message file does not match header")
+	}
+	return &encryptedFile{f: f, size: size, chunkSize: chunkSize, dataStart: dataStart, aead: aead, chunk: -1}, nil
+}
+
+func chunkNonce(aead cipher.AEAD, chunk int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(chunk))
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// ReadAt reads plaintext, decrypting chunks as needed.
+func (ef *encryptedFile) ReadAt(buf []byte, off int64) (int, error) {
+	ef.Lock()
+	defer ef.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	var n int
+	for n < len(buf) && off < ef.size {
+		if err := ef.load(off / ef.chunkSize); err != nil {
+			return n, err
+		}
+		nn := copy(buf[n:], ef.buf[off%ef.chunkSize:])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load decrypts a chunk into ef.buf, if not already present.
+func (ef *encryptedFile) load(chunk int64) error {
+	if int64(ef.chunk) == chunk {
+		return nil
+	}
+	ef.chunk = -1
+
+	n := ef.size - chunk*ef.chunkSize
+	last := n <= ef.chunkSize
+	if !last {
+		n = ef.chunkSize
+	}
+	overhead := int64(ef.aead.Overhead())
+	if int64(cap(ef.sbuf)) < n+overhead {
+		ef.sbuf = make([]byte, n+overhead)
+	}
+	ef.sbuf = ef.sbuf[:n+overhead]
+	if _, err := ef.f.ReadAt(ef.sbuf, ef.dataStart+chunk*(ef.chunkSize+overhead)); err != nil {
+		return fmt.Errorf("reading encrypted chunk %d: %w", chunk, err)
+	}
+	buf, err := ef.aead.Open(ef.buf[:0], chunkNonce(ef.aead, chunk), ef.sbuf, chunkAD(last))
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %w", chunk, err)
+	}
+	ef.buf = buf
+	ef.chunk = int(chunk)
+	return nil
+}
+
+// Close closes the underlying file.
+func (ef *encryptedFile) Close() error {
+	return ef.f.Close()
+}
+
+// writeEncrypted writes the size bytes of r to w, encrypted with a new file key
+// that is wrapped with pub.
+func writeEncrypted(w io.Writer, r io.ReaderAt, size int64, pub *rsa.PublicKey) error {
+	fileKey := make([]byte, 32)
+	if _, err := cryptorand.Read(fileKey); err != nil {
+		return fmt.Errorf("generating file key: %v", err)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), cryptorand.Reader, pub, fileKey, encryptLabel)
+	if err != nil {
+		return fmt.Errorf("wrapping file key: %v", err)
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 10+len(wrapped)+12)
+	copy(hdr, encryptMagic)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(wrapped)))
+	copy(hdr[10:], wrapped)
+	binary.BigEndian.PutUint64(hdr[10+len(wrapped):], uint64(size))
+	binary.BigEndian.PutUint32(hdr[10+len(wrapped)+8:], encryptChunkSize)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptChunkSize)
+	var sbuf []byte
+	for chunk := int64(0); chunk == 0 || chunk*encryptChunkSize < size; chunk++ {
+		n := size - chunk*encryptChunkSize
+		last := n <= encryptChunkSize
+		if !last {
+			n = encryptChunkSize
+		}
+		if nn, err := r.ReadAt(buf[:n], chunk*encryptChunkSize); int64(nn) != n {
+			return fmt.Errorf("reading plaintext: %w", err)
+		}
+		sbuf = aead.Seal(sbuf[:0], chunkNonce(aead, chunk), buf[:n], chunkAD(last))
+		if _, err := w.Write(sbuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type nopMessageFile struct {
+	*bytes.Reader
+}
+
+func (nopMessageFile) Close() error {
+	return nil
+}
+
+// sealParsed encrypts the plaintext m.ParsedBuf with pub, for a message that is
+// being encrypted. The plaintext is kept in m for use during delivery, when the
+// account may be locked.
+func (m *Message) sealParsed(pub *rsa.PublicKey) error {
+	if m.ParsedBuf == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	if err := writeEncrypted(&b, bytes.NewReader(m.ParsedBuf), int64(len(m.ParsedBuf)), pub); err != nil {
+		return fmt.Errorf("encrypting parsed message: %w", err)
+	}
+	m.parsedPlain = m.ParsedBuf
+	m.ParsedBuf = b.Bytes()
+	return nil
+}
+
+// parsedPlaintext returns the plaintext JSON of m.ParsedBuf, decrypting it with
+// key if needed. Returns ErrAccountLocked if key is needed but nil.
+func (m Message) parsedPlaintext(key *rsa.PrivateKey) ([]byte, error) {
+	if !m.Encrypted {
+		return m.ParsedBuf, nil
+	} else if m.parsedPlain != nil {
+		return m.parsedPlain, nil
+	}
+	ef, err := newEncryptedFile(nopMessageFile{bytes.NewReader(m.ParsedBuf)}, int64(len(m.ParsedBuf)), key)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ef.size)
+	if _, err := ef.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decrypting parsed message: %w", err)
+	}
+	return buf, nil
+}
+
+// SetParsed stores p in m.ParsedBuf, encrypted if the message is encrypted. The
+// caller must update m in the database.
+func (a *Account) SetParsed(tx *bstore.Tx, m *Message, p message.Part) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal parsed message: %w", err)
+	}
+	m.ParsedBuf = buf
+	m.parsedPlain = nil
+	if !m.Encrypted {
+		return nil
+	}
+	pub, err := accountPublicKey(tx)
+	if err != nil {
+		return err
+	}
+	return m.sealParsed(pub)
+}
+
+// EncryptMessages encrypts the existing message files of the account that are
+// not yet encrypted, with the public key of the account. The received headers in
+// the message prefix are moved into the encrypted message file, and the parsed
+// message structure in the database is encrypted too. The account does not have
+// to be unlocked. Returns the number of encrypted messages.
+func (a *Account) EncryptMessages(log *mlog.Log) (int, error) {
+	var pub *rsa.PublicKey
+	err := a.DB.Read(context.TODO(), func(tx *bstore.Tx) (err error) {
+		pub, err = accountPublicKey(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = a.convertMessageFiles(log, func(m *Message, f, tf *os.File, size int64) (bool, error) {
+		if m.Encrypted {
+			return false, nil
+		}
+		// The plaintext is the message prefix followed by the uncompressed message file,
+		// compressed again if the message file was compressed.
+		var mf messageFile = f
+		if m.Compressed {
+			cf, err := newCompressedFile(f, size)
+			if err != nil {
+				return false, err
+			}
+			mf = cf
+			size = cf.size
+		}
+		// We don't close mr, it would close f.
+		mr := &MsgReader{prefix: m.MsgPrefix, f: mf, size: int64(len(m.MsgPrefix)) + size}
+		compressed, err := writeMessageData(tf, mr, mr.size, m.Compressed, pub)
+		if err != nil {
+			return false, err
+		}
+		if err := m.sealParsed(pub); err != nil {
+			return false, err
+		}
+		m.Compressed = compressed
+		m.Encrypted = true
+		m.MsgPrefix = nil
+		n++
+		return true, nil
+	})
+	return n, err
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestEncryptFile(t *testing.T) {
+	k, priv, err := newEncryptionKey("test1234")
+	tcheck(t, err, "new encryption key")
+	xpriv, err := k.unsealPrivateKey("test1234")
+	tcheck(t, err, "unseal private key")
+	if !xpriv.Equal(priv) {
+		t.Fatalf("unsealed private key differs")
+	}
+	if _, err := k.unsealPrivateKey("bad"); err == nil {
+		t.Fatalf("unsealing with bad password succeeded")
+	}
+	pub, err := k.publicKey()
+	tcheck(t, err, "public key")
+
+	check := func(data []byte) {
+		t.Helper()
+
+		var buf bytes.Buffer
+		err := writeEncrypted(&buf, bytes.NewReader(data), int64(len(data)), pub)
+		tcheck(t, err, "write encrypted")
+		if len(data) > 16 && bytes.Contains(buf.Bytes(), data[:16]) {
+			t.Fatalf("encrypted file contains plaintext")
+		}
+
+		ef, err := newEncryptedFile(nopMessageFile{bytes.NewReader(buf.Bytes())}, int64(buf.Len()), priv)
+		tcheck(t, err, "open encrypted file")
+		xbuf, err := io.ReadAll(io.NewSectionReader(ef, 0, ef.size))
+		tcheck(t, err, "read all")
+		if !bytes.Equal(xbuf, data) {
+			t.Fatalf("decrypted data differs")
+		}
+		for _, off := range []int64{0, encryptChunkSize - 3, int64(len(data)) - 5} {
+			if off < 0 || off > int64(len(data)) {
+				continue
+			}
+			xbuf := make([]byte, 10)
+			n, err := ef.ReadAt(xbuf, off)
+			if err != nil && err != io.EOF {
+				t.Fatalf("readat %d: %v", off, err)
+			}
+			end := off + 10
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			if !bytes.Equal(xbuf[:n], data[off:end]) {
+				t.Fatalf("readat %d: got %q, expected %q", off, xbuf[:n], data[off:end])
+			}
+		}
+
+		// Without key, we cannot read.
+		if _, err := newEncryptedFile(nopMessageFile{bytes.NewReader(buf.Bytes())}, int64(buf.Len()), nil); !errors.Is(err, ErrAccountLocked) {
+			t.Fatalf("got err %v, expected ErrAccountLocked", err)
+		}
+
+		// Truncated file is rejected.
+		if _, err := newEncryptedFile(nopMessageFile{bytes.NewReader(buf.Bytes()[:buf.Len()-1])}, int64(buf.Len()-1), priv); err == nil {
+			t.Fatalf("open truncated encrypted file succeeded")
+		}
+
+		// Modified data is detected.
+		xb := buf.Bytes()
+		xb[len(xb)-1] ^= 1
+		ef, err = newEncryptedFile(nopMessageFile{bytes.NewReader(xb)}, int64(len(xb)), priv)
+		tcheck(t, err, "open encrypted file")
+		if _, err := io.ReadAll(io.NewSectionReader(ef, 0, ef.size+1)); err == nil && len(data) > 0 {
+			t.Fatalf("reading modified encrypted file succeeded")
+		}
+	}
+	check([]byte(strings.Repeat("test message\r\n", 10000)))
+	check([]byte("short"))
+	check(nil)
+}
+
+func TestEncryptAccount(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	// The received header in the prefix is stored in the encrypted message file for
+	// encrypted messages, not in the database.
+	prefix := "Received: from secret.example\r\n"
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("test message text\r\n", 1000)
+	deliverErr := func() (Message, error) {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("encrypt-test")
+		tcheck(t, err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now(), MsgPrefix: []byte(prefix), Size: int64(len(prefix) + len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Inbox", &m, msgFile, false)
+		})
+		return m, err
+	}
+	deliver := func() Message {
+		t.Helper()
+		m, err := deliverErr()
+		tcheck(t, err, "deliver message")
+		return m
+	}
+
+	// Reads message file and parsed message, as stored in the database.
+	readMessage := func(m Message) error {
+		t.Helper()
+		m = Message{ID: m.ID}
+		err := acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get message")
+		mr := acc.MessageReader(m)
+		defer mr.Close()
+		p, err := m.LoadPart(mr)
+		if err != nil {
+			return err
+		} else if p.Envelope == nil || p.Envelope.Subject != "test" {
+			t.Fatalf("parsed message has envelope %#v, expected subject test", p.Envelope)
+		}
+		buf, err := io.ReadAll(mr)
+		if err == nil && string(buf) != prefix+msg {
+			t.Fatalf("read message differs")
+		}
+		return err
+	}
+
+	checkEncrypted := func(m Message, exp bool) {
+		t.Helper()
+		m = Message{ID: m.ID}
+		err = acc.DB.Get(ctxbg, &m)
+		tcheck(t, err, "get message")
+		if m.Encrypted != exp {
+			t.Fatalf("message encrypted %v, expected %v", m.Encrypted, exp)
+		}
+		buf, err := os.ReadFile(acc.MessagePath(m.ID))
+		tcheck(t, err, "read message file")
+		if exp && !bytes.HasPrefix(buf, []byte(encryptMagic)) {
+			t.Fatalf("message file not encrypted")
+		}
+		if exp && (bytes.Contains(buf, []byte("secret")) || bytes.Contains(m.ParsedBuf, []byte("test")) || m.MsgPrefix != nil) {
+			t.Fatalf("encrypted message has plaintext in message file or database")
+		}
+	}
+
+	// A plain message that looks like an encrypted file is read as is, its contents
+	// come from the sender. It must not make the account look locked.
+	xmsg := msg
+	msg = encryptMagic + "\x00\x10\r\n" + msg
+	mx := deliver()
+	checkEncrypted(mx, false)
+	mr := acc.MessageReader(mx)
+	buf, err := io.ReadAll(mr)
+	tcheck(t, err, "read message")
+	mr.Close()
+	if string(buf) != prefix+msg {
+		t.Fatalf("read message differs")
+	}
+	msg = xmsg
+
+	// Message delivered compressed before enabling encryption.
+	conf := mox.Conf.Dynamic.Accounts["mjl"]
+	conf.CompressMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	m0 := deliver()
+	conf.CompressMessages = false
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	checkEncrypted(m0, false)
+	tcheck(t, readMessage(m0), "read compressed message")
+
+	conf.EncryptMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	defer func() {
+		conf.EncryptMessages = false
+		mox.Conf.Dynamic.Accounts["mjl"] = conf
+	}()
+
+	// Without key pair, messages are refused instead of stored unencrypted.
+	if _, err := deliverErr(); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Fatalf("delivering without key pair, got err %v, expected ErrNoEncryptionKey", err)
+	}
+
+	// Key pair is created when setting the password, and the account is unlocked.
+	err = acc.SetPassword("test1234")
+	tcheck(t, err, "set password")
+	if locked, err := acc.Locked(); err != nil || locked {
+		t.Fatalf("account locked %v, err %v, expected unlocked", locked, err)
+	}
+
+	m1 := deliver()
+	checkEncrypted(m1, true)
+	tcheck(t, readMessage(m1), "read encrypted message")
+
+	n, err := acc.EncryptMessages(log)
+	tcheck(t, err, "encrypt messages")
+	if n != 2 {
+		t.Fatalf("encrypted %d messages, expected 2", n)
+	}
+	checkEncrypted(m0, true)
+	tcheck(t, readMessage(m0), "read encrypted message")
+	if err := acc.DB.Get(ctxbg, &m0); err != nil || !m0.Compressed {
+		t.Fatalf("encrypted message not compressed anymore, err %v", err)
+	}
+
+	// Lock account, as if it was no longer in use.
+	lock := func() {
+		acc.encLock.Lock()
+		acc.encKey = nil
+		acc.encLock.Unlock()
+	}
+	lock()
+	if locked, err := acc.Locked(); err != nil || !locked {
+		t.Fatalf("account locked %v, err %v, expected locked", locked, err)
+	}
+	if err := readMessage(m1); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("reading message of locked account, got err %v, expected ErrAccountLocked", err)
+	}
+	// Deliveries still work, and are encrypted.
+	m2 := deliver()
+	checkEncrypted(m2, true)
+	// Encrypted parsed messages are not consistency problems while locked.
+	var stats CheckStats
+	acc.WithWLock(func() {
+		stats, err = acc.CheckConsistency(log, false)
+	})
+	tcheck(t, err, "check consistency")
+	if len(stats.Problems) != 0 {
+		t.Fatalf("consistency problems for locked account: %v", stats.Problems)
+	}
+	// Password cannot be changed, the private key would be lost.
+	if err := acc.SetPassword("test12345"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("setting password for locked account, got err %v, expected ErrAccountLocked", err)
+	}
+
+	// Unlock with the password, as done by mox encrypt.
+	if err := acc.UnlockWithPassword("bad password"); !errors.Is(err, ErrUnknownCredentials) {
+		t.Fatalf("unlock with bad password, got err %v, expected ErrUnknownCredentials", err)
+	}
+	err = acc.UnlockWithPassword("test1234")
+	tcheck(t, err, "unlock with password")
+	tcheck(t, readMessage(m2), "read encrypted message")
+	lock()
+
+	// Unlock by logging in.
+	xacc, err := OpenEmailAuth("mjl@mox.example", "test1234")
+	tcheck(t, err, "open account with password")
+	defer xacc.Close()
+	tcheck(t, readMessage(m2), "read encrypted message")
+
+	// New password, private key is resealed.
+	err = acc.SetPassword("test12345")
+	tcheck(t, err, "set password")
+	priv := acc.MessageKey()
+	lock()
+	xacc2, err := OpenEmailAuth("mjl@mox.example", "test12345")
+	tcheck(t, err, "open account with new password")
+	defer xacc2.Close()
+	if !acc.MessageKey().Equal(priv) {
+		t.Fatalf("different key after changing password")
+	}
+}
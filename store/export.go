@@ -6,6 +6,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -16,6 +18,7 @@ import (
 
 	"github.com/mjl-/bstore"
 
+	"github.com/mjl-/mox/message"
 	"github.com/mjl-/mox/mlog"
 )
 
@@ -98,14 +101,183 @@ func (a DirArchiver) Close() error {
 	return nil
 }
 
+// ExportOptions select the messages to export, and whether to add a manifest.
+// With zero values, all messages in all mailboxes are exported.
+type ExportOptions struct {
+	Mailbox string    // If set, only messages in this mailbox.
+	Start   time.Time // If set, only messages received at or after this time.
+	End     time.Time // If set, only messages received before this time.
+
+	// If set, only messages with this text, case-insensitive, in an address in the
+	// From header, or in the SMTP MAIL FROM.
+	From string
+
+	// If set, only messages with this text, case-insensitive, in an address in the
+	// To, Cc or Bcc headers, or in the SMTP RCPT TO.
+	To string
+
+	// If set, only messages with this text, case-insensitive, in the headers or
+	// (decoded) text parts.
+	Search string
+
+	// Add a file "manifest.json" with an ExportManifest to the archive.
+	Manifest bool
+}
+
+// ExportManifest is added as "manifest.json" to an export if requested, with
+// metadata about the exported messages.
+type ExportManifest struct {
+	Version  int // Currently 1.
+	Created  time.Time
+	Options  ExportOptions
+	Messages []ExportManifestMessage
+}
+
+// ExportManifestMessage holds metadata about an exported message.
+type ExportManifestMessage struct {
+	ID        int64
+	Mailbox   string
+	Path      string // In archive, of maildir message file or mbox file.
+	MboxIndex int    // For mbox, index of the message in the mbox file, starting at 0.
+	UID       UID
+	Received  time.Time
+	Size      int64 // As stored, with CRLF line endings.
+	Flags     Flags
+
+	// From parsed message headers, if available.
+	MessageID string
+	Date      time.Time
+	Subject   string
+	From      []string
+	To        []string
+	CC        []string
+	BCC       []string
+
+	// Delivery and authentication results at time of incoming delivery. Empty for
+	// messages not delivered over SMTP, e.g. imported or sent messages.
+	RemoteIP           string
+	EHLODomain         string
+	MailFrom           string
+	RcptTo             string
+	EHLOValidation     string
+	MailFromValidation string
+	MsgFromValidation  string
+	DKIMDomains        []string
+}
+
+// ParseExportTime parses a date (2006-01-02, in local time) or time (RFC3339) for
+// ExportOptions.Start or End. For an end time, a date selects the end of that day.
+func ParseExportTime(s string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// match returns whether a message with parsed message p matches the From, To and
+// Search options. Reading from msg files happens through p.
+func (o ExportOptions) match(m Message, p *message.Part) (bool, error) {
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	containsAddress := func(l []message.Address, sub string) bool {
+		for _, a := range exportAddresses(l) {
+			if contains(a, sub) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if o.From != "" && !contains(m.MailFrom, o.From) && (p.Envelope == nil || !containsAddress(p.Envelope.From, o.From)) {
+		return false, nil
+	}
+	if o.To != "" {
+		var rcptTo string
+		if m.RcptToDomain != "" {
+			rcptTo = m.RcptToLocalpart.String() + "@" + m.RcptToDomain
+		}
+		env := p.Envelope
+		if !contains(rcptTo, o.To) && (env == nil || !containsAddress(env.To, o.To) && !containsAddress(env.CC, o.To) && !containsAddress(env.BCC, o.To)) {
+			return false, nil
+		}
+	}
+	if o.Search != "" {
+		return exportPartContains(p, strings.ToLower(o.Search), true)
+	}
+	return true, nil
+}
+
+// exportPartContains returns whether the message or part p contains lower, which
+// must be in lower case. The decoded text parts are checked, and the headers if
+// headerToo is set.
+func exportPartContains(p *message.Part, lower string, headerToo bool) (bool, error) {
+	readContains := func(r io.Reader) (bool, error) {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(strings.ToLower(string(buf)), lower), nil
+	}
+
+	if headerToo {
+		if ok, err := readContains(p.HeaderReader()); err != nil || ok {
+			return ok, err
+		}
+	}
+	if len(p.Parts) == 0 {
+		// Without content-type, the part is treated as text/plain.
+		if p.MediaType != "TEXT" && p.MediaType != "" {
+			return false, nil
+		}
+		return readContains(p.Reader())
+	}
+	for _, pp := range p.Parts {
+		headerToo := pp.MediaType == "MESSAGE" && (pp.MediaSubType == "RFC822" || pp.MediaSubType == "GLOBAL")
+		if ok, err := exportPartContains(&pp, lower, headerToo); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// exportPart returns the parsed message for m, parsing the message if it was not
+// yet parsed before.
+func exportPart(m Message, mr *MsgReader) (message.Part, error) {
+	if m.ParsedBuf != nil {
+		return m.LoadPart(mr)
+	}
+	p, err := message.Parse(mr)
+	if err == nil {
+		err = p.Walk(nil)
+	}
+	return p, err
+}
+
+// exportAddresses formats addresses for matching and the manifest.
+func exportAddresses(l []message.Address) []string {
+	var r []string
+	for _, a := range l {
+		s := a.User + "@" + a.Host
+		if a.Name != "" {
+			s = a.Name + " <" + s + ">"
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
 // ExportMessages writes messages to archiver. Either in maildir format, or otherwise in
-// mbox. If mailboxOpt is empty, all mailboxes are exported, otherwise only the
-// named mailbox.
+// mbox. Messages are selected with opts. Encrypted message files are decrypted
+// with msgKey, which is nil for a locked account.
 //
 // Some errors are not fatal and result in skipped messages. In that happens, a
 // file "errors.txt" is added to the archive describing the errors. The goal is to
 // let users export (hopefully) most messages even in the face of errors.
-func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDir string, archiver Archiver, maildir bool, mailboxOpt string) error {
+func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDir string, msgKey *rsa.PrivateKey, archiver Archiver, maildir bool, opts ExportOptions) error {
 	// todo optimize: should prepare next file to add to archive (can be an mbox with many messages) while writing a file to the archive (which typically compresses, which takes time).
 
 	// Start transaction without closure, we are going to close it early, but don't
@@ -138,9 +310,9 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 	}
 
 	var mailboxID int64
-	if mailboxOpt != "" {
+	if opts.Mailbox != "" {
 		var ok bool
-		mailboxID, ok = name2id[mailboxOpt]
+		mailboxID, ok = name2id[opts.Mailbox]
 		if !ok {
 			return fmt.Errorf("mailbox not found")
 		}
@@ -148,7 +320,7 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 
 	var names []string
 	for _, name := range id2name {
-		if mailboxOpt != "" && name != mailboxOpt {
+		if opts.Mailbox != "" && name != opts.Mailbox {
 			continue
 		}
 		names = append(names, name)
@@ -172,6 +344,12 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 	if mailboxID > 0 {
 		q.FilterNonzero(Message{MailboxID: mailboxID})
 	}
+	if !opts.Start.IsZero() {
+		q.FilterGreaterEqual("Received", opts.Start)
+	}
+	if !opts.End.IsZero() {
+		q.FilterLess("Received", opts.End)
+	}
 	msgs, err := q.List()
 	if err != nil {
 		return fmt.Errorf("listing messages: %v", err)
@@ -186,6 +364,42 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 	}
 	tx = nil
 
+	msgReader := func(m Message) *MsgReader {
+		return &MsgReader{prefix: m.MsgPrefix, path: filepath.Join(accountDir, "msg", MessagePath(m.ID)), size: m.Size, compressed: m.Compressed, encrypted: m.Encrypted, key: msgKey}
+	}
+
+	// We keep track of errors reading message files. We continue exporting and add an
+	// errors.txt file to the archive. In case of errors, the user can get (hopefully)
+	// most of their emails, and see something went wrong. For other errors, like
+	// writing to the archiver (e.g. a browser), we abort, because we don't want to
+	// continue with useless work.
+	var errors string
+
+	// Filter the messages on contents. This reads messages that aren't parsed yet, and
+	// the text of all messages when searching, so can take a while.
+	if opts.From != "" || opts.To != "" || opts.Search != "" {
+		var matched []Message
+		for _, m := range msgs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			mr := msgReader(m)
+			p, err := exportPart(m, mr)
+			var ok bool
+			if err == nil {
+				ok, err = opts.match(m, &p)
+			}
+			xerr := mr.Close()
+			log.Check(xerr, "closing message reader after matching")
+			if err != nil {
+				errors += fmt.Sprintf("matching message id %d: %v (message skipped)\n", m.ID, err)
+			} else if ok {
+				matched = append(matched, m)
+			}
+		}
+		msgs = matched
+	}
+
 	// Order the messages by mailbox, received time and finally message ID.
 	sort.Slice(msgs, func(i, j int) bool {
 		iid := msgs[i].MailboxID
@@ -199,15 +413,53 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 		return msgs[i].ID < msgs[j].ID
 	})
 
-	// We keep track of errors reading message files. We continue exporting and add an
-	// errors.txt file to the archive. In case of errors, the user can get (hopefully)
-	// most of their emails, and see something went wrong. For other errors, like
-	// writing to the archiver (e.g. a browser), we abort, because we don't want to
-	// continue with useless work.
-	var errors string
-
 	var curMailboxID int64 // Used to set curMailbox and finish a previous mbox file.
 	var curMailbox string
+	var mboxIndex int // Index of next message in mbox file.
+
+	manifest := ExportManifest{Version: 1, Created: start, Options: opts, Messages: []ExportManifestMessage{}}
+	addManifest := func(m Message, path string, index int) {
+		if !opts.Manifest {
+			return
+		}
+		mm := ExportManifestMessage{
+			ID:          m.ID,
+			Mailbox:     curMailbox,
+			Path:        path,
+			MboxIndex:   index,
+			UID:         m.UID,
+			Received:    m.Received,
+			Size:        m.Size,
+			Flags:       m.Flags,
+			RemoteIP:    m.RemoteIP,
+			EHLODomain:  m.EHLODomain,
+			MailFrom:    m.MailFrom,
+			DKIMDomains: m.DKIMDomains,
+		}
+		if m.RcptToDomain != "" {
+			mm.RcptTo = m.RcptToLocalpart.String() + "@" + m.RcptToDomain
+		}
+		if m.RemoteIP != "" {
+			mm.EHLOValidation = m.EHLOValidation.String()
+			mm.MailFromValidation = m.MailFromValidation.String()
+			mm.MsgFromValidation = m.MsgFromValidation.String()
+		}
+		mr := msgReader(m)
+		if p, err := exportPart(m, mr); err != nil {
+			errors += fmt.Sprintf("parsing message id %d for manifest: %v (headers not in manifest)\n", m.ID, err)
+		} else if env := p.Envelope; env != nil {
+			mm.MessageID = env.MessageID
+			mm.Date = env.Date
+			mm.Subject = env.Subject
+			mm.From = exportAddresses(env.From)
+			mm.To = exportAddresses(env.To)
+			mm.CC = exportAddresses(env.CC)
+			mm.BCC = exportAddresses(env.BCC)
+		}
+		err := mr.Close()
+		log.Check(err, "closing message reader for manifest")
+		manifest.Messages = append(manifest.Messages, mm)
+	}
 
 	var mboxtmp *os.File
 	var mboxwriter *bufio.Writer
@@ -300,7 +552,7 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 		if m.Size == int64(len(m.MsgPrefix)) {
 			mr = io.NopCloser(bytes.NewReader(m.MsgPrefix))
 		} else {
-			mf, err := os.Open(mp)
+			mf, err := openMessageFile(mp, msgKey, m.Compressed, m.Encrypted)
 			if err != nil {
 				errors += fmt.Sprintf("open message file for id %d, path %s: %v (message skipped)\n", m.ID, mp, err)
 				return nil
@@ -309,16 +561,16 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 				err := mf.Close()
 				log.Check(err, "closing message file after export")
 			}()
-			st, err := mf.Stat()
+			fsize, err := messageFileSize(mf)
 			if err != nil {
 				errors += fmt.Sprintf("stat message file for id %d, path %s: %v (message skipped)\n", m.ID, mp, err)
 				return nil
 			}
-			size := st.Size() + int64(len(m.MsgPrefix))
+			size := fsize + int64(len(m.MsgPrefix))
 			if size != m.Size {
-				errors += fmt.Sprintf("message size mismatch for message id %d, database has %d, size is %d+%d=%d, using calculated size\n", m.ID, m.Size, len(m.MsgPrefix), st.Size(), size)
+				errors += fmt.Sprintf("message size mismatch for message id %d, database has %d, size is %d+%d=%d, using calculated size\n", m.ID, m.Size, len(m.MsgPrefix), fsize, size)
 			}
-			mr = FileMsgReader(m.MsgPrefix, mf)
+			mr = &MsgReader{prefix: m.MsgPrefix, path: mp, size: size, f: mf}
 		}
 
 		if maildir {
@@ -400,7 +652,11 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 				log.Check(xerr, "closing message")
 				return fmt.Errorf("copying message to archive: %v", err)
 			}
-			return w.Close()
+			if err := w.Close(); err != nil {
+				return err
+			}
+			addManifest(m, p, 0)
+			return nil
 		}
 
 		mailfrom := "mox"
@@ -496,6 +752,8 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 		if _, err := fmt.Fprint(mboxwriter, "\n"); err != nil {
 			return fmt.Errorf("writing end of message newline: %v", err)
 		}
+		addManifest(m, curMailbox+".mbox", mboxIndex)
+		mboxIndex++
 		return nil
 	}
 
@@ -529,6 +787,7 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 					return fmt.Errorf("removing temp file just created: %v", err)
 				}
 				mboxwriter = bufio.NewWriter(mboxtmp)
+				mboxIndex = 0
 			}
 		}
 
@@ -540,6 +799,28 @@ func ExportMessages(ctx context.Context, log *mlog.Log, db *bstore.DB, accountDi
 		return err
 	}
 
+	if opts.Manifest {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false) // Keep message-ids and addresses readable.
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(manifest); err != nil {
+			return fmt.Errorf("marshal manifest: %v", err)
+		}
+		w, err := archiver.Create("manifest.json", int64(buf.Len()), time.Now())
+		if err != nil {
+			return fmt.Errorf("adding manifest.json to archive: %v", err)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			xerr := w.Close()
+			log.Check(xerr, "closing manifest.json after error")
+			return fmt.Errorf("writing manifest.json: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+
 	if errors != "" {
 		w, err := archiver.Create("errors.txt", int64(len(errors)), time.Now())
 		if err != nil {
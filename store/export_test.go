@@ -4,10 +4,12 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -49,7 +51,7 @@ func TestExport(t *testing.T) {
 
 	archive := func(archiver Archiver, maildir bool) {
 		t.Helper()
-		err = ExportMessages(ctxbg, log, acc.DB, acc.Dir, archiver, maildir, "")
+		err = ExportMessages(ctxbg, log, acc.DB, acc.Dir, nil, archiver, maildir, ExportOptions{})
 		tcheck(t, err, "export messages")
 		err = archiver.Close()
 		tcheck(t, err, "archiver close")
@@ -118,4 +120,115 @@ func TestExport(t *testing.T) {
 
 	checkDirFiles("../testdata/exportmaildir", 2)
 	checkDirFiles("../testdata/exportmbox", 2)
+
+	// Add an older message with headers, and select messages with options.
+	const msg2 = "From: <sender@remote.example>\r\nTo: <mjl@mox.example>\r\nSubject: contract\r\nMessage-Id: <123@remote.example>\r\n\r\nthe terms are attached\r\n"
+	msgFile2, err := os.CreateTemp("", "mox-test-export")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile2.Name()) // To be sure.
+	_, err = msgFile2.Write([]byte(msg2))
+	tcheck(t, err, "write message")
+	received := time.Now().Add(-48 * time.Hour)
+	m = Message{Received: received, Size: int64(len(msg2)), MailFrom: "bounce@remote.example", RemoteIP: "10.0.0.1", MsgFromValidation: ValidationDMARC, DKIMDomains: []string{"remote.example"}, Flags: Flags{Seen: true}}
+	err = acc.DeliverMailbox(xlog, "Inbox", &m, msgFile2, true)
+	tcheck(t, err, "deliver")
+
+	exportManifest := func(opts ExportOptions, maildir bool, expIDs ...int64) {
+		t.Helper()
+		var buf bytes.Buffer
+		opts.Manifest = true
+		zw := zip.NewWriter(&buf)
+		err := ExportMessages(ctxbg, log, acc.DB, acc.Dir, nil, ZipArchiver{zw}, maildir, opts)
+		tcheck(t, err, "export messages")
+		err = zw.Close()
+		tcheck(t, err, "zip close")
+
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		tcheck(t, err, "reading zip")
+		var manifest ExportManifest
+		files := map[string]bool{}
+		for _, f := range r.File {
+			files[f.Name] = true
+			if f.Name == "errors.txt" {
+				t.Fatalf("got errors.txt")
+			} else if f.Name != "manifest.json" {
+				continue
+			}
+			fr, err := f.Open()
+			tcheck(t, err, "open manifest")
+			err = json.NewDecoder(fr).Decode(&manifest)
+			tcheck(t, err, "parse manifest")
+		}
+		var ids []int64
+		for _, mm := range manifest.Messages {
+			ids = append(ids, mm.ID)
+			if !files[mm.Path] {
+				t.Fatalf("manifest path %q not in archive", mm.Path)
+			}
+		}
+		if len(ids) != len(expIDs) {
+			t.Fatalf("got messages %v, expected %v", ids, expIDs)
+		}
+		for i := range ids {
+			if ids[i] != expIDs[i] {
+				t.Fatalf("got messages %v, expected %v", ids, expIDs)
+			}
+		}
+	}
+
+	exportManifest(ExportOptions{}, true, 3, 1, 2)
+	exportManifest(ExportOptions{}, false, 3, 1, 2)
+	exportManifest(ExportOptions{Mailbox: "Inbox"}, false, 3, 1)
+	exportManifest(ExportOptions{End: time.Now().Add(-time.Hour)}, true, 3)
+	exportManifest(ExportOptions{Start: time.Now().Add(-time.Hour)}, true, 1, 2)
+	exportManifest(ExportOptions{From: "SENDER@remote"}, true, 3)
+	exportManifest(ExportOptions{From: "bounce@"}, true, 3)
+	exportManifest(ExportOptions{From: "other"}, true)
+	exportManifest(ExportOptions{To: "mjl@mox.example"}, true, 3)
+	exportManifest(ExportOptions{Search: "Terms"}, true, 3)
+	exportManifest(ExportOptions{Search: "contract", Mailbox: "Trash"}, true)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err = ExportMessages(ctxbg, log, acc.DB, acc.Dir, nil, ZipArchiver{zw}, false, ExportOptions{Search: "test", Manifest: true})
+	tcheck(t, err, "export")
+	err = zw.Close()
+	tcheck(t, err, "zip close")
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	tcheck(t, err, "reading zip")
+	for _, f := range r.File {
+		if f.Name != "manifest.json" {
+			continue
+		}
+		fr, err := f.Open()
+		tcheck(t, err, "open manifest")
+		var manifest ExportManifest
+		err = json.NewDecoder(fr).Decode(&manifest)
+		tcheck(t, err, "parse manifest")
+		if len(manifest.Messages) != 2 || manifest.Messages[0].Path != "Inbox.mbox" || manifest.Messages[1].Path != "Trash.mbox" || manifest.Messages[1].MboxIndex != 0 {
+			t.Fatalf("unexpected manifest messages %#v", manifest.Messages)
+		}
+	}
+
+	// Compressed message files are decoded for matching.
+	conf := mox.Conf.Dynamic.Accounts["mjl"]
+	conf.CompressMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	defer func() {
+		conf.CompressMessages = false
+		mox.Conf.Dynamic.Accounts["mjl"] = conf
+	}()
+	msg3 := "Subject: archive\r\n\r\n" + strings.Repeat("compressible line\r\n", 1000)
+	msgFile3, err := os.CreateTemp("", "mox-test-export")
+	tcheck(t, err, "create temp")
+	defer os.Remove(msgFile3.Name()) // To be sure.
+	_, err = msgFile3.Write([]byte(msg3))
+	tcheck(t, err, "write message")
+	m = Message{Received: time.Now(), Size: int64(len(msg3))}
+	err = acc.DeliverMailbox(xlog, "Inbox", &m, msgFile3, true)
+	tcheck(t, err, "deliver")
+	if !m.Compressed {
+		t.Fatalf("message not compressed")
+	}
+	exportManifest(ExportOptions{Search: "compressible LINE"}, false, m.ID)
 }
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"mime"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/mjl-/bstore"
+)
+
+// SpecialUseMailboxes returns the names of the mailboxes with a special-use flag,
+// keyed by the lower-case IMAP special-use flag, e.g. `\sent`. If multiple
+// mailboxes have the same special-use flag, the first by ID is returned.
+func SpecialUseMailboxes(tx *bstore.Tx) (map[string]string, error) {
+	specialUse := map[string]string{}
+	err := bstore.QueryTx[Mailbox](tx).ForEach(func(mb Mailbox) error {
+		for flag, ok := range map[string]bool{`\archive`: mb.Archive, `\drafts`: mb.Draft, `\junk`: mb.Junk, `\sent`: mb.Sent, `\trash`: mb.Trash} {
+			if ok && specialUse[flag] == "" {
+				specialUse[flag] = mb.Name
+			}
+		}
+		return nil
+	})
+	return specialUse, err
+}
+
+// GmailLabelMailboxes returns the mailboxes to deliver a message with Gmail labels
+// to, as found in X-Gmail-Labels headers in mbox files from Google Takeout.
+//
+// Labels Sent, Spam, Trash, Drafts and Archived are mapped to the mailboxes with
+// the corresponding special-use flag in specialUse (see SpecialUseMailboxes), or
+// to a mailbox with a default name if the account does not have one. Messages
+// labeled Spam or Trash are only delivered to that mailbox. Messages without
+// labels that map to a mailbox, i.e. messages only in Gmail's "All Mail", are
+// delivered to the archive mailbox. Labels that are flags (Opened, Starred, etc,
+// see MboxReader), and labels for categories and Important, for which mox has no
+// equivalent, don't result in a mailbox. Other labels are mailboxes with the same
+// name, with nested labels separated by a slash, like mox mailboxes.
+func GmailLabelMailboxes(labels []string, specialUse map[string]string) []string {
+	special := func(flag, name string) string {
+		if s, ok := specialUse[flag]; ok {
+			return s
+		}
+		return name
+	}
+
+	var mailboxes []string
+	var spam, trash bool
+	for _, label := range labels {
+		var name string
+		switch strings.ToLower(label) {
+		case "inbox":
+			name = "Inbox"
+		case "sent":
+			name = special(`\sent`, "Sent")
+		case "spam":
+			spam = true
+		case "trash":
+			trash = true
+		case "draft", "drafts":
+			name = special(`\drafts`, "Drafts")
+		case "archived":
+			name = special(`\archive`, "Archive")
+		case "opened", "unread", "starred", "important", "chat":
+			// Flags, or no equivalent in mox.
+		default:
+			if strings.HasPrefix(strings.ToLower(label), "category ") {
+				continue
+			}
+			name = norm.NFC.String(strings.Trim(label, "/"))
+			if strings.HasPrefix(strings.ToLower(name), "inbox/") {
+				name = "Inbox/" + name[len("inbox/"):]
+			}
+		}
+		if name == "" {
+			continue
+		}
+		var have bool
+		for _, mb := range mailboxes {
+			have = have || mb == name
+		}
+		if !have {
+			mailboxes = append(mailboxes, name)
+		}
+	}
+	if spam {
+		return []string{special(`\junk`, "Junk")}
+	} else if trash {
+		return []string{special(`\trash`, "Trash")}
+	} else if len(mailboxes) == 0 {
+		return []string{special(`\archive`, "Archive")}
+	}
+	return mailboxes
+}
+
+// gmailLabelFlags returns the flags that are set for gmail labels.
+func gmailLabelFlags(labels []string) Flags {
+	var flags Flags
+	for _, label := range labels {
+		switch strings.ToLower(label) {
+		case "opened":
+			flags.Seen = true
+		case "starred":
+			flags.Flagged = true
+		case "spam":
+			flags.Junk = true
+		case "draft", "drafts":
+			flags.Draft = true
+		}
+	}
+	return flags
+}
+
+// parseGmailLabels parses the value of an X-Gmail-Labels header: comma-separated
+// labels, each possibly in double quotes (if it contains a comma) and possibly
+// with MIME encoded-words for non-ASCII labels.
+func parseGmailLabels(s string) []string {
+	dec := mime.WordDecoder{}
+	var labels []string
+	add := func(label string) {
+		label = strings.TrimSpace(label)
+		if ds, err := dec.DecodeHeader(label); err == nil {
+			label = ds
+		}
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	var label string
+	var quoted bool
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			label += string(s[i])
+		case c == ',' && !quoted:
+			add(label)
+			label = ""
+		default:
+			label += string(c)
+		}
+	}
+	add(label)
+	return labels
+}
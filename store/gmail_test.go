@@ -0,0 +1,72 @@
+package store
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/mlog"
+)
+
+func TestGmailLabels(t *testing.T) {
+	check := func(s string, exp []string) {
+		t.Helper()
+		if l := parseGmailLabels(s); !reflect.DeepEqual(l, exp) {
+			t.Fatalf("parsing gmail labels %q: got %q, expected %q", s, l, exp)
+		}
+	}
+	check("Inbox,Opened", []string{"Inbox", "Opened"})
+	check(`Inbox, "a, b" ,Work/Projects`, []string{"Inbox", "a, b", "Work/Projects"})
+	check("=?UTF-8?Q?Caf=C3=A9?=", []string{"Café"})
+	check("", nil)
+
+	specialUse := map[string]string{`\sent`: "Sent Items"}
+	checkMailboxes := func(labels []string, exp ...string) {
+		t.Helper()
+		if l := GmailLabelMailboxes(labels, specialUse); !reflect.DeepEqual(l, exp) {
+			t.Fatalf("mailboxes for gmail labels %q: got %q, expected %q", labels, l, exp)
+		}
+	}
+	checkMailboxes([]string{"Inbox", "Sent", "Opened", "Important", "Category Personal", "Work"}, "Inbox", "Sent Items", "Work")
+	checkMailboxes([]string{"Opened", "Starred"}, "Archive")
+	checkMailboxes([]string{"INBOX/sub", "Spam"}, "Junk")
+	checkMailboxes([]string{"Work", "Trash"}, "Trash")
+	checkMailboxes([]string{"Work", "Work/"}, "Work")
+
+	mbox := strings.Join([]string{
+		"From 1234@xxx Mon Jan  2 15:04:05 2006",
+		"X-Gmail-Labels: Inbox,Opened,",
+		" Starred",
+		"Subject: test",
+		"",
+		"test",
+		"",
+		"From 1235@xxx Mon Jan  2 15:04:05 2006",
+		"Subject: test",
+		"",
+		"test",
+		"",
+	}, "\n")
+	createTemp := func(pattern string) (*os.File, error) {
+		return os.CreateTemp("", pattern)
+	}
+	mr := NewMboxReader(createTemp, "test.mbox", strings.NewReader(mbox), mlog.New("mboxreader"))
+	m, mf, _, err := mr.Next()
+	tcheck(t, err, "next message")
+	mf.Close()
+	os.Remove(mf.Name())
+	if labels := mr.GmailLabels(); !reflect.DeepEqual(labels, []string{"Inbox", "Opened", "Starred"}) {
+		t.Fatalf("got labels %q", labels)
+	}
+	if m.Flags != (Flags{Seen: true, Flagged: true}) {
+		t.Fatalf("got flags %#v, expected seen and flagged", m.Flags)
+	}
+	_, mf, _, err = mr.Next()
+	tcheck(t, err, "next message")
+	mf.Close()
+	os.Remove(mf.Name())
+	if labels := mr.GmailLabels(); labels != nil {
+		t.Fatalf("got labels %q for message without labels", labels)
+	}
+}
@@ -33,6 +33,7 @@ type MboxReader struct {
 	eof        bool
 	fromLine   string // "From "-line for this message.
 	header     bool   // Now in header section.
+	labels     []string
 }
 
 func NewMboxReader(createTemp func(pattern string) (*os.File, error), filename string, r io.Reader, log *mlog.Log) *MboxReader {
@@ -50,10 +51,18 @@ func (mr *MboxReader) Position() string {
 	return fmt.Sprintf("%s:%d", mr.path, mr.line)
 }
 
+// GmailLabels returns the labels from the X-Gmail-Labels header of the message
+// last returned by Next, as found in mbox files from Google Takeout. Nil if the
+// message had no such header. See GmailLabelMailboxes.
+func (mr *MboxReader) GmailLabels() []string {
+	return mr.labels
+}
+
 // Next returns the next message read from the mbox file. The file is a temporary
 // file and must be removed/consumed. The third return value is the position in the
 // file.
 func (mr *MboxReader) Next() (*Message, *os.File, string, error) {
+	mr.labels = nil
 	if mr.eof {
 		return nil, nil, "", io.EOF
 	}
@@ -93,6 +102,8 @@ func (mr *MboxReader) Next() (*Message, *os.File, string, error) {
 	bf := bufio.NewWriter(f)
 	var flags Flags
 	var size int64
+	var gmailLabels *string // Header value, set while in X-Gmail-Labels header, for continuation lines.
+	var labels []string
 	for {
 		line, err := mr.r.ReadBytes('\n')
 		if err != nil && err != io.EOF {
@@ -106,6 +117,13 @@ func (mr *MboxReader) Next() (*Message, *os.File, string, error) {
 			}
 
 			if mr.header {
+				if gmailLabels != nil && (bytes.HasPrefix(line, []byte(" ")) || bytes.HasPrefix(line, []byte("\t"))) {
+					*gmailLabels += " " + strings.TrimSpace(string(line))
+				} else if gmailLabels != nil {
+					labels = parseGmailLabels(*gmailLabels)
+					gmailLabels = nil
+				}
+
 				// See https://doc.dovecot.org/admin_manual/mailbox_formats/mbox/
 				if bytes.HasPrefix(line, []byte("Status:")) {
 					s := strings.TrimSpace(strings.SplitN(string(line), ":", 2)[1])
@@ -134,6 +152,9 @@ func (mr *MboxReader) Next() (*Message, *os.File, string, error) {
 					for _, t := range strings.Split(s, ",") {
 						flagSet(&flags, strings.ToLower(strings.TrimSpace(t)))
 					}
+				} else if bytes.HasPrefix(bytes.ToLower(line), []byte("x-gmail-labels:")) {
+					s := strings.TrimSpace(strings.SplitN(string(line), ":", 2)[1])
+					gmailLabels = &s
 				}
 			}
 			if bytes.Equal(line, []byte("\r\n")) {
@@ -165,6 +186,14 @@ func (mr *MboxReader) Next() (*Message, *os.File, string, error) {
 		return nil, nil, mr.Position(), fmt.Errorf("flush: %v", err)
 	}
 
+	if gmailLabels != nil {
+		labels = parseGmailLabels(*gmailLabels)
+	}
+	if labels != nil {
+		flags = flags.Set(gmailLabelFlags(labels), gmailLabelFlags(labels))
+		mr.labels = labels
+	}
+
 	m := &Message{Flags: flags, Size: size}
 
 	if t := strings.SplitN(fromLine, " ", 3); len(t) == 3 {
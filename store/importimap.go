@@ -0,0 +1,899 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/imapclient"
+	"github.com/mjl-/mox/junk"
+	"github.com/mjl-/mox/message"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// IMAPImportSource is a remote IMAP server to import messages from, see
+// ImportIMAP.
+type IMAPImportSource struct {
+	Host     string // Hostname with optional port. Default port is 993, or 143 with StartTLS.
+	StartTLS bool   // Connect without TLS and switch to TLS with STARTTLS, instead of immediately using TLS.
+	Username string
+	Password string
+}
+
+// String returns the identifier for the source under which the import state is
+// kept: username and host.
+func (s IMAPImportSource) String() string {
+	return s.Username + " at " + s.Host
+}
+
+// IMAPImportMailbox is the import state of a mailbox on a remote IMAP server.
+// Messages with a UID up to LastUID have been imported. Later imports only fetch
+// newer messages, as long as the UIDValidity of the remote mailbox is unchanged.
+type IMAPImportMailbox struct {
+	ID          int64
+	Source      string `bstore:"nonzero,unique Source+Mailbox"` // See IMAPImportSource.String.
+	Mailbox     string `bstore:"nonzero"`                       // Name on the remote server.
+	UIDValidity uint32
+	LastUID     uint32
+	Updated     time.Time `bstore:"default now"`
+}
+
+// IMAPImportMessage links a message on a remote IMAP server to the message it was
+// imported as. Used to apply flag changes on the remote server in later imports.
+type IMAPImportMessage struct {
+	ID              int64
+	ImportMailboxID int64  `bstore:"nonzero,ref IMAPImportMailbox,index ImportMailboxID+UID"`
+	UID             uint32 // Zero after the UIDValidity of the remote mailbox changed, until the message is found again.
+	MessageID       int64  // No reference, the message may have been removed.
+	RemoteFlags     Flags  // Flags on the remote server at previous import.
+
+	// Hash of Message-ID header and size, to recognize the message after a
+	// UIDValidity change. Nil for messages without Message-ID.
+	Hash []byte
+}
+
+// IMAPImportStats holds the results of an IMAP import.
+type IMAPImportStats struct {
+	Mailboxes    int // Remote mailboxes processed.
+	Messages     int // Messages imported.
+	FlagsChanged int // Previously imported messages with flags changed on the remote server.
+}
+
+// IMAPImportProgress receives progress updates during ImportIMAP, for the total
+// count of messages imported into the (local) mailbox, and for problems that did
+// not cause the import to be aborted.
+type IMAPImportProgress struct {
+	Count   func(mailbox string, count int)
+	Problem func(msg string)
+}
+
+// Maximum number of messages and their total size fetched and delivered in a
+// single transaction.
+const (
+	imapImportBatchMessages = 100
+	imapImportBatchSize     = 32 * 1024 * 1024
+)
+
+// Timeout for each read and write on the connection to the remote IMAP server.
+const imapImportIOTimeout = 2 * time.Minute
+
+// ErrIMAPImportAddress is returned by IMAPImportConnect for a host or port that
+// is not allowed by the configuration.
+var ErrIMAPImportAddress = errors.New("address not allowed for imap import")
+
+// imapImportConn sets a deadline before each read and write, so an unresponsive
+// remote server cannot keep an import hanging.
+type imapImportConn struct {
+	net.Conn
+}
+
+func (c imapImportConn) Read(buf []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(imapImportIOTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(buf)
+}
+
+func (c imapImportConn) Write(buf []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(imapImportIOTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(buf)
+}
+
+// imapImportCheckIP returns an error if ip is loopback, private, link-local or
+// otherwise not a public unicast address, unless allowed by the configuration.
+func imapImportCheckIP(ip net.IP) error {
+	if mox.Conf.Static.IMAPImport.AllowPrivateIPs {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: ip %s is not public", ErrIMAPImportAddress, ip)
+	}
+	return nil
+}
+
+// imapImportCheckPort returns an error if port is not a standard IMAP port, and not
+// allowed by the configuration.
+func imapImportCheckPort(port int) error {
+	if port == 993 || port == 143 {
+		return nil
+	}
+	for _, p := range mox.Conf.Static.IMAPImport.AllowPorts {
+		if p == port {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: port %d, only 993 and 143 are allowed", ErrIMAPImportAddress, port)
+}
+
+// IMAPImportConnect connects and logs in to the remote IMAP server.
+//
+// Only the standard IMAP ports and public IPs can be connected to, unless the
+// configuration allows more. Errors from the connection are logged, but not
+// returned in detail, so imports cannot be used to probe other services.
+func IMAPImportConnect(ctx context.Context, log *mlog.Log, src IMAPImportSource) (*imapclient.Conn, error) {
+	host := src.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if src.StartTLS {
+			host = net.JoinHostPort(host, "143")
+		} else {
+			host = net.JoinHostPort(host, "993")
+		}
+	}
+	hostname, portstr, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, fmt.Errorf("parsing host: %v", err)
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing port: %v", err)
+	}
+	if err := imapImportCheckPort(port); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: hostname}
+
+	// The IP is checked after resolving the name, right before connecting, so DNS
+	// responses cannot point us to another IP than the one checked.
+	dialer := net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, rc syscall.RawConn) error {
+			ipstr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(ipstr)
+			if ip == nil {
+				return fmt.Errorf("bad ip %q", ipstr)
+			}
+			return imapImportCheckIP(ip)
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.Is(err, ErrIMAPImportAddress) && errors.As(err, &opErr) {
+			return nil, opErr.Err
+		}
+		log.Infox("dialing remote imap server for import", err, mlog.Field("host", host))
+		return nil, fmt.Errorf("connecting to remote imap server failed")
+	}
+	conn = imapImportConn{conn}
+	if !src.StartTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			log.Infox("tls handshake with remote imap server for import", err, mlog.Field("host", host))
+			return nil, fmt.Errorf("tls handshake with remote imap server failed")
+		}
+		conn = tlsConn
+	}
+
+	c, err := imapclient.New(conn, false)
+	if err != nil {
+		conn.Close()
+		log.Infox("imap greeting from remote imap server for import", err, mlog.Field("host", host))
+		return nil, fmt.Errorf("no imap greeting from remote server")
+	}
+	defer func() {
+		if c != nil {
+			err := c.Close()
+			log.Check(err, "closing imap connection")
+		}
+	}()
+	if src.StartTLS {
+		if _, _, err := c.Starttls(tlsConfig); err != nil {
+			log.Infox("starttls with remote imap server for import", err, mlog.Field("host", host))
+			return nil, fmt.Errorf("starttls with remote imap server failed")
+		}
+	}
+	if _, _, err := c.Capability(); err != nil {
+		log.Infox("capability command on remote imap server for import", err, mlog.Field("host", host))
+		return nil, fmt.Errorf("capability command on remote imap server failed")
+	}
+	if _, ok := c.CapAvailable[imapclient.CapAuthPlain]; ok {
+		_, _, err = c.AuthenticatePlain(src.Username, src.Password)
+	} else {
+		_, _, err = c.Login(src.Username, src.Password)
+	}
+	if err != nil {
+		log.Infox("login on remote imap server for import", err, mlog.Field("host", host))
+		return nil, fmt.Errorf("login on remote imap server failed, check username and password")
+	}
+	if _, _, err := c.Capability(); err != nil {
+		return nil, fmt.Errorf("capability: %v", err)
+	}
+	xc := c
+	c = nil
+	return xc, nil
+}
+
+// ImportIMAPSource connects to the remote IMAP server and imports its messages,
+// see ImportIMAP.
+func (a *Account) ImportIMAPSource(ctx context.Context, log *mlog.Log, src IMAPImportSource, progress IMAPImportProgress) (IMAPImportStats, error) {
+	c, err := IMAPImportConnect(ctx, log, src)
+	if err != nil {
+		return IMAPImportStats{}, err
+	}
+	defer func() {
+		err := c.Close()
+		log.Check(err, "closing imap connection")
+	}()
+
+	stats, err := a.ImportIMAP(ctx, log, c, src.String(), progress)
+	if err == nil {
+		_, _, err := c.Logout()
+		log.Check(err, "imap logout")
+	}
+	return stats, err
+}
+
+// imapImportHash returns the hash of the Message-ID header and size of msg for
+// IMAPImportMessage.Hash, or nil if msg has no Message-ID.
+func imapImportHash(msg string) []byte {
+	p, err := message.Parse(strings.NewReader(msg))
+	if err != nil {
+		return nil
+	}
+	h, err := p.Header()
+	if err != nil {
+		return nil
+	}
+	msgID := strings.TrimSpace(h.Get("Message-Id"))
+	if msgID == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d", msgID, len(msg))))
+	return sum[:]
+}
+
+// ImportIMAP imports the messages from all mailboxes of logged in IMAP connection
+// c, with their flags and received (internal) date. Keywords for flags known to
+// mox, like $Forwarded and $Junk, are imported, other keywords are ignored.
+// Mailboxes are created as needed, remote special-use mailboxes (e.g. \Sent) are
+// imported into the local mailboxes with the same special-use flag.
+//
+// Messages are delivered in batches, each in its own transaction. The progress is
+// kept in the account database for source. An interrupted import can be restarted,
+// and an import can be repeated, e.g. until the account is switched over to mox:
+// only messages not yet imported are fetched, and flag changes on the remote server
+// to previously imported messages are applied. If the UIDValidity of a remote
+// mailbox changed, all its messages are fetched again, but messages with the same
+// Message-ID and size as a previously imported message are not imported again.
+//
+// The account wlock is taken for each batch.
+// Changes are broadcasted.
+func (a *Account) ImportIMAP(ctx context.Context, log *mlog.Log, c *imapclient.Conn, source string, progress IMAPImportProgress) (stats IMAPImportStats, rerr error) {
+	problem := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Info("imap import problem", mlog.Field("problem", msg))
+		if progress.Problem != nil {
+			progress.Problem(msg)
+		}
+	}
+
+	// With UTF8=ACCEPT, mailbox names are UTF-8 instead of modified UTF-7.
+	var utf8 bool
+	if _, ok := c.CapAvailable[imapclient.CapUTF8Accept]; ok {
+		if _, _, err := c.Enable(string(imapclient.CapUTF8Accept)); err == nil {
+			utf8 = true
+		} else {
+			log.Debugx("enabling utf8=accept, continuing", err)
+		}
+	}
+
+	untagged, _, err := c.List("*")
+	if err != nil {
+		return stats, fmt.Errorf("listing mailboxes: %v", err)
+	}
+
+	// Local mailboxes with special-use flags.
+	var specialUse map[string]string
+	err = a.DB.Read(ctx, func(tx *bstore.Tx) error {
+		specialUse, err = SpecialUseMailboxes(tx)
+		return err
+	})
+	if err != nil {
+		return stats, fmt.Errorf("listing special-use mailboxes: %v", err)
+	}
+
+	for _, u := range untagged {
+		l, ok := u.(imapclient.UntaggedList)
+		if !ok {
+			continue
+		}
+		var skip bool
+		var local string
+		for _, f := range l.Flags {
+			switch strings.ToLower(f) {
+			case `\noselect`, `\nonexistent`:
+				skip = true
+			case `\archive`, `\drafts`, `\junk`, `\sent`, `\trash`:
+				if name, ok := specialUse[strings.ToLower(f)]; ok {
+					local = name
+				}
+			}
+		}
+		if skip {
+			continue
+		}
+		if local == "" {
+			local, err = imapImportMailboxName(l.Mailbox, l.Separator, utf8)
+			if err != nil {
+				problem("mailbox %q: %v (skipping)", l.Mailbox, err)
+				continue
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err := a.importIMAPMailbox(ctx, log, c, source, l.Mailbox, local, progress, problem, &stats); err != nil {
+			return stats, fmt.Errorf("mailbox %q: %w", l.Mailbox, err)
+		}
+		stats.Mailboxes++
+	}
+	return stats, nil
+}
+
+// importIMAPMailbox imports new messages and flag changes from remote mailbox into
+// local mailbox.
+func (a *Account) importIMAPMailbox(ctx context.Context, log *mlog.Log, c *imapclient.Conn, source, remote, local string, progress IMAPImportProgress, problem func(format string, args ...any), stats *IMAPImportStats) error {
+	untagged, _, err := c.Examine(remote)
+	if err != nil {
+		return fmt.Errorf("examine: %v", err)
+	}
+	var uidValidity, exists uint32
+	for _, u := range untagged {
+		switch x := u.(type) {
+		case imapclient.UntaggedResult:
+			if arg, ok := x.CodeArg.(imapclient.CodeUint); ok && arg.Code == "UIDVALIDITY" {
+				uidValidity = arg.Num
+			}
+		case imapclient.UntaggedExists:
+			exists = uint32(x)
+		}
+	}
+	if uidValidity == 0 {
+		return fmt.Errorf("missing uidvalidity")
+	}
+
+	var state IMAPImportMailbox
+	err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		q := bstore.QueryTx[IMAPImportMailbox](tx)
+		q.FilterNonzero(IMAPImportMailbox{Source: source, Mailbox: remote})
+		var err error
+		state, err = q.Get()
+		if err == bstore.ErrAbsent {
+			state = IMAPImportMailbox{Source: source, Mailbox: remote, UIDValidity: uidValidity}
+			return tx.Insert(&state)
+		} else if err != nil {
+			return err
+		}
+		if state.UIDValidity == uidValidity {
+			return nil
+		}
+		problem("mailbox %q: uidvalidity changed, fetching all messages again", remote)
+		// Previously imported messages with a hash are kept with UID 0, so they are
+		// recognized and not imported again.
+		qm := bstore.QueryTx[IMAPImportMessage](tx)
+		qm.FilterNonzero(IMAPImportMessage{ImportMailboxID: state.ID})
+		qm.FilterFn(func(im IMAPImportMessage) bool { return im.Hash == nil })
+		if _, err := qm.Delete(); err != nil {
+			return fmt.Errorf("removing previously imported messages: %v", err)
+		}
+		qm = bstore.QueryTx[IMAPImportMessage](tx)
+		qm.FilterNonzero(IMAPImportMessage{ImportMailboxID: state.ID})
+		if _, err := qm.UpdateField("UID", uint32(0)); err != nil {
+			return fmt.Errorf("updating previously imported messages: %v", err)
+		}
+		state.UIDValidity = uidValidity
+		state.LastUID = 0
+		return tx.Update(&state)
+	})
+	if err != nil {
+		return fmt.Errorf("import state: %v", err)
+	}
+	if exists == 0 {
+		return nil
+	}
+
+	if state.LastUID > 0 {
+		n, err := a.importIMAPFlags(ctx, log, c, state)
+		if err != nil {
+			return fmt.Errorf("updating flags: %v", err)
+		}
+		stats.FlagsChanged += n
+	}
+
+	// Gather UIDs and sizes of the new messages. The range always matches the last
+	// message, even if it was already imported.
+	untagged, _, err = c.Transactf("uid fetch %d:* (uid rfc822.size)", state.LastUID+1)
+	if err != nil {
+		return fmt.Errorf("fetching new message uids: %v", err)
+	}
+	type newMessage struct {
+		uid  uint32
+		size int64
+	}
+	var msgs []newMessage
+	for _, u := range untagged {
+		f, ok := u.(imapclient.UntaggedFetch)
+		if !ok {
+			continue
+		}
+		var nm newMessage
+		for _, attr := range f.Attrs {
+			switch x := attr.(type) {
+			case imapclient.FetchUID:
+				nm.uid = uint32(x)
+			case imapclient.FetchRFC822Size:
+				nm.size = int64(x)
+			}
+		}
+		if nm.uid > state.LastUID {
+			msgs = append(msgs, nm)
+		}
+	}
+
+	var count int
+	for len(msgs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := 1
+		size := msgs[0].size
+		for n < len(msgs) && n < imapImportBatchMessages && size+msgs[n].size <= imapImportBatchSize {
+			size += msgs[n].size
+			n++
+		}
+		var uids []string
+		for _, nm := range msgs[:n] {
+			uids = append(uids, fmt.Sprintf("%d", nm.uid))
+		}
+		msgs = msgs[n:]
+
+		untagged, _, err := c.Transactf("uid fetch %s (uid flags internaldate body.peek[])", strings.Join(uids, ","))
+		if err != nil {
+			return fmt.Errorf("fetching messages: %v", err)
+		}
+		delivered, err := a.importIMAPBatch(ctx, log, &state, local, untagged, problem)
+		if err != nil {
+			return err
+		}
+		count += delivered
+		stats.Messages += delivered
+		if progress.Count != nil {
+			progress.Count(local, count)
+		}
+	}
+
+	// Previously imported messages that were not found after a UIDValidity change
+	// are gone from the remote mailbox.
+	err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+		qm := bstore.QueryTx[IMAPImportMessage](tx)
+		qm.FilterNonzero(IMAPImportMessage{ImportMailboxID: state.ID})
+		qm.FilterEqual("UID", uint32(0))
+		_, err := qm.Delete()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("removing previously imported messages: %v", err)
+	}
+	return nil
+}
+
+// importIMAPBatch delivers the messages in untagged fetch responses to mailbox,
+// and updates the import state.
+func (a *Account) importIMAPBatch(ctx context.Context, log *mlog.Log, state *IMAPImportMailbox, mailbox string, untagged []imapclient.Untagged, problem func(format string, args ...any)) (int, error) {
+	type fetched struct {
+		uid      uint32
+		flags    Flags
+		received time.Time
+		hash     []byte
+		f        *os.File
+	}
+	var msgs []fetched
+	defer func() {
+		for _, fm := range msgs {
+			err := os.Remove(fm.f.Name())
+			log.Check(err, "removing temporary message file")
+			err = fm.f.Close()
+			log.Check(err, "closing temporary message file")
+		}
+	}()
+
+	var lastUID uint32
+	for _, u := range untagged {
+		fu, ok := u.(imapclient.UntaggedFetch)
+		if !ok {
+			continue
+		}
+		var fm fetched
+		var body *string
+		for _, attr := range fu.Attrs {
+			switch x := attr.(type) {
+			case imapclient.FetchUID:
+				fm.uid = uint32(x)
+			case imapclient.FetchFlags:
+				fm.flags = imapImportFlags(x)
+			case imapclient.FetchInternalDate:
+				t, err := time.Parse("_2-Jan-2006 15:04:05 -0700", string(x))
+				if err != nil {
+					log.Debugx("parsing internal date, continuing", err, mlog.Field("internaldate", string(x)))
+				} else {
+					fm.received = t
+				}
+			case imapclient.FetchBody:
+				if x.Section == "" || x.Section == "[]" {
+					body = &x.Body
+				}
+			}
+		}
+		if fm.uid > lastUID {
+			lastUID = fm.uid
+		}
+		if fm.uid <= state.LastUID {
+			// Server sent an unrequested fetch response.
+			continue
+		}
+		if body == nil {
+			problem("mailbox %q: message with uid %d: missing message in fetch response (skipping)", state.Mailbox, fm.uid)
+			continue
+		}
+		fm.hash = imapImportHash(*body)
+		f, err := CreateMessageTemp("imapimport")
+		if err != nil {
+			return 0, fmt.Errorf("creating temporary file: %v", err)
+		}
+		fm.f = f
+		msgs = append(msgs, fm)
+		if _, err := f.Write([]byte(*body)); err != nil {
+			return 0, fmt.Errorf("writing temporary file: %v", err)
+		}
+	}
+	if lastUID <= state.LastUID {
+		return 0, nil
+	}
+
+	var changes []Change
+	var jf *junk.Filter
+	var newIDs []int64
+	var err error
+	a.WithWLock(func() {
+		defer func() {
+			if jf != nil {
+				err := jf.CloseDiscard()
+				log.Check(err, "closing junk filter")
+			}
+		}()
+
+		err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			mb, chl, err := a.MailboxEnsure(tx, mailbox, true)
+			if err != nil {
+				return fmt.Errorf("ensuring mailbox: %w", err)
+			}
+			changes = append(changes, chl...)
+
+			for _, fm := range msgs {
+				// Recognize messages imported before a UIDValidity change.
+				if fm.hash != nil {
+					q := bstore.QueryTx[IMAPImportMessage](tx)
+					q.FilterNonzero(IMAPImportMessage{ImportMailboxID: state.ID})
+					q.FilterEqual("UID", uint32(0))
+					q.FilterFn(func(im IMAPImportMessage) bool { return bytes.Equal(im.Hash, fm.hash) })
+					q.Limit(1)
+					im, err := q.Get()
+					if err == nil {
+						im.UID = fm.uid
+						im.RemoteFlags = fm.flags
+						if err := tx.Update(&im); err != nil {
+							return fmt.Errorf("updating previously imported message: %v", err)
+						}
+						continue
+					} else if err != bstore.ErrAbsent {
+						return fmt.Errorf("looking up previously imported message: %v", err)
+					}
+				}
+
+				fi, err := fm.f.Stat()
+				if err != nil {
+					return fmt.Errorf("stat temporary file: %v", err)
+				}
+				m := Message{
+					MailboxID:     mb.ID,
+					MailboxOrigID: mb.ID,
+					Received:      fm.received,
+					Flags:         fm.flags,
+					Size:          fi.Size(),
+				}
+				if m.Received.IsZero() {
+					m.Received = time.Now()
+				}
+				// We keep the file for training ourselves, with a single opened junk filter
+				// instead of one for each message.
+				if err := a.DeliverMessage(log, tx, &m, fm.f, false, mb.Sent, false, true); err != nil {
+					return fmt.Errorf("delivering message with uid %d: %w", fm.uid, err)
+				}
+				newIDs = append(newIDs, m.ID)
+				if m.NeedsTraining() {
+					if jf == nil {
+						jf, _, err = a.OpenJunkFilter(ctx, log)
+						if err != nil && errors.Is(err, ErrNoJunkFilter) {
+							jf = nil
+						} else if err != nil {
+							return fmt.Errorf("open junk filter: %v", err)
+						}
+					}
+					if jf != nil {
+						if err := a.retrainMessage(ctx, log, tx, jf, &m, false, FileMsgReader(m.MsgPrefix, fm.f)); err != nil {
+							return fmt.Errorf("training junk filter: %v", err)
+						}
+					}
+				}
+				im := IMAPImportMessage{ImportMailboxID: state.ID, UID: fm.uid, MessageID: m.ID, RemoteFlags: fm.flags, Hash: fm.hash}
+				if err := tx.Insert(&im); err != nil {
+					return fmt.Errorf("inserting imported message: %v", err)
+				}
+				changes = append(changes, ChangeAddUID{m.MailboxID, m.UID, m.Flags})
+			}
+
+			st := *state
+			st.LastUID = lastUID
+			st.Updated = time.Now()
+			if err := tx.Update(&st); err != nil {
+				return fmt.Errorf("updating import state: %v", err)
+			}
+			*state = st
+			return nil
+		})
+		if err != nil {
+			for _, id := range newIDs {
+				p := a.MessagePath(id)
+				err := os.Remove(p)
+				log.Check(err, "removing message file after error", mlog.Field("path", p))
+			}
+			return
+		}
+		if jf != nil {
+			err = jf.Close()
+			jf = nil
+			if err != nil {
+				err = fmt.Errorf("saving junk filter: %v", err)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+
+	return len(newIDs), nil
+}
+
+// importIMAPFlags applies changes to flags of previously imported messages on the
+// remote server to the local messages. Only flags that changed remotely since the
+// previous import are changed, local changes to other flags are kept. Returns the
+// number of messages updated.
+func (a *Account) importIMAPFlags(ctx context.Context, log *mlog.Log, c *imapclient.Conn, state IMAPImportMailbox) (int, error) {
+	untagged, _, err := c.Transactf("uid fetch 1:%d (uid flags)", state.LastUID)
+	if err != nil {
+		return 0, fmt.Errorf("fetching flags: %v", err)
+	}
+	remoteFlags := map[uint32]Flags{}
+	for _, u := range untagged {
+		f, ok := u.(imapclient.UntaggedFetch)
+		if !ok {
+			continue
+		}
+		var uid uint32
+		var flags Flags
+		for _, attr := range f.Attrs {
+			switch x := attr.(type) {
+			case imapclient.FetchUID:
+				uid = uint32(x)
+			case imapclient.FetchFlags:
+				flags = imapImportFlags(x)
+			}
+		}
+		remoteFlags[uid] = flags
+	}
+
+	var n int
+	var changes []Change
+	a.WithWLock(func() {
+		err = a.DB.Write(ctx, func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[IMAPImportMessage](tx)
+			q.FilterNonzero(IMAPImportMessage{ImportMailboxID: state.ID})
+			imported, err := q.List()
+			if err != nil {
+				return fmt.Errorf("listing imported messages: %v", err)
+			}
+
+			var retrain []Message
+			for _, im := range imported {
+				flags, ok := remoteFlags[im.UID]
+				if !ok || flags == im.RemoteFlags {
+					// Expunged remotely, or unchanged.
+					continue
+				}
+				mask := flagsDiff(im.RemoteFlags, flags)
+				im.RemoteFlags = flags
+				if err := tx.Update(&im); err != nil {
+					return fmt.Errorf("updating imported message: %v", err)
+				}
+
+				m := Message{ID: im.MessageID}
+				if err := tx.Get(&m); err == bstore.ErrAbsent {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("get message: %v", err)
+				}
+				nflags := m.Flags.Set(mask, flags)
+				if nflags == m.Flags {
+					continue
+				}
+				m.Flags = nflags
+				if err := tx.Update(&m); err != nil {
+					return fmt.Errorf("updating message flags: %v", err)
+				}
+				changes = append(changes, ChangeFlags{MailboxID: m.MailboxID, UID: m.UID, Mask: mask, Flags: m.Flags})
+				if m.NeedsTraining() {
+					retrain = append(retrain, m)
+				}
+				n++
+			}
+			return a.RetrainMessages(ctx, log, tx, retrain, true)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	comm := RegisterComm(a)
+	defer comm.Unregister()
+	comm.Broadcast(changes)
+
+	return n, nil
+}
+
+// flagsDiff returns a mask with the flags that differ between a and b.
+func flagsDiff(a, b Flags) Flags {
+	return Flags{
+		Seen:      a.Seen != b.Seen,
+		Answered:  a.Answered != b.Answered,
+		Flagged:   a.Flagged != b.Flagged,
+		Forwarded: a.Forwarded != b.Forwarded,
+		Junk:      a.Junk != b.Junk,
+		Notjunk:   a.Notjunk != b.Notjunk,
+		Deleted:   a.Deleted != b.Deleted,
+		Draft:     a.Draft != b.Draft,
+		Phishing:  a.Phishing != b.Phishing,
+		MDNSent:   a.MDNSent != b.MDNSent,
+	}
+}
+
+// imapImportFlags returns the flags for IMAP system flags and keywords. Unknown
+// keywords are ignored.
+func imapImportFlags(l []string) Flags {
+	var flags Flags
+	for _, f := range l {
+		f = strings.ToLower(f)
+		switch f {
+		case `\seen`:
+			flags.Seen = true
+		case `\answered`:
+			flags.Answered = true
+		case `\flagged`:
+			flags.Flagged = true
+		case `\deleted`:
+			flags.Deleted = true
+		case `\draft`:
+			flags.Draft = true
+		default:
+			flagSet(&flags, f)
+		}
+	}
+	return flags
+}
+
+// imapImportMailboxName returns the local mailbox name for a remote mailbox name
+// with hierarchy separator sep. If the name is not utf8, it is decoded from
+// modified UTF-7.
+func imapImportMailboxName(name string, sep byte, utf8 bool) (string, error) {
+	if !utf8 {
+		var err error
+		name, err = imapUTF7Decode(name)
+		if err != nil {
+			return "", err
+		}
+	}
+	if sep != 0 && sep != '/' {
+		name = strings.ReplaceAll(name, string(rune(sep)), "/")
+	}
+	name = norm.NFC.String(name)
+	if strings.EqualFold(name, "inbox") {
+		name = "Inbox"
+	} else if strings.HasPrefix(strings.ToLower(name), "inbox/") {
+		name = "Inbox/" + name[len("inbox/"):]
+	}
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+		return "", fmt.Errorf("invalid mailbox name")
+	}
+	return name, nil
+}
+
+// imapUTF7Decode decodes a mailbox name in modified UTF-7, RFC 3501 section 5.1.3.
+func imapUTF7Decode(s string) (string, error) {
+	encoding := base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+	var r strings.Builder
+	for {
+		i := strings.IndexByte(s, '&')
+		if i < 0 {
+			r.WriteString(s)
+			return r.String(), nil
+		}
+		r.WriteString(s[:i])
+		s = s[i+1:]
+		j := strings.IndexByte(s, '-')
+		if j < 0 {
+			return "", fmt.Errorf("utf7: unfinished shift")
+		}
+		if j == 0 {
+			r.WriteByte('&')
+		} else {
+			buf, err := encoding.DecodeString(s[:j])
+			if err != nil || len(buf)%2 != 0 {
+				return "", fmt.Errorf("utf7: bad base64 %q", s[:j])
+			}
+			u := make([]uint16, len(buf)/2)
+			for k := range u {
+				u[k] = uint16(buf[2*k])<<8 | uint16(buf[2*k+1])
+			}
+			r.WriteString(string(utf16.Decode(u)))
+		}
+		s = s[j+1:]
+	}
+}
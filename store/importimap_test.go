@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestIMAPImportConnect(t *testing.T) {
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	log := mlog.New("store")
+
+	connect := func(host string, startTLS bool) error {
+		t.Helper()
+		src := IMAPImportSource{Host: host, StartTLS: startTLS, Username: "mjl", Password: "test1234"}
+		c, err := IMAPImportConnect(context.Background(), log, src)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	// Only standard ports, and no loopback/private/link-local IPs.
+	for _, host := range []string{"127.0.0.1:25", "127.0.0.1", "10.0.0.1:993", "192.168.1.1:143", "169.254.1.1", "[::1]:993", "[fe80::1]:993", "0.0.0.0"} {
+		if err := connect(host, false); !errors.Is(err, ErrIMAPImportAddress) {
+			t.Fatalf("connect to %s, got err %v, expected ErrIMAPImportAddress", host, err)
+		}
+	}
+
+	// Server that does not speak IMAP. Details about its response must not be returned
+	// to the user.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tcheck(t, err, "listen")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "* BYE secret internal service\r\n")
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// Allowed by configuration.
+	imapImport := mox.Conf.Static.IMAPImport
+	defer func() {
+		mox.Conf.Static.IMAPImport = imapImport
+	}()
+	mox.Conf.Static.IMAPImport.AllowPrivateIPs = true
+	if err := connect(ln.Addr().String(), true); !errors.Is(err, ErrIMAPImportAddress) {
+		t.Fatalf("connect to not allowed port, got err %v, expected ErrIMAPImportAddress", err)
+	}
+	mox.Conf.Static.IMAPImport.AllowPorts = []int{port}
+	err = connect(ln.Addr().String(), true)
+	if err == nil || errors.Is(err, ErrIMAPImportAddress) {
+		t.Fatalf("connect to allowed address, got err %v, expected error about greeting", err)
+	} else if strings.Contains(err.Error(), "bye") || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("error %q contains details about response of remote server", err)
+	}
+}
@@ -0,0 +1,326 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+// RenameAccount renames an account: its data directory and its name in the
+// configuration, including the references for DMARC and TLS reports, see
+// mox.AccountRename. The account cannot be renamed while it is open, e.g. by an
+// IMAP session: the name and paths of an open account are used without locking.
+// The account cannot be opened while it is being renamed.
+//
+// The sender account of messages in the queue must be updated by the caller, see
+// queue.RenameAccount.
+func RenameAccount(ctx context.Context, log *mlog.Log, account, newName string) (rerr error) {
+	openAccounts.Lock()
+	defer openAccounts.Unlock()
+	if _, ok := openAccounts.names[account]; ok {
+		return fmt.Errorf("account is in use, e.g. by imap sessions, try again later")
+	}
+	if _, ok := openAccounts.names[newName]; ok {
+		return fmt.Errorf("account %q is in use", newName)
+	}
+
+	basePath := mox.DataDirPath("accounts")
+	dir := filepath.Join(basePath, account)
+	ndir := filepath.Join(basePath, newName)
+	if _, err := os.Stat(ndir); err == nil {
+		return fmt.Errorf("data directory %s for new account name already exists", ndir)
+	}
+	var renamed bool
+	if err := os.Rename(dir, ndir); err == nil {
+		renamed = true
+	} else if !os.IsNotExist(err) {
+		// Account without data directory has not been used yet.
+		return fmt.Errorf("renaming account data directory: %v", err)
+	}
+
+	if err := mox.AccountRename(ctx, account, newName); err != nil {
+		if renamed {
+			xerr := os.Rename(ndir, dir)
+			log.Check(xerr, "renaming account data directory back after error")
+		}
+		return err
+	}
+	return nil
+}
+
+// MoveAddress moves an address to another account in the configuration, see
+// mox.AddressMove. If moveMessages is set, messages delivered to the address are
+// moved to the account too, see MoveAddressMessages. Returns the number of
+// messages moved.
+func MoveAddress(ctx context.Context, log *mlog.Log, address, account string, moveMessages bool) (int, error) {
+	if moveMessages && strings.HasPrefix(address, "@") {
+		return 0, fmt.Errorf("cannot move messages for catchall address")
+	}
+	oldAccount, err := mox.AddressMove(ctx, address, account)
+	if err != nil || !moveMessages {
+		return 0, err
+	}
+
+	src, err := OpenAccount(oldAccount)
+	if err != nil {
+		return 0, fmt.Errorf("open account: %w", err)
+	}
+	defer func() {
+		err := src.Close()
+		log.Check(err, "closing account after moving messages")
+	}()
+	dst, err := OpenAccount(account)
+	if err != nil {
+		return 0, fmt.Errorf("open account: %w", err)
+	}
+	defer func() {
+		err := dst.Close()
+		log.Check(err, "closing account after moving messages")
+	}()
+	n, err := MoveAddressMessages(log, src, dst, address)
+	if err != nil {
+		return n, fmt.Errorf("address moved, but moving messages: %w", err)
+	}
+	return n, nil
+}
+
+// MoveMailboxTree moves the messages in mailbox name and its child mailboxes from
+// account src to mailboxes with the same names in account dst, and removes the
+// mailboxes from src. The Inbox is not removed, only emptied. Returns the number of
+// messages moved.
+//
+// Write locks of both accounts are taken.
+// Changes are broadcasted.
+func MoveMailboxTree(log *mlog.Log, src, dst *Account, name string) (int, error) {
+	match := func(mb Mailbox) bool {
+		return mb.Name == name || strings.HasPrefix(mb.Name, name+"/")
+	}
+	return moveMessages(log, src, dst, match, nil, true)
+}
+
+// MoveAddressMessages moves the messages in account src that were delivered to
+// address to account dst, in mailboxes with the same names. Typically used after
+// moving an address to another account, see mox.AddressMove. Catchall addresses
+// are not supported. Returns the number of messages moved.
+//
+// Write locks of both accounts are taken.
+// Changes are broadcasted.
+func MoveAddressMessages(log *mlog.Log, src, dst *Account, address string) (int, error) {
+	addr, err := smtp.ParseAddress(address)
+	if err != nil {
+		return 0, fmt.Errorf("parsing address: %v", err)
+	}
+	dc, ok := mox.Conf.Domain(addr.Domain)
+	if !ok {
+		return 0, fmt.Errorf("unknown domain")
+	}
+	lp, err := mox.CanonicalLocalpart(addr.Localpart, dc)
+	if err != nil {
+		return 0, fmt.Errorf("canonical localpart: %v", err)
+	}
+
+	matchMessage := func(m Message) bool {
+		d, err := dns.ParseDomain(m.RcptToDomain)
+		if err != nil || d != addr.Domain {
+			return false
+		}
+		mlp, err := mox.CanonicalLocalpart(m.RcptToLocalpart, dc)
+		return err == nil && mlp == lp
+	}
+	all := func(mb Mailbox) bool { return true }
+	return moveMessages(log, src, dst, all, matchMessage, false)
+}
+
+// moveMessages moves messages in mailboxes of src matching matchMailbox, and
+// matching matchMessage if not nil, to dst. If removeMailboxes is set, the
+// matching mailboxes are removed from src after their messages have been moved.
+func moveMessages(log *mlog.Log, src, dst *Account, matchMailbox func(mb Mailbox) bool, matchMessage func(m Message) bool, removeMailboxes bool) (int, error) {
+	if src == dst {
+		return 0, fmt.Errorf("source and destination account are the same")
+	}
+
+	// Take locks in order of name, to prevent deadlocks.
+	if src.Name < dst.Name {
+		src.Lock()
+		dst.Lock()
+	} else {
+		dst.Lock()
+		src.Lock()
+	}
+	defer src.Unlock()
+	defer dst.Unlock()
+
+	var srcChanges, dstChanges []Change
+	defer func() {
+		if len(srcChanges) > 0 {
+			comm := RegisterComm(src)
+			comm.Broadcast(srcChanges)
+			comm.Unregister()
+		}
+		if len(dstChanges) > 0 {
+			comm := RegisterComm(dst)
+			comm.Broadcast(dstChanges)
+			comm.Unregister()
+		}
+	}()
+
+	var mailboxes []Mailbox
+	err := src.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+		var err error
+		mailboxes, err = bstore.QueryTx[Mailbox](tx).FilterFn(matchMailbox).SortAsc("Name").List()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("listing mailboxes: %w", err)
+	}
+	if removeMailboxes && len(mailboxes) == 0 {
+		return 0, fmt.Errorf("mailbox not found")
+	}
+
+	var n int
+	for _, mb := range mailboxes {
+		var msgs []Message
+		err := src.DB.Read(context.TODO(), func(tx *bstore.Tx) error {
+			q := bstore.QueryTx[Message](tx)
+			q.FilterNonzero(Message{MailboxID: mb.ID})
+			if matchMessage != nil {
+				q.FilterFn(matchMessage)
+			}
+			q.SortAsc("UID")
+			var err error
+			msgs, err = q.List()
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("listing messages in mailbox %q: %w", mb.Name, err)
+		}
+		if len(msgs) == 0 && !removeMailboxes {
+			continue
+		}
+
+		// Add the messages to dst. If we fail halfway, the transaction is rolled back and
+		// new message files are removed, leaving src untouched.
+		var newPaths []string
+		now := time.Now()
+		err = dst.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+			dmb, chl, err := dst.MailboxEnsure(tx, mb.Name, true)
+			if err != nil {
+				return fmt.Errorf("ensuring mailbox: %w", err)
+			}
+			for _, m := range msgs {
+				nm := m
+				nm.ID = 0
+				nm.UID = 0
+				nm.MailboxID = dmb.ID
+				nm.MailboxOrigID = dmb.ID
+				nm.MailboxDestinedID = 0
+				nm.TrainedJunk = nil
+				nm.Moved = now
+				if err := src.deliverCopy(log, tx, dst, m.ID, &nm, dmb.Sent); err != nil {
+					return fmt.Errorf("adding message %d: %w", m.ID, err)
+				}
+				newPaths = append(newPaths, dst.MessagePath(nm.ID))
+				chl = append(chl, ChangeAddUID{nm.MailboxID, nm.UID, nm.Flags})
+			}
+			dstChanges = append(dstChanges, chl...)
+			return nil
+		})
+		if err != nil {
+			for _, p := range newPaths {
+				err := os.Remove(p)
+				log.Check(err, "removing new message file after error", mlog.Field("path", p))
+			}
+			return n, fmt.Errorf("moving messages of mailbox %q: %w", mb.Name, err)
+		}
+
+		// Remove the messages, and possibly the mailbox, from src.
+		err = src.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+			chl, err := src.removeMessages(context.TODO(), log, tx, &mb, msgs, true)
+			if err != nil {
+				return fmt.Errorf("removing messages: %w", err)
+			}
+			if removeMailboxes && mb.Name != "Inbox" {
+				if err := tx.Delete(&mb); err != nil {
+					return fmt.Errorf("removing mailbox: %w", err)
+				}
+				chl = append(chl, ChangeRemoveMailbox{mb.Name})
+			}
+			srcChanges = append(srcChanges, chl...)
+			return nil
+		})
+		if err != nil {
+			// Messages are present in both accounts now, we don't lose data.
+			return n, fmt.Errorf("removing moved messages from mailbox %q: %w", mb.Name, err)
+		}
+		for _, m := range msgs {
+			p := src.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file after moving to other account", mlog.Field("path", p))
+		}
+		n += len(msgs)
+	}
+	return n, nil
+}
+
+// deliverCopy delivers message file id of account a as message m to account dst.
+// Plain message files are hardlinked. Compressed and encrypted message files are
+// decoded first, so dst can store them according to its own configuration.
+func (a *Account) deliverCopy(log *mlog.Log, tx *bstore.Tx, dst *Account, id int64, m *Message, isSent bool) error {
+	p := a.MessagePath(id)
+	if !m.Compressed && !m.Encrypted {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("open message file: %w", err)
+		}
+		defer func() {
+			err := f.Close()
+			log.Check(err, "closing message file")
+		}()
+		return dst.DeliverMessage(log, tx, m, f, false, isSent, true, false)
+	}
+
+	// An encrypted parsed message can only be read with the key of this account, dst
+	// gets the plaintext and stores it according to its own configuration.
+	parsed, err := m.parsedPlaintext(a.MessageKey())
+	if err != nil {
+		return fmt.Errorf("parsed message: %w", err)
+	}
+	mf, err := openMessageFile(p, a.MessageKey(), m.Compressed, m.Encrypted)
+	if err != nil {
+		return fmt.Errorf("open message file: %w", err)
+	}
+	defer mf.Close()
+	size, err := messageFileSize(mf)
+	if err != nil {
+		return fmt.Errorf("size of message file: %w", err)
+	}
+	tf, err := CreateMessageTemp("move")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		err := tf.Close()
+		log.Check(err, "closing temporary file")
+		if err := os.Remove(tf.Name()); err != nil && !os.IsNotExist(err) {
+			log.Errorx("removing temporary file", err, mlog.Field("path", tf.Name()))
+		}
+	}()
+	if _, err := io.Copy(tf, io.NewSectionReader(mf, 0, size)); err != nil {
+		return fmt.Errorf("decoding message file: %w", err)
+	}
+	m.ParsedBuf = parsed
+	m.Compressed = false
+	m.Encrypted = false
+	return dst.DeliverMessage(log, tx, m, tf, true, isSent, true, false)
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+	"github.com/mjl-/mox/smtp"
+)
+
+func TestMoveMessages(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	src, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer src.Close()
+	dst, err := OpenAccount("mjl2")
+	tcheck(t, err, "open account")
+	defer dst.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	msg := "Subject: test\r\n\r\ntest message\r\n"
+	deliver := func(mailbox string, rcptTo smtp.Localpart) {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("move-test")
+		tcheck(t, err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: time.Now(), Size: int64(len(msg)), RcptToLocalpart: rcptTo, RcptToDomain: "mox.example"}
+		src.WithWLock(func() {
+			err = src.DeliverMailbox(log, mailbox, &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver message")
+	}
+
+	count := func(acc *Account, mailbox string) int {
+		t.Helper()
+		var n int
+		err := acc.DB.Read(ctxbg, func(tx *bstore.Tx) error {
+			mb, err := acc.MailboxFind(tx, mailbox)
+			tcheck(t, err, "find mailbox")
+			if mb == nil {
+				n = -1
+				return nil
+			}
+			msgs, err := bstore.QueryTx[Message](tx).FilterNonzero(Message{MailboxID: mb.ID}).List()
+			tcheck(t, err, "list messages")
+			for _, m := range msgs {
+				if acc == dst && m.Moved.IsZero() {
+					t.Fatalf("moved message without moved time")
+				}
+				mr := acc.MessageReader(m)
+				buf, err := io.ReadAll(mr)
+				mr.Close()
+				tcheck(t, err, "read message")
+				if string(buf) != msg {
+					t.Fatalf("message differs")
+				}
+			}
+			n = len(msgs)
+			return nil
+		})
+		tcheck(t, err, "read account")
+		return n
+	}
+
+	deliver("Lists", "mjl")
+	deliver("Lists/a", "mjl")
+	deliver("Lists/a", "mjl")
+	deliver("Inbox", "mjl")
+	deliver("Inbox", "other+tag")
+	deliver("Archive", "Other")
+
+	// Compressed message files are decoded and stored as configured for the destination account.
+	conf := mox.Conf.Dynamic.Accounts["mjl"]
+	conf.CompressMessages = true
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+	deliver("Lists/b", "mjl")
+	conf.CompressMessages = false
+	mox.Conf.Dynamic.Accounts["mjl"] = conf
+
+	n, err := MoveMailboxTree(log, src, dst, "Lists")
+	tcheck(t, err, "move mailbox tree")
+	if n != 4 {
+		t.Fatalf("moved %d messages, expected 4", n)
+	}
+	for _, name := range []string{"Lists", "Lists/a", "Lists/b"} {
+		if n := count(src, name); n != -1 {
+			t.Fatalf("mailbox %q still present in source account", name)
+		}
+	}
+	if count(dst, "Lists") != 1 || count(dst, "Lists/a") != 2 || count(dst, "Lists/b") != 1 {
+		t.Fatalf("unexpected messages in destination account")
+	}
+
+	if _, err := MoveMailboxTree(log, src, dst, "Bogus"); err == nil {
+		t.Fatalf("moving absent mailbox succeeded")
+	}
+
+	// Messages for other@mox.example, including through catchall separator and
+	// different case.
+	n, err = MoveAddressMessages(log, src, dst, "other@mox.example")
+	tcheck(t, err, "move address messages")
+	if n != 2 {
+		t.Fatalf("moved %d messages, expected 2", n)
+	}
+	if count(src, "Inbox") != 1 || count(dst, "Inbox") != 1 || count(dst, "Archive") != 1 || count(src, "Archive") != 0 {
+		t.Fatalf("unexpected messages after moving address messages")
+	}
+}
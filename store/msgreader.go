@@ -1,6 +1,7 @@
 package store
 
 import (
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"io"
@@ -9,14 +10,18 @@ import (
 
 // MsgReader provides access to a message. Reads return the "msg_prefix" in the
 // database (typically received headers), followed by the on-disk msg file
-// contents. MsgReader is an io.Reader, io.ReaderAt and io.Closer.
+// contents. Compressed and encrypted msg files are decompressed and decrypted
+// transparently. MsgReader is an io.Reader, io.ReaderAt and io.Closer.
 type MsgReader struct {
-	prefix []byte   // First part of the message. Typically contains received headers.
-	path   string   // To on-disk message file.
-	size   int64    // Total size of message, including prefix and contents from path.
-	offset int64    // Current reading offset.
-	f      *os.File // Opened path, automatically opened after prefix has been read.
-	err    error    // If set, error to return for reads. Sets io.EOF for readers, but ReadAt ignores them.
+	prefix     []byte          // First part of the message. Typically contains received headers.
+	path       string          // To on-disk message file.
+	compressed bool            // Whether the file at path is compressed.
+	encrypted  bool            // Whether the file at path is encrypted.
+	key        *rsa.PrivateKey // For decrypting encrypted message files, nil if account is locked.
+	size       int64           // Total size of message, including prefix and contents from path.
+	offset     int64           // Current reading offset.
+	f          messageFile     // Opened path, automatically opened after prefix has been read.
+	err        error           // If set, error to return for reads. Sets io.EOF for readers, but ReadAt ignores them.
 }
 
 var errMsgClosed = errors.New("msg is closed")
@@ -73,7 +78,7 @@ func (m *MsgReader) read(buf []byte, off int64, pread bool) (int, error) {
 
 		// Now we need to read from file. Ensure it is open.
 		if m.f == nil {
-			f, err := os.Open(m.path)
+			f, err := openMessageFile(m.path, m.key, m.compressed, m.encrypted)
 			if err != nil {
 				m.err = err
 				break
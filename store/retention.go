@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+// StartRetention starts a goroutine that regularly expunges messages that are
+// past the retention period of their mailbox, as configured per account.
+func StartRetention() {
+	go manageRetention()
+}
+
+func manageRetention() {
+	for {
+		retentionAccounts()
+
+		select {
+		case <-mox.Shutdown.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+func retentionAccounts() {
+	log := xlog.WithCid(mox.Cid())
+
+	defer func() {
+		x := recover()
+		if x != nil {
+			log.Error("expunging messages for mailbox retention panic", mlog.Field("panic", x))
+			debug.PrintStack()
+		}
+	}()
+
+	for _, name := range mox.Conf.Accounts() {
+		if conf, ok := mox.Conf.Account(name); !ok || len(conf.MailboxRetention) == 0 && conf.DefaultMailboxRetention == nil {
+			continue
+		}
+
+		acc, err := OpenAccount(name)
+		if err != nil {
+			log.Errorx("open account for mailbox retention", err, mlog.Field("account", name))
+			continue
+		}
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.ExpungeRetention(log, time.Now())
+		})
+		if err != nil {
+			log.Errorx("expunging messages for mailbox retention", err, mlog.Field("account", name))
+		} else if n > 0 {
+			log.Info("expunged messages for mailbox retention", mlog.Field("account", name), mlog.Field("count", n))
+		}
+		err = acc.Close()
+		log.Check(err, "closing account after mailbox retention")
+	}
+}
+
+// ExpungeRetention removes messages from mailboxes that are older than the
+// retention period configured for the mailbox, or the default retention period
+// of the account for mailboxes without their own policy. Removed messages are
+// not untrained from the junk filter. Returns the number of removed messages.
+// Caller must hold account wlock.
+// Changes are broadcasted.
+func (a *Account) ExpungeRetention(log *mlog.Log, now time.Time) (int, error) {
+	conf, _ := a.Conf()
+	if len(conf.MailboxRetention) == 0 && conf.DefaultMailboxRetention == nil {
+		return 0, nil
+	}
+
+	var changes []Change
+
+	var remove []Message
+	defer func() {
+		for _, m := range remove {
+			p := a.MessagePath(m.ID)
+			err := os.Remove(p)
+			log.Check(err, "removing message file for mailbox retention", mlog.Field("path", p))
+		}
+	}()
+
+	err := a.DB.Write(context.TODO(), func(tx *bstore.Tx) error {
+		var mailboxes []Mailbox
+		if conf.DefaultMailboxRetention != nil {
+			var err error
+			mailboxes, err = bstore.QueryTx[Mailbox](tx).List()
+			if err != nil {
+				return fmt.Errorf("listing mailboxes: %w", err)
+			}
+		} else {
+			for mbName := range conf.MailboxRetention {
+				mb, err := a.MailboxFind(tx, mbName)
+				if err != nil {
+					return fmt.Errorf("finding mailbox %q: %w", mbName, err)
+				}
+				if mb != nil {
+					mailboxes = append(mailboxes, *mb)
+				}
+			}
+		}
+
+		for i := range mailboxes {
+			mb := &mailboxes[i]
+			mbName := mb.Name
+			r, ok := conf.MailboxRetention[mbName]
+			if !ok && conf.DefaultMailboxRetention != nil {
+				r = *conf.DefaultMailboxRetention
+			}
+			if r.Age == 0 {
+				continue
+			}
+
+			old := now.Add(-r.Age)
+			q := bstore.QueryTx[Message](tx)
+			q.FilterNonzero(Message{MailboxID: mb.ID})
+			if r.Since == "moved" {
+				q.FilterFn(func(m Message) bool {
+					tm := m.Moved
+					if tm.IsZero() {
+						tm = m.Received
+					}
+					return tm.Before(old)
+				})
+			} else {
+				q.FilterLess("Received", old)
+			}
+			l, err := q.List()
+			if err != nil {
+				return fmt.Errorf("listing old messages in mailbox %q: %w", mbName, err)
+			}
+
+			mbchanges, err := a.removeMessages(context.TODO(), log, tx, mb, l, false)
+			if err != nil {
+				return fmt.Errorf("removing messages from mailbox %q: %w", mbName, err)
+			}
+			remove = append(remove, l...)
+			changes = append(changes, mbchanges...)
+		}
+		return nil
+	})
+	if err != nil {
+		remove = nil // Don't remove files on failure.
+		return 0, err
+	}
+
+	if len(changes) > 0 {
+		comm := RegisterComm(a)
+		defer comm.Unregister()
+		comm.Broadcast(changes)
+	}
+
+	return len(remove), nil
+}
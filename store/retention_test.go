@@ -0,0 +1,119 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjl-/bstore"
+
+	"github.com/mjl-/mox/config"
+	"github.com/mjl-/mox/mlog"
+	"github.com/mjl-/mox/mox-"
+)
+
+func TestRetention(t *testing.T) {
+	os.RemoveAll("../testdata/store/data")
+	mox.ConfigStaticPath = "../testdata/store/mox.conf"
+	mox.MustLoadConfig(false)
+	acc, err := OpenAccount("mjl")
+	tcheck(t, err, "open account")
+	defer acc.Close()
+	switchDone := Switchboard()
+	defer close(switchDone)
+
+	log := mlog.New("store")
+
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+
+	// Deliver messages to Trash: one received long ago, one received long ago but
+	// moved recently, and one received recently.
+	deliver := func(received, moved time.Time) int64 {
+		t.Helper()
+		msgFile, err := CreateMessageTemp("retention-test")
+		tcheck(t, err, "create temp message")
+		defer os.Remove(msgFile.Name())
+		defer msgFile.Close()
+		const msg = "Subject: test\r\n\r\ntest\r\n"
+		_, err = msgFile.Write([]byte(msg))
+		tcheck(t, err, "write message")
+		m := Message{Received: received, Moved: moved, Size: int64(len(msg))}
+		acc.WithWLock(func() {
+			err = acc.DeliverMailbox(log, "Trash", &m, msgFile, false)
+		})
+		tcheck(t, err, "deliver message")
+		return m.ID
+	}
+	idOld := deliver(old, time.Time{})
+	idMoved := deliver(old, recent)
+	idRecent := deliver(recent, time.Time{})
+
+	expungeDefault := func(mbr map[string]config.MailboxRetention, def *config.MailboxRetention, expCount int, expIDs ...int64) {
+		t.Helper()
+
+		conf := mox.Conf.Dynamic.Accounts["mjl"]
+		conf.MailboxRetention = mbr
+		conf.DefaultMailboxRetention = def
+		mox.Conf.Dynamic.Accounts["mjl"] = conf
+		defer func() {
+			conf.MailboxRetention = nil
+			conf.DefaultMailboxRetention = nil
+			mox.Conf.Dynamic.Accounts["mjl"] = conf
+		}()
+
+		var n int
+		acc.WithWLock(func() {
+			n, err = acc.ExpungeRetention(log, now)
+		})
+		tcheck(t, err, "expunge for retention")
+		if n != expCount {
+			t.Fatalf("expunged %d messages, expected %d", n, expCount)
+		}
+
+		var ids []int64
+		err = bstore.QueryDB[Message](ctxbg, acc.DB).ForEach(func(m Message) error {
+			ids = append(ids, m.ID)
+			return nil
+		})
+		tcheck(t, err, "list messages")
+		if len(ids) != len(expIDs) {
+			t.Fatalf("got messages %v, expected %v", ids, expIDs)
+		}
+		for i := range ids {
+			if ids[i] != expIDs[i] {
+				t.Fatalf("got messages %v, expected %v", ids, expIDs)
+			}
+		}
+		for _, id := range []int64{idOld, idMoved, idRecent} {
+			_, err := os.Stat(acc.MessagePath(id))
+			exists := err == nil
+			kept := false
+			for _, xid := range expIDs {
+				kept = kept || xid == id
+			}
+			if exists != kept {
+				t.Fatalf("message file for id %d exists %v, expected %v", id, exists, kept)
+			}
+		}
+	}
+
+	expunge := func(r config.MailboxRetention, expCount int, expIDs ...int64) {
+		t.Helper()
+		expungeDefault(map[string]config.MailboxRetention{"Trash": r}, nil, expCount, expIDs...)
+	}
+
+	// Based on time of moving into mailbox.
+	expunge(config.MailboxRetention{Age: 30 * 24 * time.Hour, Since: "moved"}, 1, idMoved, idRecent)
+	// Based on time received.
+	expunge(config.MailboxRetention{Age: 30 * 24 * time.Hour}, 1, idRecent)
+	expunge(config.MailboxRetention{Age: time.Hour}, 1)
+
+	// Default retention for the account, for mailboxes without their own policy.
+	idOld = deliver(old, time.Time{})
+	idRecent = deliver(recent, time.Time{})
+	// Mailbox exempted from default retention.
+	expungeDefault(map[string]config.MailboxRetention{"Trash": {}}, &config.MailboxRetention{Age: time.Hour}, 0, idOld, idRecent)
+	expungeDefault(nil, &config.MailboxRetention{Age: 30 * 24 * time.Hour}, 1, idRecent)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -73,8 +74,13 @@ func Switchboard() chan struct{} {
 	regs := map[*Account]map[*Comm][]Change{}
 	done := make(chan struct{})
 
-	if !switchboardBusy.CompareAndSwap(false, true) {
-		panic("switchboard already busy")
+	// A previous switchboard, e.g. in tests, may still be processing the close of
+	// its done channel. Give it a moment.
+	for i := 0; !switchboardBusy.CompareAndSwap(false, true); i++ {
+		if i >= 100 {
+			panic("switchboard already busy")
+		}
+		time.Sleep(time.Millisecond)
 	}
 
 	go func() {
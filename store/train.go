@@ -47,14 +47,24 @@ func (a *Account) OpenJunkFilter(ctx context.Context, log *mlog.Log) (*junk.Filt
 // RetrainMessages (un)trains messages, if relevant given their flags. Updates
 // m.TrainedJunk after retraining.
 func (a *Account) RetrainMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, msgs []Message, absentOK bool) (rerr error) {
+	l := make([]*Message, len(msgs))
+	for i := range msgs {
+		l[i] = &msgs[i]
+	}
+	return a.retrainMessages(ctx, log, tx, l, absentOK, nil)
+}
+
+// retrainMessages is like RetrainMessages. If mr is not nil, the single message
+// is read from mr instead of the stored message file.
+func (a *Account) retrainMessages(ctx context.Context, log *mlog.Log, tx *bstore.Tx, msgs []*Message, absentOK bool, mr *MsgReader) (rerr error) {
 	if len(msgs) == 0 {
 		return nil
 	}
 
 	var jf *junk.Filter
 
-	for i := range msgs {
-		if !msgs[i].NeedsTraining() {
+	for _, m := range msgs {
+		if !m.NeedsTraining() {
 			continue
 		}
 
@@ -77,7 +87,13 @@ func (a *Account) RetrainMessages(ctx context.Context, log *mlog.Log, tx *bstore
 				}
 			}()
 		}
-		if err := a.RetrainMessage(ctx, log, tx, jf, &msgs[i], absentOK); err != nil {
+		var err error
+		if mr != nil {
+			err = a.retrainMessage(ctx, log, tx, jf, m, absentOK, mr)
+		} else {
+			err = a.RetrainMessage(ctx, log, tx, jf, m, absentOK)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -87,6 +103,15 @@ func (a *Account) RetrainMessages(ctx context.Context, log *mlog.Log, tx *bstore
 // RetrainMessage untrains and/or trains a message, if relevant given m.TrainedJunk
 // and m.Junk/m.Notjunk. Updates m.TrainedJunk after retraining.
 func (a *Account) RetrainMessage(ctx context.Context, log *mlog.Log, tx *bstore.Tx, jf *junk.Filter, m *Message, absentOK bool) error {
+	mr := a.MessageReader(*m)
+	defer func() {
+		err := mr.Close()
+		log.Check(err, "closing message reader after retraining")
+	}()
+	return a.retrainMessage(ctx, log, tx, jf, m, absentOK, mr)
+}
+
+func (a *Account) retrainMessage(ctx context.Context, log *mlog.Log, tx *bstore.Tx, jf *junk.Filter, m *Message, absentOK bool, mr *MsgReader) error {
 	untrain := m.TrainedJunk != nil
 	untrainJunk := untrain && *m.TrainedJunk
 	train := m.Junk || m.Notjunk && !(m.Junk && m.Notjunk)
@@ -98,12 +123,6 @@ func (a *Account) RetrainMessage(ctx context.Context, log *mlog.Log, tx *bstore.
 
 	log.Debug("updating junk filter", mlog.Field("untrain", untrain), mlog.Field("untrainjunk", untrainJunk), mlog.Field("train", train), mlog.Field("trainjunk", trainJunk))
 
-	mr := a.MessageReader(*m)
-	defer func() {
-		err := mr.Close()
-		log.Check(err, "closing message reader after retraining")
-	}()
-
 	p, err := m.LoadPart(mr)
 	if err != nil {
 		log.Errorx("loading part for message", err)
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	bolt "go.etcd.io/bbolt"
 
@@ -50,7 +51,16 @@ possibly making them potentially no longer readable by the previous version.
 	}
 
 	dataDir := filepath.Clean(args[0])
+	if !verifyDataDir(dataDir, fix, "") {
+		log.Fatalf("errors were found")
+	}
+	fmt.Printf("%s: OK\n", dataDir)
+}
 
+// verifyDataDir checks the databases and files in a data directory, logging
+// problems. If account is set, only that account in the data directory is
+// checked. Returns whether no errors were found.
+func verifyDataDir(dataDir string, fix bool, account string) bool {
 	ctxbg := context.Background()
 
 	// Check whether file exists, or rather, that it doesn't not exist. Other errors
@@ -157,6 +167,8 @@ possibly making them potentially no longer readable by the previous version.
 				return nil
 			})
 			checkf(err, dbpath, "reading messages in queue database to check files")
+			err = db.Close()
+			checkf(err, dbpath, "closing queue database")
 		}
 
 		// Check that there are no files that could be treated as a message.
@@ -206,6 +218,32 @@ possibly making them potentially no longer readable by the previous version.
 	}
 
 	// Check an account, with its database file and messages.
+	// Message files can be stored once for multiple messages, as hardlinks. We count
+	// them to report the sharing. Removing a message only removes the file contents
+	// when it was the last reference.
+	shared := map[fileID]int{}
+	countShared := func(p string) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint64(st.Nlink) > 1 {
+			shared[fileID{uint64(st.Dev), uint64(st.Ino)}]++
+		}
+	}
+	reportShared := func() {
+		var nfiles, nmsgs int
+		for _, count := range shared {
+			if count > 1 {
+				nfiles++
+				nmsgs += count
+			}
+		}
+		if nfiles > 0 {
+			log.Printf("%d message files are shared by %d messages", nfiles, nmsgs)
+		}
+	}
+
 	checkAccount := func(name string) {
 		accdir := filepath.Join(dataDir, "accounts", name)
 		checkDB(filepath.Join(accdir, "index.db"), store.DBTypes)
@@ -228,9 +266,12 @@ possibly making them potentially no longer readable by the previous version.
 				seen[mp] = struct{}{}
 				p := filepath.Join(accdir, "msg", mp)
 				checkFile(p)
+				countShared(p)
 				return nil
 			})
 			checkf(err, dbpath, "reading messages in account database to check files")
+			err = db.Close()
+			checkf(err, dbpath, "closing account database")
 		}
 
 		// Walk through all files in the msg directory. Warn about files that weren't in
@@ -328,20 +369,23 @@ possibly making them potentially no longer readable by the previous version.
 		checkf(err, dataDir, "walking data directory")
 	}
 
+	if account != "" {
+		checkAccount(account)
+		reportShared()
+		return !fail
+	}
+
 	checkDB(filepath.Join(dataDir, "dmarcrpt.db"), dmarcdb.DBTypes)
 	checkDB(filepath.Join(dataDir, "mtasts.db"), mtastsdb.DBTypes)
 	checkDB(filepath.Join(dataDir, "tlsrpt.db"), tlsrptdb.DBTypes)
 	checkQueue()
 	checkAccounts()
 	checkOther()
+	reportShared()
 
 	if backupmoxversion != moxvar.Version {
 		log.Printf("NOTE: The backup was made with mox version %q, while verifydata was run with mox version %q. Database files have probably been modified by running mox verifydata. Make a fresh backup before upgrading.", backupmoxversion, moxvar.Version)
 	}
 
-	if fail {
-		log.Fatalf("errors were found")
-	} else {
-		fmt.Printf("%s: OK\n", dataDir)
-	}
+	return !fail
 }